@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"os/exec"
@@ -11,6 +12,7 @@ import (
 	"syscall"
 
 	"github.com/subgraph/oz"
+	"github.com/subgraph/oz/network"
 
 	"github.com/codegangsta/cli"
 )
@@ -60,6 +62,12 @@ func main() {
 					Name:   "check",
 					Usage:  "check oz configuration and profiles for errors",
 					Action: handleConfigcheck,
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "show, s",
+							Usage: "Print the merged profiles (all of them, or only the ones named as arguments)",
+						},
+					},
 				},
 				{
 					Name:   "show",
@@ -106,16 +114,97 @@ func handleConfigcheck(c *cli.Context) {
 	}
 
 	OzConfig = loadConfig()
-	_, err = oz.LoadProfiles(OzConfig.ProfileDir)
+	ps, err := oz.LoadProfiles(OzConfig.ProfileDir)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Unable to load profiles from `%s`: %v\n", OzConfig.ProfileDir, err)
 		os.Exit(1)
 	}
 
+	if _, err := network.NewFirewall(network.FirewallBackend(OzConfig.FirewallBackend), OzConfig.FWDaemonSocket, nil); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration `%s`: %v\n", oz.DefaultConfigPath, err)
+		os.Exit(1)
+	}
+	if err := network.CheckIPv6(network.IPv6Mode(OzConfig.IPv6Mode), OzConfig.IPv6Prefix); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration `%s`: %v\n", oz.DefaultConfigPath, err)
+		os.Exit(1)
+	}
+	if !checkFirewallRules(ps) {
+		os.Exit(1)
+	}
+
+	if c.Bool("show") {
+		showMergedProfiles(ps, c.Args())
+	}
+
 	fmt.Println("Configurations and profiles ok!")
 	os.Exit(0)
 }
 
+// checkFirewallRules prints the firewall rules of the profiles along with
+// the addresses they resolve to, it returns false if some are invalid.
+func checkFirewallRules(ps oz.Profiles) bool {
+	ok := true
+	for _, p := range ps {
+		if len(p.Firewall) == 0 && p.FirewallPolicy == network.FW_POLICY_DEFAULT {
+			continue
+		}
+		rs, err := p.FirewallRuleset()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid firewall rules in profile `%s`: %v\n", p.Name, err)
+			ok = false
+			continue
+		}
+		policy := rs.Policy
+		if policy == network.FW_POLICY_DEFAULT {
+			policy = "default"
+		}
+		fmt.Printf("Firewall rules of profile `%s` (policy: %s):\n", p.Name, policy)
+		for i, r := range rs.Rules {
+			if r.IsPattern() {
+				fmt.Printf("  [%d] %s -> addresses resolved by the DNS forwarder\n", i, r)
+				continue
+			}
+			nets, err := r.Resolve()
+			if err != nil {
+				fmt.Printf("  [%d] %s: %v\n", i, r, err)
+				continue
+			}
+			addrs := make([]string, len(nets))
+			for j, n := range nets {
+				addrs[j] = n.String()
+			}
+			fmt.Printf("  [%d] %s -> %s\n", i, r, strings.Join(addrs, ", "))
+		}
+	}
+	return ok
+}
+
+func showMergedProfiles(ps oz.Profiles, names []string) {
+	if len(names) > 0 {
+		sel := oz.Profiles{}
+		for _, name := range names {
+			p, err := ps.GetProfileByName(name)
+			if err != nil || p == nil {
+				p, err = ps.GetProfileByPath(name)
+			}
+			if err != nil || p == nil {
+				fmt.Fprintf(os.Stderr, "Unable to find profile `%s`\n", name)
+				os.Exit(1)
+			}
+			sel = append(sel, p)
+		}
+		ps = sel
+	}
+	for _, p := range ps {
+		out, err := json.MarshalIndent(p, "", "    ")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to print profile `%s`: %v\n", p.Name, err)
+			os.Exit(1)
+		}
+		fmt.Printf("# %s (%s)\n%s\n\n", p.Name, p.ProfilePath, out)
+	}
+}
+
 func handleConfigshow(c *cli.Context) {
 	config, err := oz.LoadConfig(oz.DefaultConfigPath)
 	useDefaults := false
@@ -13,15 +13,23 @@ type Config struct {
 	PrefixPath       string   `json:"prefix_path" desc:"Prefix path containing the oz executables"`
 	EtcPrefix        string   `json:"etc_prefix" desc:"Prefix for configuration files"`
 	SandboxPath      string   `json:"sandbox_path" desc:"Path of the sandboxes base"`
+	CgroupPath       string   `json:"cgroup_path" desc:"Path of the cgroup v2 hierarchy holding the sandboxes"`
 	OpenVPNRunPath   string   `json:"openvpn_run_path" desc: "Path for OpenVPN run state"`
 	OpenVPNConfDir   string   `json:"openvpn_conf_dir" desc: "Path for OpenVPN conf files"`
 	OpenVPNGroup     string   `json:"openvpn_group" desc: "GID for OpenVPN process"`
 	RouteTableBase   int      `json:"route_table_base" desc: "Base for routing table"`
+	WireGuardConfDir string   `json:"wireguard_conf_dir" desc:"Path for WireGuard conf files"`
 	DivertSuffix     string   `json:"divert_suffix" desc:"Suffix using for dpkg-divert of application executables, can be left empty when using a divert path"`
 	DivertPath       bool     `json:"divert_path" desc:"Whether the diverted executable should be moved out of the path"`
 	NMIgnoreFile     string   `json:"nm_ignore_file" desc:"Path to the NetworkManager ignore config file, disables the warning if empty"`
 	UseFullDev       bool     `json:"use_full_dev" desc:"Give sandboxes full access to devices instead of a restricted set"`
 	AllowRootShell   bool     `json:"allow_root_shell" desc:"Allow entering a sandbox shell as root"`
+	UserNamespace    bool     `json:"user_namespace" desc:"Run all sandboxes in a user namespace, can also be enabled per profile"`
+	UserNSRoot       uint32   `json:"user_namespace_root" desc:"Host uid and gid that root inside a user namespace is mapped to"`
+	FirewallBackend  string   `json:"firewall_backend" desc:"Firewall backend for the rules of the sandboxes, nftables or fw-daemon"`
+	FWDaemonSocket   string   `json:"fw_daemon_socket" desc:"Control socket of fw-daemon, for the fw-daemon firewall backend"`
+	IPv6Mode         string   `json:"ipv6_mode" desc:"IPv6 for bridged sandboxes: none, nat66 or routed"`
+	IPv6Prefix       string   `json:"ipv6_prefix" desc:"Prefix the IPv6 subnets of the bridges are taken from, a random unique local prefix if empty"`
 	LogXpra          bool     `json:"log_xpra" desc:"Log output of Xpra"`
 	EnableEphemerals bool     `json:"enable_ephemerals" desc:"Enable prompting to launch sandbox in ephemeral mode"`
 	EnvironmentVars  []string `json:"environment_vars" desc:"Default environment variables passed to sandboxes"`
@@ -91,15 +99,22 @@ func NewDefaultConfig() *Config {
 		PrefixPath:       "/usr/local",
 		EtcPrefix:        "/etc/oz",
 		SandboxPath:      "/srv/oz",
+		CgroupPath:       "/sys/fs/cgroup/oz",
 		OpenVPNRunPath:   "/var/run/openvpn",
 		OpenVPNConfDir:   "/var/lib/oz/openvpn",
 		OpenVPNGroup:     "oz-openvpn",
 		RouteTableBase:   8000,
+		WireGuardConfDir: "/var/lib/oz/wireguard",
 		DivertPath:       false,
 		NMIgnoreFile:     "/etc/NetworkManager/conf.d/oz.conf",
 		DivertSuffix:     "",
 		UseFullDev:       false,
 		AllowRootShell:   false,
+		UserNamespace:    false,
+		UserNSRoot:       99999,
+		FirewallBackend:  "nftables",
+		FWDaemonSocket:   "/tmp/fwoz.sock",
+		IPv6Mode:         "none",
 		LogXpra:          true,
 		EnableEphemerals: false,
 		EnvironmentVars: []string{
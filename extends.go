@@ -0,0 +1,170 @@
+package oz
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+	"reflect"
+	"strings"
+)
+
+// A profile may extend one or more base profiles by listing them under the
+// `extends` key, either as a single path or as a list of paths. Relative paths
+// are resolved from the directory of the profile referencing them, absolute
+// paths are used as is. Base profiles may themselves extend other profiles.
+//
+// Bases are merged in the order they are listed, then the extending profile
+// is merged on top of the result using the following rules:
+//
+//  - objects (ie: xserver, networking, seccomp) are merged key by key
+//  - lists (ie: whitelist, blacklist, environment) are appended to the
+//    inherited list, entries identical to an inherited one are skipped
+//  - any other value replaces the inherited one
+//
+// The name, path, paths and extends keys are never inherited from a base.
+//
+// Base profiles are usually kept in a sub-directory of the profile directory
+// (ie: `_base/gui.json`) so that they are not loaded as profiles of their own.
+
+const maxExtendsDepth = 16
+
+var nonInheritedKeys = []string{"name", "path", "paths", "extends"}
+
+// loadProfileData reads the profile at fpath and returns its content merged
+// with the content of all the profiles it extends. The chain argument holds
+// the profiles currently being loaded and is used to detect cycles.
+func loadProfileData(fpath string, chain []string) (map[string]interface{}, error) {
+	fpath = path.Clean(fpath)
+	for _, p := range chain {
+		if p == fpath {
+			return nil, fmt.Errorf("profile inheritance cycle: %s -> %s", strings.Join(chain, " -> "), fpath)
+		}
+	}
+	if len(chain) >= maxExtendsDepth {
+		return nil, fmt.Errorf("profile inheritance is nested more than %d levels deep", maxExtendsDepth)
+	}
+	chain = append(chain[:len(chain):len(chain)], fpath)
+
+	bs, err := readProfileJSON(fpath)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateProfileJSON(fpath, bs); err != nil {
+		return nil, err
+	}
+	data := make(map[string]interface{})
+	dec := json.NewDecoder(bytes.NewReader(bs))
+	dec.UseNumber()
+	if err := dec.Decode(&data); err != nil {
+		return nil, err
+	}
+
+	bases, err := profileExtends(data)
+	if err != nil {
+		return nil, err
+	}
+
+	merged := make(map[string]interface{})
+	for _, base := range bases {
+		bpath := base
+		if !path.IsAbs(bpath) {
+			bpath = path.Join(path.Dir(fpath), bpath)
+		}
+		bdata, err := loadProfileData(bpath, chain)
+		if err != nil {
+			return nil, fmt.Errorf("extends '%s': %v", base, err)
+		}
+		for _, key := range nonInheritedKeys {
+			if k, ok := findKey(bdata, key); ok {
+				delete(bdata, k)
+			}
+		}
+		mergeProfileData(merged, bdata)
+	}
+	mergeProfileData(merged, data)
+
+	return merged, nil
+}
+
+// profileExtends returns the list of base profiles from the extends key,
+// normalizing a single string value into a list.
+func profileExtends(data map[string]interface{}) ([]string, error) {
+	k, ok := findKey(data, "extends")
+	if !ok {
+		return nil, nil
+	}
+	var bases []string
+	switch v := data[k].(type) {
+	case nil:
+	case string:
+		bases = append(bases, v)
+	case []interface{}:
+		for _, e := range v {
+			s, ok := e.(string)
+			if !ok || s == "" {
+				return nil, fmt.Errorf("extends must only contain profile paths, found: %v", e)
+			}
+			bases = append(bases, s)
+		}
+	default:
+		return nil, fmt.Errorf("extends must be a profile path or a list of profile paths, found: %v", v)
+	}
+	delete(data, k)
+	data["extends"] = bases
+	return bases, nil
+}
+
+// mergeProfileData merges src on top of dst following the inheritance rules
+func mergeProfileData(dst, src map[string]interface{}) {
+	for k, sv := range src {
+		dk, ok := findKey(dst, k)
+		if !ok {
+			dst[k] = sv
+			continue
+		}
+		switch dv := dst[dk].(type) {
+		case map[string]interface{}:
+			if sm, ok := sv.(map[string]interface{}); ok {
+				mergeProfileData(dv, sm)
+				continue
+			}
+		case []interface{}:
+			if sl, ok := sv.([]interface{}); ok {
+				dst[dk] = appendUnique(dv, sl)
+				continue
+			}
+		}
+		dst[dk] = sv
+	}
+}
+
+func appendUnique(dst, src []interface{}) []interface{} {
+	for _, sv := range src {
+		found := false
+		for _, dv := range dst {
+			if reflect.DeepEqual(dv, sv) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			dst = append(dst, sv)
+		}
+	}
+	return dst
+}
+
+// findKey looks up a key the same way encoding/json matches keys to
+// struct fields, that is without regard to case.
+func findKey(data map[string]interface{}, key string) (string, bool) {
+	if _, ok := data[key]; ok {
+		return key, true
+	}
+	for k := range data {
+		if strings.EqualFold(k, key) {
+			return k, true
+		}
+	}
+	return "", false
+}
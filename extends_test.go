@@ -0,0 +1,191 @@
+package oz
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/subgraph/oz/network"
+)
+
+func writeTestProfiles(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "oz-extends")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		fpath := path.Join(dir, name)
+		if err := os.MkdirAll(path.Dir(fpath), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fpath, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestLoadProfileExtends(t *testing.T) {
+	dir := writeTestProfiles(t, map[string]string{
+		"_base/gui.json": `{
+			"name": "gui",
+			"xserver": {"enabled": true, "audio_mode": "pulseaudio"},
+			"whitelist": [{"path": "${HOME}/Downloads"}],
+			"environment": [{"name": "GTK_THEME"}]
+		}`,
+		"_base/net.json": `{
+			"networking": {"type": "bridge"},
+			"whitelist": [{"path": "/etc/ssl"}]
+		}`,
+		"browser.json": `{
+			# comments are allowed in base and extending profiles
+			"path": "/usr/bin/browser",
+			"extends": ["_base/gui.json", "_base/net.json"],
+			"xserver": {"audio_mode": "none"},
+			"whitelist": [{"path": "${HOME}/Downloads"}, {"path": "${HOME}/.browser"}]
+		}`,
+	})
+	defer os.RemoveAll(dir)
+
+	p, err := loadProfileFile(path.Join(dir, "browser.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Name != "browser" {
+		t.Errorf("name should not be inherited, got %s", p.Name)
+	}
+	if !p.XServer.Enabled || p.XServer.AudioMode != PROFILE_AUDIO_NONE {
+		t.Errorf("bad xserver merge: %+v", p.XServer)
+	}
+	if p.Display.Type != PROFILE_DISPLAY_XPRA {
+		t.Errorf("display type %s, expected xpra with the XServer enabled", p.Display.Type)
+	}
+	if p.Networking.Nettype != network.TYPE_BRIDGE {
+		t.Errorf("bad networking merge: %+v", p.Networking)
+	}
+	var wl []string
+	for _, w := range p.Whitelist {
+		wl = append(wl, w.Path)
+	}
+	expected := []string{"${HOME}/Downloads", "/etc/ssl", "${HOME}/.browser"}
+	if !reflect.DeepEqual(wl, expected) {
+		t.Errorf("bad whitelist merge: %v, expected %v", wl, expected)
+	}
+	if len(p.Environment) != 1 {
+		t.Errorf("bad environment merge: %+v", p.Environment)
+	}
+	if !reflect.DeepEqual(p.Extends, []string{"_base/gui.json", "_base/net.json"}) {
+		t.Errorf("bad extends: %v", p.Extends)
+	}
+}
+
+func TestLoadProfileExtendsErrors(t *testing.T) {
+	dir := writeTestProfiles(t, map[string]string{
+		"a.json":       `{"path": "/bin/a", "extends": "b.json"}`,
+		"b.json":       `{"extends": "a.json"}`,
+		"self.json":    `{"path": "/bin/self", "extends": "self.json"}`,
+		"missing.json": `{"path": "/bin/missing", "extends": "_base/nope.json"}`,
+		"bad.json":     `{"path": "/bin/bad", "extends": 42}`,
+	})
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		profile string
+		err     string
+	}{
+		{"a.json", "profile inheritance cycle"},
+		{"self.json", "profile inheritance cycle"},
+		{"missing.json", "extends '_base/nope.json'"},
+		{"bad.json", "bad.json:1:33: extends: expected a list"},
+	}
+	for _, tt := range tests {
+		_, err := loadProfileFile(path.Join(dir, tt.profile))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: expected error containing %q, got %v", tt.profile, tt.err, err)
+		}
+	}
+}
+
+func TestLoadProfileDisplay(t *testing.T) {
+	dir := writeTestProfiles(t, map[string]string{
+		"none.json":    `{"path": "/usr/bin/a"}`,
+		"xpra.json":    `{"path": "/usr/bin/a", "display": {"type": "xpra"}}`,
+		"wayland.json": `{"path": "/usr/bin/a", "xserver": {"enabled": true}, "display": {"type": "wayland-proxy"}}`,
+	})
+	defer os.RemoveAll(dir)
+
+	for file, expected := range map[string]struct {
+		display DisplayType
+		xserver bool
+	}{
+		"none.json":    {PROFILE_DISPLAY_NONE, false},
+		"xpra.json":    {PROFILE_DISPLAY_XPRA, true},
+		"wayland.json": {PROFILE_DISPLAY_WAYLAND_PROXY, false},
+	} {
+		p, err := loadProfileFile(path.Join(dir, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Display.Type != expected.display || p.XServer.Enabled != expected.xserver {
+			t.Errorf("%s: display type %s and XServer enabled %v, expected %s and %v",
+				file, p.Display.Type, p.XServer.Enabled, expected.display, expected.xserver)
+		}
+	}
+}
+
+// Settings which depend on each other may come from different files
+func TestLoadProfileMergedChecks(t *testing.T) {
+	dir := writeTestProfiles(t, map[string]string{
+		"_base/forward.json": `{"networking": {"type": "bridge", "dns_mode": "forward"}}`,
+		"_base/allow.json":   `{"networking": {"type": "bridge", "dns_allow": ["*.mozilla.org"]}}`,
+		"dns-child.json":     `{"path": "/usr/bin/a", "extends": "_base/forward.json", "networking": {"dns_allow": ["*.mozilla.org"]}}`,
+		"dns-parent.json":    `{"path": "/usr/bin/a", "extends": "_base/allow.json", "networking": {"dns_mode": "dhcp"}}`,
+		"dns-missing.json":   `{"path": "/usr/bin/a", "extends": "_base/allow.json", "networking": {"dns_mode": "pass"}}`,
+		"_base/proxy.json":   `{"networking": {"type": "proxy"}}`,
+		"_base/port.json":    `{"networking": {"proxy_port": 3128}}`,
+		"port-child.json":    `{"path": "/usr/bin/a", "extends": "_base/proxy.json", "networking": {"proxy_port": 3128}}`,
+		"port-parent.json":   `{"path": "/usr/bin/a", "extends": "_base/port.json", "networking": {"type": "proxy"}}`,
+		"port-bridge.json":   `{"path": "/usr/bin/a", "extends": "_base/port.json", "networking": {"type": "bridge"}}`,
+		"_base/vpn.json":     `{"networking": {"type": "bridge", "vpn": {"type": "wireguard"}}}`,
+		"_base/vpnconf.json": `{"networking": {"type": "bridge", "vpn": {"ConfigPath": "home.conf"}}}`,
+		"vpn-child.json":     `{"path": "/usr/bin/a", "extends": "_base/vpn.json", "networking": {"vpn": {"ConfigPath": "home.conf"}}}`,
+		"vpn-parent.json":    `{"path": "/usr/bin/a", "extends": "_base/vpnconf.json", "networking": {"vpn": {"type": "openvpn"}}}`,
+		"vpn-missing.json":   `{"path": "/usr/bin/a", "extends": "_base/vpn.json"}`,
+		"vpn-dns.json":       `{"path": "/usr/bin/a", "extends": "_base/forward.json", "networking": {"vpn": {"type": "openvpn", "ConfigPath": "a.ovpn"}}}`,
+		"_base/wayland.json": `{"display": {"type": "wayland-proxy"}}`,
+		"_base/ext.json":     `{"display": {"extensions": ["wp_viewporter"]}}`,
+		"ext-child.json":     `{"path": "/usr/bin/a", "extends": "_base/wayland.json", "display": {"extensions": ["wp_viewporter"]}}`,
+		"ext-parent.json":    `{"path": "/usr/bin/a", "extends": "_base/ext.json", "display": {"type": "wayland-proxy"}}`,
+		"ext-xpra.json":      `{"path": "/usr/bin/a", "extends": "_base/ext.json", "xserver": {"enabled": true}}`,
+	})
+	defer os.RemoveAll(dir)
+
+	for _, tt := range []struct {
+		profile string
+		err     string
+	}{
+		{"dns-child.json", ""},
+		{"dns-parent.json", ""},
+		{"dns-missing.json", "dns-missing.json: networking.dns_allow: requires dns_mode forward or dhcp"},
+		{"port-child.json", ""},
+		{"port-parent.json", ""},
+		{"port-bridge.json", "port-bridge.json: networking.proxy_port: requires type proxy"},
+		{"vpn-child.json", ""},
+		{"vpn-parent.json", ""},
+		{"vpn-missing.json", "vpn-missing.json: networking.vpn: ConfigPath is required for type wireguard"},
+		{"vpn-dns.json", "vpn-dns.json: networking.dns_mode: forward cannot be used with vpn type openvpn"},
+		{"ext-child.json", ""},
+		{"ext-parent.json", ""},
+		{"ext-xpra.json", "ext-xpra.json: display.extensions: requires type wayland-proxy"},
+	} {
+		_, err := loadProfileFile(path.Join(dir, tt.profile))
+		if tt.err == "" && err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.profile, err)
+		} else if tt.err != "" && (err == nil || !strings.HasSuffix(err.Error(), tt.err)) {
+			t.Errorf("%s: expected error ending with %q, got %v", tt.profile, tt.err, err)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package oz
+
+import (
+	"fmt"
+
+	"github.com/subgraph/oz/network"
+)
+
+// Rule converts the firewall rule of a profile, the deprecated dst_host
+// and dst_port fields are used if dst and dst_ports are not set.
+func (r *FWRule) Rule() (network.FirewallRule, error) {
+	rule := network.FirewallRule{
+		Whitelist: r.Whitelist,
+		Direction: r.Direction,
+		Proto:     r.Proto,
+		Dst:       r.Dst,
+	}
+	if r.Dst != "" && r.DstHost != "" {
+		return rule, fmt.Errorf("dst and dst_host cannot be used together")
+	}
+	if rule.Dst == "" {
+		rule.Dst = r.DstHost
+	}
+	if rule.Dst == "" {
+		return rule, fmt.Errorf("missing dst_host or dst")
+	}
+	if len(r.DstPorts) > 0 && r.DstPort != 0 {
+		return rule, fmt.Errorf("dst_ports and dst_port cannot be used together")
+	}
+	if r.DstPort < 0 || r.DstPort > 65535 {
+		return rule, fmt.Errorf("dst_port: %d is out of range, must be between 0 (any) and 65535", r.DstPort)
+	}
+	if r.DstPort != 0 {
+		rule.Ports = []network.PortRange{{First: uint16(r.DstPort), Last: uint16(r.DstPort)}}
+	}
+	for _, p := range r.DstPorts {
+		pr, err := network.ParsePortRange(p)
+		if err != nil {
+			return rule, fmt.Errorf("dst_ports: %v", err)
+		}
+		rule.Ports = append(rule.Ports, pr)
+	}
+	if err := rule.Check(); err != nil {
+		return rule, err
+	}
+	return rule, nil
+}
+
+// FirewallRuleset returns the firewall rules of the profile along with its policy
+func (p *Profile) FirewallRuleset() (*network.FirewallRuleset, error) {
+	rs := &network.FirewallRuleset{Policy: p.FirewallPolicy}
+	for i := range p.Firewall {
+		rule, err := p.Firewall[i].Rule()
+		if err != nil {
+			return nil, fmt.Errorf("firewall[%d]: %v", i, err)
+		}
+		rs.Rules = append(rs.Rules, rule)
+	}
+	return rs, nil
+}
@@ -0,0 +1,53 @@
+package oz
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/subgraph/oz/network"
+)
+
+func TestFWRuleRule(t *testing.T) {
+	tests := []struct {
+		rule     FWRule
+		expected network.FirewallRule
+		err      bool
+	}{
+		{
+			FWRule{Whitelist: true, DstHost: "example.com", DstPort: 443},
+			network.FirewallRule{Whitelist: true, Dst: "example.com", Ports: []network.PortRange{{First: 443, Last: 443}}},
+			false,
+		},
+		{
+			FWRule{DstHost: "10.0.0.1"},
+			network.FirewallRule{Dst: "10.0.0.1"},
+			false,
+		},
+		{
+			FWRule{Direction: network.FW_DIRECTION_IN, Proto: network.FW_PROTO_TCP, Dst: "10.0.0.0/8", DstPorts: []string{"22", "8000-8080"}},
+			network.FirewallRule{Direction: network.FW_DIRECTION_IN, Proto: network.FW_PROTO_TCP, Dst: "10.0.0.0/8",
+				Ports: []network.PortRange{{First: 22, Last: 22}, {First: 8000, Last: 8080}}},
+			false,
+		},
+		{FWRule{DstPort: 80}, network.FirewallRule{}, true},
+		{FWRule{Dst: "10.0.0.1", DstHost: "10.0.0.2"}, network.FirewallRule{}, true},
+		{FWRule{Dst: "10.0.0.1", DstPort: 80, DstPorts: []string{"80"}}, network.FirewallRule{}, true},
+		{FWRule{Dst: "10.0.0.1", DstPorts: []string{"http"}}, network.FirewallRule{}, true},
+		{FWRule{Dst: "10.0.0.1", DstPort: 70000}, network.FirewallRule{}, true},
+		{FWRule{Dst: "10.0.0.1", Proto: network.FW_PROTO_ICMP, DstPort: 1}, network.FirewallRule{}, true},
+	}
+	for _, tt := range tests {
+		rule, err := tt.rule.Rule()
+		if tt.err {
+			if err == nil {
+				t.Errorf("%+v: expected an error, got %v", tt.rule, rule)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%+v: unexpected error: %v", tt.rule, err)
+		} else if !reflect.DeepEqual(rule, tt.expected) {
+			t.Errorf("%+v: expected %+v, got %+v", tt.rule, tt.expected, rule)
+		}
+	}
+}
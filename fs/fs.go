@@ -22,6 +22,14 @@ type Filesystem struct {
 	xdgDirs *xdgdirs.Dirs
 	user    *user.User
 	profile *oz.Profile
+	userns  bool
+	bound   []boundPath
+}
+
+// boundPath is a path bind mounted into the sandbox with the flags it was bound with
+type boundPath struct {
+	path  string
+	flags int
 }
 
 func NewFilesystem(config *oz.Config, log *logging.Logger, u *user.User, p *oz.Profile) *Filesystem {
@@ -39,6 +47,7 @@ func NewFilesystem(config *oz.Config, log *logging.Logger, u *user.User, p *oz.P
 		user:    u,
 		xdgDirs: dirs,
 		profile: p,
+		userns:  p != nil && p.UseUserNamespace(config),
 	}
 }
 
@@ -67,6 +76,9 @@ func (fs *Filesystem) CreateEmptyDir(target string) error {
 
 func (fs *Filesystem) CreateDevice(devpath string, dev int, mode uint32, gid int) error {
 	p := fs.absPath(devpath)
+	if fs.userns {
+		return bindDevice(devpath, p)
+	}
 	um := syscall.Umask(0)
 	if err := syscall.Mknod(p, mode, dev); err != nil {
 		return fmt.Errorf("failed to mknod device '%s': %v", p, err)
@@ -80,6 +92,22 @@ func (fs *Filesystem) CreateDevice(devpath string, dev int, mode uint32, gid int
 	return nil
 }
 
+// bindDevice makes the host device node available inside the sandbox.
+// Device nodes cannot be created from inside a user namespace, and would be
+// unusable on a tmpfs mounted there, so the host node is bind mounted instead.
+func bindDevice(devpath, target string) error {
+	if _, err := os.Stat(devpath); err != nil {
+		return fmt.Errorf("failed to stat device '%s': %v", devpath, err)
+	}
+	if err := createEmptyFile(target, 0600); err != nil {
+		return fmt.Errorf("failed to create mount point for device '%s': %v", target, err)
+	}
+	if err := syscall.Mount(devpath, target, "", syscall.MS_BIND, ""); err != nil {
+		return fmt.Errorf("failed to bind device '%s': %v", devpath, err)
+	}
+	return nil
+}
+
 func (fs *Filesystem) CreateSymlink(oldpath, newpath string) (string, error) {
 	if err := syscall.Symlink(oldpath, fs.absPath(newpath)); err != nil {
 		return "", fmt.Errorf("failed to symlink %s to %s: %v", fs.absPath(newpath), oldpath, err)
@@ -139,6 +167,7 @@ func (fs *Filesystem) bindSame(p string, flags int, display int) error {
 }
 
 func (fs *Filesystem) bind(from string, to string, flags int) error {
+	bflags := flags
 	cc := flags&BindCanCreate != 0
 	ii := flags&BindIgnore != 0
 	ff := flags&BindForce != 0
@@ -209,7 +238,11 @@ func (fs *Filesystem) bind(from string, to string, flags int) error {
 		mntflags |= syscall.MS_NOSUID
 	}
 	fs.log.Info("bind mounting %s%s%s -> %s", rolog, sulog, src, to)
-	return bindMount(src, to, mntflags)
+	if err := bindMount(src, to, mntflags); err != nil {
+		return err
+	}
+	fs.bound = append(fs.bound, boundPath{path: oto, flags: bflags})
+	return nil
 }
 
 func (fs *Filesystem) UnbindPath(to string) error {
@@ -390,12 +423,56 @@ func bindMount(source, target string, flags int) error {
 
 func remount(target string, flags int) error {
 	fl := uintptr(flags | syscall.MS_BIND | syscall.MS_REMOUNT)
-	if err := syscall.Mount("", target, "", fl, ""); err != nil {
+	err := syscall.Mount("", target, "", fl, "")
+	if err == syscall.EPERM {
+		// Inside a user namespace the flags of mounts inherited from the
+		// host are locked and a remount has to keep them.
+		fl |= lockedMountFlags(target)
+		err = syscall.Mount("", target, "", fl, "")
+	}
+	if err != nil {
 		return fmt.Errorf("failed to remount %s with flags %x: %v", target, flags, err)
 	}
 	return nil
 }
 
+// lockedMountFlags returns the mount flags of target that cannot be cleared
+// from inside a user namespace
+func lockedMountFlags(target string) uintptr {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(target, &st); err != nil {
+		return 0
+	}
+	fl := uintptr(0)
+	for _, f := range []struct {
+		st, ms uintptr
+	}{
+		{stRdonly, syscall.MS_RDONLY},
+		{stNosuid, syscall.MS_NOSUID},
+		{stNodev, syscall.MS_NODEV},
+		{stNoexec, syscall.MS_NOEXEC},
+		{stNoatime, syscall.MS_NOATIME},
+		{stNodiratime, syscall.MS_NODIRATIME},
+		{stRelatime, syscall.MS_RELATIME},
+	} {
+		if uintptr(st.Flags)&f.st != 0 {
+			fl |= f.ms
+		}
+	}
+	return fl
+}
+
+// statfs(2) f_flags values
+const (
+	stRdonly     = 0x0001
+	stNosuid     = 0x0002
+	stNodev      = 0x0004
+	stNoexec     = 0x0008
+	stNoatime    = 0x0400
+	stNodiratime = 0x0800
+	stRelatime   = 0x1000
+)
+
 const emptyFilePath = "/oz.ro.file"
 const emptyDirPath = "/oz.ro.dir"
 
@@ -0,0 +1,181 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Landlock filesystem access rights, see linux/landlock.h
+const (
+	landlockExecute = 1 << iota
+	landlockWriteFile
+	landlockReadFile
+	landlockReadDir
+	landlockRemoveDir
+	landlockRemoveFile
+	landlockMakeChar
+	landlockMakeDir
+	landlockMakeReg
+	landlockMakeSock
+	landlockMakeFifo
+	landlockMakeBlock
+	landlockMakeSym
+	landlockRefer    // ABI 2
+	landlockTruncate // ABI 3
+	landlockIoctlDev // ABI 5
+)
+
+// Access rights which can be granted on a file instead of a directory
+const landlockFileAccess = landlockExecute | landlockWriteFile | landlockReadFile | landlockTruncate | landlockIoctlDev
+
+// Access rights granted to the paths of a sandbox
+const (
+	// Read and execute files, list directories
+	LandlockRead uint64 = landlockExecute | landlockReadFile | landlockReadDir
+	// Also write existing files
+	LandlockReadWrite = LandlockRead | landlockWriteFile | landlockTruncate
+	// Also create, rename and remove files and directories
+	LandlockCreate = LandlockReadWrite | landlockRemoveDir | landlockRemoveFile | landlockMakeDir |
+		landlockMakeReg | landlockMakeSock | landlockMakeFifo | landlockMakeSym | landlockRefer
+	// Read, write and ioctl on existing device nodes
+	LandlockDevices = LandlockReadWrite | landlockIoctlDev
+	// Everything, for directories private to the sandbox
+	LandlockFull = LandlockCreate | landlockMakeChar | landlockMakeBlock | landlockIoctlDev
+)
+
+const (
+	sysLandlockCreateRuleset = 444
+	sysLandlockAddRule       = 445
+	sysLandlockRestrictSelf  = 446
+
+	landlockCreateRulesetVersion = 1
+	landlockRulePathBeneath      = 1
+
+	prSetNoNewPrivs = 38
+	oPath           = 0x200000
+)
+
+var ErrLandlockUnsupported = errors.New("landlock is not supported by the kernel")
+
+// LandlockRule grants access rights to everything beneath a path
+type LandlockRule struct {
+	Path   string
+	Access uint64
+}
+
+type landlockRulesetAttr struct {
+	handledAccessFs uint64
+}
+
+// Mirrors the packed struct landlock_path_beneath_attr,
+// the kernel only reads the first 12 bytes
+type landlockPathBeneathAttr struct {
+	allowedAccess uint64
+	parentFd      int32
+	_             int32
+}
+
+// LandlockABI returns the version of the Landlock ABI supported by the kernel, 0 if none
+func LandlockABI() int {
+	v, _, errno := syscall.Syscall(sysLandlockCreateRuleset, 0, 0, landlockCreateRulesetVersion)
+	if errno != 0 {
+		return 0
+	}
+	return int(v)
+}
+
+// handledAccess returns the access rights known to a Landlock ABI version
+func handledAccess(abi int) uint64 {
+	access := uint64(landlockRefer - 1)
+	if abi >= 2 {
+		access |= landlockRefer
+	}
+	if abi >= 3 {
+		access |= landlockTruncate
+	}
+	if abi >= 5 {
+		access |= landlockIoctlDev
+	}
+	return access
+}
+
+// LandlockRules returns the rules granting access to the paths bound into
+// the sandbox: read only items can be read, items which can be created can
+// be modified freely and the others can only have their files written.
+func (fs *Filesystem) LandlockRules() []LandlockRule {
+	rules := []LandlockRule{}
+	for _, b := range fs.bound {
+		access := LandlockReadWrite
+		if b.flags&BindReadOnly != 0 {
+			access = LandlockRead
+		} else if b.flags&BindCanCreate != 0 {
+			access = LandlockCreate
+		}
+		rules = append(rules, LandlockRule{Path: b.path, Access: access})
+	}
+	return rules
+}
+
+// LandlockRestrictSelf denies the calling thread, and the processes it
+// starts, any access to the filesystem other than what the rules grant.
+// Paths which do not exist are skipped. The caller must be locked to its
+// OS thread and should not unlock it, the thread cannot be unrestricted.
+func LandlockRestrictSelf(rules []LandlockRule) error {
+	abi := LandlockABI()
+	if abi < 1 {
+		return ErrLandlockUnsupported
+	}
+	handled := handledAccess(abi)
+	attr := landlockRulesetAttr{handledAccessFs: handled}
+	fd, _, errno := syscall.Syscall(sysLandlockCreateRuleset, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return fmt.Errorf("failed to create landlock ruleset: %v", errno)
+	}
+	defer syscall.Close(int(fd))
+
+	for _, r := range rules {
+		if err := landlockAddRule(int(fd), r, handled); err != nil {
+			return err
+		}
+	}
+
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		return fmt.Errorf("failed to set no_new_privs: %v", errno)
+	}
+	if _, _, errno := syscall.Syscall(sysLandlockRestrictSelf, fd, 0, 0); errno != 0 {
+		return fmt.Errorf("failed to enforce landlock ruleset: %v", errno)
+	}
+	return nil
+}
+
+func landlockAddRule(fd int, r LandlockRule, handled uint64) error {
+	pfd, err := syscall.Open(r.Path, oPath|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to open %s for landlock rule: %v", r.Path, err)
+	}
+	defer syscall.Close(pfd)
+
+	var st syscall.Stat_t
+	if err := syscall.Fstat(pfd, &st); err != nil {
+		return err
+	}
+	access := r.Access & handled
+	if st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		access &= landlockFileAccess
+	}
+	if access == 0 {
+		return nil
+	}
+	attr := landlockPathBeneathAttr{allowedAccess: access, parentFd: int32(pfd)}
+	_, _, errno := syscall.Syscall6(sysLandlockAddRule, uintptr(fd), landlockRulePathBeneath, uintptr(unsafe.Pointer(&attr)), 0, 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("failed to add landlock rule for %s: %v", r.Path, errno)
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/milosgajdos83/tenus"
+	"github.com/subgraph/oz/ns"
+)
+
+// adoptedVeth is a veth pair created by a previous instance of the daemon.
+// Only the host side is reachable from the host namespace, the peer already
+// lives in the network namespace of the sandbox and is only known by name.
+type adoptedVeth struct {
+	tenus.Linker
+	peerIfc *net.Interface
+}
+
+var errAdoptedVeth = errors.New("operation not supported on an adopted veth")
+
+func (av *adoptedVeth) PeerNetInterface() *net.Interface {
+	return av.peerIfc
+}
+
+func (av *adoptedVeth) SetPeerLinkUp() error {
+	return errAdoptedVeth
+}
+
+func (av *adoptedVeth) DeletePeerLink() error {
+	return av.DeleteLink()
+}
+
+func (av *adoptedVeth) SetPeerLinkIp(net.IP, *net.IPNet) error {
+	return errAdoptedVeth
+}
+
+func (av *adoptedVeth) SetPeerLinkNsToDocker(string, string) error {
+	return errAdoptedVeth
+}
+
+func (av *adoptedVeth) SetPeerLinkNsPid(int) error {
+	return errAdoptedVeth
+}
+
+func (av *adoptedVeth) SetPeerLinkNsFd(string) error {
+	return errAdoptedVeth
+}
+
+// SetPeerLinkNetInNs configures the peer, looking it up by name from inside
+// the network namespace of the sandbox
+func (av *adoptedVeth) SetPeerLinkNetInNs(nspid int, ip net.IP, network *net.IPNet, gw *net.IP) error {
+	return ns.WithProcessNetNS(nspid, func() error {
+		peer, err := tenus.NewLinkFrom(av.peerIfc.Name)
+		if err != nil {
+			return err
+		}
+		if err := peer.SetLinkIp(ip, network); err != nil {
+			return fmt.Errorf("Unable to set IP: %s in pid: %d network namespace", ip.String(), nspid)
+		}
+		if err := peer.SetLinkUp(); err != nil {
+			return fmt.Errorf("Unable to bring %s interface UP: %v", av.peerIfc.Name, err)
+		}
+		if gw != nil {
+			if err := peer.SetLinkDefaultGw(gw); err != nil {
+				return fmt.Errorf("Unable to set Default gateway: %s in pid: %d network namespace", gw.String(), nspid)
+			}
+		}
+		return nil
+	})
+}
+
+// AdoptVeth takes back ownership of the veth pair of a sandbox that was
+// created by a previous instance of the daemon. The bridge it is attached
+// to is adopted as well, along with its address ranges, instead of being
+// recreated.
+func (bs *Bridges) AdoptVeth(name string, id, peerPid int, hostName, peerName string, sbip, sbip6 net.IP) (*OzVeth, error) {
+	if err := bs.ensureInitialized(); err != nil {
+		return nil, err
+	}
+	br := bs.bridgeMap[name]
+	if br == nil {
+		var err error
+		if br, err = bs.adoptBridge(name); err != nil {
+			return nil, err
+		}
+		bs.bridgeMap[name] = br
+	}
+	if br.veths[id] != nil {
+		return nil, fmt.Errorf("a veth already exists on this bridge for id=%d", id)
+	}
+
+	link, err := tenus.NewLinkFrom(hostName)
+	if err != nil {
+		return nil, fmt.Errorf("unable to find veth %s: %v", hostName, err)
+	}
+	if sbip != nil && !br.ipr.Claim(sbip) {
+		bs.log.Warningf("Address %v of veth %s is not part of the range of bridge %s", sbip, hostName, br.Name)
+	}
+	if sbip6 != nil && (br.ipr6 == nil || !br.ipr6.Claim(sbip6)) {
+		bs.log.Warningf("Address %v of veth %s is not part of the IPv6 range of bridge %s", sbip6, hostName, br.Name)
+	}
+	v := &OzVeth{
+		Vether:  &adoptedVeth{Linker: link, peerIfc: &net.Interface{Name: peerName}},
+		id:      id,
+		peerPid: peerPid,
+		bridge:  br,
+		sbip:    sbip,
+		sbip6:   sbip6,
+		log:     bs.log,
+	}
+	br.veths[id] = v
+	return v, nil
+}
+
+// adoptBridge opens an existing bridge and rebuilds its address range from
+// the address configured on it
+func (bs *Bridges) adoptBridge(name string) (*OzBridge, error) {
+	brname := ozDefaultInterfaceBridgeBase + name
+	br, err := tenus.BridgeFromName(brname)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := br.NetInterface().Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read addresses of bridge %s: %v", brname, err)
+	}
+	for _, a := range addrs {
+		ipn, ok := a.(*net.IPNet)
+		if !ok || ipn.IP.To4() == nil {
+			continue
+		}
+		ip := ipn.IP.To4()
+		subnet := &net.IPNet{IP: ip.Mask(ipn.Mask), Mask: ipn.Mask}
+		bs.alloc.reserve(subnet)
+		bs.log.Infof("Adopting bridge '%s' with IP address %v", brname, ip)
+		ipr := newIPRange(subnet, brname)
+		ipr.Claim(ip)
+		b := &OzBridge{
+			Bridger: br,
+			Name:    name,
+			ipr:     ipr,
+			ip:      &ip,
+			veths:   make(map[int]*OzVeth),
+			fw:      bs.fw,
+			log:     bs.log,
+		}
+		bs.adoptIPv6(b, addrs)
+		return b, nil
+	}
+	return nil, fmt.Errorf("bridge %s has no IPv4 address", brname)
+}
+
+// DeleteVeth removes the host side of a veth pair left by a sandbox which is gone
+func DeleteVeth(name string) error {
+	if _, err := net.InterfaceByName(name); err != nil {
+		// Destroyed along with the network namespace of the sandbox
+		return nil
+	}
+	return tenus.DeleteLink(name)
+}
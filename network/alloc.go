@@ -37,6 +37,17 @@ func (sa *subnetAllocator) allocate() (*net.IPNet, error) {
 	return sub, nil
 }
 
+// reserve prevents a subnet already in use by an adopted bridge from being allocated again
+func (sa *subnetAllocator) reserve(n *net.IPNet) {
+	ip4 := n.IP.To4()
+	if ip4 == nil || !sa.baseNet.Contains(ip4) {
+		return
+	}
+	if int(ip4[2]) >= sa.nextSubnet {
+		sa.nextSubnet = int(ip4[2]) + 1
+	}
+}
+
 func (sa *subnetAllocator) needsReconfigure() bool {
 	return overlapsAny(sa.baseNet, getLocalNetworks())
 }
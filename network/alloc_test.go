@@ -1,6 +1,7 @@
 package network
 
 import (
+	"net"
 	"testing"
 )
 
@@ -30,3 +31,22 @@ func TestParseRanges(t *testing.T) {
 		parseRanges("1.2.3.4")
 	})
 }
+
+func TestReserve(t *testing.T) {
+	sa := &subnetAllocator{baseNet: parseRanges("10.1.0.0/16")[0], nextSubnet: 1}
+	for _, d := range []struct {
+		cidr string
+		next int
+	}{
+		{"10.1.4.0/24", 5},
+		{"10.1.2.0/24", 5},
+		{"10.2.9.0/24", 5},
+		{"10.1.7.0/24", 8},
+	} {
+		_, n, _ := net.ParseCIDR(d.cidr)
+		sa.reserve(n)
+		if sa.nextSubnet != d.next {
+			t.Errorf("after reserving %s expecting next subnet %d, got %d", d.cidr, d.next, sa.nextSubnet)
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/milosgajdos83/tenus"
 	"github.com/op/go-logging"
 	"net"
+	"sync"
 )
 
 // Bridges manages the creation of bridges for sandbox bridged networking
@@ -14,6 +15,9 @@ type Bridges struct {
 	initialized bool                 // Initialize the following fields lazily
 	alloc       *subnetAllocator     // allocates subnet ranges for new bridges
 	bridgeMap   map[string]*OzBridge // Map of names to bridge instances
+	fw          Firewall             // Firewall holding the rules of the sandboxes
+	ipv6        IPv6Mode             // How sandboxes reach IPv6 networks, if at all
+	alloc6      *subnetAllocator6    // allocates IPv6 subnets for new bridges if IPv6 is enabled
 }
 
 // OzBridge represents a single bridge used for sandbox bridged networking
@@ -22,7 +26,11 @@ type OzBridge struct {
 	Name          string          // Name of bridge
 	ipr           *IPRange        // IPRange for allocating addresses to veth interfaces
 	ip            *net.IP         // IP assigned to the bridge itself
+	ipr6          *IPRange6       // IPv6 range of the bridge, nil if IPv6 is disabled
+	ip6           net.IP          // IPv6 address assigned to the bridge itself
 	veths         map[int]*OzVeth // map from sandbox id to OzVeth instances
+	fw            Firewall        // Firewall holding the rules of the sandboxes
+	dns           *dnsForwarder   // DNS forwarder of the sandboxes, started when first needed
 	log           *logging.Logger
 }
 
@@ -33,7 +41,16 @@ type OzVeth struct {
 	peerPid      int       // The process id of the init process of the sandbox this veth pair belongs to
 	bridge       *OzBridge // The bridge this veth pair is attached to
 	sbip         net.IP    // The sandbox's IP through the bridge
+	sbip6        net.IP    // The sandbox's IPv6 address through the bridge, if any
 	log          *logging.Logger
+	fwrules      *FirewallRuleset
+	dhcp         *dhcpResponder
+	dns          []net.IP
+	dnsc         *dnsClient
+	bandwidth    Bandwidth
+	killSwitch   bool       // Whether a VPN kill-switch was installed
+	fwmtx        sync.Mutex // Serializes the changes to the firewall rules
+	fwremoved    bool       // Whether the firewall rules were removed for good
 }
 
 func (b *OzBridge) configure() error {
@@ -58,6 +75,18 @@ func (b *OzBridge) reconfigure(ipr *IPRange) error {
 
 	}
 	b.ipr = ipr
+	ip := ipr.FirstIP()
+	b.ip = &ip
+	if b.dns != nil {
+		// The sandboxes register again as their addresses change
+		b.dns.close()
+		f, err := newDNSForwarder(ip, b.log)
+		if err != nil {
+			b.dns = nil
+			return err
+		}
+		b.dns = f
+	}
 	for _, veth := range b.veths {
 		if err := veth.AssignIP(); err != nil {
 			return err
@@ -120,9 +149,23 @@ func (v *OzVeth) Setup() error {
 		return fmt.Errorf("failed to send peer veth %s into sandbox (pid: %d): %v", v.PeerNetInterface().Name, v.peerPid, err)
 	}
 
+	// Chosen first so that the firewall rules cover it from the start,
+	// DHCP clients only learn about the IPv4 address
+	if v.bridge.ipr6 != nil && v.dhcp == nil {
+		if v.sbip6 = v.bridge.ipr6.FreshIP(); v.sbip6 == nil {
+			return errors.New("unable to find usable IPv6 address")
+		}
+	}
+
 	if err := v.AssignIP(); err != nil {
 		return fmt.Errorf("failed to assign address to peer veth %s: %v", v.PeerNetInterface().Name, err)
 	}
+
+	if v.sbip6 != nil {
+		if err := v.assignIP6(); err != nil {
+			return fmt.Errorf("failed to assign IPv6 address to peer veth %s: %v", v.PeerNetInterface().Name, err)
+		}
+	}
 	return nil
 }
 
@@ -140,17 +183,39 @@ func (v *OzVeth) AssignIP() error {
 func (v *OzVeth) SetIP(ip net.IP) error {
 	ipnet := v.bridge.ipr
 	gw := v.bridge.ip
-	err := v.SetPeerLinkNetInNs(v.peerPid, ip, ipnet.IPNet, gw)
+	v.fwmtx.Lock()
+	defer v.fwmtx.Unlock()
+	// The rules are in place before the sandbox starts using the address
+	if err := v.installFWRules(ip); err != nil {
+		return fmt.Errorf("unable to install firewall rules for %v: %v", ip, err)
+	}
+	var err error
+	if v.dhcp != nil {
+		err = setLinkUpInNs(v.peerPid, v.PeerNetInterface().Name)
+	} else {
+		err = v.SetPeerLinkNetInNs(v.peerPid, ip, ipnet.IPNet, gw)
+	}
 
 	if err == nil {
-		if v.sbip != nil {
-			err2 := v.RemoveFWRules()
+		if v.sbip != nil && !v.sbip.Equal(ip) {
+			if v.dnsc != nil {
+				v.bridge.dns.unregister(v.sbip)
+			}
+			err2 := v.removeFWRules(v.sbip)
 
 			if err2 != nil {
 				v.log.Warning("Error: could not remove firewall rules for reconfigured interface: ", err2.Error())
 			}
 		}
 		v.sbip = ip
+		if v.dhcp != nil {
+			v.updateLease()
+		}
+		if v.dnsc != nil {
+			v.bridge.dns.register(ip, v.dnsc)
+		}
+	} else {
+		v.removeFWRules(ip)
 	}
 
 	return err
@@ -161,7 +226,28 @@ func (v *OzVeth) GetSandboxIP() net.IP {
 	return v.sbip
 }
 
+// GetSandboxIP6 returns the IPv6 address of the sandbox, nil if it has none
+func (v *OzVeth) GetSandboxIP6() net.IP {
+	return v.sbip6
+}
+
 func (v *OzVeth) Delete() error {
+	if v.dhcp != nil {
+		v.dhcp.close()
+	}
+	if v.dnsc != nil && v.sbip != nil && v.bridge.dns != nil {
+		v.bridge.dns.unregister(v.sbip)
+	}
+	if v.bandwidth.Limited() {
+		if err := v.SetBandwidth(Bandwidth{}); err != nil {
+			v.log.Warningf("Unable to remove the bandwidth limits of sandbox %d: %v", v.id, err)
+		}
+	}
+	if v.killSwitch && v.sbip != nil {
+		if err := RemoveKillSwitch(v.sbip); err != nil {
+			v.log.Warningf("Unable to remove the VPN kill-switch of sandbox %d: %v", v.id, err)
+		}
+	}
 	return v.DeleteLink()
 }
 
@@ -202,6 +288,9 @@ func (bs *Bridges) GetBridge(name string) (*OzBridge, error) {
 		if err := br.configure(); err != nil {
 			return nil, err
 		}
+		if err := bs.configureIPv6(br); err != nil {
+			return nil, err
+		}
 		bs.bridgeMap[name] = br
 	}
 	return bs.bridgeMap[name], nil
@@ -218,11 +307,19 @@ func (bs *Bridges) createBridge(name string) (*OzBridge, error) {
 	if err != nil {
 		return nil, err
 	}
+	var r6 *IPRange6
+	if bs.alloc6 != nil {
+		if r6, err = bs.alloc6.allocateRange(brname); err != nil {
+			return nil, err
+		}
+	}
 	return &OzBridge{
 		Bridger: br,
 		Name:    name,
 		ipr:     r,
+		ipr6:    r6,
 		veths:   make(map[int]*OzVeth),
+		fw:      bs.fw,
 		log:     bs.log,
 	}, nil
 }
@@ -265,35 +362,3 @@ func (bs *Bridges) Reconfigure() error {
 func (v *OzVeth) GetVethBridge() *OzBridge {
 	return v.bridge
 }
-
-const ReceiverSocketPath = "/tmp/fwoz.sock"
-
-func (v *OzVeth) RemoveFWRules() error {
-	src := v.sbip
-	fmt.Println("--------------- removing all rules by if = ", src.String())
-	if src == nil {
-		return errors.New("Could not remove firewall rules from null interface")
-	}
-	c, err := net.Dial("unix", ReceiverSocketPath)
-	if err != nil {
-		return err
-	}
-
-	defer c.Close()
-
-	reqstr := "removeall " + src.String() + "\n"
-	c.Write([]byte(reqstr))
-
-	buf := make([]byte, 1024)
-
-	for {
-		n, err := c.Read(buf[:])
-		if err != nil {
-			return err
-		}
-		fmt.Println(string(buf[0:n]))
-	}
-
-	fmt.Println("Done.")
-	return nil
-}
@@ -0,0 +1,259 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/subgraph/oz/ns"
+
+	"github.com/op/go-logging"
+)
+
+// Time after which a datagram session without traffic is dropped, unless
+// the socket configures an idle timeout
+const defaultDgramTimeout = 60 * time.Second
+
+// Largest datagram relayed
+const maxDatagram = 65535
+
+var dgramSeq uint64
+
+func isDatagram(proto ProtoType) bool {
+	return proto == PROTO_UDP || proto == PROTO_UNIXGRAM
+}
+
+// dgramProxy relays the datagrams received on its socket. Each peer gets a
+// session with a socket of its own on the other side, so that replies can
+// be sent back to it.
+type dgramProxy struct {
+	pid  int
+	desc string
+	conn net.PacketConn
+	dial func() (net.Conn, error)
+	// The peers are on the sandbox side, as in client mode
+	inSandbox bool
+	timeout   time.Duration
+	max       int
+	log       *logging.Logger
+
+	lock     sync.Mutex
+	sessions map[string]*dgramSession
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+type dgramSession struct {
+	peer net.Addr
+	conn net.Conn
+	// Registered with the open connections to be listed and counted
+	pc *proxyConn
+}
+
+// startDgramProxy registers a datagram proxy for the sandbox and starts
+// relaying what is received on conn
+func startDgramProxy(pid int, config *ProxyConfig, desc string, conn net.PacketConn, dial func() (net.Conn, error), inSandbox bool, log *logging.Logger) *dgramProxy {
+	p := &dgramProxy{
+		pid:       pid,
+		desc:      desc,
+		conn:      conn,
+		dial:      dial,
+		inSandbox: inSandbox,
+		timeout:   defaultDgramTimeout,
+		max:       int(config.MaxConns),
+		log:       log,
+		sessions:  make(map[string]*dgramSession),
+		done:      make(chan struct{}),
+	}
+	if config.IdleTimeout != 0 {
+		p.timeout = time.Duration(config.IdleTimeout) * time.Second
+	}
+	if p.max == 0 {
+		p.max = defaultProxyMaxConns
+	}
+	proxyLock.Lock()
+	proxies[pid] = append(proxies[pid], p)
+	proxyLock.Unlock()
+
+	p.wg.Add(1)
+	go p.serve()
+	return p
+}
+
+// counters returns the counters of the datagrams from the peer and to it
+func (p *dgramProxy) counters(s *dgramSession) (*uint64, *uint64) {
+	if p.inSandbox {
+		return &s.pc.pair.Sent, &s.pc.pair.Received
+	}
+	return &s.pc.pair.Received, &s.pc.pair.Sent
+}
+
+func (p *dgramProxy) serve() {
+	defer p.wg.Done()
+	buf := make([]byte, maxDatagram)
+	for {
+		n, peer, err := p.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-p.done:
+				return
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			p.log.Error("Socket: %+v.", err)
+			time.Sleep(proxyAcceptBackoff)
+			continue
+		}
+		s, err := p.session(peer)
+		if err != nil {
+			p.log.Warning("%s: dropping datagram from %v: %v", p.desc, peer, err)
+			continue
+		}
+		atomic.StoreInt64(&s.pc.active, time.Now().UnixNano())
+		if _, err := s.conn.Write(buf[:n]); err == nil {
+			from, _ := p.counters(s)
+			atomic.AddUint64(from, uint64(n))
+		}
+	}
+}
+
+// session returns the session of the peer, opened on its first datagram.
+// Peers without an address, such as unbound unix sockets, share a session
+// which cannot send replies.
+func (p *dgramProxy) session(peer net.Addr) (*dgramSession, error) {
+	key := ""
+	if peer != nil {
+		key = peer.String()
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if s, ok := p.sessions[key]; ok {
+		return s, nil
+	}
+	if len(p.sessions) >= p.max {
+		return nil, fmt.Errorf("%d sessions open", p.max)
+	}
+	c, err := p.dial()
+	if err != nil {
+		return nil, err
+	}
+	s := &dgramSession{peer: peer, conn: c}
+	s.pc = &proxyConn{in: c, active: time.Now().UnixNano()}
+	s.pc.pair.Pid = p.pid
+	if p.inSandbox {
+		s.pc.pair.In, s.pc.pair.Out = addrToPConn(peer, p.conn.LocalAddr()), connToPConn(c, true)
+	} else {
+		s.pc.pair.In, s.pc.pair.Out = connToPConn(c, true), addrToPConn(peer, p.conn.LocalAddr())
+	}
+	p.sessions[key] = s
+
+	proxyLock.Lock()
+	proxySeq++
+	s.pc.seq = proxySeq
+	proxyConns[c] = s.pc
+	proxyLock.Unlock()
+
+	p.wg.Add(1)
+	go p.reply(key, s)
+	return s, nil
+}
+
+// reply relays the datagrams received on the socket of the session back to
+// its peer, until the session times out or is closed
+func (p *dgramProxy) reply(key string, s *dgramSession) {
+	defer p.wg.Done()
+	defer p.closeSession(key, s)
+	buf := make([]byte, maxDatagram)
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(p.timeout))
+		n, err := s.conn.Read(buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			if time.Since(time.Unix(0, atomic.LoadInt64(&s.pc.active))) < p.timeout {
+				continue
+			}
+			return
+		}
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			// Nothing listening on the other side for now
+			continue
+		}
+		if err != nil {
+			return
+		}
+		atomic.StoreInt64(&s.pc.active, time.Now().UnixNano())
+		if s.peer == nil {
+			continue
+		}
+		if _, err := p.conn.WriteTo(buf[:n], s.peer); err == nil {
+			_, to := p.counters(s)
+			atomic.AddUint64(to, uint64(n))
+		}
+	}
+}
+
+func (p *dgramProxy) closeSession(key string, s *dgramSession) {
+	p.lock.Lock()
+	if p.sessions[key] == s {
+		delete(p.sessions, key)
+	}
+	p.lock.Unlock()
+
+	proxyLock.Lock()
+	delete(proxyConns, s.conn)
+	proxyLock.Unlock()
+	s.conn.Close()
+}
+
+// shutdown stops relaying at once, datagrams have no connection to finish
+func (p *dgramProxy) shutdown(grace time.Duration) {
+	close(p.done)
+	p.conn.Close()
+	p.lock.Lock()
+	for _, s := range p.sessions {
+		s.conn.Close()
+	}
+	p.lock.Unlock()
+	p.wg.Wait()
+}
+
+// addrToPConn returns the addresses of a datagram from src to dst, or nil
+// if they are not IP addresses
+func addrToPConn(src, dst net.Addr) *PConnInfo {
+	s, ok := src.(*net.UDPAddr)
+	d, ok2 := dst.(*net.UDPAddr)
+	if !ok || !ok2 || s == nil || d == nil {
+		return nil
+	}
+	return &PConnInfo{Saddr: s.IP, Sport: uint16(s.Port), Daddr: d.IP, Dport: uint16(d.Port)}
+}
+
+// dialDatagram opens a socket sending to rAddr. Unix sockets are bound to
+// an abstract address of their own, without which they cannot get replies.
+func dialDatagram(proto ProtoType, rAddr string) (net.Conn, error) {
+	if proto != PROTO_UNIXGRAM {
+		return net.Dial(string(proto), rAddr)
+	}
+	laddr := &net.UnixAddr{
+		Name: fmt.Sprintf("@oz-dgram-%d-%d", os.Getpid(), atomic.AddUint64(&dgramSeq, 1)),
+		Net:  string(proto),
+	}
+	return net.DialUnix(string(proto), laddr, &net.UnixAddr{Name: rAddr, Net: string(proto)})
+}
+
+func proxyPacketListener(pid int, proto ProtoType, lAddr string) (conn net.PacketConn, err error) {
+	nerr := ns.WithProcessNetNS(pid, func() error {
+		conn, err = net.ListenPacket(string(proto), lAddr)
+		return nil
+	})
+	if nerr != nil {
+		return nil, nerr
+	}
+	return conn, err
+}
@@ -0,0 +1,217 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/op/go-logging"
+
+	"github.com/subgraph/oz/network/nettest"
+	"github.com/subgraph/oz/ns"
+)
+
+// inNetNS runs f in the namespace of the process, failing the test on error
+func inNetNS(t *testing.T, pid int, f func() error) {
+	if err := ns.WithProcessNetNS(pid, f); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// dgramEcho answers each datagram with its content prefixed by prefix
+func dgramEcho(c net.PacketConn, prefix string) {
+	buf := make([]byte, maxDatagram)
+	for {
+		n, addr, err := c.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if addr != nil {
+			c.WriteTo(append([]byte(prefix), buf[:n]...), addr)
+		}
+	}
+}
+
+func freeUDPPort(t *testing.T) int {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	return c.LocalAddr().(*net.UDPAddr).Port
+}
+
+func exchange(t *testing.T, c net.Conn, msg, expected string) {
+	c.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := c.Write([]byte(msg)); err != nil {
+		t.Fatalf("write %q: %v", msg, err)
+	}
+	buf := make([]byte, 512)
+	n, err := c.Read(buf)
+	if err != nil || string(buf[:n]) != expected {
+		t.Fatalf("sent %q, got %q (%v), expected %q", msg, buf[:n], err, expected)
+	}
+}
+
+func TestDgramProxyClientUDP(t *testing.T) {
+	pid := nettest.NetNS(t)
+	host, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Close()
+	go dgramEcho(host, "host:")
+
+	config := []ProxyConfig{{Nettype: PROXY_CLIENT, Proto: PROTO_UDP, Port: 53, DPort: host.LocalAddr().(*net.UDPAddr).Port}}
+	if err := ProxySetup(pid, config, logging.MustGetLogger("oz-test")); err != nil {
+		t.Fatal(err)
+	}
+	defer ProxyShutdown(pid, time.Second)
+
+	var c1, c2 net.Conn
+	inNetNS(t, pid, func() (err error) {
+		if c1, err = net.Dial("udp", "127.0.0.1:53"); err != nil {
+			return err
+		}
+		c2, err = net.Dial("udp", "127.0.0.1:53")
+		return err
+	})
+	defer c1.Close()
+	defer c2.Close()
+	exchange(t, c1, "one", "host:one")
+	exchange(t, c2, "two", "host:two")
+	exchange(t, c1, "three", "host:three")
+
+	pairs := SandboxProxyPairs(pid)
+	if len(pairs) != 2 {
+		t.Fatalf("SandboxProxyPairs() = %+v, expected a session per peer", pairs)
+	}
+	if pairs[0].Sent != 8 || pairs[0].Received != 18 || pairs[0].In.Sport != uint16(c1.LocalAddr().(*net.UDPAddr).Port) {
+		t.Errorf("first session = %+v, expected 8 bytes sent and 18 received from port %v", pairs[0], c1.LocalAddr())
+	}
+}
+
+func TestDgramProxyServerUDP(t *testing.T) {
+	pid := nettest.NetNS(t)
+	port := freeUDPPort(t)
+	var sandbox net.PacketConn
+	inNetNS(t, pid, func() (err error) {
+		sandbox, err = net.ListenPacket("udp", fmt.Sprintf("127.0.0.1:%d", port))
+		return err
+	})
+	defer sandbox.Close()
+	go dgramEcho(sandbox, "sandbox:")
+
+	config := []ProxyConfig{{Nettype: PROXY_SERVER, Proto: PROTO_UDP, Port: port}}
+	if err := ProxySetup(pid, config, logging.MustGetLogger("oz-test")); err != nil {
+		t.Fatal(err)
+	}
+	defer ProxyShutdown(pid, time.Second)
+
+	c, err := net.Dial("udp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	exchange(t, c, "ping", "sandbox:ping")
+	if pairs := SandboxProxyPairs(pid); len(pairs) != 1 || pairs[0].Sent != 12 || pairs[0].Received != 4 {
+		t.Errorf("SandboxProxyPairs() = %+v, expected 12 bytes sent and 4 received", pairs)
+	}
+}
+
+func TestDgramProxyClientUnixgram(t *testing.T) {
+	pid := nettest.NetNS(t)
+	addr := fmt.Sprintf("@oz-test-log-%d", pid)
+	host, err := net.ListenPacket("unixgram", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Close()
+	received := make(chan string, 4)
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, peer, err := host.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			received <- string(buf[:n])
+			if peer != nil {
+				host.WriteTo([]byte("ack"), peer)
+			}
+		}
+	}()
+
+	config := []ProxyConfig{{Nettype: PROXY_CLIENT, Proto: PROTO_UNIXGRAM, Destination: addr}}
+	if err := ProxySetup(pid, config, logging.MustGetLogger("oz-test")); err != nil {
+		t.Fatal(err)
+	}
+	defer ProxyShutdown(pid, time.Second)
+
+	// An unbound sender, as used by syslog(3), only sends
+	var anon net.Conn
+	var named *net.UnixConn
+	inNetNS(t, pid, func() (err error) {
+		if anon, err = net.Dial("unixgram", addr); err != nil {
+			return err
+		}
+		named, err = net.DialUnix("unixgram", &net.UnixAddr{Name: addr + "-client", Net: "unixgram"}, &net.UnixAddr{Name: addr, Net: "unixgram"})
+		return err
+	})
+	defer anon.Close()
+	defer named.Close()
+
+	anon.Write([]byte("<13>hello"))
+	select {
+	case msg := <-received:
+		if msg != "<13>hello" {
+			t.Errorf("received %q", msg)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("datagram of an unbound sender not relayed")
+	}
+	exchange(t, named, "<13>again", "ack")
+}
+
+func TestDgramProxyLimits(t *testing.T) {
+	pid := nettest.NetNS(t)
+	host, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Close()
+	go dgramEcho(host, "")
+
+	config := []ProxyConfig{{Nettype: PROXY_CLIENT, Proto: PROTO_UDP, Port: 5353, DPort: host.LocalAddr().(*net.UDPAddr).Port, MaxConns: 1, IdleTimeout: 1}}
+	if err := ProxySetup(pid, config, logging.MustGetLogger("oz-test")); err != nil {
+		t.Fatal(err)
+	}
+	defer ProxyShutdown(pid, time.Second)
+
+	var c1, c2 net.Conn
+	inNetNS(t, pid, func() (err error) {
+		if c1, err = net.Dial("udp", "127.0.0.1:5353"); err != nil {
+			return err
+		}
+		c2, err = net.Dial("udp", "127.0.0.1:5353")
+		return err
+	})
+	defer c1.Close()
+	defer c2.Close()
+	exchange(t, c1, "a", "a")
+
+	// Over the limit of sessions
+	c2.SetDeadline(time.Now().Add(200 * time.Millisecond))
+	c2.Write([]byte("b"))
+	if _, err := c2.Read(make([]byte, 8)); err == nil {
+		t.Fatal("datagram relayed over the session limit")
+	}
+
+	// Once the first session expired
+	time.Sleep(1500 * time.Millisecond)
+	if pairs := SandboxProxyPairs(pid); len(pairs) != 0 {
+		t.Fatalf("SandboxProxyPairs() = %+v, expected the session to time out", pairs)
+	}
+	exchange(t, c2, "c", "c")
+}
@@ -0,0 +1,500 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+const (
+	dhcpServerPort = 67
+	dhcpClientPort = 68
+
+	dhcpOpRequest = 1
+	dhcpOpReply   = 2
+
+	// Length of the fixed part of a message, up to the magic cookie
+	dhcpHeaderLen = 236
+
+	// Leases are short so that clients pick up reconfigured addresses quickly
+	dhcpLeaseTime = 10 * time.Minute
+)
+
+var dhcpMagicCookie = []byte{99, 130, 83, 99}
+
+type dhcpMessageType byte
+
+const (
+	DHCPDISCOVER dhcpMessageType = 1
+	DHCPOFFER    dhcpMessageType = 2
+	DHCPREQUEST  dhcpMessageType = 3
+	DHCPDECLINE  dhcpMessageType = 4
+	DHCPACK      dhcpMessageType = 5
+	DHCPNAK      dhcpMessageType = 6
+	DHCPRELEASE  dhcpMessageType = 7
+	DHCPINFORM   dhcpMessageType = 8
+)
+
+var dhcpMessageTypeNames = map[dhcpMessageType]string{
+	DHCPDISCOVER: "DHCPDISCOVER",
+	DHCPOFFER:    "DHCPOFFER",
+	DHCPREQUEST:  "DHCPREQUEST",
+	DHCPDECLINE:  "DHCPDECLINE",
+	DHCPACK:      "DHCPACK",
+	DHCPNAK:      "DHCPNAK",
+	DHCPRELEASE:  "DHCPRELEASE",
+	DHCPINFORM:   "DHCPINFORM",
+}
+
+func (t dhcpMessageType) String() string {
+	if name, ok := dhcpMessageTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("DHCP message type %d", byte(t))
+}
+
+// Options used by the responder (RFC 2132)
+const (
+	dhcpOptPad           = 0
+	dhcpOptSubnetMask    = 1
+	dhcpOptRouter        = 3
+	dhcpOptDNS           = 6
+	dhcpOptRequestedIP   = 50
+	dhcpOptLeaseTime     = 51
+	dhcpOptMessageType   = 53
+	dhcpOptServerID      = 54
+	dhcpOptRenewalTime   = 58
+	dhcpOptRebindingTime = 59
+	dhcpOptEnd           = 255
+)
+
+// DHCPLease is what the responder hands out to the sandbox behind a port,
+// the router is the address of the bridge and serves as server identifier
+type DHCPLease struct {
+	IP     net.IP
+	Mask   net.IPMask
+	Router net.IP
+	DNS    []net.IP
+}
+
+type dhcpMessage struct {
+	op      byte
+	xid     uint32
+	flags   uint16
+	ciaddr  net.IP
+	yiaddr  net.IP
+	siaddr  net.IP
+	giaddr  net.IP
+	chaddr  net.HardwareAddr
+	options map[byte][]byte
+}
+
+func parseDHCPMessage(b []byte) (*dhcpMessage, error) {
+	if len(b) < dhcpHeaderLen+len(dhcpMagicCookie) {
+		return nil, errors.New("message too short")
+	}
+	if !bytes.Equal(b[dhcpHeaderLen:dhcpHeaderLen+4], dhcpMagicCookie) {
+		return nil, errors.New("invalid magic cookie")
+	}
+	hlen := int(b[2])
+	if b[1] != 1 || hlen != 6 {
+		return nil, fmt.Errorf("unsupported hardware type %d/%d", b[1], hlen)
+	}
+	m := &dhcpMessage{
+		op:      b[0],
+		xid:     binary.BigEndian.Uint32(b[4:8]),
+		flags:   binary.BigEndian.Uint16(b[10:12]),
+		ciaddr:  net.IP(append([]byte{}, b[12:16]...)),
+		yiaddr:  net.IP(append([]byte{}, b[16:20]...)),
+		siaddr:  net.IP(append([]byte{}, b[20:24]...)),
+		giaddr:  net.IP(append([]byte{}, b[24:28]...)),
+		chaddr:  net.HardwareAddr(append([]byte{}, b[28:28+hlen]...)),
+		options: make(map[byte][]byte),
+	}
+	opts := b[dhcpHeaderLen+4:]
+	for i := 0; i < len(opts); {
+		code := opts[i]
+		if code == dhcpOptEnd {
+			break
+		}
+		if code == dhcpOptPad {
+			i++
+			continue
+		}
+		if i+1 >= len(opts) || i+2+int(opts[i+1]) > len(opts) {
+			return nil, fmt.Errorf("truncated option %d", code)
+		}
+		n := int(opts[i+1])
+		m.options[code] = append(m.options[code], opts[i+2:i+2+n]...)
+		i += 2 + n
+	}
+	return m, nil
+}
+
+func (m *dhcpMessage) messageType() dhcpMessageType {
+	if v := m.options[dhcpOptMessageType]; len(v) == 1 {
+		return dhcpMessageType(v[0])
+	}
+	return 0
+}
+
+func (m *dhcpMessage) marshal() []byte {
+	b := make([]byte, dhcpHeaderLen, dhcpHeaderLen+64)
+	b[0] = m.op
+	b[1] = 1
+	b[2] = byte(len(m.chaddr))
+	binary.BigEndian.PutUint32(b[4:8], m.xid)
+	binary.BigEndian.PutUint16(b[10:12], m.flags)
+	for i, ip := range []net.IP{m.ciaddr, m.yiaddr, m.siaddr, m.giaddr} {
+		if ip4 := ip.To4(); ip4 != nil {
+			copy(b[12+4*i:], ip4)
+		}
+	}
+	copy(b[28:44], m.chaddr)
+	b = append(b, dhcpMagicCookie...)
+	// Message type first, as some clients expect
+	codes := []byte{dhcpOptMessageType}
+	for code := range m.options {
+		if code != dhcpOptMessageType {
+			codes = append(codes, code)
+		}
+	}
+	sort.Slice(codes[1:], func(i, j int) bool { return codes[1+i] < codes[1+j] })
+	for _, code := range codes {
+		if v, ok := m.options[code]; ok {
+			b = append(b, code, byte(len(v)))
+			b = append(b, v...)
+		}
+	}
+	return append(b, dhcpOptEnd)
+}
+
+func uint32Option(d time.Duration) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(d/time.Second))
+	return b
+}
+
+// dhcpReply returns the answer to a request of a client for the lease,
+// or nil if the request is not answered
+func dhcpReply(req *dhcpMessage, lease *DHCPLease) *dhcpMessage {
+	if req.op != dhcpOpRequest || lease == nil {
+		return nil
+	}
+	reply := &dhcpMessage{
+		op:      dhcpOpReply,
+		xid:     req.xid,
+		flags:   req.flags,
+		giaddr:  req.giaddr,
+		chaddr:  req.chaddr,
+		options: map[byte][]byte{dhcpOptServerID: lease.Router.To4()},
+	}
+	switch req.messageType() {
+	case DHCPDISCOVER:
+		reply.options[dhcpOptMessageType] = []byte{byte(DHCPOFFER)}
+	case DHCPREQUEST:
+		// Requests for another server, or for an address that is not the
+		// one of the sandbox anymore, are declined
+		if sid := req.options[dhcpOptServerID]; sid != nil && !net.IP(sid).Equal(lease.Router) {
+			return nil
+		}
+		requested := net.IP(req.options[dhcpOptRequestedIP])
+		if requested == nil {
+			requested = req.ciaddr
+		}
+		if !requested.Equal(lease.IP) {
+			reply.options[dhcpOptMessageType] = []byte{byte(DHCPNAK)}
+			return reply
+		}
+		reply.ciaddr = req.ciaddr
+		reply.options[dhcpOptMessageType] = []byte{byte(DHCPACK)}
+	default:
+		return nil
+	}
+	reply.yiaddr = lease.IP.To4()
+	reply.options[dhcpOptSubnetMask] = []byte(lease.Mask[len(lease.Mask)-net.IPv4len:])
+	reply.options[dhcpOptRouter] = lease.Router.To4()
+	reply.options[dhcpOptLeaseTime] = uint32Option(dhcpLeaseTime)
+	reply.options[dhcpOptRenewalTime] = uint32Option(dhcpLeaseTime / 2)
+	reply.options[dhcpOptRebindingTime] = uint32Option(dhcpLeaseTime * 7 / 8)
+	if len(lease.DNS) > 0 {
+		var dns []byte
+		for _, ip := range lease.DNS {
+			if ip4 := ip.To4(); ip4 != nil {
+				dns = append(dns, ip4...)
+			}
+		}
+		if len(dns) > 0 {
+			reply.options[dhcpOptDNS] = dns
+		}
+	}
+	return reply
+}
+
+// parseDHCPFrame returns the DHCP request carried by an ethernet frame,
+// or nil if the frame is not a request to a DHCP server
+func parseDHCPFrame(frame []byte) *dhcpMessage {
+	payload := udpPayload(frame, dhcpServerPort)
+	if payload == nil {
+		return nil
+	}
+	m, err := parseDHCPMessage(payload)
+	if err != nil {
+		return nil
+	}
+	return m
+}
+
+// udpPayload returns the payload of an ethernet frame carrying an IPv4
+// UDP datagram to port, or nil if the frame is anything else
+func udpPayload(frame []byte, port uint16) []byte {
+	if len(frame) < 14+20+8 || binary.BigEndian.Uint16(frame[12:14]) != syscall.ETH_P_IP {
+		return nil
+	}
+	ip := frame[14:]
+	ihl := int(ip[0]&0x0f) * 4
+	if ip[0]>>4 != 4 || ihl < 20 || len(ip) < ihl+8 || ip[9] != syscall.IPPROTO_UDP {
+		return nil
+	}
+	// Fragments are not reassembled, no client sends them
+	if binary.BigEndian.Uint16(ip[6:8])&0x3fff != 0 {
+		return nil
+	}
+	udp := ip[ihl:]
+	if binary.BigEndian.Uint16(udp[2:4]) != port {
+		return nil
+	}
+	n := int(binary.BigEndian.Uint16(udp[4:6]))
+	if n < 8 || n > len(udp) {
+		return nil
+	}
+	return udp[8:n]
+}
+
+// udpFrame wraps a UDP datagram in an IPv4 packet in an ethernet frame,
+// clients without an address yet can only be answered this way
+func udpFrame(src, dst net.HardwareAddr, srcIP, dstIP net.IP, srcPort, dstPort uint16, payload []byte) []byte {
+	udpLen := 8 + len(payload)
+	frame := make([]byte, 14+20+udpLen)
+	copy(frame[0:6], dst)
+	copy(frame[6:12], src)
+	binary.BigEndian.PutUint16(frame[12:14], syscall.ETH_P_IP)
+
+	ip := frame[14:34]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:4], uint16(20+udpLen))
+	ip[8] = 64
+	ip[9] = syscall.IPPROTO_UDP
+	copy(ip[12:16], srcIP.To4())
+	copy(ip[16:20], dstIP.To4())
+	binary.BigEndian.PutUint16(ip[10:12], checksum(ip, 0))
+
+	udp := frame[34:]
+	binary.BigEndian.PutUint16(udp[0:2], srcPort)
+	binary.BigEndian.PutUint16(udp[2:4], dstPort)
+	binary.BigEndian.PutUint16(udp[4:6], uint16(udpLen))
+	copy(udp[8:], payload)
+	// Pseudo header: addresses, protocol and length
+	var sum uint32
+	for i := 12; i < 20; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(ip[i : i+2]))
+	}
+	sum += syscall.IPPROTO_UDP + uint32(udpLen)
+	csum := checksum(udp, sum)
+	if csum == 0 {
+		csum = 0xffff
+	}
+	binary.BigEndian.PutUint16(udp[6:8], csum)
+	return frame
+}
+
+func checksum(b []byte, sum uint32) uint16 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i : i+2]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// dhcpResponder answers the DHCP requests coming through the host side of
+// the veth of a sandbox. It reads the frames with a packet socket bound to
+// the port, so that whatever client is behind it, the sandbox itself or a
+// VM it runs, gets the address preselected for the sandbox, and the
+// requests of other sandboxes flooded through the bridge are ignored.
+type dhcpResponder struct {
+	port   *net.Interface
+	server string // Interface whose hardware address the answers are sent from
+	fd     int
+	log    *logging.Logger
+	mtx    sync.Mutex
+	lease  *DHCPLease
+	done   chan struct{}
+}
+
+// How often a responder checks whether it was closed while waiting for requests
+const dhcpPollInterval = 500 * time.Millisecond
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+func newDHCPResponder(port *net.Interface, server string, log *logging.Logger) (*dhcpResponder, error) {
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(syscall.ETH_P_IP)))
+	if err != nil {
+		return nil, fmt.Errorf("unable to open packet socket: %v", err)
+	}
+	sa := &syscall.SockaddrLinklayer{Protocol: htons(syscall.ETH_P_IP), Ifindex: port.Index}
+	if err := syscall.Bind(fd, sa); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("unable to bind packet socket to %s: %v", port.Name, err)
+	}
+	tv := syscall.NsecToTimeval(int64(dhcpPollInterval))
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return &dhcpResponder{
+		port:   port,
+		server: server,
+		fd:     fd,
+		log:    log,
+		done:   make(chan struct{}),
+	}, nil
+}
+
+func (r *dhcpResponder) setLease(lease *DHCPLease) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.lease = lease
+}
+
+func (r *dhcpResponder) getLease() *DHCPLease {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.lease
+}
+
+// close stops the responder, the socket is closed by serve
+func (r *dhcpResponder) close() {
+	select {
+	case <-r.done:
+	default:
+		close(r.done)
+	}
+}
+
+func (r *dhcpResponder) serve() {
+	defer syscall.Close(r.fd)
+	buf := make([]byte, 1600)
+	for {
+		select {
+		case <-r.done:
+			return
+		default:
+		}
+		n, from, err := syscall.Recvfrom(r.fd, buf, 0)
+		if err != nil {
+			if err == syscall.EAGAIN || err == syscall.EINTR {
+				continue
+			}
+			r.log.Warningf("DHCP responder on %s stopped: %v", r.port.Name, err)
+			return
+		}
+		// Frames flooded by the bridge to the sandbox are seen as outgoing
+		if ll, ok := from.(*syscall.SockaddrLinklayer); ok && ll.Pkttype == syscall.PACKET_OUTGOING {
+			continue
+		}
+		req := parseDHCPFrame(buf[:n])
+		if req == nil {
+			continue
+		}
+		if err := r.answer(req); err != nil {
+			r.log.Warningf("Unable to answer DHCP request on %s: %v", r.port.Name, err)
+		}
+	}
+}
+
+func (r *dhcpResponder) answer(req *dhcpMessage) error {
+	lease := r.getLease()
+	reply := dhcpReply(req, lease)
+	if reply == nil {
+		return nil
+	}
+	r.log.Infof("%v from %v on %s, answering %v for %v", req.messageType(), req.chaddr, r.port.Name, reply.messageType(), lease.IP)
+
+	src := r.port.HardwareAddr
+	if ifc, err := net.InterfaceByName(r.server); err == nil {
+		src = ifc.HardwareAddr
+	}
+	dst, dstIP := net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, net.IPv4bcast
+	if reply.messageType() != DHCPNAK && !req.ciaddr.Equal(net.IPv4zero) {
+		dst, dstIP = req.chaddr, req.ciaddr
+	}
+	frame := udpFrame(src, dst, lease.Router, dstIP, dhcpServerPort, dhcpClientPort, reply.marshal())
+	sa := &syscall.SockaddrLinklayer{Protocol: htons(syscall.ETH_P_IP), Ifindex: r.port.Index, Halen: 6}
+	copy(sa.Addr[:], dst)
+	return syscall.Sendto(r.fd, frame, 0, sa)
+}
+
+// ResolvConfNameservers returns the name servers of a resolv.conf file
+func ResolvConfNameservers(fpath string) []net.IP {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var servers []net.IP
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		if ip := net.ParseIP(fields[1]); ip != nil {
+			servers = append(servers, ip)
+		}
+	}
+	return servers
+}
+
+// EnableDHCP makes the sandbox address available through DHCP instead of
+// configuring it statically inside the sandbox, the peer interface is only
+// brought up. It must be called before the veth is set up or when adopting it.
+func (v *OzVeth) EnableDHCP(dns []net.IP) error {
+	r, err := newDHCPResponder(v.NetInterface(), ozDefaultInterfaceBridgeBase+v.bridge.Name, v.log)
+	if err != nil {
+		return err
+	}
+	v.dhcp = r
+	v.dns = dns
+	if v.sbip != nil {
+		v.updateLease()
+	}
+	go r.serve()
+	return nil
+}
+
+func (v *OzVeth) updateLease() {
+	v.dhcp.setLease(&DHCPLease{
+		IP:     v.sbip,
+		Mask:   v.bridge.ipr.Mask,
+		Router: *v.bridge.ip,
+		DNS:    v.dns,
+	})
+}
@@ -0,0 +1,264 @@
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/milosgajdos83/tenus"
+	"github.com/op/go-logging"
+)
+
+var testLease = &DHCPLease{
+	IP:     net.ParseIP("10.0.3.5"),
+	Mask:   net.CIDRMask(24, 32),
+	Router: net.ParseIP("10.0.3.1"),
+	DNS:    []net.IP{net.ParseIP("9.9.9.9"), net.ParseIP("2620:fe::fe")},
+}
+
+var testClientMAC = net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x05}
+
+func testRequest(t dhcpMessageType, options map[byte][]byte) *dhcpMessage {
+	m := &dhcpMessage{
+		op:      dhcpOpRequest,
+		xid:     0x12345678,
+		ciaddr:  net.IPv4zero,
+		chaddr:  testClientMAC,
+		options: map[byte][]byte{dhcpOptMessageType: {byte(t)}},
+	}
+	for code, v := range options {
+		m.options[code] = v
+	}
+	return m
+}
+
+func TestDHCPMessageRoundTrip(t *testing.T) {
+	m := testRequest(DHCPREQUEST, map[byte][]byte{dhcpOptRequestedIP: net.ParseIP("10.0.3.5").To4()})
+	m.flags = 0x8000
+	b := m.marshal()
+	if b[dhcpHeaderLen+4] != dhcpOptMessageType {
+		t.Errorf("message type is not the first option: %v", b[dhcpHeaderLen+4:])
+	}
+	parsed, err := parseDHCPMessage(b)
+	if err != nil {
+		t.Fatalf("parseDHCPMessage() failed: %v", err)
+	}
+	if parsed.xid != m.xid || parsed.flags != m.flags || parsed.chaddr.String() != m.chaddr.String() {
+		t.Errorf("parsed %+v, expected %+v", parsed, m)
+	}
+	if !reflect.DeepEqual(parsed.options, m.options) {
+		t.Errorf("parsed options %v, expected %v", parsed.options, m.options)
+	}
+
+	for _, bad := range [][]byte{
+		b[:100],
+		append(append([]byte{}, b[:dhcpHeaderLen]...), 1, 2, 3, 4),
+		append(append([]byte{}, b[:len(b)-1]...), dhcpOptRouter, 8, 1, 2),
+	} {
+		if _, err := parseDHCPMessage(bad); err == nil {
+			t.Errorf("parseDHCPMessage(%v) did not fail", bad)
+		}
+	}
+}
+
+func TestDHCPReply(t *testing.T) {
+	router := testLease.Router.To4()
+	for _, d := range []struct {
+		req      *dhcpMessage
+		expected dhcpMessageType
+	}{
+		{testRequest(DHCPDISCOVER, nil), DHCPOFFER},
+		{testRequest(DHCPREQUEST, map[byte][]byte{dhcpOptRequestedIP: {10, 0, 3, 5}, dhcpOptServerID: router}), DHCPACK},
+		{testRequest(DHCPREQUEST, map[byte][]byte{dhcpOptRequestedIP: {10, 0, 3, 6}}), DHCPNAK},
+		{testRequest(DHCPREQUEST, map[byte][]byte{dhcpOptRequestedIP: {10, 0, 3, 5}, dhcpOptServerID: {10, 0, 3, 2}}), 0},
+		{testRequest(DHCPRELEASE, nil), 0},
+	} {
+		reply := dhcpReply(d.req, testLease)
+		if d.expected == 0 {
+			if reply != nil {
+				t.Errorf("%v: unexpected reply %v", d.req.options, reply.messageType())
+			}
+			continue
+		}
+		if reply == nil {
+			t.Errorf("%v: no reply, expected %v", d.req.options, d.expected)
+			continue
+		}
+		if reply.messageType() != d.expected || reply.xid != d.req.xid || reply.op != dhcpOpReply {
+			t.Errorf("%v: got %v (xid %x), expected %v", d.req.options, reply.messageType(), reply.xid, d.expected)
+		}
+		if d.expected == DHCPNAK {
+			continue
+		}
+		if !reply.yiaddr.Equal(testLease.IP) {
+			t.Errorf("%v: offered %v, expected %v", d.req.options, reply.yiaddr, testLease.IP)
+		}
+		for code, v := range map[byte][]byte{
+			dhcpOptServerID:   router,
+			dhcpOptRouter:     router,
+			dhcpOptSubnetMask: {255, 255, 255, 0},
+			dhcpOptDNS:        {9, 9, 9, 9},
+			dhcpOptLeaseTime:  {0, 0, 0x02, 0x58},
+		} {
+			if !reflect.DeepEqual(reply.options[code], v) {
+				t.Errorf("%v: option %d is %v, expected %v", d.req.options, code, reply.options[code], v)
+			}
+		}
+	}
+	if reply := dhcpReply(testRequest(DHCPDISCOVER, nil), nil); reply != nil {
+		t.Errorf("reply without a lease: %v", reply.messageType())
+	}
+}
+
+func TestDHCPFrame(t *testing.T) {
+	req := testRequest(DHCPDISCOVER, nil)
+	frame := udpFrame(testClientMAC, net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		net.IPv4zero, net.IPv4bcast, dhcpClientPort, dhcpServerPort, req.marshal())
+	if checksum(frame[14:34], 0) != 0 {
+		t.Errorf("invalid IP header checksum")
+	}
+	// The UDP checksum covers the pseudo header as well
+	udp := frame[34:]
+	sum := uint32(syscall.IPPROTO_UDP) + uint32(len(udp))
+	for i := 26; i < 34; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(frame[i : i+2]))
+	}
+	if checksum(udp, sum) != 0 {
+		t.Errorf("invalid UDP checksum")
+	}
+	parsed := parseDHCPFrame(frame)
+	if parsed == nil || parsed.messageType() != DHCPDISCOVER || parsed.xid != req.xid {
+		t.Errorf("parseDHCPFrame() = %+v", parsed)
+	}
+	// Answers from the server are not requests
+	frame = udpFrame(testClientMAC, testClientMAC, net.IPv4zero, net.IPv4bcast, dhcpServerPort, dhcpClientPort, req.marshal())
+	if parsed := parseDHCPFrame(frame); parsed != nil {
+		t.Errorf("parseDHCPFrame() accepted a frame to the client port")
+	}
+}
+
+func TestResolvConfNameservers(t *testing.T) {
+	f, err := ioutil.TempFile("", "oz-resolv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# generated\nnameserver 127.0.0.53\nnameserver 192.168.1.1\nsearch example.com\nnameserver fe80::1\nnameserver 9.9.9.9\n")
+	f.Close()
+	servers := ResolvConfNameservers(f.Name())
+	expected := []string{"127.0.0.53", "192.168.1.1", "fe80::1", "9.9.9.9"}
+	if len(servers) != len(expected) {
+		t.Fatalf("ResolvConfNameservers() = %v, expected %v", servers, expected)
+	}
+	for i, s := range expected {
+		if !servers[i].Equal(net.ParseIP(s)) {
+			t.Errorf("ResolvConfNameservers() = %v, expected %v", servers, expected)
+		}
+	}
+}
+
+// TestDHCPResponder runs a responder on one end of a veth pair and a client
+// on the other, in a network namespace of its own
+func TestDHCPResponder(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("requires root")
+	}
+	result := make(chan error, 1)
+	skip := make(chan string, 1)
+	go func() {
+		// The thread is left in the namespace and discarded when the goroutine exits
+		runtime.LockOSThread()
+		if err := syscall.Unshare(syscall.CLONE_NEWNET); err != nil {
+			skip <- "unable to create a network namespace: " + err.Error()
+			return
+		}
+		result <- runDHCPExchange()
+	}()
+	select {
+	case msg := <-skip:
+		t.Skip(msg)
+	case err := <-result:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Error("timed out")
+	}
+}
+
+func runDHCPExchange() error {
+	veth, err := tenus.NewVethPairWithOptions("dhcps0", tenus.VethOptions{PeerName: "dhcpc0"})
+	if err != nil {
+		return err
+	}
+	if err := veth.SetLinkUp(); err != nil {
+		return err
+	}
+	if err := veth.SetPeerLinkUp(); err != nil {
+		return err
+	}
+	server, err := net.InterfaceByName("dhcps0")
+	if err != nil {
+		return err
+	}
+	client, err := net.InterfaceByName("dhcpc0")
+	if err != nil {
+		return err
+	}
+
+	r, err := newDHCPResponder(server, server.Name, logging.MustGetLogger("oz-test"))
+	if err != nil {
+		return err
+	}
+	r.setLease(testLease)
+	go r.serve()
+	defer r.close()
+
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(syscall.ETH_P_IP)))
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	sa := &syscall.SockaddrLinklayer{Protocol: htons(syscall.ETH_P_IP), Ifindex: client.Index, Halen: 6}
+	if err := syscall.Bind(fd, sa); err != nil {
+		return err
+	}
+	tv := syscall.NsecToTimeval(int64(5 * time.Second))
+	syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv)
+
+	bcast := net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	copy(sa.Addr[:], bcast)
+	req := testRequest(DHCPDISCOVER, nil)
+	req.chaddr = client.HardwareAddr
+	frame := udpFrame(client.HardwareAddr, bcast, net.IPv4zero, net.IPv4bcast, dhcpClientPort, dhcpServerPort, req.marshal())
+	if err := syscall.Sendto(fd, frame, 0, sa); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 1600)
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return err
+		}
+		payload := udpPayload(buf[:n], dhcpClientPort)
+		if payload == nil {
+			continue
+		}
+		reply, err := parseDHCPMessage(payload)
+		if err != nil {
+			return err
+		}
+		if reply.messageType() != DHCPOFFER || !reply.yiaddr.Equal(testLease.IP) {
+			return fmt.Errorf("unexpected reply %v for %v", reply.messageType(), reply.yiaddr)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,206 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Record types the forwarder cares about
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+	dnsClassIN  = 1
+
+	dnsHeaderLen = 12
+
+	dnsRcodeServFail = 2
+	dnsRcodeNXDomain = 3
+)
+
+var dnsTypeNames = map[uint16]string{
+	1: "A", 2: "NS", 5: "CNAME", 6: "SOA", 12: "PTR", 15: "MX", 16: "TXT",
+	28: "AAAA", 33: "SRV", 65: "HTTPS", 255: "ANY",
+}
+
+func dnsTypeName(t uint16) string {
+	if name, ok := dnsTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("TYPE%d", t)
+}
+
+// dnsQuestion is the first question of a query, the only one servers answer
+type dnsQuestion struct {
+	name  string
+	qtype uint16
+	// Offset of the end of the question in the message
+	end int
+}
+
+// dnsAddress is an address record of an answer
+type dnsAddress struct {
+	name string
+	ip   net.IP
+	ttl  time.Duration
+}
+
+var errDNSTruncated = errors.New("truncated DNS message")
+
+// readDNSName reads a possibly compressed name at off, it returns the name
+// in lower case without the final dot and the offset following it
+func readDNSName(msg []byte, off int) (string, int, error) {
+	labels := []string{}
+	end := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errDNSTruncated
+		}
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			if end == -1 {
+				end = off + 1
+			}
+			return strings.ToLower(strings.Join(labels, ".")), end, nil
+		case n&0xc0 == 0xc0:
+			if off+1 >= len(msg) {
+				return "", 0, errDNSTruncated
+			}
+			if jumps++; jumps > 16 {
+				return "", 0, errors.New("too many compression pointers in DNS name")
+			}
+			if end == -1 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:off+2]) & 0x3fff)
+		case n&0xc0 != 0:
+			return "", 0, fmt.Errorf("invalid DNS label type %#x", n&0xc0)
+		default:
+			if off+1+n > len(msg) {
+				return "", 0, errDNSTruncated
+			}
+			labels = append(labels, string(msg[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+}
+
+func parseDNSQuestion(msg []byte) (*dnsQuestion, error) {
+	if len(msg) < dnsHeaderLen {
+		return nil, errDNSTruncated
+	}
+	if binary.BigEndian.Uint16(msg[4:6]) == 0 {
+		return nil, errors.New("DNS message without question")
+	}
+	name, off, err := readDNSName(msg, dnsHeaderLen)
+	if err != nil {
+		return nil, err
+	}
+	if off+4 > len(msg) {
+		return nil, errDNSTruncated
+	}
+	return &dnsQuestion{name: name, qtype: binary.BigEndian.Uint16(msg[off : off+2]), end: off + 4}, nil
+}
+
+// parseDNSAddresses returns the A and AAAA records found in the answer section of a response
+func parseDNSAddresses(msg []byte) ([]dnsAddress, error) {
+	if len(msg) < dnsHeaderLen {
+		return nil, errDNSTruncated
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:6]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:8]))
+	off := dnsHeaderLen
+	for i := 0; i < qdcount; i++ {
+		_, end, err := readDNSName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		off = end + 4
+	}
+	addrs := []dnsAddress{}
+	for i := 0; i < ancount; i++ {
+		name, end, err := readDNSName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		if end+10 > len(msg) {
+			return nil, errDNSTruncated
+		}
+		rtype := binary.BigEndian.Uint16(msg[end : end+2])
+		class := binary.BigEndian.Uint16(msg[end+2 : end+4])
+		ttl := time.Duration(binary.BigEndian.Uint32(msg[end+4:end+8])) * time.Second
+		rdlen := int(binary.BigEndian.Uint16(msg[end+8 : end+10]))
+		rdata := end + 10
+		if rdata+rdlen > len(msg) {
+			return nil, errDNSTruncated
+		}
+		if class == dnsClassIN && ((rtype == dnsTypeA && rdlen == net.IPv4len) || (rtype == dnsTypeAAAA && rdlen == net.IPv6len)) {
+			ip := net.IP(append([]byte{}, msg[rdata:rdata+rdlen]...))
+			addrs = append(addrs, dnsAddress{name: name, ip: ip, ttl: ttl})
+		}
+		off = rdata + rdlen
+	}
+	return addrs, nil
+}
+
+// dnsErrorResponse answers a query with an error code and no records
+func dnsErrorResponse(query []byte, q *dnsQuestion, rcode int) []byte {
+	resp := append([]byte{}, query[:q.end]...)
+	// Response, same opcode and recursion desired, recursion available
+	resp[2] = 0x80 | query[2]&0x79
+	resp[3] = 0x80 | byte(rcode)
+	binary.BigEndian.PutUint16(resp[4:6], 1)
+	binary.BigEndian.PutUint16(resp[6:8], 0)
+	binary.BigEndian.PutUint16(resp[8:10], 0)
+	binary.BigEndian.PutUint16(resp[10:12], 0)
+	return resp
+}
+
+// MatchDomain returns true if name matches the domain pattern, either a
+// name (ie: `mozilla.org`) or `*.` followed by a domain whose sub-domains
+// are matched (ie: `*.mozilla.org` matches `www.mozilla.org`)
+func MatchDomain(pattern, name string) bool {
+	pattern = strings.TrimSuffix(strings.ToLower(pattern), ".")
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(name, pattern[1:])
+	}
+	return name == pattern
+}
+
+// IsDomainPattern returns true if s is a sub-domain wildcard (ie: `*.mozilla.org`)
+func IsDomainPattern(s string) bool {
+	return strings.HasPrefix(s, "*.") && len(s) > 2 && !strings.Contains(s[2:], "*")
+}
+
+// DNSPolicy decides which names a sandbox may resolve, denied names are
+// refused first, then if the allow list is not empty only names matching
+// it are allowed
+type DNSPolicy struct {
+	Allow []string
+	Deny  []string
+}
+
+func (p *DNSPolicy) Allowed(name string) bool {
+	if p == nil {
+		return true
+	}
+	for _, pattern := range p.Deny {
+		if MatchDomain(pattern, name) {
+			return false
+		}
+	}
+	if len(p.Allow) == 0 {
+		return true
+	}
+	for _, pattern := range p.Allow {
+		if MatchDomain(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,212 @@
+package network
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+// dnsName encodes a name without compression
+func dnsName(name string) []byte {
+	b := []byte{}
+	for _, l := range strings.Split(name, ".") {
+		b = append(b, byte(len(l)))
+		b = append(b, l...)
+	}
+	return append(b, 0)
+}
+
+func testDNSQuery(name string, qtype uint16) []byte {
+	msg := []byte{0xab, 0xcd, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	msg = append(msg, dnsName(name)...)
+	return append(msg, byte(qtype>>8), byte(qtype), 0, dnsClassIN)
+}
+
+// testDNSResponse answers the query with a CNAME and address records,
+// the names of the answers are compressed
+func testDNSResponse(query []byte, ips ...string) []byte {
+	msg := append([]byte{}, query...)
+	msg[2], msg[3] = 0x81, 0x80
+	binary.BigEndian.PutUint16(msg[6:8], uint16(1+len(ips)))
+	// CNAME of the question name to cdn.<question name>
+	msg = append(msg, 0xc0, dnsHeaderLen, 0, 5, 0, dnsClassIN, 0, 0, 0, 60, 0, 6, 3, 'c', 'd', 'n', 0xc0, dnsHeaderLen)
+	cname := len(msg) - 6
+	for _, s := range ips {
+		ip := net.ParseIP(s)
+		rtype, rdata := dnsTypeAAAA, []byte(ip)
+		if ip4 := ip.To4(); ip4 != nil {
+			rtype, rdata = dnsTypeA, []byte(ip4)
+		}
+		msg = append(msg, 0xc0|byte(cname>>8), byte(cname), 0, byte(rtype), 0, dnsClassIN, 0, 0, 0x0e, 0x10, 0, byte(len(rdata)))
+		msg = append(msg, rdata...)
+	}
+	return msg
+}
+
+func TestParseDNSQuestion(t *testing.T) {
+	query := testDNSQuery("WWW.Mozilla.org", dnsTypeAAAA)
+	q, err := parseDNSQuestion(query)
+	if err != nil {
+		t.Fatalf("parseDNSQuestion() failed: %v", err)
+	}
+	if q.name != "www.mozilla.org" || q.qtype != dnsTypeAAAA || q.end != len(query) {
+		t.Errorf("parseDNSQuestion() = %+v", q)
+	}
+	for _, bad := range [][]byte{
+		query[:8],
+		query[:len(query)-2],
+		append(append([]byte{}, query[:dnsHeaderLen]...), 0xc0, dnsHeaderLen, 0, 1, 0, 1),
+		append(append([]byte{}, query[:dnsHeaderLen]...), 0x80, 0, 0, 1, 0, 1),
+	} {
+		if q, err := parseDNSQuestion(bad); err == nil {
+			t.Errorf("parseDNSQuestion(%v) = %+v, expected an error", bad, q)
+		}
+	}
+}
+
+func TestParseDNSAddresses(t *testing.T) {
+	resp := testDNSResponse(testDNSQuery("www.mozilla.org", dnsTypeA), "93.184.216.34", "2606:2800:220:1::1")
+	addrs, err := parseDNSAddresses(resp)
+	if err != nil {
+		t.Fatalf("parseDNSAddresses() failed: %v", err)
+	}
+	if len(addrs) != 2 {
+		t.Fatalf("parseDNSAddresses() = %v, expected 2 addresses", addrs)
+	}
+	for i, s := range []string{"93.184.216.34", "2606:2800:220:1::1"} {
+		a := addrs[i]
+		if a.name != "cdn.www.mozilla.org" || !a.ip.Equal(net.ParseIP(s)) || a.ttl != time.Hour {
+			t.Errorf("address %d = %+v, expected cdn.www.mozilla.org %s 1h", i, a, s)
+		}
+	}
+	if _, err := parseDNSAddresses(resp[:len(resp)-3]); err == nil {
+		t.Errorf("parseDNSAddresses() of a truncated response did not fail")
+	}
+}
+
+func TestDNSErrorResponse(t *testing.T) {
+	query := testDNSQuery("ads.example.com", dnsTypeA)
+	query = append(query, 0, 0, 41, 0x10, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(query[10:12], 1)
+	q, _ := parseDNSQuestion(query)
+	resp := dnsErrorResponse(query, q, dnsRcodeNXDomain)
+	if len(resp) != q.end || resp[0] != 0xab || resp[1] != 0xcd {
+		t.Errorf("dnsErrorResponse() = %v", resp)
+	}
+	if resp[2] != 0x81 || resp[3] != 0x83 {
+		t.Errorf("dnsErrorResponse() flags = %#x %#x, expected 0x81 0x83", resp[2], resp[3])
+	}
+	if binary.BigEndian.Uint16(resp[4:6]) != 1 || binary.BigEndian.Uint16(resp[10:12]) != 0 {
+		t.Errorf("dnsErrorResponse() counts = %v", resp[4:12])
+	}
+}
+
+func TestMatchDomain(t *testing.T) {
+	for _, d := range []struct {
+		pattern, name string
+		match         bool
+	}{
+		{"mozilla.org", "mozilla.org", true},
+		{"mozilla.org", "Mozilla.ORG.", true},
+		{"mozilla.org", "www.mozilla.org", false},
+		{"*.mozilla.org", "www.mozilla.org", true},
+		{"*.mozilla.org", "a.b.mozilla.org", true},
+		{"*.mozilla.org", "mozilla.org", false},
+		{"*.mozilla.org", "evilmozilla.org", false},
+	} {
+		if MatchDomain(d.pattern, d.name) != d.match {
+			t.Errorf("MatchDomain(%s, %s) != %v", d.pattern, d.name, d.match)
+		}
+	}
+	for s, expected := range map[string]bool{"*.mozilla.org": true, "mozilla.org": false, "*.": false, "*.*.org": false} {
+		if IsDomainPattern(s) != expected {
+			t.Errorf("IsDomainPattern(%s) != %v", s, expected)
+		}
+	}
+}
+
+func TestDNSPolicy(t *testing.T) {
+	var none *DNSPolicy
+	if !none.Allowed("example.com") {
+		t.Errorf("a nil policy denied example.com")
+	}
+	p := &DNSPolicy{Allow: []string{"*.mozilla.org", "mozilla.org"}, Deny: []string{"ads.mozilla.org"}}
+	for name, expected := range map[string]bool{
+		"mozilla.org":     true,
+		"www.mozilla.org": true,
+		"ads.mozilla.org": false,
+		"example.com":     false,
+	} {
+		if p.Allowed(name) != expected {
+			t.Errorf("Allowed(%s) != %v", name, expected)
+		}
+	}
+	p = &DNSPolicy{Deny: []string{"*.example.com"}}
+	if !p.Allowed("mozilla.org") || p.Allowed("www.example.com") {
+		t.Errorf("deny list not applied")
+	}
+}
+
+func TestDNSForwarderPolicy(t *testing.T) {
+	f := &dnsForwarder{log: logging.MustGetLogger("oz-test"), clients: make(map[string]*dnsClient)}
+	sbip := net.ParseIP("10.0.3.5")
+	f.register(sbip, &dnsClient{label: "test", policy: &DNSPolicy{Deny: []string{"*.example.com"}}})
+
+	query := testDNSQuery("ads.example.com", dnsTypeA)
+	if resp := f.handle(query, net.ParseIP("10.0.3.6"), false); resp != nil {
+		t.Errorf("query of an unknown address answered: %v", resp)
+	}
+	resp := f.handle(query, sbip, false)
+	if resp == nil || resp[3]&0x0f != dnsRcodeNXDomain {
+		t.Errorf("denied query answered with %v, expected NXDOMAIN", resp)
+	}
+	f.unregister(sbip)
+	if resp := f.handle(query, sbip, false); resp != nil {
+		t.Errorf("query of an unregistered address answered: %v", resp)
+	}
+}
+
+func TestDNSTCPFraming(t *testing.T) {
+	var b strings.Builder
+	msg := testDNSQuery("mozilla.org", dnsTypeA)
+	if err := writeDNSTCP(&b, msg); err != nil {
+		t.Fatal(err)
+	}
+	read, err := readDNSTCP(strings.NewReader(b.String()))
+	if err != nil || string(read) != string(msg) {
+		t.Errorf("readDNSTCP() = %v (%v), expected %v", read, err, msg)
+	}
+	if _, err := readDNSTCP(strings.NewReader(b.String()[:10])); err == nil {
+		t.Errorf("readDNSTCP() of a truncated message did not fail")
+	}
+}
+
+func TestNftAddElements(t *testing.T) {
+	ips := []net.IP{net.ParseIP("93.184.216.34"), net.ParseIP("2606:2800:220:1::1"), net.ParseIP("93.184.216.35")}
+	script := nftAddElements("oz_10_0_3_5", 2, ips, 90*time.Second+time.Millisecond)
+	expected := "add element inet oz_10_0_3_5 dns4_2 { 93.184.216.34 timeout 91s, 93.184.216.35 timeout 91s }\n" +
+		"add element inet oz_10_0_3_5 dns6_2 { 2606:2800:220:1::1 timeout 91s }\n"
+	if script != expected {
+		t.Errorf("nftAddElements() = %q, expected %q", script, expected)
+	}
+	if script := nftAddElements("oz_10_0_3_5", 0, nil, time.Minute); script != "" {
+		t.Errorf("nftAddElements() without addresses = %q", script)
+	}
+}
+
+func TestParseDefaultGateway(t *testing.T) {
+	routes := "Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n" +
+		"eth0\t0003000A\t00000000\t0001\t0\t0\t0\t00FFFFFF\t0\t0\t0\n" +
+		"eth0\t00000000\t0103000A\t0003\t0\t0\t0\t00000000\t0\t0\t0\n"
+	gw, err := parseDefaultGateway(strings.NewReader(routes))
+	if err != nil || !gw.Equal(net.ParseIP("10.0.3.1")) {
+		t.Errorf("parseDefaultGateway() = %v (%v), expected 10.0.3.1", gw, err)
+	}
+	if gw, err := parseDefaultGateway(strings.NewReader(routes[:strings.LastIndex(routes, "eth0")])); err == nil {
+		t.Errorf("parseDefaultGateway() without default route = %v", gw)
+	}
+}
@@ -0,0 +1,345 @@
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+const (
+	dnsPort = 53
+
+	// How long to wait for an upstream server to answer
+	dnsUpstreamTimeout = 5 * time.Second
+	// How long an idle TCP connection of a sandbox is kept open
+	dnsTCPIdleTimeout = 10 * time.Second
+	// Addresses fed into the firewall are kept at least this long, as
+	// applications often cache them longer than their time to live
+	dnsMinAddressTimeout = 5 * time.Minute
+)
+
+// Name servers the forwarder sends the queries of the sandboxes to
+var dnsResolvConf = "/etc/resolv.conf"
+
+// dnsForwarder is the stub resolver listening on the address of a bridge.
+// It only answers the sandboxes registered with it, identified by their
+// address, applies their policy, logs their queries and feeds the addresses
+// it resolves for them into their firewall rules.
+type dnsForwarder struct {
+	addr    net.IP
+	log     *logging.Logger
+	udp     *net.UDPConn
+	tcp     *net.TCPListener
+	mtx     sync.Mutex
+	clients map[string]*dnsClient
+}
+
+// dnsClient is a sandbox using the forwarder
+type dnsClient struct {
+	// Prefix of the log messages of the sandbox
+	label  string
+	policy *DNSPolicy
+	veth   *OzVeth
+	mtx    sync.Mutex
+	// Addresses learned for each firewall rule using a domain pattern, with their expiry
+	learned map[int]map[string]time.Time
+}
+
+func newDNSForwarder(addr net.IP, log *logging.Logger) (*dnsForwarder, error) {
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: addr, Port: dnsPort})
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen for DNS queries on %v: %v", addr, err)
+	}
+	tcp, err := net.ListenTCP("tcp", &net.TCPAddr{IP: addr, Port: dnsPort})
+	if err != nil {
+		udp.Close()
+		return nil, fmt.Errorf("unable to listen for DNS queries on %v: %v", addr, err)
+	}
+	f := &dnsForwarder{
+		addr:    addr,
+		log:     log,
+		udp:     udp,
+		tcp:     tcp,
+		clients: make(map[string]*dnsClient),
+	}
+	log.Infof("DNS forwarder listening on %v", addr)
+	go f.serveUDP()
+	go f.serveTCP()
+	return f, nil
+}
+
+func (f *dnsForwarder) close() {
+	f.udp.Close()
+	f.tcp.Close()
+}
+
+func (f *dnsForwarder) register(ip net.IP, c *dnsClient) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.clients[ip.String()] = c
+}
+
+func (f *dnsForwarder) unregister(ip net.IP) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	delete(f.clients, ip.String())
+}
+
+func (f *dnsForwarder) client(ip net.IP) *dnsClient {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.clients[ip.String()]
+}
+
+func (f *dnsForwarder) serveUDP() {
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := f.udp.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		query := append([]byte{}, buf[:n]...)
+		go func() {
+			if resp := f.handle(query, from.IP, false); resp != nil {
+				f.udp.WriteToUDP(resp, from)
+			}
+		}()
+	}
+}
+
+func (f *dnsForwarder) serveTCP() {
+	for {
+		conn, err := f.tcp.AcceptTCP()
+		if err != nil {
+			return
+		}
+		go f.serveTCPConn(conn)
+	}
+}
+
+func (f *dnsForwarder) serveTCPConn(conn *net.TCPConn) {
+	defer conn.Close()
+	from := conn.RemoteAddr().(*net.TCPAddr).IP
+	for {
+		conn.SetDeadline(time.Now().Add(dnsTCPIdleTimeout))
+		query, err := readDNSTCP(conn)
+		if err != nil {
+			return
+		}
+		resp := f.handle(query, from, true)
+		if resp == nil {
+			return
+		}
+		if err := writeDNSTCP(conn, resp); err != nil {
+			return
+		}
+	}
+}
+
+func readDNSTCP(r io.Reader) ([]byte, error) {
+	var n uint16
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func writeDNSTCP(w io.Writer, msg []byte) error {
+	b := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(b, uint16(len(msg)))
+	copy(b[2:], msg)
+	_, err := w.Write(b)
+	return err
+}
+
+// handle returns the response to a query, or nil if it is not answered at all
+func (f *dnsForwarder) handle(query []byte, from net.IP, tcp bool) []byte {
+	c := f.client(from)
+	if c == nil {
+		f.log.Warningf("Ignoring DNS query from unknown address %v", from)
+		return nil
+	}
+	q, err := parseDNSQuestion(query)
+	if err != nil {
+		f.log.Warningf("%s: invalid DNS query: %v", c.label, err)
+		return nil
+	}
+	if !c.policy.Allowed(q.name) {
+		f.log.Noticef("%s: DNS query denied: %s %s", c.label, dnsTypeName(q.qtype), q.name)
+		return dnsErrorResponse(query, q, dnsRcodeNXDomain)
+	}
+	f.log.Infof("%s: DNS query: %s %s", c.label, dnsTypeName(q.qtype), q.name)
+
+	resp, err := f.forward(query, tcp)
+	if err != nil {
+		f.log.Warningf("%s: DNS query for %s failed: %v", c.label, q.name, err)
+		return dnsErrorResponse(query, q, dnsRcodeServFail)
+	}
+	if q.qtype == dnsTypeA || q.qtype == dnsTypeAAAA {
+		if addrs, err := parseDNSAddresses(resp); err == nil && len(addrs) > 0 {
+			c.resolved(q.name, addrs)
+		}
+	}
+	return resp
+}
+
+// forward sends the query to the name servers of the host in turn
+func (f *dnsForwarder) forward(query []byte, tcp bool) ([]byte, error) {
+	servers := ResolvConfNameservers(dnsResolvConf)
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no name server found in %s", dnsResolvConf)
+	}
+	var err error
+	for _, s := range servers {
+		// Never loop back to the forwarder itself
+		if s.Equal(f.addr) {
+			continue
+		}
+		var resp []byte
+		if resp, err = exchangeDNS(net.JoinHostPort(s.String(), strconv.Itoa(dnsPort)), query, tcp); err == nil {
+			return resp, nil
+		}
+	}
+	return nil, err
+}
+
+func exchangeDNS(server string, query []byte, tcp bool) ([]byte, error) {
+	proto := "udp"
+	if tcp {
+		proto = "tcp"
+	}
+	conn, err := net.DialTimeout(proto, server, dnsUpstreamTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsUpstreamTimeout))
+	if tcp {
+		if err := writeDNSTCP(conn, query); err != nil {
+			return nil, err
+		}
+		return readDNSTCP(conn)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Answers to other queries are late answers of a previous attempt
+		if n >= 2 && buf[0] == query[0] && buf[1] == query[1] {
+			return buf[:n], nil
+		}
+	}
+}
+
+// resolved feeds the addresses resolved for name into the firewall rules
+// of the sandbox using a domain pattern matching it
+func (c *dnsClient) resolved(name string, addrs []dnsAddress) {
+	v := c.veth
+	if v.fwrules == nil || v.bridge.fw == nil || v.sbip == nil {
+		return
+	}
+	for i, r := range v.fwrules.Rules {
+		if !r.IsPattern() || !MatchDomain(r.Dst, name) {
+			continue
+		}
+		ips := make([]net.IP, len(addrs))
+		timeout := dnsMinAddressTimeout
+		for j, a := range addrs {
+			ips[j] = a.ip
+			if a.ttl > timeout {
+				timeout = a.ttl
+			}
+		}
+		c.learn(i, ips, timeout)
+		if err := v.bridge.fw.AddAddresses(v.sbip, i, ips, timeout); err != nil {
+			v.log.Warningf("%s: unable to add the addresses of %s to the firewall: %v", c.label, name, err)
+		}
+	}
+}
+
+func (c *dnsClient) learn(rule int, ips []net.IP, timeout time.Duration) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.learned[rule] == nil {
+		c.learned[rule] = make(map[string]time.Time)
+	}
+	expiry := time.Now().Add(timeout)
+	for _, ip := range ips {
+		c.learned[rule][ip.String()] = expiry
+	}
+}
+
+// restore adds the addresses learned so far to the firewall again, after
+// the rules of the sandbox were replaced
+func (c *dnsClient) restore(fw Firewall, src net.IP) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	now := time.Now()
+	for rule, learned := range c.learned {
+		for s, expiry := range learned {
+			timeout := expiry.Sub(now)
+			if timeout <= 0 {
+				delete(learned, s)
+				continue
+			}
+			if err := fw.AddAddresses(src, rule, []net.IP{net.ParseIP(s)}, timeout); err != nil {
+				c.veth.log.Warningf("%s: unable to restore address %s in the firewall: %v", c.label, s, err)
+			}
+		}
+	}
+}
+
+// forwarder returns the DNS forwarder of the bridge, starting it if needed
+func (b *OzBridge) forwarder() (*dnsForwarder, error) {
+	if b.dns != nil {
+		return b.dns, nil
+	}
+	f, err := newDNSForwarder(*b.ip, b.log)
+	if err != nil {
+		return nil, err
+	}
+	b.dns = f
+	return f, nil
+}
+
+// EnableDNS makes the sandbox use the DNS forwarder of its bridge, label
+// prefixes the messages logging its queries. It must be called before the
+// veth is set up or when adopting it.
+func (v *OzVeth) EnableDNS(label string, policy *DNSPolicy) error {
+	if _, err := v.bridge.forwarder(); err != nil {
+		return err
+	}
+	v.dnsc = &dnsClient{
+		label:   label,
+		policy:  policy,
+		veth:    v,
+		learned: make(map[int]map[string]time.Time),
+	}
+	if v.sbip != nil {
+		v.bridge.dns.register(v.sbip, v.dnsc)
+	}
+	return nil
+}
+
+// DNSServer returns the address of the DNS forwarder used by the sandbox, nil if it uses none
+func (v *OzVeth) DNSServer() net.IP {
+	if v.dnsc == nil {
+		return nil
+	}
+	return *v.bridge.ip
+}
@@ -0,0 +1,356 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+// Port of the egress proxy on the loopback interface of the sandbox
+const DefaultEgressProxyPort = 1080
+
+const (
+	// Time given to a client to ask for a destination
+	egressHandshakeTimeout = 30 * time.Second
+	egressDialTimeout      = 15 * time.Second
+)
+
+var errEgressDenied = errors.New("denied by the firewall rules")
+
+const socks5Version = 5
+
+// SOCKS5 reply codes (RFC 1928)
+const (
+	socksSucceeded           = 0
+	socksGeneralFailure      = 1
+	socksNotAllowed          = 2
+	socksNetworkUnreachable  = 3
+	socksHostUnreachable     = 4
+	socksConnectionRefused   = 5
+	socksCommandNotSupported = 7
+	socksAddressNotSupported = 8
+)
+
+// egressProxy is a SOCKS5 and HTTP CONNECT proxy through which a sandbox
+// without network interface reaches what its firewall rules allow
+type egressProxy struct {
+	label string
+	rules *FirewallRuleset
+	log   *logging.Logger
+}
+
+// EgressProxyEnv returns the environment variables pointing the programs
+// of a sandbox to its egress proxy
+func EgressProxyEnv(port int) []string {
+	socks := fmt.Sprintf("socks5h://127.0.0.1:%d", port)
+	connect := fmt.Sprintf("http://127.0.0.1:%d", port)
+	return []string{
+		"all_proxy=" + socks,
+		"ALL_PROXY=" + socks,
+		"https_proxy=" + connect,
+		"HTTPS_PROXY=" + connect,
+		"no_proxy=localhost,127.0.0.1",
+		"NO_PROXY=localhost,127.0.0.1",
+	}
+}
+
+// StartEgressProxy starts a SOCKS5 and HTTP CONNECT proxy on port of the
+// loopback interface of the sandbox with the given init process. Each
+// connection is checked against the rules and logged with label, which
+// identifies the sandbox. It is stopped by ProxyShutdown.
+func StartEgressProxy(pid int, port int, label string, rules *FirewallRuleset, log *logging.Logger) error {
+	lAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	listen, err := proxySocketListener(pid, PROTO_TCP, lAddr)
+	if err != nil {
+		return err
+	}
+	log.Info("Starting egress proxy of %s on %s.", label, lAddr)
+	e := &egressProxy{label: label, rules: rules, log: log}
+	startProxy(pid, &ProxyConfig{}, "egress proxy of "+label, listen, e.handshake, true, log)
+	return nil
+}
+
+// handshake reads the destination asked for by the client and returns the
+// connection opened to it
+func (e *egressProxy) handshake(in net.Conn) (net.Conn, error) {
+	in.SetDeadline(time.Now().Add(egressHandshakeTimeout))
+	br := bufio.NewReader(in)
+	first, err := br.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	var out net.Conn
+	if first[0] == socks5Version {
+		out, err = e.socks(in, br)
+	} else {
+		out, err = e.httpConnect(in, br)
+	}
+	if err != nil {
+		return nil, err
+	}
+	in.SetDeadline(time.Time{})
+
+	// Sent by the client along with its request
+	if n := br.Buffered(); n > 0 {
+		b, _ := br.Peek(n)
+		if _, err := out.Write(b); err != nil {
+			out.Close()
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func (e *egressProxy) socks(in net.Conn, br *bufio.Reader) (net.Conn, error) {
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return nil, err
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return nil, err
+	}
+	// Only connections without authentication are supported
+	if bytes.IndexByte(methods, 0) == -1 {
+		in.Write([]byte{socks5Version, 0xff})
+		return nil, fmt.Errorf("socks5: no supported authentication method")
+	}
+	if _, err := in.Write([]byte{socks5Version, 0}); err != nil {
+		return nil, err
+	}
+
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(br, req); err != nil {
+		return nil, err
+	}
+	if req[0] != socks5Version {
+		return nil, fmt.Errorf("socks5: invalid version %d", req[0])
+	}
+	var host string
+	switch req[3] {
+	case 1, 4:
+		ip := make(net.IP, 4)
+		if req[3] == 4 {
+			ip = make(net.IP, 16)
+		}
+		if _, err := io.ReadFull(br, ip); err != nil {
+			return nil, err
+		}
+		host = ip.String()
+	case 3:
+		n, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		name := make([]byte, n)
+		if _, err := io.ReadFull(br, name); err != nil {
+			return nil, err
+		}
+		host = string(name)
+	default:
+		socksReply(in, socksAddressNotSupported, nil)
+		return nil, fmt.Errorf("socks5: unsupported address type %d", req[3])
+	}
+	p := make([]byte, 2)
+	if _, err := io.ReadFull(br, p); err != nil {
+		return nil, err
+	}
+	port := uint16(p[0])<<8 | uint16(p[1])
+	if req[1] != 1 {
+		socksReply(in, socksCommandNotSupported, nil)
+		return nil, fmt.Errorf("socks5: unsupported command %d to %s", req[1], net.JoinHostPort(host, strconv.Itoa(int(port))))
+	}
+
+	out, err := e.connect("socks5", host, port)
+	if err != nil {
+		socksReply(in, socksReplyCode(err), nil)
+		return nil, err
+	}
+	if err := socksReply(in, socksSucceeded, out.LocalAddr()); err != nil {
+		out.Close()
+		return nil, err
+	}
+	return out, nil
+}
+
+func socksReply(w io.Writer, code byte, bound net.Addr) error {
+	ip, port := net.IPv4zero.To4(), 0
+	if a, ok := bound.(*net.TCPAddr); ok {
+		ip, port = a.IP, a.Port
+	}
+	atyp := byte(1)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	} else {
+		atyp = 4
+	}
+	b := append([]byte{socks5Version, code, 0, atyp}, ip...)
+	b = append(b, byte(port>>8), byte(port))
+	_, err := w.Write(b)
+	return err
+}
+
+func socksReplyCode(err error) byte {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, errEgressDenied):
+		return socksNotAllowed
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socksConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socksNetworkUnreachable
+	case errors.As(err, &dnsErr), errors.Is(err, syscall.EHOSTUNREACH), isTimeout(err):
+		return socksHostUnreachable
+	}
+	return socksGeneralFailure
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+func (e *egressProxy) httpConnect(in net.Conn, br *bufio.Reader) (net.Conn, error) {
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return nil, fmt.Errorf("http: %v", err)
+	}
+	if req.Method != http.MethodConnect {
+		httpReply(in, http.StatusMethodNotAllowed, "Allow: CONNECT\r\n")
+		return nil, fmt.Errorf("http: unsupported method %s for %s", req.Method, req.RequestURI)
+	}
+	host, ps, err := net.SplitHostPort(req.Host)
+	port, perr := strconv.ParseUint(ps, 10, 16)
+	if err != nil || perr != nil || port == 0 {
+		httpReply(in, http.StatusBadRequest, "")
+		return nil, fmt.Errorf("http: invalid destination `%s`", req.Host)
+	}
+
+	out, err := e.connect("http", host, uint16(port))
+	if err != nil {
+		status := http.StatusBadGateway
+		if errors.Is(err, errEgressDenied) {
+			status = http.StatusForbidden
+		} else if isTimeout(err) {
+			status = http.StatusGatewayTimeout
+		}
+		httpReply(in, status, "")
+		return nil, err
+	}
+	if _, err := io.WriteString(in, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		out.Close()
+		return nil, err
+	}
+	return out, nil
+}
+
+func httpReply(w io.Writer, status int, headers string) {
+	fmt.Fprintf(w, "HTTP/1.1 %d %s\r\n%sContent-Length: 0\r\nConnection: close\r\n\r\n", status, http.StatusText(status), headers)
+}
+
+// connect opens a connection to the first address of host allowed by the
+// rules. Addresses of the host itself and of the oz bridges are only
+// reachable when a whitelist rule allows them, as the proxy runs outside of
+// the sandbox.
+func (e *egressProxy) connect(kind, host string, port uint16) (net.Conn, error) {
+	dest := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	name := host
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips, name = []net.IP{ip}, ""
+	} else {
+		var err error
+		if ips, err = lookupHost(host); err != nil {
+			return nil, fmt.Errorf("%s connection to %s: %w", kind, dest, err)
+		}
+	}
+
+	err := errEgressDenied
+	for _, ip := range ips {
+		if !e.allows(name, ip, port) {
+			continue
+		}
+		c, derr := net.DialTimeout("tcp", net.JoinHostPort(ip.String(), strconv.Itoa(int(port))), egressDialTimeout)
+		if derr != nil {
+			err = derr
+			continue
+		}
+		e.log.Info("Egress proxy of %s: %s connection to %s (%v).", e.label, kind, dest, ip)
+		return c, nil
+	}
+	return nil, fmt.Errorf("%s connection to %s: %w", kind, dest, err)
+}
+
+func (e *egressProxy) allows(name string, ip net.IP, port uint16) bool {
+	rs := e.rules
+	if rs == nil {
+		rs = &FirewallRuleset{}
+	}
+	if isHostAddress(ip) {
+		strict := *rs
+		strict.Policy = FW_POLICY_DROP
+		rs = &strict
+	}
+	return rs.AllowsConnection(name, ip, port)
+}
+
+// hostNetworks returns the addresses of the host and the subnets of the oz
+// bridges, along with the addresses of the other sandboxes
+var hostNetworks = func() ([]*net.IPNet, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var nets []*net.IPNet
+	for _, ifc := range ifaces {
+		addrs, err := ifc.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			ipn, ok := a.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			if strings.HasPrefix(ifc.Name, ozDefaultInterfaceBridgeBase) {
+				nets = append(nets, &net.IPNet{IP: ipn.IP.Mask(ipn.Mask), Mask: ipn.Mask})
+			} else {
+				ip := ipn.IP
+				if ip4 := ip.To4(); ip4 != nil {
+					ip = ip4
+				}
+				nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(8*len(ip), 8*len(ip))})
+			}
+		}
+	}
+	return nets, nil
+}
+
+// isHostAddress returns whether ip is served by the host itself or is on an
+// oz bridge, which the proxy reaches from outside of the sandbox. When the
+// addresses of the host can not be listed any address is treated as such.
+func isHostAddress(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	nets, err := hostNetworks()
+	if err != nil {
+		return true
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,228 @@
+package network
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+func TestAllowsConnection(t *testing.T) {
+	lookupHost = func(host string) ([]net.IP, error) {
+		if host == "example.com" {
+			return []net.IP{net.ParseIP("93.184.216.34")}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+	defer func() { lookupHost = net.LookupIP }()
+
+	https := []PortRange{{443, 443}}
+	whitelist := &FirewallRuleset{Rules: []FirewallRule{
+		{Whitelist: true, Dst: "example.com", Ports: https},
+		{Whitelist: true, Dst: "*.mozilla.org", Ports: https},
+		{Whitelist: true, Dst: "10.0.0.0/8", Proto: FW_PROTO_UDP},
+		{Whitelist: false, Dst: "10.1.0.0/16"},
+		{Whitelist: true, Dst: "10.0.0.0/8"},
+	}}
+	blacklist := &FirewallRuleset{Rules: []FirewallRule{
+		{Whitelist: false, Dst: "192.168.0.0/16"},
+		{Whitelist: true, Dst: "192.168.1.1", Direction: FW_DIRECTION_IN},
+	}}
+	tests := []struct {
+		rules *FirewallRuleset
+		host  string
+		ip    string
+		port  uint16
+		allow bool
+	}{
+		{whitelist, "", "93.184.216.34", 443, true},
+		{whitelist, "example.com", "93.184.216.34", 443, true},
+		{whitelist, "", "93.184.216.34", 80, false},
+		{whitelist, "www.mozilla.org", "1.2.3.4", 443, true},
+		{whitelist, "mozilla.org", "1.2.3.4", 443, false},
+		{whitelist, "", "1.2.3.4", 443, false},
+		{whitelist, "", "10.2.3.4", 22, true},
+		{whitelist, "", "10.1.3.4", 22, false},
+		{blacklist, "", "192.168.1.1", 80, false},
+		{blacklist, "", "8.8.8.8", 53, true},
+		{&FirewallRuleset{Policy: FW_POLICY_DROP}, "", "8.8.8.8", 53, false},
+		{&FirewallRuleset{Policy: FW_POLICY_ACCEPT, Rules: whitelist.Rules}, "", "1.2.3.4", 80, true},
+		{nil, "", "8.8.8.8", 53, true},
+	}
+	for _, tt := range tests {
+		if allow := tt.rules.AllowsConnection(tt.host, net.ParseIP(tt.ip), tt.port); allow != tt.allow {
+			t.Errorf("AllowsConnection(%q, %s, %d) = %v, expected %v", tt.host, tt.ip, tt.port, allow, tt.allow)
+		}
+	}
+}
+
+// testEgressProxy starts an egress proxy of a fake sandbox with the given
+// rules on a local port
+func testEgressProxy(t *testing.T, pid int, rules *FirewallRuleset) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &egressProxy{label: fmt.Sprintf("test (id=%d)", pid), rules: rules, log: logging.MustGetLogger("oz-test")}
+	startProxy(pid, &ProxyConfig{}, "egress proxy of "+e.label, l, e.handshake, true, e.log)
+	t.Cleanup(func() { ProxyShutdown(pid, time.Second) })
+	return l.Addr().String()
+}
+
+// socksConnect asks the proxy for a connection to host and port, returning
+// the reply code
+func socksConnect(t *testing.T, c net.Conn, host string, port int) byte {
+	c.SetDeadline(time.Now().Add(2 * time.Second))
+	c.Write([]byte{socks5Version, 1, 0})
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(c, reply); err != nil || reply[1] != 0 {
+		t.Fatalf("socks5 method reply %v (%v)", reply, err)
+	}
+	req := []byte{socks5Version, 1, 0, 3, byte(len(host))}
+	req = append(append(req, host...), byte(port>>8), byte(port))
+	c.Write(req)
+	reply = make([]byte, 10)
+	if _, err := io.ReadFull(c, reply); err != nil {
+		t.Fatalf("socks5 connect reply: %v", err)
+	}
+	c.SetDeadline(time.Time{})
+	return reply[1]
+}
+
+func loopbackRules(port int) *FirewallRuleset {
+	return &FirewallRuleset{Rules: []FirewallRule{
+		{Whitelist: true, Dst: "127.0.0.1", Ports: []PortRange{{uint16(port), uint16(port)}}},
+	}}
+}
+
+func TestEgressProxySocks(t *testing.T) {
+	backend := testBackend(t, echo)
+	defer backend.Close()
+	port := backend.Addr().(*net.TCPAddr).Port
+	addr := testEgressProxy(t, 4101, loopbackRules(port))
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if code := socksConnect(t, c, "127.0.0.1", port); code != socksSucceeded {
+		t.Fatalf("socks5 connect reply %d, expected success", code)
+	}
+	exchange(t, c, "hello", "hello")
+
+	// The host is only reachable on the whitelisted port
+	denied, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer denied.Close()
+	if code := socksConnect(t, denied, "127.0.0.1", port+1); code != socksNotAllowed {
+		t.Errorf("socks5 connect reply %d, expected not allowed", code)
+	}
+}
+
+func TestEgressProxyHTTPConnect(t *testing.T) {
+	backend := testBackend(t, echo)
+	defer backend.Close()
+	port := backend.Addr().(*net.TCPAddr).Port
+	addr := testEgressProxy(t, 4102, loopbackRules(port))
+
+	connect := func(dest string) (net.Conn, *bufio.Reader, int) {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetDeadline(time.Now().Add(2 * time.Second))
+		fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", dest, dest)
+		br := bufio.NewReader(c)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("CONNECT %s: %v", dest, err)
+		}
+		return c, br, resp.StatusCode
+	}
+
+	c, br, status := connect(net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	defer c.Close()
+	if status != http.StatusOK {
+		t.Fatalf("CONNECT status %d, expected 200", status)
+	}
+	c.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(br, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("got %q (%v), expected hello", buf, err)
+	}
+
+	// Without a whitelist rule the host is not reachable
+	lookupHost = func(host string) ([]net.IP, error) { return []net.IP{net.ParseIP("127.0.0.1")}, nil }
+	defer func() { lookupHost = net.LookupIP }()
+	denied, _, status := connect(net.JoinHostPort("localhost", strconv.Itoa(port+1)))
+	defer denied.Close()
+	if status != http.StatusForbidden {
+		t.Errorf("CONNECT status %d, expected 403", status)
+	}
+}
+
+func TestEgressProxyLoopbackPolicy(t *testing.T) {
+	backend := testBackend(t, echo)
+	defer backend.Close()
+	port := backend.Addr().(*net.TCPAddr).Port
+	// Accepting everything else does not open the host
+	addr := testEgressProxy(t, 4103, &FirewallRuleset{Policy: FW_POLICY_ACCEPT})
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if code := socksConnect(t, c, "127.0.0.1", port); code != socksNotAllowed {
+		t.Errorf("socks5 connect reply %d, expected not allowed", code)
+	}
+}
+
+func TestEgressProxyHostAddresses(t *testing.T) {
+	e := &egressProxy{rules: &FirewallRuleset{Policy: FW_POLICY_ACCEPT, Rules: []FirewallRule{
+		{Whitelist: true, Dst: "192.0.2.10", Ports: []PortRange{{443, 443}}},
+	}}}
+
+	// Every address of an interface of the host
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range addrs {
+		if ipn, ok := a.(*net.IPNet); ok && e.allows("", ipn.IP, 53) {
+			t.Errorf("connection to host address %v allowed", ipn.IP)
+		}
+	}
+
+	defer func(orig func() ([]*net.IPNet, error)) { hostNetworks = orig }(hostNetworks)
+	hostNetworks = func() ([]*net.IPNet, error) {
+		_, lan, _ := net.ParseCIDR("192.0.2.10/32")
+		_, bridge, _ := net.ParseCIDR("10.137.4.0/24")
+		return []*net.IPNet{lan, bridge}, nil
+	}
+	for _, tt := range []struct {
+		ip    string
+		port  uint16
+		allow bool
+	}{
+		{"192.0.2.10", 53, false},
+		{"192.0.2.10", 443, true},
+		{"10.137.4.1", 53, false},
+		{"10.137.4.23", 8080, false},
+		{"198.51.100.7", 53, true},
+	} {
+		if allow := e.allows("", net.ParseIP(tt.ip), tt.port); allow != tt.allow {
+			t.Errorf("allows(%s, %d) = %v, expected %v", tt.ip, tt.port, allow, tt.allow)
+		}
+	}
+}
@@ -0,0 +1,392 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+type FirewallBackend string
+
+const (
+	FW_BACKEND_NFTABLES FirewallBackend = "nftables"
+	FW_BACKEND_FWDAEMON FirewallBackend = "fw-daemon"
+)
+
+type FirewallProto string
+
+const (
+	FW_PROTO_ANY  FirewallProto = ""
+	FW_PROTO_TCP  FirewallProto = "tcp"
+	FW_PROTO_UDP  FirewallProto = "udp"
+	FW_PROTO_ICMP FirewallProto = "icmp"
+)
+
+type FirewallDirection string
+
+const (
+	// Connections made by the sandbox
+	FW_DIRECTION_OUT FirewallDirection = "out"
+	// Connections made to the sandbox
+	FW_DIRECTION_IN FirewallDirection = "in"
+)
+
+type FirewallPolicy string
+
+const (
+	// Drop what is not whitelisted if there are whitelist rules, accept otherwise
+	FW_POLICY_DEFAULT FirewallPolicy = ""
+	FW_POLICY_ACCEPT  FirewallPolicy = "accept"
+	FW_POLICY_DROP    FirewallPolicy = "drop"
+)
+
+// PortRange is an inclusive range of ports
+type PortRange struct {
+	First uint16
+	Last  uint16
+}
+
+// ParsePortRange parses a single port (ie: `443`) or a range of ports (ie: `8000-8080`)
+func ParsePortRange(s string) (PortRange, error) {
+	first, last := s, s
+	if i := strings.Index(s, "-"); i != -1 {
+		first, last = s[:i], s[i+1:]
+	}
+	f, err := strconv.ParseUint(strings.TrimSpace(first), 10, 16)
+	if err != nil || f == 0 {
+		return PortRange{}, fmt.Errorf("invalid port `%s`", s)
+	}
+	l, err := strconv.ParseUint(strings.TrimSpace(last), 10, 16)
+	if err != nil || l == 0 {
+		return PortRange{}, fmt.Errorf("invalid port `%s`", s)
+	}
+	if l < f {
+		return PortRange{}, fmt.Errorf("invalid port range `%s`, %d is lower than %d", s, l, f)
+	}
+	return PortRange{First: uint16(f), Last: uint16(l)}, nil
+}
+
+func (pr PortRange) String() string {
+	if pr.First == pr.Last {
+		return strconv.Itoa(int(pr.First))
+	}
+	return fmt.Sprintf("%d-%d", pr.First, pr.Last)
+}
+
+// FirewallRule allows (whitelist) or denies (blacklist) the traffic between
+// a sandbox and a remote host, address or network. Rules without ports
+// match all the ports, rules without a protocol match tcp and udp if they
+// have ports and all the protocols otherwise.
+type FirewallRule struct {
+	Whitelist bool
+	Direction FirewallDirection
+	Proto     FirewallProto
+	// Host name, address, network in CIDR notation or sub-domain
+	// wildcard (ie: `*.mozilla.org`)
+	Dst   string
+	Ports []PortRange
+}
+
+func (r FirewallRule) String() string {
+	s := "blacklist"
+	if r.Whitelist {
+		s = "whitelist"
+	}
+	dir := r.Direction
+	if dir == "" {
+		dir = FW_DIRECTION_OUT
+	}
+	s += " " + string(dir)
+	if r.Proto != FW_PROTO_ANY {
+		s += " " + string(r.Proto)
+	}
+	s += " " + r.Dst
+	if len(r.Ports) > 0 {
+		ports := make([]string, len(r.Ports))
+		for i, p := range r.Ports {
+			ports[i] = p.String()
+		}
+		s += " port " + strings.Join(ports, ",")
+	}
+	return s
+}
+
+// IsName returns true if the destination of the rule is a host name,
+// which is resolved when the rule is installed and refreshed periodically
+func (r FirewallRule) IsName() bool {
+	if net.ParseIP(r.Dst) != nil || r.IsPattern() {
+		return false
+	}
+	_, _, err := net.ParseCIDR(r.Dst)
+	return err != nil
+}
+
+// IsPattern returns true if the destination of the rule is a sub-domain
+// wildcard, it matches the addresses the DNS forwarder of the sandbox
+// resolved for names matching it
+func (r FirewallRule) IsPattern() bool {
+	return IsDomainPattern(r.Dst)
+}
+
+// Check returns an error if the rule is inconsistent
+func (r FirewallRule) Check() error {
+	if r.Dst == "" {
+		return fmt.Errorf("missing destination")
+	}
+	if r.Proto == FW_PROTO_ICMP && len(r.Ports) > 0 {
+		return fmt.Errorf("ports cannot be used with icmp")
+	}
+	if strings.Contains(r.Dst, "*") && !r.IsPattern() {
+		return fmt.Errorf("invalid destination `%s`, wildcards are only allowed as `*.domain`", r.Dst)
+	}
+	return nil
+}
+
+// Resolve returns the IPv4 and IPv6 networks matched by the destination of the rule
+func (r FirewallRule) Resolve() ([]*net.IPNet, error) {
+	if r.IsPattern() {
+		return nil, fmt.Errorf("%s is only resolved by the DNS forwarder", r.Dst)
+	}
+	if ip := net.ParseIP(r.Dst); ip != nil {
+		return []*net.IPNet{hostNet(ip)}, nil
+	}
+	if _, ipnet, err := net.ParseCIDR(r.Dst); err == nil {
+		return []*net.IPNet{ipnet}, nil
+	}
+	ips, err := lookupHost(r.Dst)
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve %s: %v", r.Dst, err)
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no address found for %s", r.Dst)
+	}
+	nets := make([]*net.IPNet, len(ips))
+	for i, ip := range ips {
+		nets[i] = hostNet(ip)
+	}
+	return nets, nil
+}
+
+// matchesConnection returns true if the rule matches a tcp connection made
+// by the sandbox to ip on port, host being the name it was asked for if any
+func (r FirewallRule) matchesConnection(host string, ip net.IP, port uint16) bool {
+	if (r.Direction != "" && r.Direction != FW_DIRECTION_OUT) || (r.Proto != FW_PROTO_ANY && r.Proto != FW_PROTO_TCP) {
+		return false
+	}
+	if len(r.Ports) > 0 {
+		found := false
+		for _, pr := range r.Ports {
+			if port >= pr.First && port <= pr.Last {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if r.IsPattern() {
+		return host != "" && MatchDomain(r.Dst, host)
+	}
+	if r.IsName() && host != "" && MatchDomain(r.Dst, host) {
+		return true
+	}
+	nets, err := r.Resolve()
+	if err != nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostNet returns the network holding only ip
+func hostNet(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// Looks up the addresses of the host names used in rules
+var lookupHost = net.LookupIP
+
+// FirewallRuleset holds the rules of a sandbox and the policy for
+// the traffic which does not match any of them
+type FirewallRuleset struct {
+	Policy FirewallPolicy
+	Rules  []FirewallRule
+	// Address of the DNS forwarder of the sandbox, always reachable, nil if it has none
+	DNSServer net.IP
+}
+
+// Empty returns true if the ruleset does not restrict anything
+func (rs *FirewallRuleset) Empty() bool {
+	return rs == nil || (len(rs.Rules) == 0 && rs.Policy != FW_POLICY_DROP)
+}
+
+// AllowsConnection returns true if the rules let the sandbox open a tcp
+// connection to ip on port, host being the name it was asked for if any.
+// They are evaluated as by the firewall: blacklist rules first, then
+// whitelist rules and then the policy.
+func (rs *FirewallRuleset) AllowsConnection(host string, ip net.IP, port uint16) bool {
+	if rs == nil {
+		return true
+	}
+	whitelist := false
+	for _, pass := range []bool{false, true} {
+		for _, r := range rs.Rules {
+			if r.Whitelist != pass || (r.Direction != "" && r.Direction != FW_DIRECTION_OUT) {
+				continue
+			}
+			whitelist = whitelist || r.Whitelist
+			if r.matchesConnection(host, ip, port) {
+				return r.Whitelist
+			}
+		}
+	}
+	switch rs.Policy {
+	case FW_POLICY_DROP:
+		return false
+	case FW_POLICY_ACCEPT:
+		return true
+	}
+	return !whitelist
+}
+
+// hasPatterns returns true if some of the rules use sub-domain wildcards
+func (rs *FirewallRuleset) hasPatterns() bool {
+	for _, r := range rs.Rules {
+		if r.IsPattern() {
+			return true
+		}
+	}
+	return false
+}
+
+// hasNames returns true if some of the rules use host names
+func (rs *FirewallRuleset) hasNames() bool {
+	for _, r := range rs.Rules {
+		if r.IsName() {
+			return true
+		}
+	}
+	return false
+}
+
+// Firewall installs the rules restricting the traffic of a sandbox, they are
+// keyed by the IPv4 address of the sandbox on its bridge.
+type Firewall interface {
+	// Install replaces the rules of the sandbox address, src6 is the IPv6
+	// address of the sandbox if it has one and pid is the init process of
+	// the sandbox. Installing the same rules again is a no-op unless
+	// host names resolve to other addresses.
+	Install(src, src6 net.IP, pid int, rs *FirewallRuleset) error
+	// Remove removes all the rules of the sandbox address, if any
+	Remove(src net.IP) error
+	// AddAddresses adds addresses resolved by the DNS forwarder to the rule
+	// at index rule of the sandbox address, which uses a sub-domain wildcard,
+	// they are removed after ttl
+	AddAddresses(src net.IP, rule int, ips []net.IP, ttl time.Duration) error
+}
+
+// NewFirewall returns the firewall of the given backend, fwDaemonSocket is
+// the control socket of fw-daemon for the fw-daemon backend
+func NewFirewall(backend FirewallBackend, fwDaemonSocket string, log *logging.Logger) (Firewall, error) {
+	switch backend {
+	case FW_BACKEND_NFTABLES, "":
+		return &nftFirewall{log: log, installed: make(map[string]string)}, nil
+	case FW_BACKEND_FWDAEMON:
+		return &fwDaemonFirewall{log: log, socket: fwDaemonSocket, installed: make(map[string]string)}, nil
+	}
+	return nil, fmt.Errorf("unknown firewall backend '%s'", backend)
+}
+
+// SetFirewall sets the firewall used for the rules of the sandboxes
+func (bs *Bridges) SetFirewall(fw Firewall) {
+	bs.fw = fw
+}
+
+// RemoveFWRules removes the rules of a sandbox address, used to clean up
+// after a sandbox which is gone and has no veth anymore
+func (bs *Bridges) RemoveFWRules(src net.IP) error {
+	if bs.fw == nil || src == nil {
+		return nil
+	}
+	return bs.fw.Remove(src)
+}
+
+// SetupFWRules installs the firewall rules of the sandbox, they are installed
+// again whenever the address of the sandbox changes
+func (v *OzVeth) SetupFWRules(rs *FirewallRuleset) error {
+	v.fwmtx.Lock()
+	defer v.fwmtx.Unlock()
+	v.fwrules = rs
+	if v.sbip == nil {
+		return nil
+	}
+	return v.installFWRules(v.sbip)
+}
+
+// AdoptFWRules records the rules installed by a previous instance of the daemon
+func (v *OzVeth) AdoptFWRules(rs *FirewallRuleset) {
+	v.fwrules = rs
+}
+
+// RefreshFWRules resolves the host names used in the rules of the sandbox
+// again and updates the rules if they changed
+func (v *OzVeth) RefreshFWRules() error {
+	v.fwmtx.Lock()
+	defer v.fwmtx.Unlock()
+	if v.fwremoved || v.fwrules.Empty() || !v.fwrules.hasNames() || v.sbip == nil {
+		return nil
+	}
+	return v.installFWRules(v.sbip)
+}
+
+func (v *OzVeth) installFWRules(ip net.IP) error {
+	if v.fwrules.Empty() {
+		return nil
+	}
+	if v.bridge.fw == nil {
+		return fmt.Errorf("no firewall available for the rules of veth %s", v.NetInterface().Name)
+	}
+	rs := v.fwrules
+	if v.dnsc != nil {
+		dns := *v.fwrules
+		dns.DNSServer = *v.bridge.ip
+		rs = &dns
+	} else if rs.hasPatterns() {
+		return fmt.Errorf("firewall rules with wildcards require the DNS forwarder (dns_mode `forward` or `dhcp`)")
+	}
+	if err := v.bridge.fw.Install(ip, v.sbip6, v.peerPid, rs); err != nil {
+		return err
+	}
+	if v.dnsc != nil {
+		v.dnsc.restore(v.bridge.fw, ip)
+	}
+	return nil
+}
+
+// RemoveFWRules removes the rules of the sandbox for good, they are not
+// refreshed anymore
+func (v *OzVeth) RemoveFWRules() error {
+	v.fwmtx.Lock()
+	defer v.fwmtx.Unlock()
+	v.fwremoved = true
+	return v.removeFWRules(v.sbip)
+}
+
+func (v *OzVeth) removeFWRules(ip net.IP) error {
+	if v.bridge.fw == nil || ip == nil {
+		return nil
+	}
+	return v.bridge.fw.Remove(ip)
+}
@@ -0,0 +1,132 @@
+package network
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+// How long to wait for fw-daemon to answer a request
+const fwDaemonTimeout = 5 * time.Second
+
+// fwDaemonFirewall hands the rules over to an external fw-daemon
+type fwDaemonFirewall struct {
+	log       *logging.Logger
+	socket    string
+	mtx       sync.Mutex
+	installed map[string]string // rules last installed for each address
+}
+
+// Install hands the rules over to fw-daemon, which only knows about outgoing
+// traffic to a host or address on a single port or on all ports. Host names
+// are resolved by fw-daemon, installing the same rules again does nothing.
+func (fw *fwDaemonFirewall) Install(src, src6 net.IP, pid int, rs *FirewallRuleset) error {
+	if src6 != nil {
+		return fmt.Errorf("IPv6 traffic cannot be filtered by fw-daemon")
+	}
+	if rs.Policy != FW_POLICY_DEFAULT {
+		return fmt.Errorf("firewall policy is not supported by fw-daemon")
+	}
+	for _, r := range rs.Rules {
+		if r.Direction == FW_DIRECTION_IN || r.Proto != FW_PROTO_ANY || len(r.Ports) > 1 ||
+			(len(r.Ports) == 1 && r.Ports[0].First != r.Ports[0].Last) {
+			return fmt.Errorf("firewall rule `%s` is not supported by fw-daemon", r)
+		}
+		if _, _, err := net.ParseCIDR(r.Dst); err == nil || r.IsPattern() {
+			return fmt.Errorf("firewall rule `%s` is not supported by fw-daemon", r)
+		}
+	}
+	key := fmt.Sprint(pid, rs.Rules)
+
+	fw.mtx.Lock()
+	defer fw.mtx.Unlock()
+	if fw.installed[src.String()] == key {
+		return nil
+	}
+	if err := fw.remove(src); err != nil {
+		return err
+	}
+	for _, r := range rs.Rules {
+		list := "blacklist"
+		if r.Whitelist {
+			list = "whitelist"
+		}
+		port := "*"
+		if len(r.Ports) == 1 {
+			port = strconv.Itoa(int(r.Ports[0].First))
+		}
+		fw.log.Infof("Adding fw-daemon %s rule for %v: %s:%s", list, src, r.Dst, port)
+		if err := FWDaemonSend(fw.socket, "add", list, src.String(), r.Dst, port, strconv.Itoa(pid)); err != nil {
+			return err
+		}
+	}
+	fw.installed[src.String()] = key
+	return nil
+}
+
+func (fw *fwDaemonFirewall) AddAddresses(src net.IP, rule int, ips []net.IP, ttl time.Duration) error {
+	return fmt.Errorf("wildcard destinations are not supported by fw-daemon")
+}
+
+func (fw *fwDaemonFirewall) Remove(src net.IP) error {
+	if src == nil {
+		return fmt.Errorf("could not remove firewall rules of a null address")
+	}
+	fw.mtx.Lock()
+	defer fw.mtx.Unlock()
+	return fw.remove(src)
+}
+
+func (fw *fwDaemonFirewall) remove(src net.IP) error {
+	delete(fw.installed, src.String())
+	return FWDaemonSend(fw.socket, "removeall", src.String())
+}
+
+// FWDaemonSend sends a request that fw-daemon does not acknowledge, such as
+// add and removeall
+func FWDaemonSend(socket string, args ...string) error {
+	c, err := fwDaemonWrite(socket, args)
+	if err != nil {
+		return err
+	}
+	return c.Close()
+}
+
+// FWDaemonRequest sends a request to fw-daemon and waits for it to be
+// acknowledged, only register-init is
+func FWDaemonRequest(socket string, args ...string) error {
+	c, err := fwDaemonWrite(socket, args)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	resp, err := bufio.NewReader(c).ReadString('\n')
+	resp = strings.TrimSpace(resp)
+	if strings.HasPrefix(resp, "OK") {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("no answer from fw-daemon to %s request: %v", args[0], err)
+	}
+	return fmt.Errorf("fw-daemon rejected %s request: %s", args[0], resp)
+}
+
+func fwDaemonWrite(socket string, args []string) (net.Conn, error) {
+	c, err := net.DialTimeout("unix", socket, fwDaemonTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c.SetDeadline(time.Now().Add(fwDaemonTimeout))
+	if _, err := c.Write([]byte(strings.Join(args, " ") + "\n")); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
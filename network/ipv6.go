@@ -0,0 +1,163 @@
+package network
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path"
+	"strings"
+
+	"github.com/milosgajdos83/tenus"
+	"github.com/subgraph/oz/ns"
+)
+
+// EnableIPv6 gives a /64 to each new bridge and an IPv6 address to the
+// sandboxes attached to it. In nat66 mode the /64 is taken from prefix,
+// or from a random unique local prefix if it is empty, and the traffic
+// of the sandboxes is masqueraded behind the addresses of the host.
+// In routed mode prefix must be routed to the host by the network.
+func (bs *Bridges) EnableIPv6(mode IPv6Mode, prefix string) error {
+	if err := CheckIPv6(mode, prefix); err != nil {
+		return err
+	}
+	if mode == IPV6_NONE || mode == "" {
+		return nil
+	}
+	a, err := newAllocator6(prefix, bs.log)
+	if err != nil {
+		return err
+	}
+	if !ipv6Forwarding() {
+		bs.log.Warning("IPv6 forwarding is disabled, sandboxes will not be able to reach IPv6 networks")
+	}
+	bs.ipv6 = mode
+	bs.alloc6 = a
+	return nil
+}
+
+// setLinkUpInNs brings the interface of a sandbox up from inside its
+// network namespace, without configuring any address
+func setLinkUpInNs(nspid int, ifname string) error {
+	return ns.WithProcessNetNS(nspid, func() error {
+		link, err := tenus.NewLinkFrom(ifname)
+		if err != nil {
+			return err
+		}
+		if err := link.SetLinkUp(); err != nil {
+			return fmt.Errorf("Unable to bring %s interface UP: %v", ifname, err)
+		}
+		return nil
+	})
+}
+
+// CheckIPv6 returns an error if the IPv6 mode or prefix is invalid
+func CheckIPv6(mode IPv6Mode, prefix string) error {
+	switch mode {
+	case IPV6_NONE, "":
+		return nil
+	case IPV6_NAT66:
+	case IPV6_ROUTED:
+		if prefix == "" {
+			return fmt.Errorf("routed IPv6 requires a prefix routed to the host")
+		}
+	default:
+		return fmt.Errorf("unknown IPv6 mode '%s'", mode)
+	}
+	if prefix != "" {
+		if _, err := parsePrefix6(prefix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func ipv6Forwarding() bool {
+	b, err := ioutil.ReadFile("/proc/sys/net/ipv6/conf/all/forwarding")
+	return err == nil && strings.TrimSpace(string(b)) == "1"
+}
+
+// configureIPv6 assigns the first address of its IPv6 range to the bridge
+// and sets up the translation of the addresses of the sandboxes if needed
+func (bs *Bridges) configureIPv6(b *OzBridge) error {
+	if b.ipr6 == nil {
+		return nil
+	}
+	b.ip6 = b.ipr6.FirstIP()
+	b.log.Infof("Configuring bridge %s with IPv6 address %v", b.Name, b.ip6)
+	if err := b.SetLinkIp(b.ip6, b.ipr6.IPNet); err != nil {
+		return fmt.Errorf("error configuring IPv6 address of bridge: %v", err)
+	}
+	if bs.ipv6 == IPV6_NAT66 {
+		if err := runNft(nat66Script(b.Name, b.ipr6.IPNet)); err != nil {
+			return fmt.Errorf("error setting up NAT66 for bridge %s: %v", b.Name, err)
+		}
+	}
+	return nil
+}
+
+// nat66Script returns the nft script masquerading the IPv6 traffic leaving
+// a bridge, the table of the bridge is replaced if it already exists
+func nat66Script(name string, subnet *net.IPNet) string {
+	brname := ozDefaultInterfaceBridgeBase + name
+	table := "oz_nat66_" + strings.Replace(name, "-", "_", -1)
+	return fmt.Sprintf("table ip6 %s\ndelete table ip6 %s\n", table, table) +
+		fmt.Sprintf("table ip6 %s {\n", table) +
+		"\tchain postrouting {\n" +
+		"\t\ttype nat hook postrouting priority 100; policy accept;\n" +
+		fmt.Sprintf("\t\tip6 saddr %v oifname != \"%s\" masquerade\n", subnet, brname) +
+		"\t}\n}\n"
+}
+
+// adoptIPv6 rebuilds the IPv6 range of an adopted bridge from the global
+// IPv6 address configured on it, if any
+func (bs *Bridges) adoptIPv6(b *OzBridge, addrs []net.Addr) {
+	if bs.alloc6 == nil {
+		return
+	}
+	for _, a := range addrs {
+		ipn, ok := a.(*net.IPNet)
+		if !ok || ipn.IP.To4() != nil || !ipn.IP.IsGlobalUnicast() {
+			continue
+		}
+		subnet := &net.IPNet{IP: ipn.IP.Mask(ipn.Mask), Mask: ipn.Mask}
+		bs.alloc6.reserve(subnet)
+		b.ipr6 = newIPRange6(subnet)
+		b.ipr6.Claim(ipn.IP)
+		b.ip6 = ipn.IP
+		bs.log.Infof("Adopting bridge '%s' with IPv6 address %v", b.Name, ipn.IP)
+		return
+	}
+}
+
+func (v *OzVeth) assignIP6() error {
+	v.log.Infof("Assigning IPv6 address %v to sandbox veth %s", v.sbip6, v.PeerNetInterface().Name)
+	return setLinkIP6InNs(v.peerPid, v.PeerNetInterface().Name, v.sbip6, v.bridge.ipr6.IPNet, v.bridge.ip6)
+}
+
+// setLinkIP6InNs configures the IPv6 address and default route of the
+// interface of a sandbox from inside its network namespace
+func setLinkIP6InNs(nspid int, ifname string, ip net.IP, network *net.IPNet, gw net.IP) error {
+	return ns.WithProcessNetNS(nspid, func() error {
+		return setLinkIP6(nspid, ifname, ip, network, gw)
+	})
+}
+
+func setLinkIP6(nspid int, ifname string, ip net.IP, network *net.IPNet, gw net.IP) error {
+	// Addresses are random in a /64, waiting for duplicate address
+	// detection would only delay the first connections of the sandbox
+	dad := path.Join("/proc/sys/net/ipv6/conf", ifname, "accept_dad")
+	if err := ioutil.WriteFile(dad, []byte("0"), 0644); err != nil {
+		return fmt.Errorf("Unable to disable duplicate address detection on %s: %v", ifname, err)
+	}
+	link, err := tenus.NewLinkFrom(ifname)
+	if err != nil {
+		return err
+	}
+	if err := link.SetLinkIp(ip, network); err != nil {
+		return fmt.Errorf("Unable to set IP: %s in pid: %d network namespace", ip.String(), nspid)
+	}
+	if err := link.SetLinkDefaultGw(&gw); err != nil {
+		return fmt.Errorf("Unable to set Default gateway: %s in pid: %d network namespace", gw.String(), nspid)
+	}
+	return nil
+}
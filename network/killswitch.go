@@ -0,0 +1,86 @@
+package network
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// killSwitchTable returns the name of the nftables table holding the
+// kill-switch of the sandbox with the given address
+func killSwitchTable(src net.IP) string {
+	return "ozvpn_" + strings.TrimPrefix(nftTableName(src), "oz_")
+}
+
+// killSwitchScript returns the nft script replacing the kill-switch of a
+// sandbox. What the sandbox sends through the host is dropped unless it
+// leaves through the tunnel interface, all of it if tunnel is empty. Without
+// a tunnel, what the sandbox sends to the host itself is dropped as well but
+// for DHCP and neighbor discovery, as services of the host would reach out
+// on its behalf through the default route of the host.
+func killSwitchScript(src, src6 net.IP, tunnel string) (string, error) {
+	ip := src.To4()
+	if ip == nil {
+		return "", fmt.Errorf("invalid sandbox address %v", src)
+	}
+	match := "drop"
+	if tunnel != "" {
+		match = fmt.Sprintf("oifname != %q drop", tunnel)
+	}
+	table := killSwitchTable(ip)
+
+	var b bytes.Buffer
+	b.WriteString(nftDeleteTable(table))
+	fmt.Fprintf(&b, "table %s %s {\n", nftFamily, table)
+	b.WriteString("\tchain forward {\n")
+	b.WriteString("\t\ttype filter hook forward priority -2; policy accept;\n")
+	fmt.Fprintf(&b, "\t\tip saddr %v %s\n", ip, match)
+	if src6 != nil {
+		fmt.Fprintf(&b, "\t\tip6 saddr %v %s\n", src6, match)
+	}
+	b.WriteString("\t}\n")
+	if tunnel == "" {
+		b.WriteString("\tchain input {\n")
+		b.WriteString("\t\ttype filter hook input priority -2; policy accept;\n")
+		b.WriteString("\t\tct state established,related accept\n")
+		fmt.Fprintf(&b, "\t\tip saddr %v udp dport 67 accept\n", ip)
+		fmt.Fprintf(&b, "\t\tip saddr %v drop\n", ip)
+		if src6 != nil {
+			fmt.Fprintf(&b, "\t\t%s\n", nftNeighborDiscovery)
+			fmt.Fprintf(&b, "\t\tip6 saddr %v drop\n", src6)
+		}
+		b.WriteString("\t}\n")
+	}
+	b.WriteString("}\n")
+	return b.String(), nil
+}
+
+// SetKillSwitch only lets the sandbox send traffic through the host by way
+// of the tunnel interface, or not at all if tunnel is empty, so that nothing
+// leaks through the default route of the host while its VPN is down. Traffic
+// to the host itself, such as connections to the proxies of the sandbox, is
+// dropped too until the tunnel is up and then left to the firewall rules.
+func (v *OzVeth) SetKillSwitch(tunnel string) error {
+	if v.sbip == nil {
+		return fmt.Errorf("sandbox %d has no address", v.id)
+	}
+	script, err := killSwitchScript(v.sbip, v.sbip6, tunnel)
+	if err != nil {
+		return err
+	}
+	if err := runNft(script); err != nil {
+		return err
+	}
+	v.killSwitch = true
+	return nil
+}
+
+// RemoveKillSwitch removes the kill-switch of the sandbox with the given
+// address, if any
+func RemoveKillSwitch(src net.IP) error {
+	if src.To4() == nil {
+		return fmt.Errorf("invalid sandbox address %v", src)
+	}
+	return runNft(nftDeleteTable(killSwitchTable(src.To4())))
+}
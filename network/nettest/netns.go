@@ -0,0 +1,44 @@
+// Package nettest holds the fixtures shared by the tests of the network
+// namespaces of sandboxes
+package nettest
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+
+	"github.com/milosgajdos83/tenus"
+
+	"github.com/subgraph/oz/ns"
+)
+
+// NetNS starts a process in a network namespace of its own with the
+// loopback interface up, standing for the init process of a sandbox. The
+// test is skipped if it is not run as root.
+func NetNS(t *testing.T) int {
+	if os.Getuid() != 0 {
+		t.Skip("requires root")
+	}
+	cmd := exec.Command("sleep", "60")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNET}
+	if err := cmd.Start(); err != nil {
+		t.Skip("unable to create a network namespace: " + err.Error())
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	pid := cmd.Process.Pid
+	err := ns.WithProcessNetNS(pid, func() error {
+		lo, err := tenus.NewLinkFrom("lo")
+		if err != nil {
+			return err
+		}
+		return lo.SetLinkUp()
+	})
+	if err != nil {
+		t.Fatalf("unable to bring up the loopback interface: %v", err)
+	}
+	return pid
+}
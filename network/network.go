@@ -26,6 +26,8 @@ const (
 	TYPE_HOST   NetType = "host"
 	TYPE_EMPTY  NetType = "empty"
 	TYPE_BRIDGE NetType = "bridge"
+	// Empty network namespace reaching the network through an egress proxy
+	TYPE_PROXY NetType = "proxy"
 )
 
 type HostNetwork struct {
@@ -0,0 +1,342 @@
+package network
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+const nftFamily = "inet"
+
+// nftFirewall installs an nftables table per sandbox, named after the address
+// of the sandbox, which filters everything the sandbox sends to or through
+// the host and, if needed, what is sent to it. Tables are replaced and
+// removed in a single nft transaction.
+type nftFirewall struct {
+	log       *logging.Logger
+	mtx       sync.Mutex
+	installed map[string]string // script last installed for each table
+}
+
+func nftTableName(src net.IP) string {
+	if ip := src.To4(); ip != nil {
+		return "oz_" + strings.Replace(ip.String(), ".", "_", -1)
+	}
+	return "oz_" + strings.Replace(src.String(), ":", "_", -1)
+}
+
+func (nft *nftFirewall) Install(src, src6 net.IP, pid int, rs *FirewallRuleset) error {
+	script, err := nftScript(src, src6, rs)
+	if err != nil {
+		return err
+	}
+	table := nftTableName(src)
+
+	nft.mtx.Lock()
+	defer nft.mtx.Unlock()
+	if old, ok := nft.installed[table]; ok {
+		if old == script {
+			return nil
+		}
+		nft.log.Infof("Updating nftables table %s for sandbox address %v", table, src)
+	} else {
+		nft.log.Infof("Installing nftables table %s for sandbox address %v", table, src)
+	}
+	if err := runNft(script); err != nil {
+		return err
+	}
+	nft.installed[table] = script
+	return nil
+}
+
+func (nft *nftFirewall) Remove(src net.IP) error {
+	if src == nil {
+		return fmt.Errorf("could not remove firewall rules of a null address")
+	}
+	table := nftTableName(src)
+
+	nft.mtx.Lock()
+	defer nft.mtx.Unlock()
+	nft.log.Infof("Removing nftables table %s", table)
+	delete(nft.installed, table)
+	return runNft(nftDeleteTable(table))
+}
+
+// AddAddresses adds the addresses to the sets of the rule, the rule
+// matches them until they time out or the table is replaced. The table
+// may have been installed by a previous instance of the daemon.
+func (nft *nftFirewall) AddAddresses(src net.IP, rule int, ips []net.IP, ttl time.Duration) error {
+	nft.mtx.Lock()
+	defer nft.mtx.Unlock()
+	script := nftAddElements(nftTableName(src), rule, ips, ttl)
+	if script == "" {
+		return nil
+	}
+	return runNft(script)
+}
+
+// nftSetNames returns the names of the IPv4 and IPv6 sets of the addresses
+// resolved for a rule using a sub-domain wildcard
+func nftSetNames(rule int) (string, string) {
+	return fmt.Sprintf("dns4_%d", rule), fmt.Sprintf("dns6_%d", rule)
+}
+
+func nftAddElements(table string, rule int, ips []net.IP, ttl time.Duration) string {
+	var elems4, elems6 []string
+	timeout := int((ttl + time.Second - 1) / time.Second)
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			elems4 = append(elems4, fmt.Sprintf("%v timeout %ds", ip4, timeout))
+		} else if ip.To16() != nil {
+			elems6 = append(elems6, fmt.Sprintf("%v timeout %ds", ip, timeout))
+		}
+	}
+	set4, set6 := nftSetNames(rule)
+	var b bytes.Buffer
+	for _, s := range []struct {
+		name  string
+		elems []string
+	}{{set4, elems4}, {set6, elems6}} {
+		if len(s.elems) > 0 {
+			fmt.Fprintf(&b, "add element %s %s %s { %s }\n", nftFamily, table, s.name, strings.Join(s.elems, ", "))
+		}
+	}
+	return b.String()
+}
+
+// nftDeleteTable declares the table before deleting it so that deleting
+// a table which does not exist is not an error
+func nftDeleteTable(table string) string {
+	return fmt.Sprintf("table %s %s\ndelete table %s %s\n", nftFamily, table, nftFamily, table)
+}
+
+// nftHook is a base chain sending the traffic of the sandbox to its chains
+type nftHook struct {
+	hook  string
+	jumps []string
+}
+
+// Neighbor discovery is not tracked by conntrack and must always be allowed
+// for IPv6 to work at all
+const nftNeighborDiscovery = "icmpv6 type { nd-router-solicit, nd-router-advert, nd-neighbor-solicit, nd-neighbor-advert } accept"
+
+// nftScript returns the nft script replacing the table of a sandbox, src6
+// is the IPv6 address of the sandbox or nil if it only has an IPv4 address.
+// In each direction blacklisted traffic is dropped first, then whitelisted
+// traffic is accepted and the rest is handled according to the policy.
+// Queries to the DNS forwarder of the sandbox are accepted before anything
+// and DNS to any other resolver is dropped.
+func nftScript(src, src6 net.IP, rs *FirewallRuleset) (string, error) {
+	ip := src.To4()
+	if ip == nil {
+		return "", fmt.Errorf("invalid sandbox address %v", src)
+	}
+	if src6 != nil && src6.To4() != nil {
+		return "", fmt.Errorf("invalid sandbox IPv6 address %v", src6)
+	}
+	table := nftTableName(ip)
+
+	out, err := nftChain(rs, FW_DIRECTION_OUT)
+	if err != nil {
+		return "", err
+	}
+	in, err := nftChain(rs, FW_DIRECTION_IN)
+	if err != nil {
+		return "", err
+	}
+	if dns := rs.DNSServer.To4(); dns != nil {
+		// Other resolvers, over IPv4 or IPv6, would bypass the forwarder and
+		// the DNS filtering of the profile
+		out = append([]string{
+			fmt.Sprintf("ip daddr %v meta l4proto { tcp, udp } th dport 53 accept", dns),
+			"meta nfproto { ipv4, ipv6 } meta l4proto { tcp, udp } th dport { 53, 853 } drop",
+		}, out...)
+	}
+
+	jumpsOut := []string{fmt.Sprintf("ip saddr %v jump out", ip)}
+	jumpsIn := []string{fmt.Sprintf("ip daddr %v jump in", ip)}
+	if src6 != nil {
+		jumpsOut = append(jumpsOut, fmt.Sprintf("ip6 saddr %v jump out", src6))
+		jumpsIn = append(jumpsIn, fmt.Sprintf("ip6 daddr %v jump in", src6))
+		out = append([]string{nftNeighborDiscovery}, out...)
+		if in != nil {
+			in = append([]string{nftNeighborDiscovery}, in...)
+		}
+	}
+	forward := jumpsOut
+	if in != nil {
+		forward = append(append([]string{}, jumpsOut...), jumpsIn...)
+	}
+	hooks := []nftHook{
+		{"forward", forward},
+		{"input", jumpsOut},
+	}
+	if in != nil {
+		hooks = append(hooks, nftHook{"output", jumpsIn})
+	}
+
+	var b bytes.Buffer
+	b.WriteString(nftDeleteTable(table))
+	fmt.Fprintf(&b, "table %s %s {\n", nftFamily, table)
+	for i, r := range rs.Rules {
+		if !r.IsPattern() {
+			continue
+		}
+		set4, set6 := nftSetNames(i)
+		fmt.Fprintf(&b, "\tset %s {\n\t\ttype ipv4_addr; flags timeout;\n\t}\n", set4)
+		fmt.Fprintf(&b, "\tset %s {\n\t\ttype ipv6_addr; flags timeout;\n\t}\n", set6)
+	}
+	for _, h := range hooks {
+		fmt.Fprintf(&b, "\tchain %s {\n", h.hook)
+		fmt.Fprintf(&b, "\t\ttype filter hook %s priority -1; policy accept;\n", h.hook)
+		for _, j := range h.jumps {
+			fmt.Fprintf(&b, "\t\t%s\n", j)
+		}
+		b.WriteString("\t}\n")
+	}
+	nftWriteChain(&b, "out", out)
+	if in != nil {
+		nftWriteChain(&b, "in", in)
+	}
+	b.WriteString("}\n")
+	return b.String(), nil
+}
+
+func nftWriteChain(b *bytes.Buffer, name string, statements []string) {
+	fmt.Fprintf(b, "\tchain %s {\n", name)
+	b.WriteString("\t\tct state established,related accept\n")
+	for _, s := range statements {
+		fmt.Fprintf(b, "\t\t%s\n", s)
+	}
+	b.WriteString("\t}\n")
+}
+
+// nftChain returns the statements filtering one direction,
+// nil if nothing needs to be filtered in this direction
+func nftChain(rs *FirewallRuleset, dir FirewallDirection) ([]string, error) {
+	statements := []string{}
+	whitelist := false
+	for _, pass := range []bool{false, true} {
+		for i, r := range rs.Rules {
+			rdir := r.Direction
+			if rdir == "" {
+				rdir = FW_DIRECTION_OUT
+			}
+			if r.Whitelist != pass || rdir != dir {
+				continue
+			}
+			matches, err := nftMatch(r, i, dir)
+			if err != nil {
+				return nil, err
+			}
+			verdict := "drop"
+			if r.Whitelist {
+				verdict = "accept"
+				whitelist = true
+			}
+			for _, m := range matches {
+				statements = append(statements, m+" "+verdict)
+			}
+		}
+	}
+	if rs.Policy == FW_POLICY_DROP || (rs.Policy == FW_POLICY_DEFAULT && whitelist) {
+		statements = append(statements, "drop")
+	}
+	if len(statements) == 0 && dir == FW_DIRECTION_IN {
+		return nil, nil
+	}
+	return statements, nil
+}
+
+// nftMatch returns the matches of the rule at index i, one for the IPv4 and
+// one for the IPv6 destinations of the rule if it has any of each. Rules
+// using a sub-domain wildcard match the sets filled by the DNS forwarder.
+func nftMatch(r FirewallRule, i int, dir FirewallDirection) ([]string, error) {
+	if err := r.Check(); err != nil {
+		return nil, err
+	}
+	var addrs4, addrs6 string
+	if r.IsPattern() {
+		set4, set6 := nftSetNames(i)
+		addrs4, addrs6 = "@"+set4, "@"+set6
+	} else {
+		nets, err := r.Resolve()
+		if err != nil {
+			return nil, err
+		}
+		var nets4, nets6 []string
+		for _, n := range nets {
+			addr := n.String()
+			if ones, bits := n.Mask.Size(); ones == bits {
+				addr = n.IP.String()
+			}
+			if n.IP.To4() != nil {
+				nets4 = append(nets4, addr)
+			} else {
+				nets6 = append(nets6, addr)
+			}
+		}
+		if len(nets4) > 0 {
+			addrs4 = "{ " + strings.Join(nets4, ", ") + " }"
+		}
+		if len(nets6) > 0 {
+			addrs6 = "{ " + strings.Join(nets6, ", ") + " }"
+		}
+	}
+	field := "daddr"
+	if dir == FW_DIRECTION_IN {
+		field = "saddr"
+	}
+
+	ports := make([]string, len(r.Ports))
+	for i, p := range r.Ports {
+		ports[i] = p.String()
+	}
+	var proto string
+	switch {
+	case r.Proto == FW_PROTO_ANY && len(ports) > 0:
+		proto = " meta l4proto { tcp, udp } th dport { " + strings.Join(ports, ", ") + " }"
+	case r.Proto == FW_PROTO_TCP || r.Proto == FW_PROTO_UDP:
+		if len(ports) > 0 {
+			proto = fmt.Sprintf(" %s dport { %s }", r.Proto, strings.Join(ports, ", "))
+		} else {
+			proto = " meta l4proto " + string(r.Proto)
+		}
+	case r.Proto != FW_PROTO_ANY && r.Proto != FW_PROTO_ICMP:
+		return nil, fmt.Errorf("unknown protocol `%s`", r.Proto)
+	}
+
+	matches := []string{}
+	for _, f := range []struct {
+		family string
+		addrs  string
+		icmp   string
+	}{{"ip", addrs4, "icmp"}, {"ip6", addrs6, "ipv6-icmp"}} {
+		if f.addrs == "" {
+			continue
+		}
+		m := fmt.Sprintf("%s %s %s", f.family, field, f.addrs)
+		if r.Proto == FW_PROTO_ICMP {
+			m += " meta l4proto " + f.icmp
+		} else {
+			m += proto
+		}
+		matches = append(matches, m)
+	}
+	return matches, nil
+}
+
+func runNft(script string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("nft failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
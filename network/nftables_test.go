@@ -0,0 +1,219 @@
+package network
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestNftTableName(t *testing.T) {
+	if name := nftTableName(net.ParseIP("10.0.3.5")); name != "oz_10_0_3_5" {
+		t.Errorf("unexpected table name %s", name)
+	}
+}
+
+func TestParsePortRange(t *testing.T) {
+	for s, expected := range map[string]PortRange{
+		"443":       {443, 443},
+		"8000-8080": {8000, 8080},
+		"53 - 53":   {53, 53},
+	} {
+		pr, err := ParsePortRange(s)
+		if err != nil {
+			t.Errorf("ParsePortRange(%q) failed: %v", s, err)
+		} else if pr != expected {
+			t.Errorf("ParsePortRange(%q) = %v, expected %v", s, pr, expected)
+		}
+	}
+	for _, s := range []string{"", "0", "http", "70000", "8080-8000", "1-", "-1"} {
+		if pr, err := ParsePortRange(s); err == nil {
+			t.Errorf("ParsePortRange(%q) = %v, expected an error", s, pr)
+		}
+	}
+}
+
+func TestNftScript(t *testing.T) {
+	lookupHost = func(host string) ([]net.IP, error) {
+		if host == "example.com" {
+			return []net.IP{net.ParseIP("93.184.216.34"), net.ParseIP("2606:2800:220:1::1")}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+	defer func() { lookupHost = net.LookupIP }()
+
+	src := net.ParseIP("10.0.3.5")
+	src6 := net.ParseIP("fd12:3456:789a:1::5")
+	for _, tt := range []struct {
+		rs      FirewallRuleset
+		src6    net.IP
+		present []string
+		absent  []string
+	}{
+		{
+			rs: FirewallRuleset{Rules: []FirewallRule{{Whitelist: true, Dst: "example.com", Ports: []PortRange{{443, 443}}}}},
+			present: []string{
+				"table inet oz_10_0_3_5\ndelete table inet oz_10_0_3_5\n",
+				"ip saddr 10.0.3.5 jump out",
+				"ip daddr { 93.184.216.34 } meta l4proto { tcp, udp } th dport { 443 } accept\n" +
+					"\t\tip6 daddr { 2606:2800:220:1::1 } meta l4proto { tcp, udp } th dport { 443 } accept\n\t\tdrop\n",
+			},
+			absent: []string{"jump in", "ip6 saddr", "icmpv6"},
+		},
+		{
+			rs: FirewallRuleset{Rules: []FirewallRule{
+				{Whitelist: true, Dst: "10.1.1.1"},
+				{Whitelist: false, Dst: "10.1.1.2", Proto: FW_PROTO_UDP, Ports: []PortRange{{53, 53}, {5353, 5360}}},
+			}},
+			present: []string{"ip daddr { 10.1.1.2 } udp dport { 53, 5353-5360 } drop\n\t\tip daddr { 10.1.1.1 } accept\n"},
+		},
+		{
+			rs:      FirewallRuleset{Rules: []FirewallRule{{Dst: "192.168.0.0/16", Proto: FW_PROTO_TCP}}},
+			present: []string{"ip daddr { 192.168.0.0/16 } meta l4proto tcp drop\n"},
+			absent:  []string{"\t\tdrop\n"},
+		},
+		{
+			rs: FirewallRuleset{Policy: FW_POLICY_DROP, Rules: []FirewallRule{
+				{Whitelist: true, Direction: FW_DIRECTION_IN, Dst: "10.0.0.0/8", Ports: []PortRange{{8080, 8080}}},
+				{Whitelist: true, Dst: "10.1.1.1", Proto: FW_PROTO_ICMP},
+			}},
+			present: []string{
+				"ip daddr 10.0.3.5 jump in",
+				"chain output {\n\t\ttype filter hook output priority -1; policy accept;\n\t\tip daddr 10.0.3.5 jump in\n",
+				"chain out {\n\t\tct state established,related accept\n\t\tip daddr { 10.1.1.1 } meta l4proto icmp accept\n\t\tdrop\n",
+				"chain in {\n\t\tct state established,related accept\n\t\tip saddr { 10.0.0.0/8 } meta l4proto { tcp, udp } th dport { 8080 } accept\n\t\tdrop\n",
+			},
+		},
+		{
+			rs:     FirewallRuleset{Policy: FW_POLICY_ACCEPT, Rules: []FirewallRule{{Whitelist: true, Dst: "10.1.1.1"}}},
+			absent: []string{"\t\tdrop\n", "jump in"},
+		},
+		{
+			rs: FirewallRuleset{Rules: []FirewallRule{
+				{Whitelist: true, Dst: "2001:db8::/32", Proto: FW_PROTO_ICMP},
+				{Whitelist: true, Direction: FW_DIRECTION_IN, Dst: "fd00::1", Proto: FW_PROTO_TCP, Ports: []PortRange{{22, 22}}},
+			}},
+			src6: src6,
+			present: []string{
+				"chain forward {\n\t\ttype filter hook forward priority -1; policy accept;\n" +
+					"\t\tip saddr 10.0.3.5 jump out\n\t\tip6 saddr fd12:3456:789a:1::5 jump out\n" +
+					"\t\tip daddr 10.0.3.5 jump in\n\t\tip6 daddr fd12:3456:789a:1::5 jump in\n",
+				"chain input {\n\t\ttype filter hook input priority -1; policy accept;\n" +
+					"\t\tip saddr 10.0.3.5 jump out\n\t\tip6 saddr fd12:3456:789a:1::5 jump out\n\t}\n",
+				"chain out {\n\t\tct state established,related accept\n\t\t" + nftNeighborDiscovery + "\n" +
+					"\t\tip6 daddr { 2001:db8::/32 } meta l4proto ipv6-icmp accept\n\t\tdrop\n",
+				"chain in {\n\t\tct state established,related accept\n\t\t" + nftNeighborDiscovery + "\n" +
+					"\t\tip6 saddr { fd00::1 } tcp dport { 22 } accept\n\t\tdrop\n",
+			},
+			absent: []string{"ip daddr {", "ip saddr {"},
+		},
+		{
+			rs: FirewallRuleset{DNSServer: net.ParseIP("10.0.3.1"), Rules: []FirewallRule{
+				{Whitelist: true, Dst: "10.1.1.1"},
+				{Whitelist: true, Dst: "*.mozilla.org", Ports: []PortRange{{443, 443}}},
+			}},
+			present: []string{
+				"	set dns4_1 {\n\t\ttype ipv4_addr; flags timeout;\n\t}\n\tset dns6_1 {\n\t\ttype ipv6_addr; flags timeout;\n\t}\n",
+				"chain out {\n\t\tct state established,related accept\n" +
+					"\t\tip daddr 10.0.3.1 meta l4proto { tcp, udp } th dport 53 accept\n" +
+					"\t\tmeta nfproto { ipv4, ipv6 } meta l4proto { tcp, udp } th dport { 53, 853 } drop\n" +
+					"\t\tip daddr { 10.1.1.1 } accept\n" +
+					"\t\tip daddr @dns4_1 meta l4proto { tcp, udp } th dport { 443 } accept\n" +
+					"\t\tip6 daddr @dns6_1 meta l4proto { tcp, udp } th dport { 443 } accept\n\t\tdrop\n",
+			},
+			absent: []string{"dns4_0"},
+		},
+		{
+			// Whitelisting another resolver does not bypass the forwarder
+			rs: FirewallRuleset{DNSServer: net.ParseIP("10.0.3.1"), Policy: FW_POLICY_ACCEPT, Rules: []FirewallRule{
+				{Whitelist: true, Dst: "8.8.8.8", Ports: []PortRange{{53, 53}}},
+			}},
+			src6: src6,
+			present: []string{
+				"chain out {\n\t\tct state established,related accept\n" +
+					"\t\t" + nftNeighborDiscovery + "\n" +
+					"\t\tip daddr 10.0.3.1 meta l4proto { tcp, udp } th dport 53 accept\n" +
+					"\t\tmeta nfproto { ipv4, ipv6 } meta l4proto { tcp, udp } th dport { 53, 853 } drop\n" +
+					"\t\tip daddr { 8.8.8.8 } meta l4proto { tcp, udp } th dport { 53 } accept\n\t}\n",
+			},
+		},
+	} {
+		script, err := nftScript(src, tt.src6, &tt.rs)
+		if err != nil {
+			t.Errorf("nftScript(%v) failed: %v", tt.rs, err)
+			continue
+		}
+		for _, s := range tt.present {
+			if !strings.Contains(script, s) {
+				t.Errorf("nftScript(%v) does not contain %q:\n%s", tt.rs, s, script)
+			}
+		}
+		for _, s := range tt.absent {
+			if strings.Contains(script, s) {
+				t.Errorf("nftScript(%v) contains %q:\n%s", tt.rs, s, script)
+			}
+		}
+	}
+
+	for _, rules := range [][]FirewallRule{
+		{{Dst: "unknown.example"}},
+		{{Dst: ""}},
+		{{Dst: "10.1.1.1", Proto: FW_PROTO_ICMP, Ports: []PortRange{{80, 80}}}},
+		{{Dst: "www.*.org"}},
+	} {
+		if _, err := nftScript(src, nil, &FirewallRuleset{Rules: rules}); err == nil {
+			t.Errorf("nftScript(%v) did not fail", rules)
+		}
+	}
+	if _, err := nftScript(src, src, &FirewallRuleset{}); err == nil {
+		t.Errorf("nftScript() did not fail with an IPv4 address as IPv6 address")
+	}
+}
+
+func TestKillSwitchScript(t *testing.T) {
+	src := net.ParseIP("10.0.3.5")
+	script, err := killSwitchScript(src, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "table inet ozvpn_10_0_3_5\ndelete table inet ozvpn_10_0_3_5\n" +
+		"table inet ozvpn_10_0_3_5 {\n\tchain forward {\n" +
+		"\t\ttype filter hook forward priority -2; policy accept;\n" +
+		"\t\tip saddr 10.0.3.5 drop\n\t}\n" +
+		"\tchain input {\n" +
+		"\t\ttype filter hook input priority -2; policy accept;\n" +
+		"\t\tct state established,related accept\n" +
+		"\t\tip saddr 10.0.3.5 udp dport 67 accept\n" +
+		"\t\tip saddr 10.0.3.5 drop\n\t}\n}\n"
+	if script != expected {
+		t.Errorf("kill-switch script without a tunnel:\n%s\nexpected:\n%s", script, expected)
+	}
+
+	script, err = killSwitchScript(src, net.ParseIP("fd12:3456:789a:1::5"), "tun0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rule := range []string{
+		"ip saddr 10.0.3.5 oifname != \"tun0\" drop\n",
+		"ip6 saddr fd12:3456:789a:1::5 oifname != \"tun0\" drop\n",
+	} {
+		if !strings.Contains(script, rule) {
+			t.Errorf("kill-switch script missing %q:\n%s", rule, script)
+		}
+	}
+	// Once the tunnel is up the host is left to the firewall rules
+	if strings.Contains(script, "chain input") {
+		t.Errorf("kill-switch script with a tunnel filters the input hook:\n%s", script)
+	}
+	script, err = killSwitchScript(src, net.ParseIP("fd12:3456:789a:1::5"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(script, "\t\t"+nftNeighborDiscovery+"\n\t\tip6 saddr fd12:3456:789a:1::5 drop\n\t}\n}\n") {
+		t.Errorf("kill-switch script without a tunnel does not drop IPv6 to the host:\n%s", script)
+	}
+
+	if _, err := killSwitchScript(net.ParseIP("fd12::5"), nil, ""); err == nil {
+		t.Errorf("expected an error for an IPv6 sandbox address")
+	}
+}
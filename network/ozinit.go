@@ -2,9 +2,15 @@ package network
 
 import (
 	//Builtin
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"os"
+	"strings"
 
 	// Internal
 	//"github.com/op/go-logging"
@@ -43,3 +49,36 @@ func setupLoopback() error {
 
 	return nil
 }
+
+// DefaultGateway returns the IPv4 default gateway of the sandbox, read from
+// the routing table of its network namespace
+func DefaultGateway() (net.IP, error) {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseDefaultGateway(f)
+}
+
+func parseDefaultGateway(r io.Reader) (net.IP, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// Iface Destination Gateway Flags ..., addresses in host byte order
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		b, err := hex.DecodeString(fields[2])
+		if err != nil || len(b) != net.IPv4len {
+			continue
+		}
+		ip := make(net.IP, net.IPv4len)
+		binary.LittleEndian.PutUint32(ip, binary.BigEndian.Uint32(b))
+		return ip, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, errors.New("no default route")
+}
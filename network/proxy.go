@@ -1,13 +1,16 @@
 package network
 
 import (
+	"errors"
 	"fmt"
-	"io"
 	"net"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/subgraph/oz/ns"
 
@@ -37,7 +40,7 @@ type ProxyConfig struct {
 	// One of client, server
 	Nettype ProxyType `json:"type"`
 
-	// One of tcp, udp, socket
+	// One of tcp, udp, unix, unixgram, unixpacket, tcp2unix
 	Proto ProtoType
 
 	// TCP or UDP port number
@@ -51,9 +54,21 @@ type ProxyConfig struct {
 	// For unix sockets this is an abstract path
 	// If left empty, localhost is used
 	Destination string
+
+	// Optional: maximum number of connections open at the same time,
+	// further connections wait in the listen backlog (default 256)
+	MaxConns uint `json:"max_conns"`
+
+	// Optional: seconds without traffic in either direction after which
+	// a connection is closed, connections are kept open if left empty
+	IdleTimeout uint `json:"idle_timeout"`
 }
 
-var wgProxy sync.WaitGroup
+const defaultProxyMaxConns = 256
+
+// Pause after a failed accept, so that running out of descriptors does not
+// turn into a busy loop
+const proxyAcceptBackoff = 50 * time.Millisecond
 
 type PConnInfo struct {
 	Saddr net.IP
@@ -62,14 +77,62 @@ type PConnInfo struct {
 	Dport uint16
 }
 
+// ProxyPair is a connection open through a proxy, In is its sandbox side
+// and Out its host side
 type ProxyPair struct {
 	In  *PConnInfo
 	Out *PConnInfo
-	Cnt int
+	// Init process of the sandbox the connection belongs to
+	Pid int
+	// Bytes sent by the sandbox and received by it, updated atomically
+	Sent     uint64
+	Received uint64
+}
+
+// sandboxProxy is a stream or datagram proxy of a sandbox
+type sandboxProxy interface {
+	shutdown(grace time.Duration)
+}
+
+// proxy forwards the connections accepted on its listener to those opened
+// by dial for them, with at most cap(slots) of them open at the same time
+type proxy struct {
+	pid    int
+	desc   string
+	listen net.Listener
+	dial   func(in net.Conn) (net.Conn, error)
+	// The accepted connections are on the sandbox side, as in client mode
+	inSandbox bool
+	idle      time.Duration
+	slots     chan struct{}
+	done      chan struct{}
+	// Set under proxyLock once the remaining connections are being closed
+	killed bool
+	conns  sync.WaitGroup
+	log    *logging.Logger
+}
+
+// proxyConn is a connection open through a proxy, or a datagram session
+// without proxy nor out connection
+type proxyConn struct {
+	pair  ProxyPair
+	seq   uint64
+	proxy *proxy
+	in    net.Conn
+	out   net.Conn
+	// Time of the last transfer in either direction, in unix nanoseconds
+	active    int64
+	closeOnce sync.Once
 }
 
-var ProxyPairs []*ProxyPair
-var PairLock = &sync.Mutex{}
+var (
+	proxyLock sync.Mutex
+	// Open connections keyed by their accepted end
+	proxyConns = make(map[net.Conn]*proxyConn)
+	// Running proxies keyed by the init process of their sandbox
+	proxies  = make(map[int][]sandboxProxy)
+	proxySeq uint64
+)
 
 func connToPConn(c net.Conn, swap bool) *PConnInfo {
 	rstr := c.LocalAddr().String()
@@ -102,13 +165,28 @@ func connToPConn(c net.Conn, swap bool) *PConnInfo {
 	return nil
 }
 
+// listedProxyConns returns the open connections with known addresses in the
+// order they were opened, matching the given filter. Must be called with
+// proxyLock held.
+func listedProxyConns(match func(*proxyConn) bool) []*proxyConn {
+	result := []*proxyConn{}
+	for _, pc := range proxyConns {
+		if pc.pair.In != nil && pc.pair.Out != nil && match(pc) {
+			result = append(result, pc)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].seq < result[j].seq })
+	return result
+}
+
 func GetProxyPairInfo() []string {
-	PairLock.Lock()
-	defer PairLock.Unlock()
+	proxyLock.Lock()
+	defer proxyLock.Unlock()
 
 	result := make([]string, 0)
 
-	for _, pair := range ProxyPairs {
+	for _, pc := range listedProxyConns(func(*proxyConn) bool { return true }) {
+		pair := &pc.pair
 		rstr := fmt.Sprintf("%v:%d -> %v:%d, %v:%d -> %v:%d", pair.In.Saddr, pair.In.Sport, pair.In.Daddr, pair.In.Dport,
 			pair.Out.Saddr, pair.Out.Sport, pair.Out.Daddr, pair.Out.Dport)
 		result = append(result, rstr)
@@ -117,66 +195,37 @@ func GetProxyPairInfo() []string {
 	return result
 }
 
-func addProxyPair(in net.Conn, out net.Conn, swap bool) bool {
-	PairLock.Lock()
-	defer PairLock.Unlock()
-	pin := connToPConn(in, false)
-	pout := connToPConn(out, swap)
-
-	if pin == nil || pout == nil {
-		return false
-	}
-
-	ProxyPairs = append(ProxyPairs, &ProxyPair{In: pin, Out: pout, Cnt: 2})
-	return true
-}
-
-func pConnEqual(pair1, pair2 *PConnInfo, loose bool) bool {
-	if loose && (pair1.Saddr.Equal(pair2.Daddr) && pair1.Sport == pair2.Dport && pair1.Daddr.Equal(pair2.Saddr) && pair1.Dport == pair2.Sport) {
-		return true
-	}
-
-	return pair1.Saddr.Equal(pair2.Saddr) && pair1.Sport == pair2.Sport && pair1.Daddr.Equal(pair2.Daddr) && pair1.Dport == pair2.Dport
-}
-
-func removeProxyPair(in net.Conn, out net.Conn) bool {
-	PairLock.Lock()
-	defer PairLock.Unlock()
-
-	pin := connToPConn(in, false)
-	pout := connToPConn(out, false)
-
-	if pin == nil || pout == nil {
-		return false
-	}
-
-	for i, pair := range ProxyPairs {
-		if pConnEqual(pair.In, pin, false) && pConnEqual(pair.Out, pout, true) {
-			pair.Cnt--
-
-			if pair.Cnt <= 0 {
-				ProxyPairs = append(ProxyPairs[:i], ProxyPairs[i+1:]...)
-			}
-
-			return true
-		}
+// SandboxProxyPairs returns a snapshot of the connections currently open
+// through the proxies of the sandbox with the given init process
+func SandboxProxyPairs(pid int) []ProxyPair {
+	proxyLock.Lock()
+	defer proxyLock.Unlock()
+
+	result := []ProxyPair{}
+	for _, pc := range listedProxyConns(func(pc *proxyConn) bool { return pc.pair.Pid == pid }) {
+		result = append(result, ProxyPair{
+			In:       pc.pair.In,
+			Out:      pc.pair.Out,
+			Pid:      pc.pair.Pid,
+			Sent:     atomic.LoadUint64(&pc.pair.Sent),
+			Received: atomic.LoadUint64(&pc.pair.Received),
+		})
 	}
-
-	return false
+	return result
 }
 
-func ProxySetup(childPid int, ozSockets []ProxyConfig, log *logging.Logger, ready sync.WaitGroup) error {
+func ProxySetup(childPid int, ozSockets []ProxyConfig, log *logging.Logger) error {
 	for _, socket := range ozSockets {
 		if socket.Nettype == "" {
 			continue
 		}
 		if socket.Nettype == PROXY_CLIENT {
-			err := newProxyClient(childPid, &socket, log, ready)
+			err := newProxyClient(childPid, &socket, log)
 			if err != nil {
 				return fmt.Errorf("%+v, %s", socket, err)
 			}
 		} else if socket.Nettype == PROXY_SERVER {
-			err := newProxyServer(childPid, &socket, log, ready)
+			err := newProxyServer(childPid, &socket, log)
 			if err != nil {
 				return fmt.Errorf("%+s, %s", socket, err)
 			}
@@ -186,44 +235,207 @@ func ProxySetup(childPid int, ozSockets []ProxyConfig, log *logging.Logger, read
 	return nil
 }
 
-/**
- * Listener/Client
-**/
-func proxyClientConn(conn *net.Conn, proto ProtoType, rAddr string, ready sync.WaitGroup) error {
-	rConn, err := net.Dial(string(proto), rAddr)
+// ProxyShutdown stops the proxies of the sandbox with the given init
+// process: they stop accepting connections at once, and those still open
+// after grace are closed. It returns once all of them are closed.
+func ProxyShutdown(pid int, grace time.Duration) {
+	proxyLock.Lock()
+	ps := proxies[pid]
+	delete(proxies, pid)
+	proxyLock.Unlock()
+
+	var wg sync.WaitGroup
+	for _, p := range ps {
+		wg.Add(1)
+		go func(p sandboxProxy) {
+			defer wg.Done()
+			p.shutdown(grace)
+		}(p)
+	}
+	wg.Wait()
+}
+
+// startProxy registers a proxy for the sandbox and starts accepting
+// connections on its listener
+func startProxy(pid int, config *ProxyConfig, desc string, listen net.Listener, dial func(in net.Conn) (net.Conn, error), inSandbox bool, log *logging.Logger) *proxy {
+	max := config.MaxConns
+	if max == 0 {
+		max = defaultProxyMaxConns
+	}
+	p := &proxy{
+		pid:       pid,
+		desc:      desc,
+		listen:    listen,
+		dial:      dial,
+		inSandbox: inSandbox,
+		idle:      time.Duration(config.IdleTimeout) * time.Second,
+		slots:     make(chan struct{}, max),
+		done:      make(chan struct{}),
+		log:       log,
+	}
+	proxyLock.Lock()
+	proxies[pid] = append(proxies[pid], p)
+	proxyLock.Unlock()
+
+	go p.serve()
+	return p
+}
+
+func (p *proxy) serve() {
+	for {
+		select {
+		case p.slots <- struct{}{}:
+		default:
+			p.log.Warning("%s: %d connections open, waiting for one to close.", p.desc, cap(p.slots))
+			select {
+			case p.slots <- struct{}{}:
+			case <-p.done:
+				return
+			}
+		}
+		conn, err := p.listen.Accept()
+		if err != nil {
+			<-p.slots
+			select {
+			case <-p.done:
+				return
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			p.log.Error("Socket: %+v.", err)
+			time.Sleep(proxyAcceptBackoff)
+			continue
+		}
+		p.conns.Add(1)
+		go p.handle(conn)
+	}
+}
+
+func (p *proxy) handle(conn net.Conn) {
+	defer func() {
+		<-p.slots
+		p.conns.Done()
+	}()
+
+	out, err := p.dial(conn)
 	if err != nil {
-		return fmt.Errorf("Socket: %+v.\n", err)
+		p.log.Warning("%s: %v.", p.desc, err)
+		conn.Close()
+		return
 	}
+	pc := p.track(conn, out)
+	defer p.untrack(conn)
 
-	var wg sync.WaitGroup
-	wg.Add(2)
+	sandbox, host := conn, out
+	if !p.inSandbox {
+		sandbox, host = out, conn
+	}
+	sent := make(chan struct{})
+	go func() {
+		pc.pipe(host, sandbox, &pc.pair.Sent)
+		close(sent)
+	}()
+	pc.pipe(sandbox, host, &pc.pair.Received)
+	<-sent
+	pc.close()
+}
+
+func (p *proxy) track(in, out net.Conn) *proxyConn {
+	pc := &proxyConn{
+		proxy:  p,
+		in:     in,
+		out:    out,
+		active: time.Now().UnixNano(),
+	}
+	pc.pair.Pid = p.pid
+	if p.inSandbox {
+		pc.pair.In, pc.pair.Out = connToPConn(in, false), connToPConn(out, true)
+	} else {
+		pc.pair.In, pc.pair.Out = connToPConn(out, true), connToPConn(in, false)
+	}
 
-	copyLoop := func(dst, src net.Conn) {
-		defer wg.Done()
-		defer dst.Close()
-		defer src.Close()
-		defer removeProxyPair(*conn, rConn)
-		io.Copy(dst, src)
+	proxyLock.Lock()
+	defer proxyLock.Unlock()
+	proxySeq++
+	pc.seq = proxySeq
+	proxyConns[in] = pc
+	if p.killed {
+		pc.close()
 	}
+	return pc
+}
 
-	//	fmt.Println("XXX: attempting to add proxy client pair...")
-	if !addProxyPair(*conn, rConn, true) {
-		fmt.Println("Could not add new proxy client pair to table.")
+func (p *proxy) untrack(in net.Conn) {
+	proxyLock.Lock()
+	delete(proxyConns, in)
+	proxyLock.Unlock()
+}
+
+func (p *proxy) shutdown(grace time.Duration) {
+	close(p.done)
+	p.listen.Close()
+
+	finished := make(chan struct{})
+	go func() {
+		p.conns.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return
+	case <-time.After(grace):
 	}
 
-	go copyLoop(*conn, rConn)
-	go copyLoop(rConn, *conn)
+	proxyLock.Lock()
+	p.killed = true
+	n := 0
+	for _, pc := range proxyConns {
+		if pc.proxy == p {
+			pc.close()
+			n++
+		}
+	}
+	proxyLock.Unlock()
+	p.log.Info("%s: closed %d connections still open after %v.", p.desc, n, grace)
+	<-finished
+}
 
-	return nil
+// pipe copies one direction of the connection. Once the source is done the
+// destination is half closed so that the other direction can still finish,
+// on errors both ends are closed.
+func (pc *proxyConn) pipe(dst, src net.Conn, count *uint64) {
+	err := proxyCopy(dst, src, count, pc.proxy.idle, &pc.active)
+	if err == errProxyIdle {
+		pc.proxy.log.Info("%s: closing connection idle for %v.", pc.proxy.desc, pc.proxy.idle)
+	}
+	if cw, ok := dst.(closeWriter); ok && err == nil {
+		cw.CloseWrite()
+		return
+	}
+	pc.close()
+}
+
+func (pc *proxyConn) close() {
+	pc.closeOnce.Do(func() {
+		pc.in.Close()
+		if pc.out != nil {
+			pc.out.Close()
+		}
+	})
 }
 
-func newProxyClient(pid int, config *ProxyConfig, log *logging.Logger, ready sync.WaitGroup) error {
+/**
+ * Listener/Client
+**/
+func newProxyClient(pid int, config *ProxyConfig, log *logging.Logger) error {
 	if config.Destination == "" {
 		config.Destination = "127.0.0.1"
 	}
 
 	var lAddr, rAddr, dport string
-	if strings.HasPrefix(string(config.Proto), "tcp") && config.Proto != PROTO_TCP_TO_UNIX {
+	if (strings.HasPrefix(string(config.Proto), "tcp") && config.Proto != PROTO_TCP_TO_UNIX) || config.Proto == PROTO_UDP {
 		if config.DPort != 0 {
 			dport = strconv.Itoa(config.DPort)
 		} else {
@@ -246,60 +458,40 @@ func newProxyClient(pid int, config *ProxyConfig, log *logging.Logger, ready syn
 		return nil
 	}
 
-	var listenProto ProtoType
+	var listenProto, dialProto ProtoType
 	if config.Proto == PROTO_TCP_TO_UNIX {
 		listenProto = PROTO_TCP
+		dialProto = PROTO_UNIX
 		log.Info("Starting socket client forwarding: %s://%s -> unix://%s.", listenProto, lAddr, config.Destination)
 	} else {
 		listenProto = config.Proto
+		dialProto = config.Proto
 		log.Info("Starting socket client forwarding: %s://%s.", listenProto, rAddr)
 	}
+	desc := fmt.Sprintf("client proxy %s://%s of sandbox %d", listenProto, lAddr, pid)
+
+	if isDatagram(config.Proto) {
+		conn, err := proxyPacketListener(pid, config.Proto, lAddr)
+		if err != nil {
+			return err
+		}
+		proto := config.Proto
+		dial := func() (net.Conn, error) {
+			return dialDatagram(proto, rAddr)
+		}
+		startDgramProxy(pid, config, desc, conn, dial, true, log)
+		return nil
+	}
+
 	listen, err := proxySocketListener(pid, listenProto, lAddr)
 	if err != nil {
 		return err
 	}
 
-	wgProxy.Add(1)
-	c := *config
-
-	go func() {
-		defer wgProxy.Done()
-		for {
-			conn, err := listen.Accept()
-			if err != nil {
-				log.Error("Socket: %+v.", err)
-				//panic(err)
-				continue
-			}
-			/*
-				if err = conn.SetDeadline(time.Now().Add(50*time.Second)); err != nil {
-					log.Error("conn: %+v", err)
-					continue
-				}
-				defer func() {
-					// Disarm the handshake timeout, only propagate the error if
-					// the handshake was successful.
-					nerr := conn.SetDeadline(time.Time{})
-					if err == nil {
-						err = nerr
-					}
-				}()
-			*/
-			/*	req := new(Request)
-				req.conn = conn
-			*/
-
-			var dialProto ProtoType
-			if c.Proto == PROTO_TCP_TO_UNIX {
-				dialProto = PROTO_UNIX
-			} else {
-				dialProto = c.Proto
-			}
-
-			go proxyClientConn(&conn, dialProto, rAddr, ready)
-		}
-	}()
-
+	dial := func(net.Conn) (net.Conn, error) {
+		return net.Dial(string(dialProto), rAddr)
+	}
+	startProxy(pid, config, desc, listen, dial, true, log)
 	return nil
 }
 
@@ -330,35 +522,7 @@ func nsSocketListener(fd uintptr, proto ProtoType, lAddr string) (net.Listener,
 /**
  * Connect/Server
 **/
-func proxyServerConn(pid int, conn *net.Conn, proto ProtoType, rAddr string, log *logging.Logger, ready sync.WaitGroup) error {
-	rConn, err := socketConnect(pid, proto, rAddr)
-	if err != nil {
-		log.Error("Socket: %+v.", err)
-		return err
-	}
-
-	var wg sync.WaitGroup
-	wg.Add(2)
-
-	copyLoop := func(dst, src net.Conn) {
-		defer wg.Done()
-		defer dst.Close()
-		defer src.Close()
-		io.Copy(dst, src)
-	}
-
-	//	log.Error("XXX: attempting to add proxy server pair...")
-	/*	if !addProxyPair(*conn, rConn, false) {
-		log.Error("Could not add new proxy server pair to table.")
-	} */
-
-	go copyLoop(*conn, rConn)
-	go copyLoop(rConn, *conn)
-
-	return nil
-}
-
-func newProxyServer(pid int, config *ProxyConfig, log *logging.Logger, ready sync.WaitGroup) error {
+func newProxyServer(pid int, config *ProxyConfig, log *logging.Logger) error {
 	if config.Destination == "" {
 		config.Destination = "127.0.0.1"
 	}
@@ -377,27 +541,37 @@ func newProxyServer(pid int, config *ProxyConfig, log *logging.Logger, ready syn
 	}
 
 	log.Info("Starting socket server forwarding: %s://%s.", config.Proto, lAddr)
+	desc := fmt.Sprintf("server proxy %s://%s of sandbox %d", config.Proto, lAddr, pid)
+	proto := config.Proto
+
+	if isDatagram(proto) {
+		conn, err := net.ListenPacket(string(proto), lAddr)
+		if err != nil {
+			return err
+		}
+		dial := func() (c net.Conn, err error) {
+			nerr := ns.WithProcessNetNS(pid, func() error {
+				c, err = dialDatagram(proto, rAddr)
+				return nil
+			})
+			if nerr != nil {
+				return nil, nerr
+			}
+			return c, err
+		}
+		startDgramProxy(pid, config, desc, conn, dial, false, log)
+		return nil
+	}
 
 	listen, err := net.Listen(string(config.Proto), lAddr)
 	if err != nil {
 		return err
 	}
 
-	wgProxy.Add(1)
-	go func() {
-		defer wgProxy.Done()
-		for {
-			conn, err := listen.Accept()
-			if err != nil {
-				log.Error("Socket: %+v.", err)
-				//panic(err)
-				continue
-			}
-
-			go proxyServerConn(pid, &conn, config.Proto, rAddr, log, ready)
-		}
-	}()
-
+	dial := func(net.Conn) (net.Conn, error) {
+		return socketConnect(pid, proto, rAddr)
+	}
+	startProxy(pid, config, desc, listen, dial, false, log)
 	return nil
 }
 
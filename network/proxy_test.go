@@ -0,0 +1,246 @@
+package network
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+// testBackend accepts connections on a local port and hands them to serve
+func testBackend(t testing.TB, serve func(net.Conn)) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serve(c)
+		}
+	}()
+	return l
+}
+
+func echo(c net.Conn) {
+	io.Copy(c, c)
+	c.Close()
+}
+
+// testProxy starts a client mode proxy of the given fake sandbox to addr
+func testProxy(t testing.TB, pid int, config ProxyConfig, addr string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dial := func(net.Conn) (net.Conn, error) { return net.Dial("tcp", addr) }
+	startProxy(pid, &config, "test proxy", l, dial, true, logging.MustGetLogger("oz-test"))
+	return l.Addr().String()
+}
+
+func TestProxyForward(t *testing.T) {
+	backend := testBackend(t, func(c net.Conn) {
+		// Half closed by the proxy once the client is done sending
+		data, _ := ioutil.ReadAll(c)
+		c.Write(bytes.ToUpper(data))
+		c.Close()
+	})
+	defer backend.Close()
+	addr := testProxy(t, 4001, ProxyConfig{}, backend.Addr().String())
+	defer ProxyShutdown(4001, time.Second)
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("hello"))
+	time.Sleep(50 * time.Millisecond)
+	pairs := SandboxProxyPairs(4001)
+	if len(pairs) != 1 || pairs[0].Sent != 5 || pairs[0].In.Dport != uint16(c.RemoteAddr().(*net.TCPAddr).Port) {
+		t.Fatalf("SandboxProxyPairs() = %+v, expected the open connection", pairs)
+	}
+
+	c.(*net.TCPConn).CloseWrite()
+	reply, err := ioutil.ReadAll(c)
+	if err != nil || string(reply) != "HELLO" {
+		t.Fatalf("got %q (%v), expected HELLO", reply, err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if pairs := SandboxProxyPairs(4001); len(pairs) != 0 {
+		t.Errorf("SandboxProxyPairs() = %+v after close, expected none", pairs)
+	}
+}
+
+func TestProxyMaxConns(t *testing.T) {
+	accepted := make(chan net.Conn, 2)
+	backend := testBackend(t, func(c net.Conn) { accepted <- c })
+	defer backend.Close()
+	addr := testProxy(t, 4002, ProxyConfig{MaxConns: 1}, backend.Addr().String())
+	defer ProxyShutdown(4002, time.Second)
+
+	c1, _ := net.Dial("tcp", addr)
+	defer c1.Close()
+	b1 := <-accepted
+	c2, _ := net.Dial("tcp", addr)
+	defer c2.Close()
+	select {
+	case <-accepted:
+		t.Fatal("a second connection was forwarded over the limit")
+	case <-time.After(100 * time.Millisecond):
+	}
+	// The connection is kept until both ends are closed
+	b1.Close()
+	c1.Close()
+	select {
+	case b2 := <-accepted:
+		b2.Close()
+	case <-time.After(time.Second):
+		t.Fatal("the waiting connection was not forwarded once the first one closed")
+	}
+}
+
+func TestProxyIdleTimeout(t *testing.T) {
+	backend := testBackend(t, echo)
+	defer backend.Close()
+	addr := testProxy(t, 4003, ProxyConfig{IdleTimeout: 1}, backend.Addr().String())
+	defer ProxyShutdown(4003, time.Second)
+
+	active, _ := net.Dial("tcp", addr)
+	defer active.Close()
+	idle, _ := net.Dial("tcp", addr)
+	defer idle.Close()
+
+	// Traffic in one direction keeps the connection open
+	buf := make([]byte, 1)
+	for i := 0; i < 8; i++ {
+		active.Write([]byte{byte(i)})
+		active.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := active.Read(buf); err != nil {
+			t.Fatalf("active connection closed after %d writes: %v", i, err)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	idle.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := idle.Read(buf); err != io.EOF {
+		t.Errorf("idle connection not closed: %v", err)
+	}
+}
+
+func TestProxyShutdown(t *testing.T) {
+	backend := testBackend(t, echo)
+	defer backend.Close()
+	addr := testProxy(t, 4004, ProxyConfig{}, backend.Addr().String())
+
+	c, _ := net.Dial("tcp", addr)
+	defer c.Close()
+	c.Write([]byte("x"))
+	c.Read(make([]byte, 1))
+
+	start := time.Now()
+	ProxyShutdown(4004, 100*time.Millisecond)
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("ProxyShutdown() took %v", d)
+	}
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("connection not closed by shutdown: %v", err)
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Errorf("proxy still accepting connections after shutdown")
+	}
+}
+
+func TestBufferCopyKeepsMessages(t *testing.T) {
+	addr := "@oz-test-" + strconv.Itoa(time.Now().Nanosecond())
+	l, err := net.Listen("unixpacket", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	src, _ := net.Dial("unixpacket", addr)
+	peer, _ := l.Accept()
+	if canSplice(src) {
+		t.Fatalf("canSplice() of a unixpacket socket")
+	}
+
+	var dst bytes.Buffer
+	var n uint64
+	var active int64
+	src.Write([]byte("one"))
+	src.Write([]byte("two"))
+	src.Close()
+	if err := bufferCopy(&dst, peer, &n, &active); err != nil || dst.String() != "onetwo" || n != 6 {
+		t.Errorf("bufferCopy() = %v, copied %q (%d)", err, dst.String(), n)
+	}
+}
+
+// benchCopy measures proxyCopy between two loopback connections
+func benchCopy(b *testing.B, splice bool) {
+	backend := testBackend(b, func(c net.Conn) {
+		io.Copy(ioutil.Discard, c)
+		c.Close()
+	})
+	defer backend.Close()
+	out, _ := net.Dial("tcp", backend.Addr().String())
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer l.Close()
+	in, _ := net.Dial("tcp", l.Addr().String())
+	peer, _ := l.Accept()
+
+	var n uint64
+	var active int64
+	done := make(chan error)
+	go func() {
+		if splice {
+			done <- proxyCopy(out, peer, &n, 0, &active)
+		} else {
+			done <- bufferCopy(out, peer, &n, &active)
+		}
+	}()
+	buf := make([]byte, 128*1024)
+	b.SetBytes(int64(len(buf)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		in.Write(buf)
+	}
+	in.Close()
+	<-done
+	out.Close()
+}
+
+func BenchmarkProxyCopySplice(b *testing.B) { benchCopy(b, true) }
+
+func BenchmarkProxyCopyBuffer(b *testing.B) { benchCopy(b, false) }
+
+// BenchmarkProxyConnections measures opening short connections through a
+// proxy, many of them open at the same time
+func BenchmarkProxyConnections(b *testing.B) {
+	backend := testBackend(b, echo)
+	defer backend.Close()
+	addr := testProxy(b, 4005, ProxyConfig{MaxConns: 1024}, backend.Addr().String())
+	defer ProxyShutdown(4005, time.Second)
+
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		buf := make([]byte, 64)
+		for pb.Next() {
+			c, err := net.Dial("tcp", addr)
+			if err != nil {
+				b.Fatal(err)
+			}
+			c.Write(buf)
+			io.ReadFull(c, buf)
+			c.Close()
+		}
+	})
+}
@@ -83,6 +83,20 @@ func (ipr *IPRange) scanIP() net.IP {
 	return nil
 }
 
+// Claim marks ip as in use so that it is never handed out by FreshIP,
+// it returns false if ip is not a usable address of the range
+func (ipr *IPRange) Claim(ip net.IP) bool {
+	if ip.To4() == nil || !ipr.Contains(ip) {
+		return false
+	}
+	offset := int(toUint32(ip)) - int(ipr.first)
+	if offset < 0 || offset >= ipr.size {
+		return false
+	}
+	ipr.inUse[offset] = true
+	return true
+}
+
 func networkSize(mask net.IPMask) int {
 	bits, _ := mask.Size()
 	switch bits {
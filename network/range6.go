@@ -0,0 +1,177 @@
+package network
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	mrand "math/rand"
+	"net"
+
+	"github.com/op/go-logging"
+)
+
+type IPv6Mode string
+
+const (
+	// Sandboxes only get IPv4 addresses
+	IPV6_NONE IPv6Mode = "none"
+	// Bridges get a /64 from a ULA prefix and the traffic of sandboxes is masqueraded
+	IPV6_NAT66 IPv6Mode = "nat66"
+	// Bridges get a /64 from a prefix routed to the host, addresses are not translated
+	IPV6_ROUTED IPv6Mode = "routed"
+)
+
+// Bits of an IPv6 address holding the interface identifier
+const ipv6SubnetBits = 64
+
+// IPRange6 is an IPv6 /64 from which individual addresses can be allocated.
+// The interface identifiers of sandboxes are random, the bridge uses ::1.
+type IPRange6 struct {
+	*net.IPNet
+	inUse map[uint64]bool
+}
+
+func newIPRange6(ipnet *net.IPNet) *IPRange6 {
+	return &IPRange6{
+		IPNet: ipnet,
+		// The subnet-router anycast address and the bridge
+		inUse: map[uint64]bool{0: true, 1: true},
+	}
+}
+
+func (ipr *IPRange6) FirstIP() net.IP {
+	return ipr.at(1)
+}
+
+func (ipr *IPRange6) FreshIP() net.IP {
+	for i := 0; i < ozMaxRandTries; i++ {
+		id := uint64(mrand.Int63())<<1 | uint64(mrand.Intn(2))
+		// Keep clear of the reserved anycast identifiers at the end of the range (RFC 2526)
+		if ipr.inUse[id] || id >= 0xfdffffffffffff80 {
+			continue
+		}
+		ipr.inUse[id] = true
+		return ipr.at(id)
+	}
+	return nil
+}
+
+// Claim marks ip as in use so that it is never handed out by FreshIP,
+// it returns false if ip is not an address of the range
+func (ipr *IPRange6) Claim(ip net.IP) bool {
+	if ip.To4() != nil || !ipr.Contains(ip) {
+		return false
+	}
+	ipr.inUse[interfaceID(ip)] = true
+	return true
+}
+
+func (ipr *IPRange6) at(id uint64) net.IP {
+	return ip6FromParts(prefix64(ipr.IP), id)
+}
+
+// prefix64 returns the upper 64 bits of an IPv6 address
+func prefix64(ip net.IP) uint64 {
+	return binary.BigEndian.Uint64(ip.To16()[:8])
+}
+
+// interfaceID returns the lower 64 bits of an IPv6 address
+func interfaceID(ip net.IP) uint64 {
+	return binary.BigEndian.Uint64(ip.To16()[8:])
+}
+
+func ip6FromParts(prefix, id uint64) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	binary.BigEndian.PutUint64(ip[:8], prefix)
+	binary.BigEndian.PutUint64(ip[8:], id)
+	return ip
+}
+
+// subnetAllocator6 allocates a /64 for each bridge from a larger prefix
+type subnetAllocator6 struct {
+	baseNet    *net.IPNet
+	nextSubnet uint64
+	log        *logging.Logger
+}
+
+func newAllocator6(prefix string, log *logging.Logger) (*subnetAllocator6, error) {
+	var base *net.IPNet
+	if prefix == "" {
+		base = randomULA()
+	} else {
+		var err error
+		if base, err = parsePrefix6(prefix); err != nil {
+			return nil, err
+		}
+	}
+	log.Infof("IPv6 subnet allocator created with base network: %v", base)
+	sa := &subnetAllocator6{baseNet: base, log: log}
+	// The first subnet of a prefix is usually the one of the host itself
+	if ones, _ := base.Mask.Size(); ones < ipv6SubnetBits {
+		sa.nextSubnet = 1
+	}
+	return sa, nil
+}
+
+// parsePrefix6 parses an IPv6 prefix large enough to hold at least one /64
+func parsePrefix6(prefix string) (*net.IPNet, error) {
+	ip, ipnet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("invalid IPv6 prefix `%s`: %v", prefix, err)
+	}
+	if ip.To4() != nil {
+		return nil, fmt.Errorf("invalid IPv6 prefix `%s`: not an IPv6 network", prefix)
+	}
+	if ones, _ := ipnet.Mask.Size(); ones > ipv6SubnetBits {
+		return nil, fmt.Errorf("invalid IPv6 prefix `%s`: must be a /64 or larger", prefix)
+	}
+	return ipnet, nil
+}
+
+// randomULA returns a unique local /48 prefix with a random global ID (RFC 4193)
+func randomULA() *net.IPNet {
+	ip := make(net.IP, net.IPv6len)
+	ip[0] = 0xfd
+	if _, err := rand.Read(ip[1:6]); err != nil {
+		binary.BigEndian.PutUint32(ip[1:5], mrand.Uint32())
+		ip[5] = byte(mrand.Intn(256))
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(48, 128)}
+}
+
+func (sa *subnetAllocator6) size() uint64 {
+	ones, _ := sa.baseNet.Mask.Size()
+	return uint64(1) << uint(ipv6SubnetBits-ones)
+}
+
+func (sa *subnetAllocator6) allocateRange(iface string) (*IPRange6, error) {
+	n, err := sa.allocate()
+	if err != nil {
+		return nil, err
+	}
+	sa.log.Infof("Allocating new IPv6 subnet range (%v) for interface '%s'", n, iface)
+	return newIPRange6(n), nil
+}
+
+func (sa *subnetAllocator6) allocate() (*net.IPNet, error) {
+	if sa.nextSubnet >= sa.size() {
+		return nil, fmt.Errorf("Cannot allocate any more subnets from %v", sa.baseNet)
+	}
+	sub := &net.IPNet{
+		IP:   ip6FromParts(prefix64(sa.baseNet.IP)|sa.nextSubnet, 0),
+		Mask: net.CIDRMask(ipv6SubnetBits, 128),
+	}
+	sa.nextSubnet += 1
+	return sub, nil
+}
+
+// reserve prevents a subnet already in use by an adopted bridge from being allocated again
+func (sa *subnetAllocator6) reserve(n *net.IPNet) {
+	if n.IP.To4() != nil || !sa.baseNet.Contains(n.IP) {
+		return
+	}
+	subnet := prefix64(n.IP) &^ prefix64(sa.baseNet.IP)
+	if subnet >= sa.nextSubnet {
+		sa.nextSubnet = subnet + 1
+	}
+}
@@ -0,0 +1,163 @@
+package network
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/op/go-logging"
+)
+
+func newTestRange6(cidr string) *IPRange6 {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic("failed to parse CIDR: " + cidr)
+	}
+	return newIPRange6(ipnet)
+}
+
+func TestFreshIP6(t *testing.T) {
+	ipr := newTestRange6("fd12:3456:789a:1::/64")
+	if first := ipr.FirstIP(); !first.Equal(net.ParseIP("fd12:3456:789a:1::1")) {
+		t.Errorf("FirstIP() = %v, expected fd12:3456:789a:1::1", first)
+	}
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		ip := ipr.FreshIP()
+		if ip == nil {
+			t.Fatalf("FreshIP() failed after %d addresses", i)
+		}
+		if !ipr.Contains(ip) {
+			t.Errorf("FreshIP() = %v, not part of %v", ip, ipr.IPNet)
+		}
+		if id := interfaceID(ip); id <= 1 {
+			t.Errorf("FreshIP() = %v, reserved interface identifier", ip)
+		}
+		if seen[ip.String()] {
+			t.Errorf("FreshIP() = %v, address handed out twice", ip)
+		}
+		seen[ip.String()] = true
+	}
+}
+
+func TestClaim6(t *testing.T) {
+	ipr := newTestRange6("fd12:3456:789a:1::/64")
+	ip := net.ParseIP("fd12:3456:789a:1:aaaa:bbbb:cccc:dddd")
+	if !ipr.Claim(ip) {
+		t.Errorf("Claim(%v) failed", ip)
+	}
+	if !ipr.inUse[interfaceID(ip)] {
+		t.Errorf("Claim(%v) did not mark the address in use", ip)
+	}
+	for _, s := range []string{"fd12:3456:789a:2::5", "10.0.0.1"} {
+		if ipr.Claim(net.ParseIP(s)) {
+			t.Errorf("Claim(%s) succeeded, expected failure", s)
+		}
+	}
+}
+
+func TestAllocator6(t *testing.T) {
+	log := logging.MustGetLogger("oz-test")
+	for _, d := range []struct {
+		prefix string
+		first  string
+		second string
+	}{
+		{"fd12:3456:789a::/48", "fd12:3456:789a:1::/64", "fd12:3456:789a:2::/64"},
+		{"2001:db8:0:100::/56", "2001:db8:0:101::/64", "2001:db8:0:102::/64"},
+		{"2001:db8:0:7::/64", "2001:db8:0:7::/64", ""},
+	} {
+		sa, err := newAllocator6(d.prefix, log)
+		if err != nil {
+			t.Errorf("newAllocator6(%s) failed: %v", d.prefix, err)
+			continue
+		}
+		for _, expected := range []string{d.first, d.second} {
+			n, err := sa.allocate()
+			if expected == "" {
+				if err == nil {
+					t.Errorf("allocate() from %s = %v, expected an error", d.prefix, n)
+				}
+			} else if err != nil || n.String() != expected {
+				t.Errorf("allocate() from %s = %v (%v), expected %s", d.prefix, n, err, expected)
+			}
+		}
+	}
+	for _, bad := range []string{"10.0.0.0/8", "fd00::/96", "fd00::", "garbage"} {
+		if _, err := newAllocator6(bad, log); err == nil {
+			t.Errorf("newAllocator6(%s) succeeded, expected failure", bad)
+		}
+	}
+}
+
+func TestRandomULA(t *testing.T) {
+	_, ula, _ := net.ParseCIDR("fd00::/8")
+	n := randomULA()
+	if ones, bits := n.Mask.Size(); ones != 48 || bits != 128 {
+		t.Errorf("randomULA() = %v, expected a /48", n)
+	}
+	if !ula.Contains(n.IP) {
+		t.Errorf("randomULA() = %v, not a unique local prefix", n)
+	}
+	sa, err := newAllocator6("", logging.MustGetLogger("oz-test"))
+	if err != nil {
+		t.Fatalf("newAllocator6(\"\") failed: %v", err)
+	}
+	if sub, err := sa.allocate(); err != nil || !ula.Contains(sub.IP) {
+		t.Errorf("allocate() from random prefix = %v (%v)", sub, err)
+	}
+}
+
+func TestReserve6(t *testing.T) {
+	sa, _ := newAllocator6("fd12:3456:789a::/48", logging.MustGetLogger("oz-test"))
+	for _, d := range []struct {
+		cidr string
+		next uint64
+	}{
+		{"fd12:3456:789a:4::/64", 5},
+		{"fd12:3456:789a:2::/64", 5},
+		{"fd12:3456:789b:9::/64", 5},
+		{"10.1.9.0/24", 5},
+		{"fd12:3456:789a:107::/64", 0x108},
+	} {
+		_, n, _ := net.ParseCIDR(d.cidr)
+		sa.reserve(n)
+		if sa.nextSubnet != d.next {
+			t.Errorf("after reserving %s expecting next subnet %d, got %d", d.cidr, d.next, sa.nextSubnet)
+		}
+	}
+}
+
+func TestCheckIPv6(t *testing.T) {
+	for _, d := range []struct {
+		mode   IPv6Mode
+		prefix string
+		ok     bool
+	}{
+		{"", "", true},
+		{IPV6_NONE, "garbage", true},
+		{IPV6_NAT66, "", true},
+		{IPV6_NAT66, "fd00:1::/48", true},
+		{IPV6_NAT66, "fd00:1::/80", false},
+		{IPV6_ROUTED, "2001:db8::/56", true},
+		{IPV6_ROUTED, "", false},
+		{"nat64", "", false},
+	} {
+		if err := CheckIPv6(d.mode, d.prefix); (err == nil) != d.ok {
+			t.Errorf("CheckIPv6(%s, %s) = %v", d.mode, d.prefix, err)
+		}
+	}
+}
+
+func TestNat66Script(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("fd12:3456:789a:1::/64")
+	script := nat66Script("my-bridge", subnet)
+	for _, s := range []string{
+		"table ip6 oz_nat66_my_bridge\ndelete table ip6 oz_nat66_my_bridge\n",
+		"ip6 saddr fd12:3456:789a:1::/64 oifname != \"oz-my-bridge\" masquerade\n",
+	} {
+		if !strings.Contains(script, s) {
+			t.Errorf("nat66Script() does not contain %q:\n%s", s, script)
+		}
+	}
+}
@@ -66,6 +66,24 @@ func TestFreshIP(t *testing.T) {
 		newTestRange("192.168.1.0/28", "192.168.1.3", "192.168.1.8").FreshIP)
 }
 
+func TestClaim(t *testing.T) {
+	ipr := newTestRange("192.168.1.0/29")
+	for _, s := range []string{"192.168.1.3", "192.168.1.5"} {
+		if !ipr.Claim(net.ParseIP(s)) {
+			t.Errorf("Claim(%s) failed", s)
+		}
+	}
+	for _, s := range []string{"192.168.1.0", "192.168.1.7", "192.168.2.1", "fd00::1"} {
+		if ipr.Claim(net.ParseIP(s)) {
+			t.Errorf("Claim(%s) succeeded, expected failure", s)
+		}
+	}
+	runRangeTest(t, []byte{2, 4, 6}, ipr.scanIP)
+	if ip := ipr.scanIP(); ip != nil {
+		t.Errorf("expecting range to be exhausted, got %v", ip)
+	}
+}
+
 var firstIPTestData = []struct {
 	cidr  string
 	first net.IP
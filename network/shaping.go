@@ -0,0 +1,185 @@
+package network
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Bandwidth limits the traffic of a sandbox, rates are in bits per second
+// and bursts in bytes. Egress is the traffic sent by the sandbox and ingress
+// the traffic it receives, a zero rate does not limit that direction and a
+// zero burst is replaced by a default suited to the rate.
+type Bandwidth struct {
+	EgressRate   uint64
+	EgressBurst  uint64
+	IngressRate  uint64
+	IngressBurst uint64
+}
+
+// Limited returns true if the traffic is limited in any direction
+func (bw Bandwidth) Limited() bool {
+	return bw.EgressRate != 0 || bw.IngressRate != 0
+}
+
+func (bw Bandwidth) String() string {
+	f := func(rate, burst uint64) string {
+		if rate == 0 {
+			return "unlimited"
+		}
+		return fmt.Sprintf("%s (burst %d bytes)", FormatRate(rate), shapingBurst(rate, burst))
+	}
+	return fmt.Sprintf("egress %s, ingress %s", f(bw.EgressRate, bw.EgressBurst), f(bw.IngressRate, bw.IngressBurst))
+}
+
+var rateUnits = map[string]float64{
+	"": 1, "bit": 1, "kbit": 1e3, "mbit": 1e6, "gbit": 1e9, "tbit": 1e12,
+	"bps": 8, "kbps": 8e3, "mbps": 8e6, "gbps": 8e9, "tbps": 8e12,
+}
+
+var sizeUnits = map[string]float64{
+	"": 1, "b": 1, "k": 1 << 10, "kb": 1 << 10, "m": 1 << 20, "mb": 1 << 20, "g": 1 << 30, "gb": 1 << 30,
+}
+
+// parseUnit parses a decimal number followed by one of the units
+func parseUnit(s string, units map[string]float64) (uint64, bool) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if i == -1 {
+		i = len(s)
+	}
+	mult, ok := units[s[i:]]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil || n <= 0 {
+		return 0, false
+	}
+	return uint64(n * mult), true
+}
+
+// ParseRate parses a rate with the units of tc: a number of bits per
+// second followed by bit, kbit, mbit, gbit or tbit, or a number of bytes
+// per second followed by bps, kbps, mbps, gbps or tbps (ie: `2.5mbit`)
+func ParseRate(s string) (uint64, error) {
+	rate, ok := parseUnit(s, rateUnits)
+	if !ok || rate < 8 {
+		return 0, fmt.Errorf("invalid rate `%s`, must be a number followed by bit, kbit, mbit, gbit, bps, kbps, mbps or gbps", s)
+	}
+	return rate, nil
+}
+
+// ParseBurst parses a size in bytes with an optional kb, mb or gb suffix
+func ParseBurst(s string) (uint64, error) {
+	size, ok := parseUnit(s, sizeUnits)
+	if !ok {
+		return 0, fmt.Errorf("invalid burst `%s`, must be a number of bytes with an optional kb, mb or gb suffix", s)
+	}
+	return size, nil
+}
+
+// FormatRate formats a rate in bits per second with the largest tc unit
+func FormatRate(rate uint64) string {
+	for _, u := range []struct {
+		name string
+		mult uint64
+	}{{"gbit", 1e9}, {"mbit", 1e6}, {"kbit", 1e3}} {
+		if rate >= u.mult {
+			return strconv.FormatFloat(float64(rate)/float64(u.mult), 'f', -1, 64) + u.name
+		}
+	}
+	return strconv.FormatUint(rate, 10) + "bit"
+}
+
+// shapingBurst returns the burst used for a rate: the given burst, or what
+// is sent in 20ms at the rate with room for at least 10 full size packets
+func shapingBurst(rate, burst uint64) uint64 {
+	if burst != 0 {
+		return burst
+	}
+	if b := rate / 8 / 50; b > 15000 {
+		return b
+	}
+	return 15000
+}
+
+// tcCommands returns the tc commands changing the limits of the host end of
+// a veth from old to bw. What the sandbox receives is sent by the host end
+// and shaped by a token bucket filter, what it sends is received by the host
+// end and policed by the ingress qdisc.
+func tcCommands(ifname string, old, bw Bandwidth) [][]string {
+	cmds := [][]string{}
+	if old.IngressRate != 0 {
+		cmds = append(cmds, []string{"qdisc", "del", "dev", ifname, "root"})
+	}
+	if old.EgressRate != 0 {
+		cmds = append(cmds, []string{"qdisc", "del", "dev", ifname, "ingress"})
+	}
+	if bw.IngressRate != 0 {
+		cmds = append(cmds, []string{"qdisc", "add", "dev", ifname, "root", "tbf",
+			"rate", strconv.FormatUint(bw.IngressRate, 10) + "bit",
+			"burst", strconv.FormatUint(shapingBurst(bw.IngressRate, bw.IngressBurst), 10),
+			"latency", "50ms"})
+	}
+	if bw.EgressRate != 0 {
+		cmds = append(cmds,
+			[]string{"qdisc", "add", "dev", ifname, "handle", "ffff:", "ingress"},
+			[]string{"filter", "add", "dev", ifname, "parent", "ffff:", "protocol", "all", "prio", "1",
+				"u32", "match", "u32", "0", "0",
+				"police", "rate", strconv.FormatUint(bw.EgressRate, 10) + "bit",
+				"burst", strconv.FormatUint(shapingBurst(bw.EgressRate, bw.EgressBurst), 10),
+				"drop", "flowid", ":1"})
+	}
+	return cmds
+}
+
+func runTc(args []string) error {
+	if out, err := exec.Command("tc", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("tc %s failed: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// SetBandwidth replaces the limits of the traffic of the sandbox
+func (v *OzVeth) SetBandwidth(bw Bandwidth) error {
+	ifc := v.NetInterface()
+	if ifc == nil {
+		return fmt.Errorf("veth of sandbox %d has no interface", v.id)
+	}
+	if bw == v.bandwidth {
+		return nil
+	}
+	v.log.Infof("Setting bandwidth of veth %s: %v", ifc.Name, bw)
+	cmds := tcCommands(ifc.Name, v.bandwidth, bw)
+	// The previous limits are gone once they are deleted, the current ones
+	// are recorded as they are installed
+	v.bandwidth = Bandwidth{}
+	for _, args := range cmds {
+		if err := runTc(args); err != nil {
+			if args[1] == "del" {
+				v.log.Warningf("Unable to remove the previous limits of veth %s: %v", ifc.Name, err)
+				continue
+			}
+			return err
+		}
+		switch {
+		case args[0] == "qdisc" && args[1] == "add" && args[4] == "root":
+			v.bandwidth.IngressRate, v.bandwidth.IngressBurst = bw.IngressRate, bw.IngressBurst
+		case args[0] == "filter":
+			v.bandwidth.EgressRate, v.bandwidth.EgressBurst = bw.EgressRate, bw.EgressBurst
+		}
+	}
+	return nil
+}
+
+// GetBandwidth returns the current limits of the traffic of the sandbox
+func (v *OzVeth) GetBandwidth() Bandwidth {
+	return v.bandwidth
+}
+
+// AdoptBandwidth records the limits set by a previous instance of the daemon
+func (v *OzVeth) AdoptBandwidth(bw Bandwidth) {
+	v.bandwidth = bw
+}
@@ -0,0 +1,123 @@
+package network
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRate(t *testing.T) {
+	for s, expected := range map[string]uint64{
+		"1000":     1000,
+		"64kbit":   64000,
+		"2.5mbit":  2500000,
+		"1Gbit":    1000000000,
+		"100kbps":  800000,
+		" 1mbps ":  8000000,
+		"0.5kbit":  500,
+		"12345bit": 12345,
+	} {
+		rate, err := ParseRate(s)
+		if err != nil {
+			t.Errorf("ParseRate(%q) failed: %v", s, err)
+		} else if rate != expected {
+			t.Errorf("ParseRate(%q) = %d, expected %d", s, rate, expected)
+		}
+	}
+	for _, s := range []string{"", "0", "fast", "mbit", "1mb", "-1mbit", "1.2.3mbit", "4bit"} {
+		if rate, err := ParseRate(s); err == nil {
+			t.Errorf("ParseRate(%q) = %d, expected an error", s, rate)
+		}
+	}
+}
+
+func TestParseBurst(t *testing.T) {
+	for s, expected := range map[string]uint64{
+		"1500": 1500,
+		"32kb": 32 << 10,
+		"1m":   1 << 20,
+		"1GB":  1 << 30,
+	} {
+		size, err := ParseBurst(s)
+		if err != nil {
+			t.Errorf("ParseBurst(%q) failed: %v", s, err)
+		} else if size != expected {
+			t.Errorf("ParseBurst(%q) = %d, expected %d", s, size, expected)
+		}
+	}
+	for _, s := range []string{"", "0", "1tb", "kb", "-10"} {
+		if size, err := ParseBurst(s); err == nil {
+			t.Errorf("ParseBurst(%q) = %d, expected an error", s, size)
+		}
+	}
+}
+
+func TestFormatRate(t *testing.T) {
+	for rate, expected := range map[uint64]string{
+		500:        "500bit",
+		64000:      "64kbit",
+		2500000:    "2.5mbit",
+		1000000000: "1gbit",
+	} {
+		if s := FormatRate(rate); s != expected {
+			t.Errorf("FormatRate(%d) = %s, expected %s", rate, s, expected)
+		}
+	}
+}
+
+func TestShapingBurst(t *testing.T) {
+	for _, tt := range []struct{ rate, burst, expected uint64 }{
+		{1000000, 0, 15000},
+		{100000000, 0, 250000},
+		{1000000, 4096, 4096},
+	} {
+		if b := shapingBurst(tt.rate, tt.burst); b != tt.expected {
+			t.Errorf("shapingBurst(%d, %d) = %d, expected %d", tt.rate, tt.burst, b, tt.expected)
+		}
+	}
+}
+
+func TestTcCommands(t *testing.T) {
+	join := func(cmds [][]string) []string {
+		lines := []string{}
+		for _, c := range cmds {
+			lines = append(lines, strings.Join(c, " "))
+		}
+		return lines
+	}
+	tests := []struct {
+		name     string
+		old, bw  Bandwidth
+		expected []string
+	}{
+		{"unlimited", Bandwidth{}, Bandwidth{}, []string{}},
+		{"both", Bandwidth{}, Bandwidth{EgressRate: 1000000, IngressRate: 8000000, IngressBurst: 65536}, []string{
+			"qdisc add dev veth0 root tbf rate 8000000bit burst 65536 latency 50ms",
+			"qdisc add dev veth0 handle ffff: ingress",
+			"filter add dev veth0 parent ffff: protocol all prio 1 u32 match u32 0 0 police rate 1000000bit burst 15000 drop flowid :1",
+		}},
+		{"change ingress", Bandwidth{IngressRate: 8000000}, Bandwidth{IngressRate: 2000000}, []string{
+			"qdisc del dev veth0 root",
+			"qdisc add dev veth0 root tbf rate 2000000bit burst 15000 latency 50ms",
+		}},
+		{"remove", Bandwidth{EgressRate: 1000000, IngressRate: 8000000}, Bandwidth{}, []string{
+			"qdisc del dev veth0 root",
+			"qdisc del dev veth0 ingress",
+		}},
+	}
+	for _, tt := range tests {
+		if cmds := join(tcCommands("veth0", tt.old, tt.bw)); !reflect.DeepEqual(cmds, tt.expected) {
+			t.Errorf("%s: got %q, expected %q", tt.name, cmds, tt.expected)
+		}
+	}
+}
+
+func TestBandwidthString(t *testing.T) {
+	bw := Bandwidth{EgressRate: 1000000, IngressRate: 2500000, IngressBurst: 4096}
+	if s, expected := bw.String(), "egress 1mbit (burst 15000 bytes), ingress 2.5mbit (burst 4096 bytes)"; s != expected {
+		t.Errorf("String() = %q, expected %q", s, expected)
+	}
+	if s := (Bandwidth{}).String(); s != "egress unlimited, ingress unlimited" {
+		t.Errorf("String() of no limits = %q", s)
+	}
+}
@@ -0,0 +1,154 @@
+package network
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// SPLICE_F_MOVE | SPLICE_F_NONBLOCK
+const spliceFlags = 0x1 | 0x2
+
+// Bytes moved by a single splice, the default capacity of a pipe
+const spliceChunk = 1 << 16
+
+var errProxyIdle = errors.New("connection idle")
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+var proxyBufPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 32*1024)
+		return &b
+	},
+}
+
+// proxyCopy copies src to dst until the end of src, adding the bytes copied
+// to count and recording the time of each transfer in active, which is
+// shared with the other direction. With a non zero idle it gives up once
+// neither direction moved anything for that long.
+func proxyCopy(dst, src net.Conn, count *uint64, idle time.Duration, active *int64) error {
+	for {
+		if idle > 0 {
+			src.SetReadDeadline(time.Now().Add(idle))
+		}
+		var err error
+		if canSplice(dst) && canSplice(src) {
+			err = spliceCopy(dst, src, count, active)
+		} else {
+			err = bufferCopy(dst, src, count, active)
+		}
+		if idle == 0 || !errors.Is(err, os.ErrDeadlineExceeded) {
+			return err
+		}
+		if time.Since(time.Unix(0, atomic.LoadInt64(active))) >= idle {
+			return errProxyIdle
+		}
+	}
+}
+
+// canSplice returns true if data can be moved from or to c with splice(2),
+// which does not keep the boundaries of the messages of packet sockets
+func canSplice(c net.Conn) bool {
+	switch c := c.(type) {
+	case *net.TCPConn:
+		return true
+	case *net.UnixConn:
+		return c.LocalAddr().Network() == "unix"
+	}
+	return false
+}
+
+// spliceCopy moves the data through a pipe without copying it to user space
+func spliceCopy(dst, src net.Conn, count *uint64, active *int64) error {
+	rsrc, err := src.(syscall.Conn).SyscallConn()
+	if err != nil {
+		return err
+	}
+	rdst, err := dst.(syscall.Conn).SyscallConn()
+	if err != nil {
+		return err
+	}
+	var p [2]int
+	if err := syscall.Pipe2(p[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK); err != nil {
+		return bufferCopy(dst, src, count, active)
+	}
+	defer syscall.Close(p[0])
+	defer syscall.Close(p[1])
+
+	for {
+		var n int64
+		var serr error
+		err := rsrc.Read(func(fd uintptr) bool {
+			n, serr = spliceRetry(int(fd), p[1], spliceChunk)
+			return serr != syscall.EAGAIN
+		})
+		if err == nil {
+			err = serr
+		}
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+		atomic.StoreInt64(active, time.Now().UnixNano())
+		// The pipe is drained before reading again, so that it never holds
+		// data when returning
+		for n > 0 {
+			var m int64
+			err := rdst.Write(func(fd uintptr) bool {
+				m, serr = spliceRetry(p[0], int(fd), int(n))
+				return serr != syscall.EAGAIN
+			})
+			if err == nil {
+				err = serr
+			}
+			if err != nil {
+				return err
+			}
+			n -= m
+			atomic.AddUint64(count, uint64(m))
+		}
+	}
+}
+
+func spliceRetry(rfd, wfd, n int) (int64, error) {
+	for {
+		m, err := syscall.Splice(rfd, nil, wfd, nil, n, spliceFlags)
+		if err != syscall.EINTR {
+			return m, err
+		}
+	}
+}
+
+// bufferCopy copies the data with read and write calls through a pooled
+// buffer, each read is written at once which keeps the message boundaries
+func bufferCopy(dst io.Writer, src io.Reader, count *uint64, active *int64) error {
+	bp := proxyBufPool.Get().(*[]byte)
+	defer proxyBufPool.Put(bp)
+	buf := *bp
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			atomic.StoreInt64(active, time.Now().UnixNano())
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			atomic.AddUint64(count, uint64(n))
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
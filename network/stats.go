@@ -0,0 +1,65 @@
+package network
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Where the counters of the interfaces are read from
+var sysClassNet = "/sys/class/net"
+
+// LinkStats are the traffic counters of the interface of a sandbox, seen
+// from inside the sandbox: received is what reached the sandbox
+type LinkStats struct {
+	RxBytes   uint64
+	RxPackets uint64
+	TxBytes   uint64
+	TxPackets uint64
+}
+
+func readLinkStats(ifname string) (LinkStats, error) {
+	var s LinkStats
+	for _, c := range []struct {
+		name string
+		val  *uint64
+	}{
+		{"rx_bytes", &s.RxBytes},
+		{"rx_packets", &s.RxPackets},
+		{"tx_bytes", &s.TxBytes},
+		{"tx_packets", &s.TxPackets},
+	} {
+		b, err := ioutil.ReadFile(path.Join(sysClassNet, ifname, "statistics", c.name))
+		if err != nil {
+			return s, err
+		}
+		n, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+		if err != nil {
+			return s, fmt.Errorf("invalid %s counter of %s: %v", c.name, ifname, err)
+		}
+		*c.val = n
+	}
+	return s, nil
+}
+
+// Stats returns the traffic counters of the sandbox. They are those of the
+// host end of the veth, which is kept along with its counters when the
+// bridges are reconfigured, with the directions swapped.
+func (v *OzVeth) Stats() (LinkStats, error) {
+	ifc := v.NetInterface()
+	if ifc == nil {
+		return LinkStats{}, fmt.Errorf("veth of sandbox %d has no interface", v.id)
+	}
+	host, err := readLinkStats(ifc.Name)
+	if err != nil {
+		return LinkStats{}, err
+	}
+	return LinkStats{
+		RxBytes:   host.TxBytes,
+		RxPackets: host.TxPackets,
+		TxBytes:   host.RxBytes,
+		TxPackets: host.RxPackets,
+	}, nil
+}
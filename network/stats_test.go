@@ -0,0 +1,61 @@
+package network
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestReadLinkStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oz-sysfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(orig string) { sysClassNet = orig }(sysClassNet)
+	sysClassNet = dir
+
+	stats := path.Join(dir, "veth0", "statistics")
+	os.MkdirAll(stats, 0755)
+	for name, val := range map[string]string{"rx_bytes": "1500\n", "rx_packets": "3\n", "tx_bytes": "64\n", "tx_packets": "1\n"} {
+		ioutil.WriteFile(path.Join(stats, name), []byte(val), 0644)
+	}
+	s, err := readLinkStats("veth0")
+	if err != nil {
+		t.Fatalf("readLinkStats() failed: %v", err)
+	}
+	if expected := (LinkStats{RxBytes: 1500, RxPackets: 3, TxBytes: 64, TxPackets: 1}); s != expected {
+		t.Errorf("readLinkStats() = %+v, expected %+v", s, expected)
+	}
+
+	ioutil.WriteFile(path.Join(stats, "tx_packets"), []byte("lots\n"), 0644)
+	if _, err := readLinkStats("veth0"); err == nil {
+		t.Errorf("readLinkStats() accepted an invalid counter")
+	}
+	if _, err := readLinkStats("veth1"); err == nil {
+		t.Errorf("readLinkStats() of a missing interface did not fail")
+	}
+}
+
+func TestSandboxProxyPairs(t *testing.T) {
+	conn := func(s string) *PConnInfo {
+		return &PConnInfo{Saddr: net.ParseIP(s), Sport: 4000, Daddr: net.ParseIP("127.0.0.1"), Dport: 9050}
+	}
+	defer func(orig map[net.Conn]*proxyConn) { proxyConns = orig }(proxyConns)
+	c1, c2, c3 := &net.TCPConn{}, &net.TCPConn{}, &net.UnixConn{}
+	proxyConns = map[net.Conn]*proxyConn{
+		c1: {pair: ProxyPair{In: conn("127.0.0.1"), Out: conn("127.0.0.2"), Pid: 100, Sent: 10, Received: 20}, seq: 1},
+		c2: {pair: ProxyPair{In: conn("127.0.0.3"), Out: conn("127.0.0.4"), Pid: 200, Sent: 30, Received: 40}, seq: 2},
+		// unix sockets have no addresses to show
+		c3: {pair: ProxyPair{Pid: 200}, seq: 3},
+	}
+	pairs := SandboxProxyPairs(200)
+	if len(pairs) != 1 || pairs[0].Sent != 30 || pairs[0].Received != 40 || !pairs[0].In.Saddr.Equal(net.ParseIP("127.0.0.3")) {
+		t.Errorf("SandboxProxyPairs(200) = %+v", pairs)
+	}
+	if pairs := SandboxProxyPairs(300); len(pairs) != 0 {
+		t.Errorf("SandboxProxyPairs(300) = %+v, expected none", pairs)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"os"
 	"path"
+	"runtime"
 	"strconv"
 	"syscall"
 )
@@ -86,3 +87,29 @@ func Open(nsPath string) (uintptr, error) {
 func Close(fd uintptr) error {
 	return syscall.Close(int(fd))
 }
+
+// WithProcessNetNS runs f in the network namespace of the process. The
+// thread is locked meanwhile, and discarded if it cannot be moved back.
+func WithProcessNetNS(pid int, f func() error) error {
+	fd, err := OpenProcess(pid, CLONE_NEWNET)
+	if err != nil {
+		return err
+	}
+	defer Close(fd)
+	origNs, err := OpenProcess(os.Getpid(), CLONE_NEWNET)
+	if err != nil {
+		return err
+	}
+	defer Close(origNs)
+
+	runtime.LockOSThread()
+	if err := Set(fd, CLONE_NEWNET); err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	err = f()
+	if Set(origNs, CLONE_NEWNET) == nil {
+		runtime.UnlockOSThread()
+	}
+	return err
+}
@@ -0,0 +1,397 @@
+package openvpn
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/subgraph/oz"
+)
+
+// Directive is an option of an OpenVPN configuration file
+type Directive struct {
+	Name string
+	Args []string
+	// Contents of the file given in a <name> block, if any
+	Inline string
+	// Line of the configuration where the directive starts
+	Line int
+}
+
+type directivePolicy int
+
+const (
+	// Passed on to OpenVPN
+	directiveAllow directivePolicy = iota
+	// Passed on with its first argument, a file of the configuration
+	// directory, or its inline block written to the run directory
+	directiveFile
+	// Passed on with its third argument, the credentials of the proxy, a
+	// file of the configuration directory unless auto or auto-nct
+	directiveProxy
+	// Set by oz-daemon or of no use to the clients it starts
+	directiveIgnore
+	// Runs commands or changes what the client may touch on the host
+	directiveReject
+)
+
+// Directives users may set in the OpenVPN configuration of a sandbox, any
+// other one is an error
+var directives = map[string]directivePolicy{
+	"allow-compression":      directiveAllow,
+	"auth":                   directiveAllow,
+	"bind":                   directiveAllow,
+	"block-outside-dns":      directiveAllow,
+	"cipher":                 directiveAllow,
+	"comp-lzo":               directiveAllow,
+	"compress":               directiveAllow,
+	"connect-retry":          directiveAllow,
+	"connect-retry-max":      directiveAllow,
+	"connect-timeout":        directiveAllow,
+	"data-ciphers":           directiveAllow,
+	"data-ciphers-fallback":  directiveAllow,
+	"dev":                    directiveAllow,
+	"dev-type":               directiveAllow,
+	"dhcp-option":            directiveAllow,
+	"explicit-exit-notify":   directiveAllow,
+	"fast-io":                directiveAllow,
+	"float":                  directiveAllow,
+	"fragment":               directiveAllow,
+	"hand-window":            directiveAllow,
+	"http-proxy-retry":       directiveAllow,
+	"ignore-unknown-option":  directiveAllow,
+	"keepalive":              directiveAllow,
+	"key-direction":          directiveAllow,
+	"link-mtu":               directiveAllow,
+	"lport":                  directiveAllow,
+	"mssfix":                 directiveAllow,
+	"mtu-disc":               directiveAllow,
+	"mute":                   directiveAllow,
+	"mute-replay-warnings":   directiveAllow,
+	"ncp-ciphers":            directiveAllow,
+	"ncp-disable":            directiveAllow,
+	"nobind":                 directiveAllow,
+	"ns-cert-type":           directiveAllow,
+	"persist-key":            directiveAllow,
+	"persist-local-ip":       directiveAllow,
+	"persist-remote-ip":      directiveAllow,
+	"port":                   directiveAllow,
+	"proto":                  directiveAllow,
+	"pull":                   directiveAllow,
+	"pull-filter":            directiveAllow,
+	"rcvbuf":                 directiveAllow,
+	"redirect-gateway":       directiveAllow,
+	"remote":                 directiveAllow,
+	"remote-cert-eku":        directiveAllow,
+	"remote-cert-ku":         directiveAllow,
+	"remote-cert-tls":        directiveAllow,
+	"remote-random":          directiveAllow,
+	"remote-random-hostname": directiveAllow,
+	"reneg-bytes":            directiveAllow,
+	"reneg-sec":              directiveAllow,
+	"replay-window":          directiveAllow,
+	"resolv-retry":           directiveAllow,
+	"route":                  directiveAllow,
+	"route-delay":            directiveAllow,
+	"route-ipv6":             directiveAllow,
+	"route-nopull":           directiveAllow,
+	"rport":                  directiveAllow,
+	"server-poll-timeout":    directiveAllow,
+	"sndbuf":                 directiveAllow,
+	"socks-proxy-retry":      directiveAllow,
+	"tls-cipher":             directiveAllow,
+	"tls-ciphersuites":       directiveAllow,
+	"tls-client":             directiveAllow,
+	"tls-timeout":            directiveAllow,
+	"tls-version-max":        directiveAllow,
+	"tls-version-min":        directiveAllow,
+	"topology":               directiveAllow,
+	"tun-ipv6":               directiveAllow,
+	"tun-mtu":                directiveAllow,
+	"tun-mtu-extra":          directiveAllow,
+	"verb":                   directiveAllow,
+	"verify-x509-name":       directiveAllow,
+
+	"ca":           directiveFile,
+	"cert":         directiveFile,
+	"crl-verify":   directiveFile,
+	"extra-certs":  directiveFile,
+	"key":          directiveFile,
+	"pkcs12":       directiveFile,
+	"secret":       directiveFile,
+	"tls-auth":     directiveFile,
+	"tls-crypt":    directiveFile,
+	"tls-crypt-v2": directiveFile,
+
+	"http-proxy":  directiveProxy,
+	"socks-proxy": directiveProxy,
+
+	"auth-nocache": directiveIgnore,
+	"auth-retry":   directiveIgnore,
+	"client":       directiveIgnore,
+	"daemon":       directiveIgnore,
+	"echo":         directiveIgnore,
+	"group":        directiveIgnore,
+	"ifconfig":     directiveIgnore,
+	"log":          directiveIgnore,
+	"log-append":   directiveIgnore,
+	"mode":         directiveIgnore,
+	"persist-tun":  directiveIgnore,
+	"ping":         directiveIgnore,
+	"ping-restart": directiveIgnore,
+	"route-noexec": directiveIgnore,
+	"server":       directiveIgnore,
+	"setenv":       directiveIgnore,
+	"setenv-safe":  directiveIgnore,
+	"status":       directiveIgnore,
+	"syslog":       directiveIgnore,
+	"user":         directiveIgnore,
+	"writepid":     directiveIgnore,
+
+	"auth-user-pass-verify": directiveReject,
+	"cd":                    directiveReject,
+	"chroot":                directiveReject,
+	"client-connect":        directiveReject,
+	"client-disconnect":     directiveReject,
+	"config":                directiveReject,
+	"down":                  directiveReject,
+	"ipchange":              directiveReject,
+	"iproute":               directiveReject,
+	"learn-address":         directiveReject,
+	"management":            directiveReject,
+	"plugin":                directiveReject,
+	"route-pre-down":        directiveReject,
+	"route-up":              directiveReject,
+	"script-security":       directiveReject,
+	"tls-export-cert":       directiveReject,
+	"tls-verify":            directiveReject,
+	"tmp-dir":               directiveReject,
+	"up":                    directiveReject,
+}
+
+// LoadConf reads the OpenVPN configuration conf from the configuration
+// directory
+func LoadConf(c *oz.Config, conf string) ([]Directive, error) {
+	f, err := os.Open(path.Join(c.OpenVPNConfDir, conf))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseConf(f)
+}
+
+// ParseConf parses an OpenVPN configuration into its directives. Only the
+// syntax is checked, see clientArgs for what the directives may be.
+func ParseConf(r io.Reader) ([]Directive, error) {
+	var dirs []Directive
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "<") && strings.HasSuffix(line, ">") {
+			name := line[1 : len(line)-1]
+			if strings.HasPrefix(name, "/") {
+				return nil, fmt.Errorf("line %d: %s without a matching <%s>", n, line, name[1:])
+			}
+			start, end := n, "</"+name+">"
+			var inline strings.Builder
+			closed := false
+			for n++; scanner.Scan(); n++ {
+				if strings.TrimSpace(scanner.Text()) == end {
+					closed = true
+					break
+				}
+				fmt.Fprintf(&inline, "%s\n", scanner.Text())
+			}
+			if !closed {
+				return nil, fmt.Errorf("line %d: %s is not closed by %s", start, line, end)
+			}
+			dirs = append(dirs, Directive{Name: name, Inline: inline.String(), Line: start})
+			continue
+		}
+		tokens, err := splitLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		if len(tokens) == 0 {
+			continue
+		}
+		// Options may be written as on the command line
+		d := Directive{Name: strings.TrimPrefix(tokens[0], "--"), Line: n}
+		if len(tokens) > 1 {
+			d.Args = tokens[1:]
+		}
+		// Arguments end up on the command line of OpenVPN, where they would
+		// be read as further options
+		for _, a := range tokens {
+			if strings.ContainsAny(a, "\x00\n") {
+				return nil, fmt.Errorf("line %d: %q contains a NUL or newline character", n, a)
+			}
+		}
+		for _, a := range d.Args {
+			if strings.HasPrefix(a, "--") {
+				return nil, fmt.Errorf("line %d: argument `%s` of %s starts with --", n, a, d.Name)
+			}
+		}
+		dirs = append(dirs, d)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return dirs, nil
+}
+
+// splitLine splits a line into its tokens as OpenVPN does: they are
+// separated by spaces unless quoted or escaped with a backslash, and a token
+// starting with # or ; starts a comment
+func splitLine(line string) ([]string, error) {
+	var tokens []string
+	var token strings.Builder
+	inToken := false
+	quote := rune(0)
+	escaped := false
+	for _, r := range line {
+		switch {
+		case escaped:
+			token.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			inToken, escaped = true, true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				token.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			inToken, quote = true, r
+		case r == ' ' || r == '\t':
+			if inToken {
+				tokens = append(tokens, token.String())
+				token.Reset()
+				inToken = false
+			}
+		case (r == '#' || r == ';') && !inToken:
+			return tokens, nil
+		default:
+			token.WriteRune(r)
+			inToken = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+	if escaped {
+		return nil, fmt.Errorf("backslash at the end of the line")
+	}
+	if inToken {
+		tokens = append(tokens, token.String())
+	}
+	return tokens, nil
+}
+
+// confFile returns the path of file, relative to the configuration
+// directory, which it may not leave
+func confFile(c *oz.Config, file string) (string, error) {
+	p := path.Join(c.OpenVPNConfDir, file)
+	if path.IsAbs(file) || !strings.HasPrefix(p, path.Clean(c.OpenVPNConfDir)+"/") {
+		return "", fmt.Errorf("`%s` is not in %s", file, c.OpenVPNConfDir)
+	}
+	return p, nil
+}
+
+// clientArgs returns the command line options of the OpenVPN client of a
+// sandbox for the directives of its configuration. The credentials are read
+// from auth, a file of the configuration directory, if given. Inline files
+// are written to the run directory once all the directives were accepted.
+func clientArgs(c *oz.Config, dirs []Directive, auth, runtoken string) ([]string, error) {
+	args := []string{"--client"}
+	inline := make(map[string]string)
+	inlineFile := func(d Directive) string {
+		p := path.Join(c.OpenVPNRunPath, runtoken+"-"+d.Name)
+		inline[p] = d.Inline
+		return p
+	}
+	authArgs := func(d Directive) ([]string, error) {
+		var file string
+		var err error
+		switch {
+		case auth != "":
+			file, err = confFile(c, auth)
+		case len(d.Args) > 0:
+			file, err = confFile(c, d.Args[0])
+		case d.Inline != "":
+			file = inlineFile(d)
+		default:
+			return nil, fmt.Errorf("line %d: auth-user-pass needs the authfile of the profile", d.Line)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: auth-user-pass: %v", d.Line, err)
+		}
+		return []string{"--auth-nocache", "--auth-user-pass", file}, nil
+	}
+
+	for _, d := range dirs {
+		if d.Name == "auth-user-pass" {
+			a, err := authArgs(d)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, a...)
+			continue
+		}
+		policy, ok := directives[d.Name]
+		if !ok {
+			return nil, fmt.Errorf("line %d: directive `%s` is not allowed", d.Line, d.Name)
+		}
+		if d.Inline != "" && policy != directiveFile {
+			return nil, fmt.Errorf("line %d: <%s> can not be inline", d.Line, d.Name)
+		}
+		switch policy {
+		case directiveAllow:
+			args = append(args, "--"+d.Name)
+			args = append(args, d.Args...)
+		case directiveFile:
+			var file string
+			switch {
+			case d.Inline != "":
+				file = inlineFile(d)
+			case len(d.Args) > 0:
+				p, err := confFile(c, d.Args[0])
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %s: %v", d.Line, d.Name, err)
+				}
+				file = p
+			default:
+				return nil, fmt.Errorf("line %d: %s needs a file", d.Line, d.Name)
+			}
+			args = append(args, "--"+d.Name, file)
+			if len(d.Args) > 1 {
+				args = append(args, d.Args[1:]...)
+			}
+		case directiveProxy:
+			dargs := d.Args
+			if len(dargs) > 2 && dargs[2] != "auto" && dargs[2] != "auto-nct" {
+				p, err := confFile(c, dargs[2])
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %s: %v", d.Line, d.Name, err)
+				}
+				dargs = append(append(dargs[:2:2], p), dargs[3:]...)
+			}
+			args = append(args, "--"+d.Name)
+			args = append(args, dargs...)
+		case directiveReject:
+			return nil, fmt.Errorf("line %d: directive `%s` is forbidden", d.Line, d.Name)
+		}
+	}
+
+	for p, contents := range inline {
+		if err := ioutil.WriteFile(p, []byte(contents), 0600); err != nil {
+			return nil, fmt.Errorf("unable to write %s: %v", p, err)
+		}
+	}
+	return args, nil
+}
@@ -0,0 +1,209 @@
+package openvpn
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/subgraph/oz"
+)
+
+func TestParseConf(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		conf string
+		dirs []Directive
+	}{
+		{"comments", `# provider config
+; disabled
+client
+remote vpn.example.com 1194 udp # primary
+verb 3 ;trailing comment
+dev tun#0
+`, []Directive{
+			{Name: "client", Line: 3},
+			{Name: "remote", Args: []string{"vpn.example.com", "1194", "udp"}, Line: 4},
+			{Name: "verb", Args: []string{"3"}, Line: 5},
+			{Name: "dev", Args: []string{"tun#0"}, Line: 6},
+		}},
+		{"quotes", `verify-x509-name "C=SE, CN=vpn server" name
+ca 'dir with spaces/ca.crt'
+auth-user-pass "creds \"a\".txt"
+pull-filter ignore route\ 10.0.0.0
+`, []Directive{
+			{Name: "verify-x509-name", Args: []string{"C=SE, CN=vpn server", "name"}, Line: 1},
+			{Name: "ca", Args: []string{"dir with spaces/ca.crt"}, Line: 2},
+			{Name: "auth-user-pass", Args: []string{`creds "a".txt`}, Line: 3},
+			{Name: "pull-filter", Args: []string{"ignore", "route 10.0.0.0"}, Line: 4},
+		}},
+		{"inline", `--dev tun
+<ca>
+-----BEGIN CERTIFICATE-----
+# not a comment
+-----END CERTIFICATE-----
+</ca>
+	<tls-auth>
+key
+	</tls-auth>
+key-direction 1
+auth-user-pass
+`, []Directive{
+			{Name: "dev", Args: []string{"tun"}, Line: 1},
+			{Name: "ca", Inline: "-----BEGIN CERTIFICATE-----\n# not a comment\n-----END CERTIFICATE-----\n", Line: 2},
+			{Name: "tls-auth", Inline: "key\n", Line: 7},
+			{Name: "key-direction", Args: []string{"1"}, Line: 10},
+			{Name: "auth-user-pass", Line: 11},
+		}},
+	} {
+		dirs, err := ParseConf(strings.NewReader(tt.conf))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(dirs, tt.dirs) {
+			t.Errorf("%s: got %+v, expected %+v", tt.name, dirs, tt.dirs)
+		}
+	}
+}
+
+func TestParseConfErrors(t *testing.T) {
+	for _, tt := range []struct {
+		conf, err string
+	}{
+		{"remote \"vpn.example.com 1194\n", "line 1: unterminated quote"},
+		{"client\nremote vpn.example.com\\\n", "line 2: backslash at the end of the line"},
+		{"<ca>\n-----BEGIN CERTIFICATE-----\n", "line 1: <ca> is not closed by </ca>"},
+		{"client\n</key>\n", "line 2: </key> without a matching <key>"},
+		{"remote vpn.example.com 1194 --script-security 2 --up /tmp/x\n", "line 1: argument `--script-security` of remote starts with --"},
+		{"ca ca.crt \"--up\"\n", "line 1: argument `--up` of ca starts with --"},
+		{"remote vpn.example.com\x00--up\n", "line 1: \"vpn.example.com\\x00--up\" contains a NUL or newline character"},
+	} {
+		if _, err := ParseConf(strings.NewReader(tt.conf)); err == nil || err.Error() != tt.err {
+			t.Errorf("ParseConf(%q) = %v, expected %q", tt.conf, err, tt.err)
+		}
+	}
+}
+
+func TestClientArgs(t *testing.T) {
+	run, err := ioutil.TempDir("", "oz-openvpn-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(run)
+	c := &oz.Config{OpenVPNConfDir: "/var/lib/oz/openvpn", OpenVPNRunPath: run}
+
+	for _, tt := range []struct {
+		name string
+		conf string
+		auth string
+		args []string
+		err  string
+	}{
+		{
+			name: "files",
+			conf: "client\ndev tun\nremote vpn.example.com 1194\nca provider/ca.crt\ntls-auth ta.key 1\nauth-user-pass\npersist-tun\nwritepid /tmp/pid\n",
+			auth: "provider/auth.txt",
+			args: []string{"--client", "--dev", "tun", "--remote", "vpn.example.com", "1194",
+				"--ca", "/var/lib/oz/openvpn/provider/ca.crt", "--tls-auth", "/var/lib/oz/openvpn/ta.key", "1",
+				"--auth-nocache", "--auth-user-pass", "/var/lib/oz/openvpn/provider/auth.txt"},
+		},
+		{
+			name: "inline",
+			conf: "remote vpn.example.com\n<ca>\nCA\n</ca>\n<key>\nKEY\n</key>\n<auth-user-pass>\nuser\npass\n</auth-user-pass>\n",
+			args: []string{"--client", "--remote", "vpn.example.com",
+				"--ca", path.Join(run, "test-ca"), "--key", path.Join(run, "test-key"),
+				"--auth-nocache", "--auth-user-pass", path.Join(run, "test-auth-user-pass")},
+		},
+		{
+			name: "auth file of the configuration",
+			conf: "auth-user-pass creds.txt\n",
+			args: []string{"--client", "--auth-nocache", "--auth-user-pass", "/var/lib/oz/openvpn/creds.txt"},
+		},
+		{
+			name: "auth without a file",
+			conf: "remote vpn.example.com\nauth-user-pass\n",
+			err:  "line 2: auth-user-pass needs the authfile of the profile",
+		},
+		{
+			name: "up script",
+			conf: "remote vpn.example.com\nup /etc/openvpn/update-resolv-conf\n",
+			err:  "line 2: directive `up` is forbidden",
+		},
+		{
+			name: "plugin",
+			conf: "plugin /usr/lib/openvpn/openvpn-plugin-down-root.so \"down.sh\"\n",
+			err:  "line 1: directive `plugin` is forbidden",
+		},
+		{
+			name: "unknown directive",
+			conf: "remote vpn.example.com\nlladdr 00:11:22:33:44:55\n",
+			err:  "line 2: directive `lladdr` is not allowed",
+		},
+		{
+			name: "file outside of the configuration directory",
+			conf: "ca ../../../etc/ssl/private/host.key\n",
+			err:  "line 1: ca: `../../../etc/ssl/private/host.key` is not in /var/lib/oz/openvpn",
+		},
+		{
+			name: "absolute file",
+			conf: "key /etc/ssl/private/host.key\n",
+			err:  "line 1: key: `/etc/ssl/private/host.key` is not in /var/lib/oz/openvpn",
+		},
+		{
+			name: "inline block of another directive",
+			conf: "<connection>\nremote vpn.example.com\n</connection>\n",
+			err:  "line 1: directive `connection` is not allowed",
+		},
+		{
+			name: "file directive without a file",
+			conf: "cert\n",
+			err:  "line 1: cert needs a file",
+		},
+		{
+			name: "proxy credentials",
+			conf: "http-proxy proxy.example.com 8080 proxy.txt basic\nsocks-proxy localhost 1080\nhttp-proxy proxy.example.com 8080 auto-nct\n",
+			args: []string{"--client", "--http-proxy", "proxy.example.com", "8080", "/var/lib/oz/openvpn/proxy.txt", "basic",
+				"--socks-proxy", "localhost", "1080", "--http-proxy", "proxy.example.com", "8080", "auto-nct"},
+		},
+		{
+			name: "proxy credentials outside of the configuration directory",
+			conf: "socks-proxy proxy.example.com 1080 /etc/shadow\n",
+			err:  "line 1: socks-proxy: `/etc/shadow` is not in /var/lib/oz/openvpn",
+		},
+	} {
+		dirs, err := ParseConf(strings.NewReader(tt.conf))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		args, err := clientArgs(c, dirs, tt.auth, "test")
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%s: got error %v, expected %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if !reflect.DeepEqual(args, tt.args) {
+			t.Errorf("%s: got %q, expected %q", tt.name, args, tt.args)
+		}
+	}
+
+	for file, contents := range map[string]string{"test-ca": "CA\n", "test-key": "KEY\n", "test-auth-user-pass": "user\npass\n"} {
+		fi, err := os.Stat(path.Join(run, file))
+		if err != nil {
+			t.Errorf("inline file %s not written: %v", file, err)
+			continue
+		}
+		if fi.Mode().Perm() != 0600 {
+			t.Errorf("inline file %s has mode %v", file, fi.Mode())
+		}
+		if b, _ := ioutil.ReadFile(path.Join(run, file)); string(b) != contents {
+			t.Errorf("inline file %s contains %q, expected %q", file, b, contents)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package daemon
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/subgraph/oz/ipc"
+	"github.com/subgraph/oz/xpra"
+)
+
+// handleMute relaunches the xpra client of the sandbox with its speaker and
+// microphone forwarding turned off or back on. The client runs outside of
+// the sandbox, so that the application can not undo it.
+func (d *daemonState) handleMute(msg *MuteMsg, m *ipc.Message) error {
+	sbox := d.sandboxById(msg.Id)
+	if sbox == nil {
+		return m.Respond(&ErrorMsg{fmt.Sprintf("no sandbox found with id = %d", msg.Id)})
+	}
+	if !sbox.profile.XServer.Enabled || !xpra.ForwardsAudio(&sbox.profile.XServer) {
+		return m.Respond(&ErrorMsg{fmt.Sprintf("sandbox %d does not forward audio through xpra", msg.Id)})
+	}
+	d.Info("Sandbox %s (%d) audio muted: %t", sbox.profile.Name, sbox.id, msg.Mute)
+	sbox.muted = msg.Mute
+	sbox.saveState()
+	// The server only keeps the last client attached, stopping the previous
+	// one first avoids it reconnecting
+	if sbox.xpra != nil && sbox.xpra.Process.Process != nil {
+		sbox.xpra.Process.Process.Signal(syscall.SIGTERM)
+	}
+	sbox.startXpraClient()
+	return m.Respond(&OkMsg{})
+}
@@ -0,0 +1,165 @@
+package daemon
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/subgraph/oz"
+)
+
+// Controllers enabled for the sandbox cgroups
+var cgroupControllers = []string{"cpu", "memory", "pids", "io"}
+
+// sandboxCgroup is the cgroup v2 directory holding all the processes of a sandbox
+type sandboxCgroup struct {
+	path string
+}
+
+// CgroupUsage is the current resource usage of a sandbox
+type CgroupUsage struct {
+	// Memory in use, in bytes
+	Memory uint64
+	// CPU time consumed, in microseconds
+	CPUUsec uint64
+	// Number of processes
+	Pids uint64
+}
+
+func cgroupAvailable() bool {
+	_, err := os.Stat("/sys/fs/cgroup/cgroup.controllers")
+	return err == nil
+}
+
+// setupCgroupRoot creates the cgroup containing all the sandboxes and
+// enables the controllers needed to apply the resource limits.
+func setupCgroupRoot(root string) error {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return err
+	}
+	for _, dir := range []string{path.Dir(root), root} {
+		if err := enableControllers(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func enableControllers(dir string) error {
+	bs, err := ioutil.ReadFile(path.Join(dir, "cgroup.controllers"))
+	if err != nil {
+		return err
+	}
+	available := strings.Fields(string(bs))
+	enable := []string{}
+	for _, c := range cgroupControllers {
+		for _, a := range available {
+			if a == c {
+				enable = append(enable, "+"+c)
+			}
+		}
+	}
+	if len(enable) == 0 {
+		return nil
+	}
+	return ioutil.WriteFile(path.Join(dir, "cgroup.subtree_control"), []byte(strings.Join(enable, " ")), 0644)
+}
+
+// createCgroup creates the cgroup of a sandbox and applies the resource
+// limits of the profile. An error is only returned if limits were requested.
+func (d *daemonState) createCgroup(id int, p *oz.Profile) (*sandboxCgroup, error) {
+	vals, err := p.Resources.CgroupValues()
+	if err != nil {
+		return nil, err
+	}
+	if !cgroupAvailable() {
+		if len(vals) > 0 {
+			return nil, fmt.Errorf("resource limits require a cgroup v2 hierarchy mounted on /sys/fs/cgroup")
+		}
+		d.Debug("No cgroup v2 hierarchy found, not creating a cgroup for sandbox %d", id)
+		return nil, nil
+	}
+	root := d.currentConfig().CgroupPath
+	if err := setupCgroupRoot(root); err != nil {
+		if len(vals) > 0 {
+			return nil, fmt.Errorf("unable to setup cgroup hierarchy %s: %v", root, err)
+		}
+		d.Warning("Unable to setup cgroup hierarchy %s, not creating a cgroup for sandbox %d: %v", root, id, err)
+		return nil, nil
+	}
+
+	cg := &sandboxCgroup{path: path.Join(root, fmt.Sprintf("%s-%d", p.Name, id))}
+	if err := os.Mkdir(cg.path, 0755); err != nil && !os.IsExist(err) {
+		return nil, fmt.Errorf("unable to create cgroup %s: %v", cg.path, err)
+	}
+	for file, val := range vals {
+		if err := ioutil.WriteFile(path.Join(cg.path, file), []byte(val), 0644); err != nil {
+			cg.remove()
+			return nil, fmt.Errorf("unable to set %s to `%s`: %v", file, val, err)
+		}
+		d.Debug("Set %s=%s for sandbox %d", file, val, id)
+	}
+	return cg, nil
+}
+
+// addProcess moves a process, and its future children, into the cgroup
+func (cg *sandboxCgroup) addProcess(pid int) error {
+	return ioutil.WriteFile(path.Join(cg.path, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644)
+}
+
+// remove kills any process left in the cgroup and deletes it
+func (cg *sandboxCgroup) remove() error {
+	var err error
+	for i := 0; i < 10; i++ {
+		if err = os.Remove(cg.path); err == nil || os.IsNotExist(err) {
+			return nil
+		}
+		// cgroup.kill is only available since Linux 5.14
+		ioutil.WriteFile(path.Join(cg.path, "cgroup.kill"), []byte("1"), 0644)
+		time.Sleep(100 * time.Millisecond)
+	}
+	return err
+}
+
+// freeze pauses or resumes all the processes of the cgroup
+func (cg *sandboxCgroup) freeze(frozen bool) error {
+	val := "0"
+	if frozen {
+		val = "1"
+	}
+	return ioutil.WriteFile(path.Join(cg.path, "cgroup.freeze"), []byte(val), 0644)
+}
+
+func (cg *sandboxCgroup) usage() CgroupUsage {
+	u := CgroupUsage{
+		Memory: cg.readUint("memory.current"),
+		Pids:   cg.readUint("pids.current"),
+	}
+	f, err := os.Open(path.Join(cg.path, "cpu.stat"))
+	if err != nil {
+		return u
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 2 && fields[0] == "usage_usec" {
+			u.CPUUsec, _ = strconv.ParseUint(fields[1], 10, 64)
+		}
+	}
+	return u
+}
+
+func (cg *sandboxCgroup) readUint(file string) uint64 {
+	bs, err := ioutil.ReadFile(path.Join(cg.path, file))
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.ParseUint(strings.TrimSpace(string(bs)), 10, 64)
+	return n
+}
@@ -209,6 +209,81 @@ func KillSandbox(id int) error {
 	}
 }
 
+func Reload() (*ReloadResp, error) {
+	resp, err := clientSend(&ReloadMsg{})
+	if err != nil {
+		return nil, err
+	}
+	switch body := resp.Body.(type) {
+	case *ErrorMsg:
+		return nil, errors.New(body.Msg)
+	case *ReloadResp:
+		return body, nil
+	default:
+		return nil, fmt.Errorf("Unexpected message received %+v", body)
+	}
+}
+
+func NetStats(id int) (*NetStatsResp, error) {
+	resp, err := clientSend(&NetStatsMsg{Id: id})
+	if err != nil {
+		return nil, err
+	}
+	switch body := resp.Body.(type) {
+	case *ErrorMsg:
+		return nil, errors.New(body.Msg)
+	case *NetStatsResp:
+		return body, nil
+	default:
+		return nil, fmt.Errorf("Unexpected message received %+v", body)
+	}
+}
+
+func Throttle(msg *ThrottleMsg) error {
+	resp, err := clientSend(msg)
+	if err != nil {
+		return err
+	}
+	switch body := resp.Body.(type) {
+	case *ErrorMsg:
+		return errors.New(body.Msg)
+	case *OkMsg:
+		return nil
+	default:
+		return fmt.Errorf("Unexpected message received %+v", body)
+	}
+}
+
+func Mute(id int, mute bool) error {
+	resp, err := clientSend(&MuteMsg{Id: id, Mute: mute})
+	if err != nil {
+		return err
+	}
+	switch body := resp.Body.(type) {
+	case *ErrorMsg:
+		return errors.New(body.Msg)
+	case *OkMsg:
+		return nil
+	default:
+		return fmt.Errorf("Unexpected message received %+v", body)
+	}
+}
+
+func InspectSandbox(id int) (*InspectSandboxResp, error) {
+	resp, err := clientSend(&InspectSandboxMsg{Id: id})
+	if err != nil {
+		return nil, err
+	}
+	switch body := resp.Body.(type) {
+	case *ErrorMsg:
+		return nil, errors.New(body.Msg)
+	case *InspectSandboxResp:
+		return body, nil
+	default:
+		return nil, fmt.Errorf("Unexpected message received %+v", body)
+	}
+}
+
 func RelaunchXpraClient(id int) error {
 	resp, err := clientSend(&RelaunchXpraClientMsg{Id: id})
 	if err != nil {
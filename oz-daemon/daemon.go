@@ -9,13 +9,18 @@ import (
 	"os"
 	"os/signal"
 	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/subgraph/oz"
 	"github.com/subgraph/oz/ipc"
 	"github.com/subgraph/oz/network"
+	"github.com/subgraph/oz/wayland"
+	"github.com/subgraph/oz/wireguard"
 
 	"github.com/op/go-logging"
 )
@@ -41,6 +46,12 @@ type daemonState struct {
 	// openvpns     *network.OpenVPNs
 	systemGroups map[string]groupEntry
 	envOverrides []string
+	reloadLock   sync.Mutex
+	// Guards config, profiles and systemGroups, replaced by a reload
+	configLock sync.RWMutex
+	// Guards sandboxes, and the interfaces of the sandboxes being removed,
+	// read through sandboxList by everything but the launch and the removal
+	sandboxesLock sync.Mutex
 }
 
 func Main() {
@@ -67,6 +78,11 @@ func Main() {
 		d.handleListForwarders,
 		d.handleListBridges,
 		d.handleListProxies,
+		d.handleReload,
+		d.handleInspectSandbox,
+		d.handleNetStats,
+		d.handleThrottle,
+		d.handleMute,
 	)
 	if err != nil {
 		d.log.Error("Error running server: %v", err)
@@ -99,12 +115,22 @@ func initialize() *daemonState {
 	d.nextDisplay = 100
 
 	d.bridges = network.NewBridges(d.log)
+	fw, err := network.NewFirewall(network.FirewallBackend(d.config.FirewallBackend), d.config.FWDaemonSocket, d.log)
+	if err != nil {
+		d.log.Fatalf("Unable to set up the firewall: %v", err)
+	}
+	d.bridges.SetFirewall(fw)
+	if err := d.bridges.EnableIPv6(network.IPv6Mode(d.config.IPv6Mode), d.config.IPv6Prefix); err != nil {
+		d.log.Fatalf("Unable to enable IPv6: %v", err)
+	}
 
 	sockets := path.Join(config.SandboxPath, "sockets")
 	if err := os.MkdirAll(sockets, 0755); err != nil {
 		d.log.Fatalf("Failed to create sockets directory: %v", err)
 	}
 
+	d.restoreSandboxes()
+
 	for _, env := range os.Environ() {
 		if strings.HasPrefix(env, "OZ_") {
 			d.envOverrides = append(d.envOverrides, env)
@@ -114,6 +140,7 @@ func initialize() *daemonState {
 	os.Clearenv()
 
 	go d.processSignals(sigs)
+	go d.refreshFirewallRules()
 
 	return d
 }
@@ -147,14 +174,11 @@ func (d *daemonState) processSignals(c <-chan os.Signal) {
 		sig := <-c
 		switch sig {
 		case syscall.SIGHUP:
-			d.log.Notice("Received HUP signal, reloading profiles.")
+			d.log.Notice("Received HUP signal, reloading configuration and profiles.")
 
-			ps, err := d.loadProfiles(d.config.ProfileDir)
-			if err != nil {
-				d.log.Error("Failed to reload profiles: %v", err)
-				continue
+			if _, err := d.reload(); err != nil {
+				d.log.Error("Reload failed, keeping the current configuration: %v", err)
 			}
-			d.profiles = ps
 		case syscall.SIGUSR2:
 			d.handleNetworkReconfigure()
 		}
@@ -189,50 +213,81 @@ func (d *daemonState) cacheSystemGroups() error {
 	if err := sg.Err(); err != nil {
 		return err
 	}
+	d.configLock.Lock()
 	d.systemGroups = newGroups
+	d.configLock.Unlock()
 	return nil
 }
 
 func (d *daemonState) handleChildExit(pid int, wstatus syscall.WaitStatus) {
 	d.Debug("Child process pid=%d exited from daemon with status %d", pid, wstatus.ExitStatus())
-	for _, sbox := range d.sandboxes {
+	for _, sbox := range d.sandboxList() {
 		if sbox.init.Process.Pid == pid {
-			sbox.remove(d.log)
-
-			/* Terminate OpenVPN client daemon */
-
-			if sbox.ovpn != nil {
-				pidfilepath := path.Join(d.config.OpenVPNRunPath, sbox.ovpn.runtoken+".pid")
-				pid, err := readOpenVPNPidFromFile(pidfilepath)
-				if err != nil {
-					d.Debug("Failed to retrieve openvpn pid: %v", err)
-				}
-				err = syscall.Kill(pid, syscall.SIGTERM)
-				if err != nil {
-					d.Debug("Failed to send openvpn SIGTERM: %v", err)
-				}
-				removeOpenVPNRunState(d, sbox.ovpn.runtoken)
-				sbox.ovpn = nil
-			}
-
+			d.sandboxExited(sbox)
 			return
 		}
+		if o := sbox.ovpn; o != nil {
+			o.lock.Lock()
+			started := o.cmd != nil && o.cmd.Process.Pid == pid
+			o.lock.Unlock()
+			if started {
+				// Forked into the background, or failed to start
+				d.Debug("OpenVPN client of sandbox %d exited with status %d", sbox.id, wstatus.ExitStatus())
+				o.check()
+				return
+			}
+		}
 	}
 	d.Notice("No sandbox found with oz-init pid = %d", pid)
 }
 
+func (d *daemonState) sandboxExited(sbox *Sandbox) {
+	/* Terminate OpenVPN client daemon, before its kill-switch goes */
+
+	if sbox.ovpn != nil {
+		d.stopOpenVPN(sbox.ovpn)
+		sbox.ovpn = nil
+	}
+	/* Its directory is inside the socket directory removed along with the sandbox */
+	if sbox.wlProxy != nil {
+		removeWaylandRunState(d, sbox.wlProxy, path.Dir(sbox.wlProxy.Socket))
+		sbox.wlProxy = nil
+	}
+	sbox.remove(d.log)
+
+	if sbox.wgDev != "" {
+		removeWireGuardRunState(d, sbox.wgDev)
+		sbox.wgDev = ""
+	}
+}
+
 func removeOpenVPNRunState(d *daemonState, runtoken string) {
-	statefiles := [...]string{"-key.key", "-cert.cert", "-ca.cert", ".pid", "-tls-auth.key"}
-	for _, suffix := range statefiles {
-		statefile := path.Join(d.config.OpenVPNRunPath, runtoken+suffix)
-		if _, err := os.Stat(statefile); err == nil {
-			err = os.Remove(statefile)
-			if err != nil {
-				d.Debug("Failed to remove openvpn state artifact at %s: %v", statefile, err)
-			}
+	// The pid file and the inline files of the configuration
+	statefiles, _ := filepath.Glob(path.Join(d.currentConfig().OpenVPNRunPath, runtoken+"[-.]*"))
+	for _, statefile := range statefiles {
+		if err := os.Remove(statefile); err != nil {
+			d.Debug("Failed to remove openvpn state artifact at %s: %v", statefile, err)
 		}
 	}
+}
 
+// removeWireGuardRunState removes the WireGuard interface of a sandbox if it
+// did not go away along with its network namespace
+func removeWireGuardRunState(d *daemonState, dev string) {
+	if err := wireguard.Stop(dev); err != nil {
+		d.Debug("Failed to remove wireguard interface %s: %v", dev, err)
+	}
+}
+
+// removeWaylandRunState stops the Wayland proxy of a sandbox, if running, and
+// removes the directory of its socket
+func removeWaylandRunState(d *daemonState, proxy *wayland.Proxy, dir string) {
+	if proxy != nil {
+		proxy.Close()
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		d.Debug("Failed to remove wayland socket directory %s: %v", dir, err)
+	}
 }
 
 func readOpenVPNPidFromFile(path string) (int, error) {
@@ -269,7 +324,7 @@ func (d *daemonState) handlePing(msg *PingMsg, m *ipc.Message) error {
 
 func (d *daemonState) handleGetConfig(msg *GetConfigMsg, m *ipc.Message) error {
 	d.Debug("received get config with data [%s]", msg.Data)
-	jdata, err := json.Marshal(d.config)
+	jdata, err := json.Marshal(d.currentConfig())
 	if err != nil {
 		return m.Respond(&ErrorMsg{err.Error()})
 	}
@@ -279,7 +334,7 @@ func (d *daemonState) handleGetConfig(msg *GetConfigMsg, m *ipc.Message) error {
 func (d *daemonState) handleListProfiles(msg *ListProfilesMsg, m *ipc.Message) error {
 	r := new(ListProfilesResp)
 	index := 1
-	for _, p := range d.profiles {
+	for _, p := range d.currentProfiles() {
 		r.Profiles = append(r.Profiles, Profile{Index: index, Name: p.Name, Path: p.Path})
 		index += 1
 	}
@@ -348,7 +403,7 @@ func (d *daemonState) handleLaunch(msg *LaunchMsg, m *ipc.Message) error {
 			return m.Respond(&ErrorMsg{errmsg})
 		} else {
 			d.Info("Found running sandbox for `%s`, running program there", p.Name)
-			sbox.launchProgram(d.config.PrefixPath, msg.Path, msg.Pwd, msg.Args, d.log)
+			sbox.launchProgram(d.currentConfig().PrefixPath, msg.Path, msg.Pwd, msg.Args, d.log)
 		}
 	} else {
 		d.Debug("Would launch %s (ephemeral: %b)", p.Name, msg.Ephemeral)
@@ -366,7 +421,7 @@ func (d *daemonState) handleLaunch(msg *LaunchMsg, m *ipc.Message) error {
 func (d *daemonState) sanitizeEnvironment(p *oz.Profile, oldEnv []string) []string {
 	newEnv := []string{}
 
-	for _, EnvItem := range d.config.EnvironmentVars {
+	for _, EnvItem := range d.currentConfig().EnvironmentVars {
 		if strings.Contains(EnvItem, "=") {
 			newEnv = append(newEnv, EnvItem)
 			continue
@@ -402,28 +457,36 @@ func (d *daemonState) sanitizeEnvironment(p *oz.Profile, oldEnv []string) []stri
 		}
 	}
 
+	if p.Networking.Nettype == network.TYPE_PROXY {
+		for _, item := range network.EgressProxyEnv(p.Networking.EgressProxyPort()) {
+			if !envHasName(newEnv, item[:strings.Index(item, "=")]) {
+				newEnv = append(newEnv, item)
+			}
+		}
+	}
+
 	return newEnv
 }
 
+// envHasName returns true if the environment sets the variable
+func envHasName(env []string, name string) bool {
+	for _, item := range env {
+		if strings.HasPrefix(item, name+"=") {
+			return true
+		}
+	}
+	return false
+}
+
 func (d *daemonState) handleKillSandbox(msg *KillSandboxMsg, m *ipc.Message) error {
 	if msg.Id == -1 {
-		for _, sb := range d.sandboxes {
+		for _, sb := range d.sandboxList() {
 			if err := sb.init.Process.Signal(os.Interrupt); err != nil {
 				return m.Respond(&ErrorMsg{fmt.Sprintf("failed to send interrupt signal: %v", err)})
 			}
 			if sb.ovpn != nil {
-				pidfilepath := path.Join(d.config.OpenVPNRunPath, sb.ovpn.runtoken+".pid")
-				pid, err := readOpenVPNPidFromFile(pidfilepath)
-				if err != nil {
-					d.Debug("Failed to retrieve openvpn pid: %v", err)
-				}
-				err = syscall.Kill(pid, syscall.SIGTERM)
-				if err != nil {
-					d.Debug("Failed to send openvpn SIGTERM: %v", err)
-				}
-				removeOpenVPNRunState(d, sb.ovpn.runtoken)
+				d.stopOpenVPN(sb.ovpn)
 				sb.ovpn = nil
-
 			}
 		}
 	} else {
@@ -435,16 +498,7 @@ func (d *daemonState) handleKillSandbox(msg *KillSandboxMsg, m *ipc.Message) err
 			return m.Respond(&ErrorMsg{fmt.Sprintf("failed to send interrupt signal: %v", err)})
 		}
 		if sbox.ovpn != nil {
-			pidfilepath := path.Join(d.config.OpenVPNRunPath, sbox.ovpn.runtoken+".pid")
-			pid, err := readOpenVPNPidFromFile(pidfilepath)
-			if err != nil {
-				d.Debug("Failed to retrieve openvpn pid: %v", err)
-			}
-			err = syscall.Kill(pid, syscall.SIGTERM)
-			if err != nil {
-				d.Debug("Failed to send openvpn SIGTERM: %v", err)
-			}
-			removeOpenVPNRunState(d, sbox.ovpn.runtoken)
+			d.stopOpenVPN(sbox.ovpn)
 			sbox.ovpn = nil
 		}
 	}
@@ -453,7 +507,7 @@ func (d *daemonState) handleKillSandbox(msg *KillSandboxMsg, m *ipc.Message) err
 
 func (d *daemonState) handleRelaunchXpraClient(msg *RelaunchXpraClientMsg, m *ipc.Message) error {
 	if msg.Id == -1 {
-		for _, sb := range d.sandboxes {
+		for _, sb := range d.sandboxList() {
 			sb.startXpraClient()
 		}
 	} else {
@@ -471,7 +525,7 @@ func (d *daemonState) handleMountFiles(msg *MountFilesMsg, m *ipc.Message) error
 	if sbox == nil {
 		return m.Respond(&ErrorMsg{fmt.Sprintf("no sandbox found with id = %d", msg.Id)})
 	}
-	if err := sbox.MountFiles(msg.Files, msg.ReadOnly, d.config.PrefixPath, d.log); err != nil {
+	if err := sbox.MountFiles(msg.Files, msg.ReadOnly, d.currentConfig().PrefixPath, d.log); err != nil {
 		return m.Respond(&ErrorMsg{fmt.Sprintf("Unable to mount: %v", err)})
 	}
 	return m.Respond(&OkMsg{})
@@ -482,7 +536,7 @@ func (d *daemonState) handleUnmountFile(msg *UnmountFileMsg, m *ipc.Message) err
 	if sbox == nil {
 		return m.Respond(&ErrorMsg{fmt.Sprintf("no sandbox found with id = %d", msg.Id)})
 	}
-	if err := sbox.UnmountFile(msg.File, d.config.PrefixPath, d.log); err != nil {
+	if err := sbox.UnmountFile(msg.File, d.currentConfig().PrefixPath, d.log); err != nil {
 		return m.Respond(&ErrorMsg{fmt.Sprintf("Unable to unmount: %v", err)})
 	}
 	return m.Respond(&OkMsg{})
@@ -513,7 +567,7 @@ func (d *daemonState) handleAskForwarder(msg *AskForwarderMsg, m *ipc.Message) e
 }
 
 func (d *daemonState) sandboxById(id int) *Sandbox {
-	for _, sb := range d.sandboxes {
+	for _, sb := range d.sandboxList() {
 		if sb.id == id {
 			return sb
 		}
@@ -529,7 +583,7 @@ func (d *daemonState) getProfileFromLaunchMsg(msg *LaunchMsg) (*oz.Profile, erro
 }
 
 func (d *daemonState) getProfileByPath(cpath string) (*oz.Profile, error) {
-	for _, p := range d.profiles {
+	for _, p := range d.currentProfiles() {
 		if p.Path == cpath {
 			return p, nil
 		}
@@ -544,14 +598,15 @@ func (d *daemonState) getProfileByPath(cpath string) (*oz.Profile, error) {
 }
 
 func (d *daemonState) getProfileByIdxOrName(index int, name string) (*oz.Profile, error) {
+	ps := d.currentProfiles()
 	if len(name) == 0 {
-		if index < 1 || index > len(d.profiles) {
+		if index < 1 || index > len(ps) {
 			return nil, fmt.Errorf("not a valid profile index (%d)", index)
 		}
-		return d.profiles[index-1], nil
+		return ps[index-1], nil
 	}
 
-	for _, p := range d.profiles {
+	for _, p := range ps {
 		if p.Name == name {
 			return p, nil
 		}
@@ -560,7 +615,7 @@ func (d *daemonState) getProfileByIdxOrName(index int, name string) (*oz.Profile
 }
 
 func (d *daemonState) getRunningSandboxByName(name string) *Sandbox {
-	for _, sb := range d.sandboxes {
+	for _, sb := range d.sandboxList() {
 		if sb.profile.Name == name {
 			return sb
 		}
@@ -571,8 +626,17 @@ func (d *daemonState) getRunningSandboxByName(name string) *Sandbox {
 
 func (d *daemonState) handleListSandboxes(list *ListSandboxesMsg, msg *ipc.Message) error {
 	r := new(ListSandboxesResp)
-	for _, sb := range d.sandboxes {
-		r.Sandboxes = append(r.Sandboxes, SandboxInfo{Id: sb.id, Address: sb.addr, Mounts: sb.mountedFiles, Profile: sb.profile.Name, InitPid: sb.init.Process.Pid})
+	for _, sb := range d.sandboxList() {
+		info := SandboxInfo{Id: sb.id, Address: sb.addr, Mounts: sb.mountedFiles, Profile: sb.profile.Name, Ephemeral: sb.ephemeral, InitPid: sb.init.Process.Pid, ShutdownIn: sb.shutdownIn()}
+		if sb.cgroup != nil {
+			usage := sb.cgroup.usage()
+			info.Usage = &usage
+		}
+		if sb.ovpn != nil {
+			state, _, _ := sb.ovpn.status()
+			info.VPN = string(state)
+		}
+		r.Sandboxes = append(r.Sandboxes, info)
 	}
 	return msg.Respond(r)
 }
@@ -617,5 +681,49 @@ func (d *daemonState) handleLogs(logs *LogsMsg, msg *ipc.Message) error {
 }
 
 func (d *daemonState) handleNetworkReconfigure() {
-	d.bridges.Reconfigure()
+	if err := d.bridges.Reconfigure(); err != nil {
+		d.Warning("Unable to reconfigure the bridges: %v", err)
+	}
+	for _, sb := range d.sandboxList() {
+		if sb.iface != nil {
+			sb.saveState()
+		}
+	}
+}
+
+// sandboxList returns a snapshot of the running sandboxes for the goroutines
+// of the daemon
+func (d *daemonState) sandboxList() []*Sandbox {
+	d.sandboxesLock.Lock()
+	defer d.sandboxesLock.Unlock()
+	return append([]*Sandbox(nil), d.sandboxes...)
+}
+
+// How often the host names used in firewall rules are resolved again
+const fwRefreshInterval = 5 * time.Minute
+
+// refreshFirewallRules periodically updates the firewall rules using host
+// names whose addresses have changed
+func (d *daemonState) refreshFirewallRules() {
+	for {
+		time.Sleep(fwRefreshInterval)
+		d.sandboxesLock.Lock()
+		var sboxes []*Sandbox
+		var ifaces []*network.OzVeth
+		for _, sb := range d.sandboxes {
+			if sb.iface != nil {
+				sboxes = append(sboxes, sb)
+				ifaces = append(ifaces, sb.iface)
+			}
+		}
+		d.sandboxesLock.Unlock()
+
+		// The names are resolved without holding the lock, the rules of a
+		// sandbox removed meanwhile are left alone by the veth
+		for i, iface := range ifaces {
+			if err := iface.RefreshFWRules(); err != nil {
+				d.Warning("Unable to refresh firewall rules of sandbox %s (%d): %v", sboxes[i].profile.Name, sboxes[i].id, err)
+			}
+		}
+	}
 }
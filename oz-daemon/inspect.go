@@ -0,0 +1,152 @@
+package daemon
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/subgraph/oz/ipc"
+)
+
+func (d *daemonState) handleInspectSandbox(msg *InspectSandboxMsg, m *ipc.Message) error {
+	sbox := d.sandboxById(msg.Id)
+	if sbox == nil {
+		return m.Respond(&ErrorMsg{fmt.Sprintf("no sandbox found with id = %d", msg.Id)})
+	}
+	return m.Respond(sbox.inspect())
+}
+
+func (sbox *Sandbox) inspect() *InspectSandboxResp {
+	r := &InspectSandboxResp{
+		Id:           sbox.id,
+		Profile:      *sbox.profile,
+		Address:      sbox.addr,
+		InitPid:      sbox.init.Process.Pid,
+		Ephemeral:    sbox.ephemeral,
+		UserNS:       sbox.userns,
+		Uid:          sbox.cred.Uid,
+		Gid:          sbox.cred.Gid,
+		Gids:         sbox.cred.Groups,
+		Display:      sbox.display,
+		SeccompMode:  string(sbox.profile.Seccomp.Mode),
+		MountedFiles: sbox.mountedFiles,
+		Started:      sbox.started,
+		Uptime:       int64(time.Since(sbox.started).Seconds()),
+		ShutdownIn:   sbox.shutdownIn(),
+	}
+	if sbox.user != nil {
+		r.User = sbox.user.Username
+	}
+	if sbox.iface != nil {
+		if ifc := sbox.iface.NetInterface(); ifc != nil {
+			r.Veth = ifc.Name
+		}
+		if ip := sbox.iface.GetSandboxIP(); ip != nil {
+			r.IP = ip.String()
+		}
+		if ip := sbox.iface.GetSandboxIP6(); ip != nil {
+			r.IP6 = ip.String()
+		}
+		if br := sbox.iface.GetVethBridge(); br != nil {
+			r.Bridge = br.Name
+		}
+		if bw := sbox.iface.GetBandwidth(); bw.Limited() {
+			r.Bandwidth = bw.String()
+		}
+	}
+	for _, f := range sbox.forwarders {
+		r.Forwarders = append(r.Forwarders, Forwarder{Name: f.name, Target: f.dest, Desc: f.desc})
+	}
+	if o := sbox.ovpn; o != nil {
+		r.OpenVPNRunToken = o.runtoken
+		pidfilepath := path.Join(sbox.daemon.currentConfig().OpenVPNRunPath, o.runtoken+".pid")
+		o.lock.Lock()
+		if pid, err := readOpenVPNPidFromFile(pidfilepath); err == nil {
+			r.OpenVPNPid = pid
+		} else if o.cmd != nil && o.cmd.Process != nil {
+			r.OpenVPNPid = o.cmd.Process.Pid
+		}
+		o.lock.Unlock()
+		state, tunnel, restarts := o.status()
+		r.VPNState, r.VPNTunnel, r.VPNRestarts = string(state), tunnel, restarts
+	}
+	r.WireGuardDev = sbox.wgDev
+	r.Muted = sbox.muted
+
+	procs, err := sandboxProcesses(r.InitPid)
+	if err != nil {
+		sbox.daemon.Warning("Unable to list processes of sandbox %d: %v", sbox.id, err)
+	}
+	r.Processes = procs
+
+	mounts, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/mounts", r.InitPid))
+	if err != nil {
+		sbox.daemon.Warning("Unable to read mount table of sandbox %d: %v", sbox.id, err)
+	}
+	for _, line := range strings.Split(string(mounts), "\n") {
+		if line != "" {
+			r.Mounts = append(r.Mounts, line)
+		}
+	}
+	return r
+}
+
+// sandboxProcesses returns all the processes sharing the pid namespace of the init process
+func sandboxProcesses(initPid int) ([]SandboxProcess, error) {
+	ns, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/pid", initPid))
+	if err != nil {
+		return nil, err
+	}
+	dirs, err := filepath.Glob("/proc/[0-9]*")
+	if err != nil {
+		return nil, err
+	}
+	procs := []SandboxProcess{}
+	for _, dir := range dirs {
+		if pns, err := os.Readlink(path.Join(dir, "ns/pid")); err != nil || pns != ns {
+			continue
+		}
+		hostPid, err := strconv.Atoi(path.Base(dir))
+		if err != nil {
+			continue
+		}
+		cmdline, err := ioutil.ReadFile(path.Join(dir, "cmdline"))
+		if err != nil {
+			// The process has exited in the meantime
+			continue
+		}
+		procs = append(procs, SandboxProcess{
+			Pid:     namespacePid(dir, hostPid),
+			HostPid: hostPid,
+			Cmdline: strings.TrimSpace(string(bytes.Replace(cmdline, []byte{0}, []byte{' '}, -1))),
+		})
+	}
+	return procs, nil
+}
+
+// namespacePid returns the pid of a process as seen from inside its own
+// namespace, that is the last entry of the NSpid line from the status file
+func namespacePid(dir string, hostPid int) int {
+	f, err := os.Open(path.Join(dir, "status"))
+	if err != nil {
+		return hostPid
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) > 1 && fields[0] == "NSpid:" {
+			if pid, err := strconv.Atoi(fields[len(fields)-1]); err == nil {
+				return pid
+			}
+		}
+	}
+	return hostPid
+}
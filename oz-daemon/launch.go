@@ -18,12 +18,16 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/subgraph/oz"
 	"github.com/subgraph/oz/network"
 	"github.com/subgraph/oz/openvpn"
 	"github.com/subgraph/oz/oz-init"
+	"github.com/subgraph/oz/wayland"
+	"github.com/subgraph/oz/wireguard"
 	"github.com/subgraph/oz/xpra"
 
 	"github.com/op/go-logging"
@@ -49,12 +53,29 @@ type Sandbox struct {
 	rawEnv       []string
 	forwarders   []ActiveForwarder
 	ovpn         *OpenVPN
+	wgDev        string
+	wlProxy      *wayland.Proxy
+	muted        bool
 	ephemeral    bool
+	shutdownAt   int64 // Unix time, accessed atomically
+	started      time.Time
+	cgroup       *sandboxCgroup
+	userns       bool
 }
 
 type OpenVPN struct {
 	cmd      *exec.Cmd
 	runtoken string
+
+	// Health of the client, see monitorVPN
+	lock     sync.Mutex
+	state    VPNState
+	tunnel   string
+	restarts int
+	wake     chan struct{}
+	done     chan struct{}
+	exited   chan struct{}
+	stopOnce sync.Once
 }
 
 type ActiveForwarder struct {
@@ -93,7 +114,7 @@ func createSocketPath(base, prefix string) (string, error) {
 	return path.Join(base, fmt.Sprintf("%s-%s", prefix, hex.EncodeToString(bs))), nil
 }
 
-func createInitCommand(initPath string, cloneNet bool) *exec.Cmd {
+func createInitCommand(initPath string, cloneNet bool, usermap *userNamespaceMap) *exec.Cmd {
 	cmd := exec.Command(initPath)
 	cmd.Dir = "/"
 
@@ -111,12 +132,19 @@ func createInitCommand(initPath string, cloneNet bool) *exec.Cmd {
 		Cloneflags: cloneFlags,
 	}
 
+	if usermap != nil {
+		cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWUSER
+		cmd.SysProcAttr.UidMappings = usermap.uids
+		cmd.SysProcAttr.GidMappings = usermap.gids
+		cmd.SysProcAttr.GidMappingsEnableSetgroups = true
+	}
+
 	cmd.Env = []string{}
 
 	return cmd
 }
 
-func (d *daemonState) launch(p *oz.Profile, msg *LaunchMsg, rawEnv []string, uid, gid uint32, ephemeral bool, log *logging.Logger) (*Sandbox, error) {
+func (d *daemonState) launch(p *oz.Profile, msg *LaunchMsg, rawEnv []string, uid, gid uint32, ephemeral bool, log *logging.Logger) (sbox *Sandbox, err error) {
 	/*
 		u, err := user.LookupId(fmt.Sprintf("%d", uid))
 		if err != nil {
@@ -137,6 +165,7 @@ func (d *daemonState) launch(p *oz.Profile, msg *LaunchMsg, rawEnv []string, uid
 	if err != nil {
 		return nil, fmt.Errorf("Unable to sanitize user groups: %v", err)
 	}
+	config := d.currentConfig()
 
 	display := 0
 	if p.XServer.Enabled && p.Networking.Nettype == network.TYPE_HOST {
@@ -144,12 +173,22 @@ func (d *daemonState) launch(p *oz.Profile, msg *LaunchMsg, rawEnv []string, uid
 		d.nextDisplay += 1
 	}
 
-	socketPath, err := createSocketPath(path.Join(d.config.SandboxPath, "sockets"), "oz-init-control")
+	var usermap *userNamespaceMap
+	socketDir := path.Join(config.SandboxPath, "sockets")
+	if p.UseUserNamespace(config) {
+		socketDir, err = d.prepareUserNamespace(d.nextSboxId)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to prepare user namespace: %v", err)
+		}
+		usermap = newUserNamespaceMap(config.UserNSRoot, uid, gid, groups)
+	}
+
+	socketPath, err := createSocketPath(socketDir, "oz-init-control")
 	if err != nil {
 		return nil, fmt.Errorf("Failed to create random socket path: %v", err)
 	}
-	initPath := path.Join(d.config.PrefixPath, "bin", "oz-init")
-	cmd := createInitCommand(initPath, (p.Networking.Nettype != network.TYPE_HOST))
+	initPath := path.Join(config.PrefixPath, "bin", "oz-init")
+	cmd := createInitCommand(initPath, (p.Networking.Nettype != network.TYPE_HOST), usermap)
 	pp, err := cmd.StderrPipe()
 	if err != nil {
 		//fs.Cleanup()
@@ -162,17 +201,49 @@ func (d *daemonState) launch(p *oz.Profile, msg *LaunchMsg, rawEnv []string, uid
 	}
 	cmd.Env = append(cmd.Env, d.envOverrides...)
 
+	var wlProxy *wayland.Proxy
+	waylandDir := ""
+	if p.Display.Type == oz.PROFILE_DISPLAY_WAYLAND_PROXY {
+		wlProxy, err = d.startWaylandProxy(p, d.nextSboxId, socketDir, rawEnv, uid, gid)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to start Wayland proxy: %v", err)
+		}
+		waylandDir = path.Dir(wlProxy.Socket)
+		defer func() {
+			// Once the sandbox exists, it is torn down along with it
+			if err != nil && wlProxy != nil {
+				removeWaylandRunState(d, wlProxy, waylandDir)
+			}
+		}()
+	}
+
+	initProfile := *p
+	var wgConf *wireguard.Conf
+	if p.Networking.VPNConf.VpnType == oz.PROFILE_VPN_WIREGUARD {
+		if p.Networking.Nettype != network.TYPE_BRIDGE && p.Networking.Nettype != network.TYPE_EMPTY {
+			return nil, fmt.Errorf("WireGuard requires bridge or empty networking")
+		}
+		wgConf, err = wireguard.LoadConf(config, p.Networking.VPNConf.ConfigPath)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load WireGuard configuration: %v", err)
+		}
+		if len(p.Networking.VPNConf.DNS) == 0 {
+			initProfile.Networking.VPNConf.DNS = wgConf.DNS
+		}
+	}
+
 	jdata, err := json.Marshal(ozinit.InitData{
-		Display:   display,
-		User:      *u,
-		Uid:       uid,
-		Gid:       gid,
-		Gids:      groups,
-		Profile:   *p,
-		Config:    *d.config,
-		Sockaddr:  socketPath,
-		LaunchEnv: msg.Env,
-		Ephemeral: ephemeral,
+		Display:    display,
+		User:       *u,
+		Uid:        uid,
+		Gid:        gid,
+		Gids:       groups,
+		Profile:    initProfile,
+		Config:     *config,
+		Sockaddr:   socketPath,
+		LaunchEnv:  msg.Env,
+		Ephemeral:  ephemeral,
+		WaylandDir: waylandDir,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("Unable to marshal init state: %+v", err)
@@ -180,12 +251,27 @@ func (d *daemonState) launch(p *oz.Profile, msg *LaunchMsg, rawEnv []string, uid
 	io.Copy(pi, bytes.NewBuffer(jdata))
 	pi.Close()
 
+	cgroup, err := d.createCgroup(d.nextSboxId, p)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to apply resource limits: %v", err)
+	}
+
 	if err := cmd.Start(); err != nil {
 		//fs.Cleanup()
+		if cgroup != nil {
+			cgroup.remove()
+		}
 		return nil, fmt.Errorf("Unable to start process: %+v", err)
 	}
+	if cgroup != nil {
+		if err := cgroup.addProcess(cmd.Process.Pid); err != nil {
+			cmd.Process.Kill()
+			cgroup.remove()
+			return nil, fmt.Errorf("Unable to move oz-init into its cgroup: %v", err)
+		}
+	}
 	//rootfs := path.Join(d.config.SandboxPath, "rootfs")
-	sbox := &Sandbox{
+	sbox = &Sandbox{
 		daemon:  d,
 		id:      d.nextSboxId,
 		display: display,
@@ -193,13 +279,26 @@ func (d *daemonState) launch(p *oz.Profile, msg *LaunchMsg, rawEnv []string, uid
 		init:    cmd,
 		cred:    &syscall.Credential{Uid: uid, Gid: gid, Groups: msg.Gids},
 		user:    u,
-		fs:      fs.NewFilesystem(d.config, log, u, p),
+		fs:      fs.NewFilesystem(config, log, u, p),
 		//addr:    path.Join(rootfs, ozinit.SocketAddress),
 		addr:      socketPath,
 		stderr:    pp,
 		rawEnv:    rawEnv,
 		ephemeral: ephemeral,
-	}
+		started:   time.Now(),
+		cgroup:    cgroup,
+		userns:    usermap != nil,
+		wlProxy:   wlProxy,
+	}
+	wlProxy = nil
+	// Tear down what was set up so far, as when oz-init exits, if the
+	// sandbox fails to start
+	defer func(sbox *Sandbox) {
+		if err != nil {
+			sbox.init.Process.Kill()
+			d.sandboxExited(sbox)
+		}
+	}(sbox)
 
 	sbox.ready.Add(1)
 	sbox.waiting.Add(1)
@@ -207,55 +306,54 @@ func (d *daemonState) launch(p *oz.Profile, msg *LaunchMsg, rawEnv []string, uid
 
 	sbox.waiting.Wait()
 
-        //pname := fmt.Sprintf("%s (%d)", sbox.profile.Name, sbox.id)
-        log.Noticef("Registering %s (%d) init pid %d with fw-daemon", sbox.profile.Name, sbox.id, sbox.init.Process.Pid)
-        err = registerSandboxPid(sbox.init.Process.Pid, sbox.profile.Name, sbox.id)
-
-        if err != nil {
- 	       log.Error("Error registering sandbox init pid with fw-daemon: ", err)
-        }
-
+	if network.FirewallBackend(config.FirewallBackend) == network.FW_BACKEND_FWDAEMON {
+		log.Noticef("Registering %s (%d) init pid %d with fw-daemon", sbox.profile.Name, sbox.id, sbox.init.Process.Pid)
+		if err := registerSandboxPid(config.FWDaemonSocket, sbox.init.Process.Pid, sbox.profile.Name, sbox.id); err != nil {
+			log.Error("Error registering sandbox init pid with fw-daemon: ", err)
+		}
+	}
 
 	if p.Networking.Nettype == network.TYPE_BRIDGE {
 		if err := sbox.configureBridgedIface(); err != nil {
-			cmd.Process.Kill()
 			return nil, fmt.Errorf("Unable to setup bridged networking: %+v", err)
 		}
 
-		//pname := fmt.Sprintf("%s (%d)", sbox.profile.Name, sbox.id)
-//		err := registerSandboxPid(sbox.init.Process.Pid, sbox.profile.Name, sbox.id)
-//		log.Notice("Registering init pid with fw-daemon..")
-
-//		if err != nil {
-//			log.Error("Error registering sandbox init pid with fw-daemon: ", err)
-//		}
-		if len(p.Firewall) == 0 {
-			log.Notice("XXX: no firewall rules found in profile... skipping.")
-		} else {
-			log.Notice("XXX: setup virtual bridge device: ", sbox.iface.GetSandboxIP().String())
-
-			for r := 0; r < len(p.Firewall); r++ {
-				log.Noticef("XXX: whitelist = %v, dsthost = %v, dstport = %v\n", p.Firewall[r].Whitelist, p.Firewall[r].DstHost, p.Firewall[r].DstPort)
-				success, err := setupFWRule(true, p.Firewall[r].Whitelist, sbox.iface.GetSandboxIP().String(), p.Firewall[r].DstHost, uint16(p.Firewall[r].DstPort), sbox.init.Process.Pid)
-				log.Noticef("XXX: success = %v, err = %v\n", success, err)
-			}
-
+		rs, err := p.FirewallRuleset()
+		if err == nil {
+			err = sbox.iface.SetupFWRules(rs)
 		}
-		if p.Networking.VPNConf.VpnType == "openvpn" {
-			var ovpn OpenVPN
+		if err != nil {
+			return nil, fmt.Errorf("Unable to install firewall rules: %v", err)
+		}
+		if p.Networking.VPNConf.VpnType == oz.PROFILE_VPN_OPENVPN {
+			// Nothing goes out before the tunnel is up. If the sandbox fails
+			// to start, the kill-switch goes along with the veth.
+			if err := sbox.iface.SetKillSwitch(""); err != nil {
+				return nil, fmt.Errorf("Unable to install VPN kill-switch: %v", err)
+			}
+			ovpn := &OpenVPN{}
 			ovpn.runtoken, err = createRunToken("openvpn")
-			sbox.ovpn = &ovpn
 			if err != nil {
 				return nil, fmt.Errorf("Unable to create run token: %+v", err)
 			}
+			sbox.ovpn = ovpn
 			ovpn.cmd, err = sbox.startOpenVPN(ovpn.runtoken)
 			if err != nil {
 				return nil, fmt.Errorf("Unable to start VPN: %+v", err)
 			}
-			log.Info("VPN started, pid %n\n", ovpn.cmd.Process.Pid)
+			if ovpn.cmd != nil {
+				log.Info("VPN started, pid %d", ovpn.cmd.Process.Pid)
+			}
+			sbox.startVPNMonitor(ovpn)
 		}
 
 	}
+	if wgConf != nil {
+		if err := sbox.startWireGuard(wgConf); err != nil {
+			return nil, fmt.Errorf("Unable to start VPN: %v", err)
+		}
+		log.Info("WireGuard interface %s moved to %s (id=%d)", sbox.wgDev, sbox.profile.Name, sbox.id)
+	}
 	cmd.Process.Signal(syscall.SIGUSR1)
 
 	wgNet := new(sync.WaitGroup)
@@ -266,17 +364,27 @@ func (d *daemonState) launch(p *oz.Profile, msg *LaunchMsg, rawEnv []string, uid
 		go func() {
 			defer wgNet.Done()
 			sbox.ready.Wait()
-			err := network.ProxySetup(sbox.init.Process.Pid, p.Networking.Sockets, d.log, sbox.ready)
+			err := network.ProxySetup(sbox.init.Process.Pid, p.Networking.Sockets, d.log)
 			if err != nil {
 				log.Warning("Unable to create connection proxy: %+s", err)
 			}
 		}()
 	}
+	if p.Networking.Nettype == network.TYPE_PROXY {
+		wgNet.Add(1)
+		go func() {
+			defer wgNet.Done()
+			sbox.ready.Wait()
+			if err := sbox.startEgressProxy(); err != nil {
+				log.Warning("Unable to start egress proxy: %v", err)
+			}
+		}()
+	}
 	if !msg.Noexec {
 		go func() {
 			sbox.ready.Wait()
 			wgNet.Wait()
-			go sbox.launchProgram(d.config.PrefixPath, msg.Path, msg.Pwd, msg.Args, log)
+			go sbox.launchProgram(config.PrefixPath, msg.Path, msg.Pwd, msg.Args, log)
 		}()
 	}
 
@@ -287,20 +395,25 @@ func (d *daemonState) launch(p *oz.Profile, msg *LaunchMsg, rawEnv []string, uid
 		}()
 	}
 	d.nextSboxId += 1
+	d.sandboxesLock.Lock()
 	d.sandboxes = append(d.sandboxes, sbox)
+	d.sandboxesLock.Unlock()
+	sbox.saveState()
 	return sbox, nil
 }
 
 func (d *daemonState) sanitizeGroups(p *oz.Profile, username string, gids []uint32) (map[string]uint32, error) {
-	allowedGroups := d.config.DefaultGroups
+	allowedGroups := d.currentConfig().DefaultGroups
 	allowedGroups = append(allowedGroups, p.AllowedGroups...)
-	if len(d.systemGroups) == 0 {
+	systemGroups := d.currentSystemGroups()
+	if len(systemGroups) == 0 {
 		if err := d.cacheSystemGroups(); err != nil {
 			return nil, err
 		}
+		systemGroups = d.currentSystemGroups()
 	}
 	groups := map[string]uint32{}
-	for _, sg := range d.systemGroups {
+	for _, sg := range systemGroups {
 		for _, gg := range allowedGroups {
 			if sg.Name == gg {
 				found := false
@@ -326,18 +439,61 @@ func (d *daemonState) sanitizeGroups(p *oz.Profile, username string, gids []uint
 func (sbox *Sandbox) startOpenVPN(runtoken string) (c *exec.Cmd, err error) {
 	bname := "oz-" + sbox.getBridgeName()
 	bip := sbox.iface.GetVethBridge().GetIP()
-	rtable := fmt.Sprintf("%d", sbox.daemon.config.RouteTableBase+sbox.id)
+	rtable := fmt.Sprintf("%d", sbox.daemon.currentConfig().RouteTableBase+sbox.id)
 	conf := sbox.profile.Networking.VPNConf.ConfigPath
 	if conf == "" {
-		sbox.daemon.log.Warning("OpenVPN Conf not specified for %s (id=%d)", sbox.profile.Name, sbox.id)
-		return nil, err
+		return nil, fmt.Errorf("OpenVPN Conf not specified for %s (id=%d)", sbox.profile.Name, sbox.id)
 	}
+	// Optional if the configuration has its credentials
 	authpath := sbox.profile.Networking.VPNConf.UserPassFilePath
-	if authpath == "" {
-		sbox.daemon.log.Warning("OpenVPN credential locations not specified for %s (id=%d)", sbox.profile.Name, sbox.id)
+	return openvpn.StartOpenVPN(sbox.daemon.currentConfig(), conf, bip, rtable, bname, authpath, runtoken)
+}
+
+// startWaylandProxy creates the directory of the Wayland proxy socket of a
+// sandbox, which oz-init binds into it, and starts relaying the connections
+// to the compositor of the user
+func (d *daemonState) startWaylandProxy(p *oz.Profile, id int, socketDir string, rawEnv []string, uid, gid uint32) (*wayland.Proxy, error) {
+	upstream, err := wayland.CompositorSocket(rawEnv, int(uid))
+	if err != nil {
+		return nil, fmt.Errorf("no Wayland compositor: %v", err)
+	}
+	for _, iface := range p.Display.Extensions {
+		if wayland.IsPrivileged(iface) {
+			d.Warning("Profile %s allows the privileged Wayland interface %s", p.Name, iface)
+		}
+	}
+	dir, err := createSocketPath(socketDir, "oz-wayland")
+	if err != nil {
 		return nil, err
 	}
-	return openvpn.StartOpenVPN(sbox.daemon.config, conf, bip, rtable, bname, authpath, runtoken)
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return nil, err
+	}
+	if err := os.Chown(dir, int(uid), int(gid)); err != nil {
+		os.Remove(dir)
+		return nil, err
+	}
+	proxy, err := wayland.NewProxy(path.Join(dir, wayland.SocketName), upstream, p.Display.Extensions, fmt.Sprintf("%s (id=%d)", p.Name, id), d.log)
+	if err != nil {
+		os.Remove(dir)
+		return nil, err
+	}
+	if err := os.Chown(proxy.Socket, int(uid), int(gid)); err != nil {
+		removeWaylandRunState(d, proxy, dir)
+		return nil, err
+	}
+	return proxy, nil
+}
+
+// startWireGuard creates the WireGuard interface of the sandbox, through
+// which all of its traffic goes
+func (sbox *Sandbox) startWireGuard(conf *wireguard.Conf) error {
+	dev := fmt.Sprintf("oz-wg%d", sbox.id)
+	if err := wireguard.Start(conf, dev, sbox.init.Process.Pid); err != nil {
+		return err
+	}
+	sbox.wgDev = dev
+	return nil
 }
 
 func (sbox *Sandbox) configureBridgedIface() error {
@@ -353,14 +509,66 @@ func (sbox *Sandbox) configureBridgedIface() error {
 	if err != nil {
 		return err
 	}
+	if err := sbox.enableDNS(veth); err != nil {
+		veth.Delete()
+		return err
+	}
+	if sbox.profile.Networking.DNSMode == oz.PROFILE_NETWORK_DNS_DHCP {
+		if err := sbox.enableDHCP(veth); err != nil {
+			veth.Delete()
+			return err
+		}
+	}
 	if err := veth.Setup(); err != nil {
 		veth.Delete()
 		return err
 	}
+	bw, err := sbox.profile.Networking.Bandwidth.Limits()
+	if err == nil && bw.Limited() {
+		err = veth.SetBandwidth(bw)
+	}
+	if err != nil {
+		veth.Delete()
+		return fmt.Errorf("unable to limit bandwidth: %v", err)
+	}
 	sbox.iface = veth
 	return nil
 }
 
+// enableDNS makes the sandbox use the DNS forwarder of its bridge if its
+// DNS mode asks for it
+func (sbox *Sandbox) enableDNS(veth *network.OzVeth) error {
+	n := sbox.profile.Networking
+	if n.DNSMode != oz.PROFILE_NETWORK_DNS_FORWARD && n.DNSMode != oz.PROFILE_NETWORK_DNS_DHCP {
+		return nil
+	}
+	label := fmt.Sprintf("%s (id=%d)", sbox.profile.Name, sbox.id)
+	if err := veth.EnableDNS(label, &network.DNSPolicy{Allow: n.DNSAllow, Deny: n.DNSDeny}); err != nil {
+		return fmt.Errorf("unable to start DNS forwarder: %v", err)
+	}
+	return nil
+}
+
+// startEgressProxy starts the proxy through which a sandbox of type proxy
+// reaches what its firewall rules allow
+func (sbox *Sandbox) startEgressProxy() error {
+	rs, err := sbox.profile.FirewallRuleset()
+	if err != nil {
+		return err
+	}
+	label := fmt.Sprintf("%s (id=%d)", sbox.profile.Name, sbox.id)
+	return network.StartEgressProxy(sbox.init.Process.Pid, sbox.profile.Networking.EgressProxyPort(), label, rs, sbox.daemon.log)
+}
+
+// enableDHCP hands out the address of the sandbox through DHCP along with
+// the address of the DNS forwarder
+func (sbox *Sandbox) enableDHCP(veth *network.OzVeth) error {
+	if err := veth.EnableDHCP([]net.IP{veth.DNSServer()}); err != nil {
+		return fmt.Errorf("unable to start DHCP responder: %v", err)
+	}
+	return nil
+}
+
 func (sbox *Sandbox) getBridgeName() string {
 	if name := sbox.profile.Networking.Bridge; name != "" {
 		return name
@@ -400,7 +608,7 @@ func (sbox *Sandbox) SetupDynamicForwarder(name, port string, log *logging.Logge
 		}
 	}
 	if lp.ExtProto == "unix" {
-		socketPath, err := createSocketPath(path.Join(sbox.daemon.config.SandboxPath, "sockets"), "oz-dynamic-listener")
+		socketPath, err := createSocketPath(path.Join(sbox.daemon.currentConfig().SandboxPath, "sockets"), "oz-dynamic-listener")
 		l, err := net.ListenUnix("unix", &net.UnixAddr{socketPath, "unix"})
 		if err != nil {
 			log.Warning("Socket creation failure: %+s", err)
@@ -460,6 +668,7 @@ func (sbox *Sandbox) SetupDynamicForwarder(name, port string, log *logging.Logge
 		return "", err
 	}
 	sbox.forwarders = append(sbox.forwarders, ActiveForwarder{name: name, desc: desc, dest: dest})
+	sbox.saveState()
 	/*
 		if sbox.forwarders[name] != nil {
 			sbox.forwarders[name] = append(sbox.forwarders[name], desc)
@@ -499,6 +708,7 @@ func (sbox *Sandbox) MountFiles(files []string, readonly bool, binpath string, l
 			sbox.mountedFiles = append(sbox.mountedFiles, mfile)
 		}
 	}
+	sbox.saveState()
 	log.Info("%s", string(pout))
 	return nil
 }
@@ -520,6 +730,7 @@ func (sbox *Sandbox) UnmountFile(file, binpath string, log *logging.Logger) erro
 			sbox.mountedFiles = append(sbox.mountedFiles[:i], sbox.mountedFiles[i+1:]...)
 		}
 	}
+	sbox.saveState()
 	log.Info("%s", string(pout))
 	return nil
 }
@@ -547,27 +758,48 @@ func (sbox *Sandbox) whitelistArgumentFiles(binpath, pwd string, args []string,
 	}
 }
 
+// How long the connections open through the proxies of a removed sandbox
+// are given to finish before being closed
+const proxyShutdownGrace = 5 * time.Second
+
 func (sbox *Sandbox) remove(log *logging.Logger) {
+	sbox.daemon.sandboxesLock.Lock()
 	sboxes := []*Sandbox{}
 	for _, sb := range sbox.daemon.sandboxes {
-		if sb == sbox {
-			if sb.iface != nil {
-				err := sb.iface.RemoveFWRules()
-
-				if err != nil {
-					sbox.daemon.Warning("Error: could not remove firewall rules for destroyed sandbox: ", err.Error())
-				}
-
-				sb.iface.Delete()
-				sb.iface = nil
-			}
-			//		sb.fs.Cleanup()
-			os.Remove(sb.addr)
-		} else {
+		if sb != sbox {
 			sboxes = append(sboxes, sb)
 		}
 	}
 	sbox.daemon.sandboxes = sboxes
+	iface := sbox.iface
+	sbox.iface = nil
+	sbox.daemon.sandboxesLock.Unlock()
+
+	// A sandbox which failed to start was never added to the list
+	if iface != nil {
+		err := iface.RemoveFWRules()
+
+		if err != nil {
+			sbox.daemon.Warning("Error: could not remove firewall rules for destroyed sandbox: ", err.Error())
+		}
+
+		iface.Delete()
+	}
+	if sbox.init != nil && (len(sbox.profile.Networking.Sockets) > 0 || sbox.profile.Networking.Nettype == network.TYPE_PROXY) {
+		go network.ProxyShutdown(sbox.init.Process.Pid, proxyShutdownGrace)
+	}
+	if sbox.cgroup != nil {
+		if err := sbox.cgroup.remove(); err != nil {
+			sbox.daemon.Warning("Unable to remove cgroup %s: %v", sbox.cgroup.path, err)
+		}
+		sbox.cgroup = nil
+	}
+	//		sb.fs.Cleanup()
+	os.Remove(sbox.addr)
+	if sbox.userns {
+		os.Remove(path.Dir(sbox.addr))
+	}
+	sbox.removeState()
 }
 
 func (sbox *Sandbox) logMessages() {
@@ -584,6 +816,8 @@ func (sbox *Sandbox) logMessages() {
 			sbox.daemon.log.Info("oz-init (%s) is ready", sbox.profile.Name)
 			seenOk = true
 			sbox.ready.Done()
+		} else if strings.HasPrefix(line, "SHUTDOWN ") {
+			sbox.setShutdownDeadline(strings.TrimPrefix(line, "SHUTDOWN "))
 		} else if len(line) > 1 {
 			sbox.logLine(line)
 		}
@@ -591,6 +825,30 @@ func (sbox *Sandbox) logMessages() {
 	sbox.stderr.Close()
 }
 
+// setShutdownDeadline records when oz-init will shutdown the sandbox in
+// soft shutdown mode, a zero timestamp means the shutdown was cancelled
+func (sbox *Sandbox) setShutdownDeadline(ts string) {
+	t, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		sbox.daemon.Warning("[%s] Invalid shutdown deadline from oz-init: %s", sbox.profile.Name, ts)
+		return
+	}
+	atomic.StoreInt64(&sbox.shutdownAt, t)
+}
+
+// shutdownIn returns the number of seconds before a pending soft shutdown, 0 if none
+func (sbox *Sandbox) shutdownIn() int {
+	at := atomic.LoadInt64(&sbox.shutdownAt)
+	if at == 0 {
+		return 0
+	}
+	left := int(time.Unix(at, 0).Sub(time.Now()).Seconds() + 0.5)
+	if left < 1 {
+		left = 1
+	}
+	return left
+}
+
 func (sbox *Sandbox) logLine(line string) {
 	if len(line) < 2 {
 		return
@@ -630,11 +888,16 @@ func (sbox *Sandbox) startXpraClient() {
 		return
 	}
 	xpraPath := path.Join(u.HomeDir, ".Xoz", sbox.profile.Name)
+	config := sbox.profile.XServer
+	if sbox.muted {
+		// Neither plays the sandbox nor records for it
+		config.AudioMode = oz.PROFILE_AUDIO_NONE
+	}
 	sbox.xpra = xpra.NewClient(
-		&sbox.profile.XServer,
+		&config,
 		uint64(sbox.display),
 		sbox.cred,
-		path.Join(sbox.daemon.config.PrefixPath, "bin", "oz-seccomp"),
+		path.Join(sbox.daemon.currentConfig().PrefixPath, "bin", "oz-seccomp"),
 		xpraPath,
 		sbox.profile.Name,
 		sbox.daemon.log)
@@ -642,7 +905,7 @@ func (sbox *Sandbox) startXpraClient() {
 	sbox.xpra.Process.Env = append(sbox.rawEnv, sbox.xpra.Process.Env...)
 
 	//sbox.daemon.log.Debug("%s %s", strings.Join(sbox.xpra.Process.Env, " "), strings.Join(sbox.xpra.Process.Args, " "))
-	if sbox.daemon.config.LogXpra {
+	if sbox.daemon.currentConfig().LogXpra {
 		sbox.setupXpraLogging()
 	}
 	if err := sbox.xpra.Process.Start(); err != nil {
@@ -673,78 +936,6 @@ func (sbox *Sandbox) logPipeOutput(p io.Reader, label string) {
 	}
 }
 
-const ReceiverSocketPath = "/var/run/fw-daemon/fwoz.sock"
-
-func registerSandboxPid(pid int, name string, id int) (error) {
-	c, err := net.Dial("unix", ReceiverSocketPath)
-	if err != nil {
-		return err
-	}
-
-	defer c.Close()
-
-	reqstr := "register-init " + strconv.Itoa(pid) + " " + name + " " + strconv.Itoa(id) + "\n"
-	c.Write([]byte(reqstr))
-
-	buf := make([]byte, 1024)
-
-	for {
-		n, err := c.Read(buf[:])
-
-		if string(buf[0:2]) == "OK" {
-			return nil
-		}
-		if n > 2 {
-			return fmt.Errorf("Unknown response received from fw-daemon: %s", string(buf[0:n]))
-		} else if err != nil && err != io.EOF {
-			return err
-		}
-	}
-	return nil
-}
-
-func setupFWRule(add, whitelist bool, src, dst string, port uint16, pid int) (bool, error) {
-	c, err := net.Dial("unix", ReceiverSocketPath)
-	if err != nil {
-		return false, err
-	}
-
-	defer c.Close()
-
-	reqstr := ""
-
-	if add {
-		reqstr += "add "
-	} else {
-		reqstr += "remove "
-	}
-
-	if whitelist {
-		reqstr += "whitelist"
-	} else {
-		reqstr += "blacklist"
-	}
-
-	pstr := strconv.Itoa(int(port))
-
-	if port == 0 {
-		pstr = "*"
-	}
-
-	reqstr += " " + src + " " + dst + " " + pstr + " " + strconv.Itoa(pid) + "\n"
-	c.Write([]byte(reqstr))
-
-	buf := make([]byte, 1024)
-
-	for {
-		n, err := c.Read(buf[:])
-		if err != nil {
-			return false, err
-		}
-		fmt.Println(string(buf[0:n]))
-	}
-
-
-	fmt.Println("Done.")
-	return true, nil
+func registerSandboxPid(socket string, pid int, name string, id int) error {
+	return network.FWDaemonRequest(socket, "register-init", strconv.Itoa(pid), name, strconv.Itoa(id))
 }
@@ -0,0 +1,65 @@
+package daemon
+
+import (
+	"fmt"
+
+	"github.com/subgraph/oz/ipc"
+	"github.com/subgraph/oz/network"
+	"github.com/subgraph/oz/oz-init"
+)
+
+func (d *daemonState) handleNetStats(msg *NetStatsMsg, m *ipc.Message) error {
+	sbox := d.sandboxById(msg.Id)
+	if sbox == nil {
+		return m.Respond(&ErrorMsg{fmt.Sprintf("no sandbox found with id = %d", msg.Id)})
+	}
+	return m.Respond(sbox.netStats())
+}
+
+func (sbox *Sandbox) netStats() *NetStatsResp {
+	r := &NetStatsResp{
+		Id:          sbox.id,
+		Profile:     sbox.profile.Name,
+		Connections: []ProxyConnection{},
+		Forwarders:  []ForwarderStats{},
+	}
+	if sbox.iface != nil {
+		if ifc := sbox.iface.NetInterface(); ifc != nil {
+			r.Veth = ifc.Name
+		}
+		if s, err := sbox.iface.Stats(); err == nil {
+			r.RxBytes, r.RxPackets = s.RxBytes, s.RxPackets
+			r.TxBytes, r.TxPackets = s.TxBytes, s.TxPackets
+		} else {
+			sbox.daemon.Warning("Unable to read traffic counters of sandbox %d: %v", sbox.id, err)
+		}
+	}
+
+	for _, p := range network.SandboxProxyPairs(sbox.init.Process.Pid) {
+		r.Connections = append(r.Connections, ProxyConnection{
+			Sandbox:  fmt.Sprintf("%v:%d -> %v:%d", p.In.Saddr, p.In.Sport, p.In.Daddr, p.In.Dport),
+			Host:     fmt.Sprintf("%v:%d -> %v:%d", p.Out.Saddr, p.Out.Sport, p.Out.Daddr, p.Out.Dport),
+			Sent:     p.Sent,
+			Received: p.Received,
+		})
+	}
+
+	if len(sbox.forwarders) == 0 {
+		return r
+	}
+	stats, err := ozinit.GetForwarderStats(sbox.addr)
+	if err != nil {
+		sbox.daemon.Warning("Unable to get forwarder counters of sandbox %d: %v", sbox.id, err)
+	}
+	// oz-init reports its forwarders in the order they were set up, as they are recorded
+	for i, f := range sbox.forwarders {
+		fs := ForwarderStats{Name: f.name, Desc: f.desc, Target: f.dest}
+		if i < len(stats) {
+			s := stats[i]
+			fs.Connections, fs.Active = s.Connections, s.Active
+			fs.Sent, fs.Received = s.Sent, s.Received
+		}
+		r.Forwarders = append(r.Forwarders, fs)
+	}
+	return r
+}
@@ -1,6 +1,11 @@
 package daemon
 
-import "github.com/subgraph/oz/ipc"
+import (
+	"time"
+
+	"github.com/subgraph/oz"
+	"github.com/subgraph/oz/ipc"
+)
 
 const SocketName = "@oz-control"
 
@@ -28,6 +33,10 @@ type ListProfilesMsg struct {
 	_ string "ListProfiles"
 }
 
+// The field names of Profile, SandboxInfo, Forwarder, InspectSandboxResp and
+// NetStatsResp are used as is in the JSON output of the oz command and documented in
+// README.mdwn, do not rename them.
+
 type Profile struct {
 	Index int
 	Name  string
@@ -91,6 +100,12 @@ type SandboxInfo struct {
 	Mounts    []string
 	Ephemeral bool
 	InitPid int
+	// Seconds left before a pending soft shutdown, 0 if none
+	ShutdownIn int
+	// Current resource usage, only available with cgroup v2
+	Usage *CgroupUsage
+	// State of the OpenVPN client, empty if the sandbox has none
+	VPN string
 }
 
 type ListSandboxesResp struct {
@@ -101,6 +116,56 @@ type KillSandboxMsg struct {
 	Id int "KillSandbox"
 }
 
+type InspectSandboxMsg struct {
+	Id int "InspectSandbox"
+}
+
+type SandboxProcess struct {
+	// Pid inside the sandbox pid namespace
+	Pid     int
+	HostPid int
+	Cmdline string
+}
+
+type InspectSandboxResp struct {
+	Id              int "InspectSandboxResp"
+	Profile         oz.Profile
+	Address         string
+	InitPid         int
+	Ephemeral       bool
+	UserNS          bool
+	User            string
+	Uid             uint32
+	Gid             uint32
+	Gids            []uint32
+	Display         int
+	Veth            string
+	IP              string
+	IP6             string
+	Bridge          string
+	Bandwidth       string
+	Forwarders      []Forwarder
+	OpenVPNPid      int
+	OpenVPNRunToken string
+	WireGuardDev    string
+	SeccompMode     string
+	Processes       []SandboxProcess
+	// State of the OpenVPN client, its tunnel interface when up and the
+	// number of restarts since it was last up
+	VPNState    string
+	VPNTunnel   string
+	VPNRestarts int
+	// Whether the audio forwarded by xpra is muted
+	Muted bool
+	// Mount table as seen from inside the sandbox, in /proc/mounts format
+	Mounts       []string
+	MountedFiles []string
+	Started      time.Time
+	// Uptime in seconds
+	Uptime     int64
+	ShutdownIn int
+}
+
 type RelaunchXpraClientMsg struct {
 	Id int "RelaunchXpraClient"
 }
@@ -156,6 +221,70 @@ type ForwarderSuccessMsg struct {
 	Port  string
 }
 
+type NetStatsMsg struct {
+	Id int "NetStats"
+}
+
+// ProxyConnection is a connection open through a connection proxy of a
+// sandbox, bytes are counted from the point of view of the sandbox
+type ProxyConnection struct {
+	Sandbox  string
+	Host     string
+	Sent     uint64
+	Received uint64
+}
+
+type ForwarderStats struct {
+	Name        string
+	Desc        string
+	Target      string
+	Connections int
+	Active      int
+	Sent        uint64
+	Received    uint64
+}
+
+// NetStatsResp holds the traffic counters of a sandbox, Rx is what the
+// sandbox received through its veth and Tx what it sent
+type NetStatsResp struct {
+	Id          int "NetStatsResp"
+	Profile     string
+	Veth        string
+	RxBytes     uint64
+	RxPackets   uint64
+	TxBytes     uint64
+	TxPackets   uint64
+	Connections []ProxyConnection
+	Forwarders  []ForwarderStats
+}
+
+// ThrottleMsg changes the bandwidth limits of a sandbox, an empty rate
+// leaves that direction unchanged and a rate of "none" removes its limit
+type ThrottleMsg struct {
+	Id           int "Throttle"
+	Egress       string
+	EgressBurst  string
+	Ingress      string
+	IngressBurst string
+}
+
+// MuteMsg mutes or unmutes the speaker and microphone a sandbox forwards
+// through xpra
+type MuteMsg struct {
+	Id   int "Mute"
+	Mute bool
+}
+
+type ReloadMsg struct {
+	_ string "Reload"
+}
+
+type ReloadResp struct {
+	Added   []string "ReloadResp"
+	Removed []string
+	Changed []string
+}
+
 var messageFactory = ipc.NewMsgFactory(
 	new(PingMsg),
 	new(OkMsg),
@@ -171,6 +300,8 @@ var messageFactory = ipc.NewMsgFactory(
 	new(ListSandboxesMsg),
 	new(ListSandboxesResp),
 	new(KillSandboxMsg),
+	new(InspectSandboxMsg),
+	new(InspectSandboxResp),
 	new(RelaunchXpraClientMsg),
 	new(MountFilesMsg),
 	new(UnmountFileMsg),
@@ -184,4 +315,10 @@ var messageFactory = ipc.NewMsgFactory(
 	new(ListBridgesResp),
 	new(ListProxiesMsg),
 	new(ListProxiesResp),
+	new(NetStatsMsg),
+	new(NetStatsResp),
+	new(ThrottleMsg),
+	new(MuteMsg),
+	new(ReloadMsg),
+	new(ReloadResp),
 )
@@ -0,0 +1,158 @@
+package daemon
+
+import (
+	"reflect"
+	"sort"
+
+	"github.com/subgraph/oz"
+	"github.com/subgraph/oz/ipc"
+)
+
+// Configuration options which are in use by running sandboxes or by the
+// daemon itself and cannot be changed without a restart
+var configRestartOptions = map[string]bool{
+	"PrefixPath":     true,
+	"SandboxPath":    true,
+	"OpenVPNRunPath": true,
+	"RouteTableBase": true,
+}
+
+type profilesDiff struct {
+	added   []string
+	removed []string
+	changed []string
+}
+
+func (pd *profilesDiff) empty() bool {
+	return len(pd.added) == 0 && len(pd.removed) == 0 && len(pd.changed) == 0
+}
+
+// reload reads the configuration and the profiles again and only swaps them
+// in once everything was loaded successfully. Running sandboxes keep a
+// reference to the profile they were launched with and are not affected.
+// Reloads are serialized by reloadLock, the rest of the daemon reads the
+// configuration and the profiles through currentConfig and currentProfiles.
+func (d *daemonState) reload() (*profilesDiff, error) {
+	d.reloadLock.Lock()
+	defer d.reloadLock.Unlock()
+
+	config, err := d.loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range diffConfig(d.config, config) {
+		if configRestartOptions[name] {
+			d.Warning("Configuration option %s changed, restart oz-daemon for it to take effect", name)
+			reflect.ValueOf(config).Elem().FieldByName(name).Set(reflect.ValueOf(d.config).Elem().FieldByName(name))
+			continue
+		}
+		d.Notice("Configuration option %s changed", name)
+	}
+
+	ps, err := d.loadProfiles(config.ProfileDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.cacheSystemGroups(); err != nil {
+		d.Warning("Unable to refresh list of system groups: %v", err)
+	}
+
+	diff := diffProfiles(d.profiles, ps)
+	d.configLock.Lock()
+	d.config = config
+	d.profiles = ps
+	d.configLock.Unlock()
+
+	if diff.empty() {
+		d.Notice("Reload done, no profile changes")
+	}
+	for _, name := range diff.added {
+		d.Notice("Reload: profile added: %s", name)
+	}
+	for _, name := range diff.removed {
+		d.Notice("Reload: profile removed: %s", name)
+	}
+	for _, name := range diff.changed {
+		if sbox := d.getRunningSandboxByName(name); sbox != nil {
+			d.Notice("Reload: profile changed: %s (running sandbox %d keeps the previous version)", name, sbox.id)
+			continue
+		}
+		d.Notice("Reload: profile changed: %s", name)
+	}
+	return diff, nil
+}
+
+// currentConfig returns the configuration in use. A reload replaces it but
+// never modifies it, callers needing a consistent view should keep the result.
+func (d *daemonState) currentConfig() *oz.Config {
+	d.configLock.RLock()
+	defer d.configLock.RUnlock()
+	return d.config
+}
+
+// currentProfiles returns the profiles in use, see currentConfig
+func (d *daemonState) currentProfiles() oz.Profiles {
+	d.configLock.RLock()
+	defer d.configLock.RUnlock()
+	return d.profiles
+}
+
+// currentSystemGroups returns the cached system groups, see currentConfig
+func (d *daemonState) currentSystemGroups() map[string]groupEntry {
+	d.configLock.RLock()
+	defer d.configLock.RUnlock()
+	return d.systemGroups
+}
+
+// diffConfig returns the names of the options which differ between two configurations
+func diffConfig(old, new *oz.Config) []string {
+	var names []string
+	ov := reflect.ValueOf(old).Elem()
+	nv := reflect.ValueOf(new).Elem()
+	for i := 0; i < ov.NumField(); i++ {
+		if !reflect.DeepEqual(ov.Field(i).Interface(), nv.Field(i).Interface()) {
+			names = append(names, ov.Type().Field(i).Name)
+		}
+	}
+	return names
+}
+
+func diffProfiles(old, new oz.Profiles) *profilesDiff {
+	diff := &profilesDiff{}
+	oldByName := make(map[string]*oz.Profile)
+	for _, p := range old {
+		oldByName[p.Name] = p
+	}
+	for _, p := range new {
+		op, ok := oldByName[p.Name]
+		if !ok {
+			diff.added = append(diff.added, p.Name)
+			continue
+		}
+		if !reflect.DeepEqual(op, p) {
+			diff.changed = append(diff.changed, p.Name)
+		}
+		delete(oldByName, p.Name)
+	}
+	for name := range oldByName {
+		diff.removed = append(diff.removed, name)
+	}
+	sort.Strings(diff.added)
+	sort.Strings(diff.removed)
+	sort.Strings(diff.changed)
+	return diff
+}
+
+func (d *daemonState) handleReload(msg *ReloadMsg, m *ipc.Message) error {
+	d.Notice("Reload requested by uid %d", m.Ucred.Uid)
+	diff, err := d.reload()
+	if err != nil {
+		d.Error("Reload failed, keeping the current configuration: %v", err)
+		return m.Respond(&ErrorMsg{err.Error()})
+	}
+	return m.Respond(&ReloadResp{
+		Added:   diff.added,
+		Removed: diff.removed,
+		Changed: diff.changed,
+	})
+}
@@ -0,0 +1,373 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/subgraph/oz"
+	"github.com/subgraph/oz/fs"
+	"github.com/subgraph/oz/network"
+	"github.com/subgraph/oz/oz-init"
+	"github.com/subgraph/oz/wayland"
+)
+
+// sandboxState is what is saved of a running sandbox so that the daemon can
+// take it back after being restarted, or clean up after it if it is gone.
+type sandboxState struct {
+	Id      int
+	Profile oz.Profile
+	InitPid int
+	// Start time of oz-init in clock ticks since boot, guards against pid reuse
+	InitStart       uint64
+	Address         string
+	Uid             uint32
+	Gid             uint32
+	Gids            []uint32
+	Display         int
+	Ephemeral       bool
+	UserNS          bool
+	RawEnv          []string
+	Started         time.Time
+	Cgroup          string
+	Veth            string
+	VethPeer        string
+	Bridge          string
+	IP              string
+	IP6             string
+	Bandwidth       network.Bandwidth
+	OpenVPNRunToken string
+	WireGuardDev    string
+	// Socket of the Wayland proxy and of the compositor it relays to
+	WaylandSocket   string
+	WaylandUpstream string
+	Forwarders      []Forwarder
+	MountedFiles    []string
+	Muted           bool
+}
+
+// How often the init process of an adopted sandbox is checked for exit
+const adoptedWatchInterval = time.Second
+
+func (d *daemonState) stateDir() string {
+	return path.Join(d.currentConfig().SandboxPath, "state")
+}
+
+func (d *daemonState) statePath(id int) string {
+	return path.Join(d.stateDir(), fmt.Sprintf("%d.json", id))
+}
+
+// saveState writes the current state of the sandbox, it is called whenever
+// the state changes. Failures are only logged as the sandbox itself is fine.
+func (sbox *Sandbox) saveState() {
+	st := sandboxState{
+		Id:           sbox.id,
+		Profile:      *sbox.profile,
+		InitPid:      sbox.init.Process.Pid,
+		Address:      sbox.addr,
+		Uid:          sbox.cred.Uid,
+		Gid:          sbox.cred.Gid,
+		Gids:         sbox.cred.Groups,
+		Display:      sbox.display,
+		Ephemeral:    sbox.ephemeral,
+		UserNS:       sbox.userns,
+		RawEnv:       sbox.rawEnv,
+		Started:      sbox.started,
+		MountedFiles: sbox.mountedFiles,
+		Muted:        sbox.muted,
+	}
+	st.InitStart, _ = processStartTime(st.InitPid)
+	if sbox.cgroup != nil {
+		st.Cgroup = sbox.cgroup.path
+	}
+	if sbox.iface != nil {
+		if ifc := sbox.iface.NetInterface(); ifc != nil {
+			st.Veth = ifc.Name
+		}
+		if ifc := sbox.iface.PeerNetInterface(); ifc != nil {
+			st.VethPeer = ifc.Name
+		}
+		if ip := sbox.iface.GetSandboxIP(); ip != nil {
+			st.IP = ip.String()
+		}
+		if ip := sbox.iface.GetSandboxIP6(); ip != nil {
+			st.IP6 = ip.String()
+		}
+		st.Bandwidth = sbox.iface.GetBandwidth()
+		st.Bridge = sbox.getBridgeName()
+	}
+	if sbox.ovpn != nil {
+		st.OpenVPNRunToken = sbox.ovpn.runtoken
+	}
+	st.WireGuardDev = sbox.wgDev
+	if sbox.wlProxy != nil {
+		st.WaylandSocket, st.WaylandUpstream = sbox.wlProxy.Socket, sbox.wlProxy.Upstream
+	}
+	for _, f := range sbox.forwarders {
+		st.Forwarders = append(st.Forwarders, Forwarder{Name: f.name, Target: f.dest, Desc: f.desc})
+	}
+
+	if err := writeState(sbox.daemon.stateDir(), sbox.daemon.statePath(sbox.id), &st); err != nil {
+		sbox.daemon.Warning("Unable to save state of sandbox %d: %v", sbox.id, err)
+	}
+}
+
+func writeState(dir, fpath string, st *sandboxState) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	bs, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := fpath + ".tmp"
+	if err := ioutil.WriteFile(tmp, bs, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fpath)
+}
+
+func (sbox *Sandbox) removeState() {
+	if err := os.Remove(sbox.daemon.statePath(sbox.id)); err != nil && !os.IsNotExist(err) {
+		sbox.daemon.Warning("Unable to remove state of sandbox %d: %v", sbox.id, err)
+	}
+}
+
+// restoreSandboxes goes through the state saved by a previous instance of the
+// daemon, sandboxes still alive are adopted and the others are cleaned up
+func (d *daemonState) restoreSandboxes() {
+	files, err := filepath.Glob(path.Join(d.stateDir(), "*.json"))
+	if err != nil {
+		d.Warning("Unable to list saved sandbox states: %v", err)
+		return
+	}
+	for _, f := range files {
+		bs, err := ioutil.ReadFile(f)
+		if err != nil {
+			d.Warning("Unable to read sandbox state %s: %v", f, err)
+			continue
+		}
+		st := new(sandboxState)
+		if err := json.Unmarshal(bs, st); err != nil {
+			d.Warning("Invalid sandbox state %s, removing it: %v", f, err)
+			os.Remove(f)
+			continue
+		}
+
+		if d.sandboxById(st.Id) == nil && d.initAlive(st) {
+			if err := d.adoptSandbox(st); err == nil {
+				continue
+			} else {
+				d.Warning("Unable to adopt sandbox %s (%d), cleaning it up: %v", st.Profile.Name, st.Id, err)
+			}
+		} else {
+			d.Notice("Sandbox %s (%d) is gone, cleaning up after it", st.Profile.Name, st.Id)
+		}
+		d.cleanupSandboxState(st)
+		os.Remove(f)
+	}
+}
+
+// initAlive checks that the oz-init process of a saved sandbox still runs
+// and answers on its control socket, a hung oz-init is killed
+func (d *daemonState) initAlive(st *sandboxState) bool {
+	if start, err := processStartTime(st.InitPid); err != nil || start != st.InitStart {
+		return false
+	}
+	if err := ozinit.Ping(st.Address); err != nil {
+		d.Warning("oz-init of sandbox %s (%d) is not answering, killing it: %v", st.Profile.Name, st.Id, err)
+		syscall.Kill(st.InitPid, syscall.SIGKILL)
+		return false
+	}
+	return true
+}
+
+func (d *daemonState) adoptSandbox(st *sandboxState) error {
+	u, err := user.LookupId(strconv.FormatUint(uint64(st.Uid), 10))
+	if err != nil {
+		return fmt.Errorf("failed to look up user with uid=%d: %v", st.Uid, err)
+	}
+	proc, err := os.FindProcess(st.InitPid)
+	if err != nil {
+		return err
+	}
+	p := st.Profile
+	sbox := &Sandbox{
+		daemon:       d,
+		id:           st.Id,
+		display:      st.Display,
+		profile:      &p,
+		init:         &exec.Cmd{Process: proc},
+		cred:         &syscall.Credential{Uid: st.Uid, Gid: st.Gid, Groups: st.Gids},
+		user:         u,
+		fs:           fs.NewFilesystem(d.currentConfig(), d.log, u, &p),
+		addr:         st.Address,
+		mountedFiles: st.MountedFiles,
+		rawEnv:       st.RawEnv,
+		ephemeral:    st.Ephemeral,
+		started:      st.Started,
+		userns:       st.UserNS,
+		wgDev:        st.WireGuardDev,
+		muted:        st.Muted,
+	}
+	if st.Cgroup != "" {
+		sbox.cgroup = &sandboxCgroup{path: st.Cgroup}
+	}
+	if st.OpenVPNRunToken != "" {
+		sbox.ovpn = &OpenVPN{runtoken: st.OpenVPNRunToken}
+	}
+	for _, f := range st.Forwarders {
+		sbox.forwarders = append(sbox.forwarders, ActiveForwarder{name: f.Name, desc: f.Desc, dest: f.Target})
+	}
+	if st.Veth != "" {
+		veth, err := d.bridges.AdoptVeth(st.Bridge, st.Id, st.InitPid, st.Veth, st.VethPeer, net.ParseIP(st.IP), net.ParseIP(st.IP6))
+		if err != nil {
+			return fmt.Errorf("unable to adopt veth %s: %v", st.Veth, err)
+		}
+		if rs, err := p.FirewallRuleset(); err == nil {
+			veth.AdoptFWRules(rs)
+		}
+		veth.AdoptBandwidth(st.Bandwidth)
+		sbox.iface = veth
+		if err := sbox.enableDNS(veth); err != nil {
+			d.Warning("Unable to restore DNS forwarding for sandbox %d: %v", st.Id, err)
+		}
+		if veth.DNSServer() != nil && p.Networking.DNSMode == oz.PROFILE_NETWORK_DNS_DHCP {
+			if err := sbox.enableDHCP(veth); err != nil {
+				d.Warning("Unable to restore DHCP for sandbox %d: %v", st.Id, err)
+			}
+		}
+		if sbox.ovpn != nil {
+			// Until the monitor finds the tunnel again
+			if err := veth.SetKillSwitch(""); err != nil {
+				d.Warning("Unable to restore VPN kill-switch of sandbox %d: %v", st.Id, err)
+			}
+			sbox.startVPNMonitor(sbox.ovpn)
+		}
+	}
+
+	// The proxies were running in the previous daemon
+	if p.Networking.Nettype != network.TYPE_HOST &&
+		p.Networking.Nettype != network.TYPE_NONE &&
+		len(p.Networking.Sockets) > 0 {
+		if err := network.ProxySetup(st.InitPid, p.Networking.Sockets, d.log); err != nil {
+			d.Warning("Unable to recreate connection proxy of sandbox %d: %+s", st.Id, err)
+		}
+	}
+	if p.Networking.Nettype == network.TYPE_PROXY {
+		if err := sbox.startEgressProxy(); err != nil {
+			d.Warning("Unable to restart egress proxy of sandbox %d: %v", st.Id, err)
+		}
+	}
+	if st.WaylandSocket != "" {
+		// In the directory bound into the sandbox, where the new socket shows up
+		proxy, err := wayland.NewProxy(st.WaylandSocket, st.WaylandUpstream, p.Display.Extensions, fmt.Sprintf("%s (id=%d)", p.Name, st.Id), d.log)
+		if err == nil {
+			err = os.Chown(proxy.Socket, int(st.Uid), int(st.Gid))
+			sbox.wlProxy = proxy
+		}
+		if err != nil {
+			d.Warning("Unable to restart Wayland proxy of sandbox %d: %v", st.Id, err)
+		}
+	}
+
+	d.sandboxesLock.Lock()
+	d.sandboxes = append(d.sandboxes, sbox)
+	d.sandboxesLock.Unlock()
+	if st.Id >= d.nextSboxId {
+		d.nextSboxId = st.Id + 1
+	}
+	if st.Display >= d.nextDisplay {
+		d.nextDisplay = st.Display + 1
+	}
+	d.Notice("Adopted sandbox %s (%d) with init pid %d", p.Name, st.Id, st.InitPid)
+	go sbox.watchInit(st.InitStart)
+	return nil
+}
+
+// watchInit waits for the exit of the init process of an adopted sandbox,
+// which is not a child of this daemon and so is not seen by the SIGCHLD handler
+func (sbox *Sandbox) watchInit(start uint64) {
+	pid := sbox.init.Process.Pid
+	for {
+		time.Sleep(adoptedWatchInterval)
+		if sbox.daemon.sandboxById(sbox.id) != sbox {
+			return
+		}
+		if s, err := processStartTime(pid); err != nil || s != start {
+			sbox.daemon.Debug("Adopted oz-init pid=%d exited", pid)
+			sbox.daemon.sandboxExited(sbox)
+			return
+		}
+	}
+}
+
+// cleanupSandboxState releases what a sandbox which is gone left behind
+func (d *daemonState) cleanupSandboxState(st *sandboxState) {
+	if st.OpenVPNRunToken != "" {
+		pidfilepath := path.Join(d.currentConfig().OpenVPNRunPath, st.OpenVPNRunToken+".pid")
+		if pid, err := readOpenVPNPidFromFile(pidfilepath); err == nil {
+			if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+				d.Debug("Failed to send openvpn SIGTERM: %v", err)
+			}
+		}
+		removeOpenVPNRunState(d, st.OpenVPNRunToken)
+	}
+	if st.WireGuardDev != "" {
+		removeWireGuardRunState(d, st.WireGuardDev)
+	}
+	if st.WaylandSocket != "" {
+		removeWaylandRunState(d, nil, path.Dir(st.WaylandSocket))
+	}
+	if ip := net.ParseIP(st.IP); ip != nil {
+		if err := d.bridges.RemoveFWRules(ip); err != nil {
+			d.Warning("Could not remove firewall rules of sandbox %d: %v", st.Id, err)
+		}
+		if st.OpenVPNRunToken != "" {
+			if err := network.RemoveKillSwitch(ip); err != nil {
+				d.Warning("Could not remove VPN kill-switch of sandbox %d: %v", st.Id, err)
+			}
+		}
+	}
+	if st.Veth != "" {
+		if err := network.DeleteVeth(st.Veth); err != nil {
+			d.Warning("Unable to delete veth %s: %v", st.Veth, err)
+		}
+	}
+	if st.Cgroup != "" {
+		cg := &sandboxCgroup{path: st.Cgroup}
+		if err := cg.remove(); err != nil {
+			d.Warning("Unable to remove cgroup %s: %v", st.Cgroup, err)
+		}
+	}
+	os.Remove(st.Address)
+	if st.UserNS {
+		os.Remove(path.Dir(st.Address))
+	}
+}
+
+// processStartTime returns the start time of a process from /proc/<pid>/stat
+func processStartTime(pid int) (uint64, error) {
+	bs, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	// The command name may contain spaces and parentheses
+	s := string(bs)
+	fields := strings.Fields(s[strings.LastIndex(s, ")")+1:])
+	// starttime is field 22, fields here start with field 3
+	if len(fields) < 20 {
+		return 0, fmt.Errorf("invalid stat file for pid %d", pid)
+	}
+	return strconv.ParseUint(fields[19], 10, 64)
+}
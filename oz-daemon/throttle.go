@@ -0,0 +1,57 @@
+package daemon
+
+import (
+	"fmt"
+
+	"github.com/subgraph/oz/ipc"
+	"github.com/subgraph/oz/network"
+)
+
+func (d *daemonState) handleThrottle(msg *ThrottleMsg, m *ipc.Message) error {
+	sbox := d.sandboxById(msg.Id)
+	if sbox == nil {
+		return m.Respond(&ErrorMsg{fmt.Sprintf("no sandbox found with id = %d", msg.Id)})
+	}
+	if sbox.iface == nil {
+		return m.Respond(&ErrorMsg{fmt.Sprintf("sandbox %d does not use bridged networking", msg.Id)})
+	}
+	bw := sbox.iface.GetBandwidth()
+	var err error
+	bw.EgressRate, bw.EgressBurst, err = throttleLimit(msg.Egress, msg.EgressBurst, bw.EgressRate, bw.EgressBurst)
+	if err == nil {
+		bw.IngressRate, bw.IngressBurst, err = throttleLimit(msg.Ingress, msg.IngressBurst, bw.IngressRate, bw.IngressBurst)
+	}
+	if err != nil {
+		return m.Respond(&ErrorMsg{err.Error()})
+	}
+	d.Info("Changing bandwidth limits of sandbox %s (%d): %v", sbox.profile.Name, sbox.id, bw)
+	err = sbox.iface.SetBandwidth(bw)
+	// The limits may have been partially changed even on failure
+	sbox.saveState()
+	if err != nil {
+		return m.Respond(&ErrorMsg{fmt.Sprintf("Unable to change bandwidth limits: %v", err)})
+	}
+	return m.Respond(&OkMsg{})
+}
+
+// throttleLimit returns the new rate and burst of a direction, an empty
+// rate keeps the current limit and "none" removes it
+func throttleLimit(rate, burst string, curRate, curBurst uint64) (uint64, uint64, error) {
+	switch rate {
+	case "":
+		return curRate, curBurst, nil
+	case "none", "0":
+		return 0, 0, nil
+	}
+	r, err := network.ParseRate(rate)
+	if err != nil {
+		return 0, 0, err
+	}
+	var b uint64
+	if burst != "" {
+		if b, err = network.ParseBurst(burst); err != nil {
+			return 0, 0, err
+		}
+	}
+	return r, b, nil
+}
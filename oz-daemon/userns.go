@@ -0,0 +1,66 @@
+package daemon
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"syscall"
+)
+
+// Group owning the pseudo terminals, used for the devpts mount
+const ttyGid = 5
+
+// userNamespaceMap holds the uid and gid mappings of a sandbox user namespace.
+// Root inside the sandbox is mapped to an unprivileged host id, the sandbox
+// user and its allowed groups keep their host ids so that file ownership
+// and /etc/passwd and /etc/group stay consistent with the host.
+type userNamespaceMap struct {
+	uids []syscall.SysProcIDMap
+	gids []syscall.SysProcIDMap
+}
+
+func newUserNamespaceMap(root, uid, gid uint32, groups map[string]uint32) *userNamespaceMap {
+	m := &userNamespaceMap{
+		uids: []syscall.SysProcIDMap{{ContainerID: 0, HostID: int(root), Size: 1}},
+		gids: []syscall.SysProcIDMap{{ContainerID: 0, HostID: int(root), Size: 1}},
+	}
+	if uid != 0 && uid != root {
+		m.uids = append(m.uids, syscall.SysProcIDMap{ContainerID: int(uid), HostID: int(uid), Size: 1})
+	}
+	ids := []uint32{gid, ttyGid}
+	for _, g := range groups {
+		ids = append(ids, g)
+	}
+	seen := map[uint32]bool{0: true, root: true}
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		m.gids = append(m.gids, syscall.SysProcIDMap{ContainerID: int(id), HostID: int(id), Size: 1})
+	}
+	return m
+}
+
+// prepareUserNamespace creates on behalf of oz-init the paths it cannot create
+// itself once root is unprivileged, and returns the directory for the control socket.
+func (d *daemonState) prepareUserNamespace(id int) (string, error) {
+	config := d.currentConfig()
+	if config.UseFullDev {
+		return "", fmt.Errorf("use_full_dev is not supported with user namespaces")
+	}
+	if err := os.MkdirAll(path.Join(config.SandboxPath, "rootfs"), 0755); err != nil {
+		return "", err
+	}
+	dir := path.Join(config.SandboxPath, "sockets", fmt.Sprintf("userns-%d", id))
+	os.RemoveAll(dir)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return "", err
+	}
+	root := int(config.UserNSRoot)
+	if err := os.Chown(dir, root, root); err != nil {
+		os.Remove(dir)
+		return "", err
+	}
+	return dir, nil
+}
@@ -0,0 +1,244 @@
+package daemon
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/subgraph/oz"
+	"github.com/subgraph/oz/openvpn"
+)
+
+// State of the VPN of a sandbox, as shown by oz list and oz inspect
+type VPNState string
+
+const (
+	VPN_STARTING VPNState = "starting"
+	VPN_UP       VPNState = "up"
+	// Down and being restarted, only the tunnel is let through meanwhile
+	VPN_DOWN VPNState = "down"
+	// Could not be restored, the sandbox is paused until it is
+	VPN_FAILED VPNState = "failed"
+)
+
+const (
+	// How often the OpenVPN client and its tunnel are checked
+	vpnCheckInterval = 2 * time.Second
+	// Time given to a client to bring its tunnel up
+	vpnStartTimeout = 30 * time.Second
+	// Delay before the first restart, doubled after each failed one
+	vpnRestartBackoff = time.Second
+	vpnMaxBackoff     = time.Minute
+	// Failed restarts after which the failure action of the profile applies
+	vpnMaxRestarts = 6
+)
+
+// status returns the state of the VPN, its tunnel interface and the number
+// of restarts since it was last up
+func (o *OpenVPN) status() (VPNState, string, int) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.state, o.tunnel, o.restarts
+}
+
+func (o *OpenVPN) setState(state VPNState, restarts int) {
+	o.lock.Lock()
+	o.state, o.restarts = state, restarts
+	o.lock.Unlock()
+}
+
+// process returns the pid of the OpenVPN client and whether it is running
+func (o *OpenVPN) process(c *oz.Config) (int, bool) {
+	pid, err := readOpenVPNPidFromFile(path.Join(c.OpenVPNRunPath, o.runtoken+".pid"))
+	if err != nil || pid <= 0 {
+		return 0, false
+	}
+	return pid, syscall.Kill(pid, 0) == nil
+}
+
+// check asks the monitor to check the VPN without waiting for its next round
+func (o *OpenVPN) check() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// startVPNMonitor starts watching the OpenVPN client of the sandbox, which
+// must have a veth holding its kill-switch
+func (sbox *Sandbox) startVPNMonitor(o *OpenVPN) {
+	o.state = VPN_STARTING
+	o.done = make(chan struct{})
+	o.exited = make(chan struct{})
+	o.wake = make(chan struct{}, 1)
+	o.check()
+	go sbox.monitorVPN(o)
+}
+
+// stopMonitor stops watching the client and waits for the monitor to return,
+// after which the kill-switch is no longer updated
+func (o *OpenVPN) stopMonitor() {
+	if o.done == nil {
+		return
+	}
+	o.stopOnce.Do(func() { close(o.done) })
+	<-o.exited
+}
+
+// monitorVPN keeps the kill-switch of the sandbox in line with the tunnel of
+// its OpenVPN client and restarts the client, with an exponential backoff,
+// when the tunnel goes down. Once the restarts failed, the sandbox is killed
+// or paused as chosen by its profile.
+func (sbox *Sandbox) monitorVPN(o *OpenVPN) {
+	defer close(o.exited)
+	d := sbox.daemon
+	label := fmt.Sprintf("%s (id=%d)", sbox.profile.Name, sbox.id)
+	table := fmt.Sprintf("%d", d.currentConfig().RouteTableBase+sbox.id)
+	ticker := time.NewTicker(vpnCheckInterval)
+	defer ticker.Stop()
+
+	started := time.Now()
+	var restartAt time.Time
+	backoff := vpnRestartBackoff
+	paused := false
+	defer func() {
+		if paused {
+			if err := sbox.freeze(false); err != nil {
+				d.Warning("Unable to resume sandbox %s: %v", label, err)
+			}
+		}
+	}()
+	for {
+		select {
+		case <-o.done:
+			return
+		case <-o.wake:
+		case <-ticker.C:
+		}
+		pid, alive := o.process(d.currentConfig())
+		tunnel := ""
+		if alive {
+			tunnel = openvpn.TunnelDev(table)
+		}
+		state, current, restarts := o.status()
+		if tunnel != current && sbox.iface != nil {
+			if err := sbox.iface.SetKillSwitch(tunnel); err != nil {
+				d.Warning("Unable to update the VPN kill-switch of %s: %v", label, err)
+			} else {
+				o.lock.Lock()
+				o.tunnel = tunnel
+				o.lock.Unlock()
+			}
+		}
+
+		if tunnel != "" {
+			if state != VPN_UP {
+				d.Notice("VPN of %s is up through %s", label, tunnel)
+			}
+			if paused {
+				if err := sbox.freeze(false); err != nil {
+					d.Warning("Unable to resume sandbox %s: %v", label, err)
+				} else {
+					d.Notice("Resumed sandbox %s", label)
+					paused = false
+				}
+			}
+			o.setState(VPN_UP, 0)
+			restartAt, backoff = time.Time{}, vpnRestartBackoff
+			continue
+		}
+		if state == VPN_STARTING && time.Since(started) < vpnStartTimeout && (alive || time.Since(started) < 2*vpnCheckInterval) {
+			continue
+		}
+		if state == VPN_UP {
+			d.Warning("VPN of %s is down, blocking its traffic until it is restored", label)
+		}
+		if !paused {
+			o.setState(VPN_DOWN, restarts)
+		}
+		if restartAt.IsZero() {
+			restartAt = time.Now().Add(backoff)
+			backoff *= 2
+			if backoff > vpnMaxBackoff {
+				backoff = vpnMaxBackoff
+			}
+		}
+		if time.Now().Before(restartAt) {
+			continue
+		}
+
+		if restarts >= vpnMaxRestarts && !paused {
+			if sbox.profile.Networking.VPNConf.OnFailure == oz.PROFILE_VPN_FAILURE_KILL {
+				d.Warning("VPN of %s could not be restored after %d restarts, killing the sandbox", label, restarts)
+				o.setState(VPN_FAILED, restarts)
+				if err := sbox.init.Process.Signal(os.Interrupt); err != nil {
+					d.Warning("Unable to kill sandbox %s: %v", label, err)
+				}
+				return
+			}
+			d.Warning("VPN of %s could not be restored after %d restarts, pausing the sandbox", label, restarts)
+			if err := sbox.freeze(true); err != nil {
+				d.Warning("Unable to pause sandbox %s: %v", label, err)
+			} else {
+				paused = true
+			}
+			o.setState(VPN_FAILED, restarts)
+		}
+
+		if alive {
+			// Running without a tunnel
+			syscall.Kill(pid, syscall.SIGTERM)
+		}
+		restarts++
+		d.Info("Restarting VPN of %s (attempt %d)", label, restarts)
+		cmd, err := sbox.startOpenVPN(o.runtoken)
+		if err != nil {
+			d.Warning("Unable to restart VPN of %s: %v", label, err)
+		}
+		o.lock.Lock()
+		o.cmd = cmd
+		o.restarts = restarts
+		if !paused {
+			o.state = VPN_STARTING
+		}
+		o.lock.Unlock()
+		started, restartAt = time.Now(), time.Time{}
+	}
+}
+
+// freeze pauses or resumes the processes of the sandbox, through its cgroup
+// if it has one. Otherwise they are stopped with signals, all but oz-init.
+func (sbox *Sandbox) freeze(frozen bool) error {
+	if sbox.cgroup != nil {
+		return sbox.cgroup.freeze(frozen)
+	}
+	sig := syscall.SIGCONT
+	if frozen {
+		sig = syscall.SIGSTOP
+	}
+	procs, err := sandboxProcesses(sbox.init.Process.Pid)
+	if err != nil {
+		return err
+	}
+	for _, p := range procs {
+		if p.HostPid != sbox.init.Process.Pid {
+			syscall.Kill(p.HostPid, sig)
+		}
+	}
+	return nil
+}
+
+// stopOpenVPN stops watching the OpenVPN client of the sandbox, terminates
+// it and removes its run state
+func (d *daemonState) stopOpenVPN(o *OpenVPN) {
+	o.stopMonitor()
+	pid, err := readOpenVPNPidFromFile(path.Join(d.currentConfig().OpenVPNRunPath, o.runtoken+".pid"))
+	if err != nil {
+		d.Debug("Failed to retrieve openvpn pid: %v", err)
+	} else if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+		d.Debug("Failed to send openvpn SIGTERM: %v", err)
+	}
+	removeOpenVPNRunState(d, o.runtoken)
+}
@@ -108,3 +108,20 @@ func SetupForwarder(addr, proto, daddr string, fd uintptr) error {
 	}
 
 }
+
+// GetForwarderStats returns the counters of the forwarders of the sandbox,
+// in the order they were set up
+func GetForwarderStats(addr string) ([]ForwarderStats, error) {
+	resp, err := clientSend(addr, new(ForwarderStatsMsg))
+	if err != nil {
+		return nil, err
+	}
+	switch body := resp.Body.(type) {
+	case *ForwarderStatsResp:
+		return body.Forwarders, nil
+	case *ErrorMsg:
+		return nil, errors.New(body.Msg)
+	default:
+		return nil, fmt.Errorf("Unexpected message received: %+v", body)
+	}
+}
@@ -15,16 +15,19 @@ import (
 	"path"
 	"path/filepath"
 	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
 	"sync"
 	"syscall"
-	//"time"
+	"time"
 
 	"github.com/subgraph/oz"
 	"github.com/subgraph/oz/fs"
 	"github.com/subgraph/oz/ipc"
 	"github.com/subgraph/oz/network"
+	"github.com/subgraph/oz/wayland"
+	"github.com/subgraph/oz/wireguard"
 	"github.com/subgraph/oz/xpra"
 
 	"github.com/kr/pty"
@@ -55,7 +58,10 @@ type initState struct {
 	xpraReady         sync.WaitGroup
 	dbusUuid          string
 	shutdownRequested bool
+	shutdownTimer     *time.Timer
 	ephemeral         bool
+	forwarders        []*ForwarderStats
+	waylandDir        string
 }
 
 type InitData struct {
@@ -69,6 +75,8 @@ type InitData struct {
 	User      user.User
 	Display   int
 	Ephemeral bool
+	// Directory of the Wayland proxy socket, in wayland-proxy mode
+	WaylandDir string
 }
 
 const (
@@ -90,6 +98,9 @@ func createLogger() *logging.Logger {
 }
 
 func Main() {
+	// Keep running when the daemon goes away and stderr is closed,
+	// a restarted daemon can then adopt the sandbox again
+	signal.Ignore(syscall.SIGPIPE)
 	parseArgs().waitForParentReady().runInit()
 }
 
@@ -119,27 +130,39 @@ func parseArgs() *initState {
 	}
 
 	env := []string{}
-	env = append(env, initData.LaunchEnv...)
+	for _, e := range initData.LaunchEnv {
+		// Only the proxy of the compositor is reachable
+		if initData.WaylandDir == "" || !strings.HasPrefix(e, "WAYLAND_DISPLAY=") {
+			env = append(env, e)
+		}
+	}
 	env = append(env, "PATH=/usr/bin:/bin")
 
 	if initData.Profile.XServer.Enabled {
 		env = append(env, "DISPLAY=:"+strconv.Itoa(initData.Display))
+		if xpra.ForwardsAudio(&initData.Profile.XServer) {
+			env = append(env, "PULSE_SERVER=unix:"+xpra.PulseSocket(xpra.GetPath(&initData.User, initData.Profile.Name)))
+		}
+	}
+	if initData.WaylandDir != "" {
+		env = append(env, "WAYLAND_DISPLAY="+path.Join(initData.WaylandDir, wayland.SocketName))
 	}
 
 	return &initState{
-		log:       log,
-		config:    &initData.Config,
-		sockaddr:  initData.Sockaddr,
-		launchEnv: env,
-		profile:   &initData.Profile,
-		children:  make(map[int]procState),
-		uid:       initData.Uid,
-		gid:       initData.Gid,
-		gids:      initData.Gids,
-		user:      &initData.User,
-		display:   initData.Display,
-		fs:        fs.NewFilesystem(&initData.Config, log, &initData.User, &initData.Profile),
-		ephemeral: initData.Ephemeral,
+		log:        log,
+		config:     &initData.Config,
+		sockaddr:   initData.Sockaddr,
+		launchEnv:  env,
+		profile:    &initData.Profile,
+		children:   make(map[int]procState),
+		uid:        initData.Uid,
+		gid:        initData.Gid,
+		gids:       initData.Gids,
+		user:       &initData.User,
+		display:    initData.Display,
+		fs:         fs.NewFilesystem(&initData.Config, log, &initData.User, &initData.Profile),
+		ephemeral:  initData.Ephemeral,
+		waylandDir: initData.WaylandDir,
 	}
 }
 
@@ -167,6 +190,7 @@ func (st *initState) runInit() {
 		st.handleRunProgram,
 		st.handleRunShell,
 		st.handleSetupForwarder,
+		st.handleForwarderStats,
 	)
 	if err != nil {
 		st.log.Error("NewServer failed: %v", err)
@@ -317,6 +341,20 @@ func (st *initState) setupEtcFiles() {
 		"machine-id": st.dbusUuid,
 		"fstab":      "# This fstab file is empty",
 	}
+	if st.profile.Networking.DNSMode == oz.PROFILE_NETWORK_DNS_FORWARD {
+		// The DNS forwarder listens on the gateway, the bridge address
+		if gw, err := network.DefaultGateway(); err != nil {
+			st.log.Warning("Unable to find the DNS forwarder: %v", err)
+		} else {
+			os.Remove("/etc/resolv.conf")
+			etcfiles["resolv.conf"] = "nameserver " + gw.String()
+		}
+	}
+	if vpn := st.profile.Networking.VPNConf; vpn.VpnType == oz.PROFILE_VPN_WIREGUARD && len(vpn.DNS) > 0 {
+		// Name servers reached through the tunnel
+		os.Remove("/etc/resolv.conf")
+		etcfiles["resolv.conf"] = wireguard.ResolvConf(vpn.DNS)
+	}
 	for fpath, fcontents := range etcfiles {
 		fpath = path.Join("/etc", fpath)
 		if err := ioutil.WriteFile(fpath, []byte(fcontents+"\n"), 0644); err != nil {
@@ -548,7 +586,7 @@ func (st *initState) launchApplication(cpath, pwd string, cmdArgs []string) (*ex
 		cmd.Dir = pwd
 	}
 
-	if err := cmd.Start(); err != nil {
+	if err := st.startApplication(cmd); err != nil {
 		st.log.Warning("Failed to start application (%s): %v", st.profile.Path, err)
 		return nil, err
 	}
@@ -560,6 +598,47 @@ func (st *initState) launchApplication(cpath, pwd string, cmdArgs []string) (*ex
 	return cmd, nil
 }
 
+// startApplication starts the command, restricted by Landlock to the paths
+// bound into the sandbox if the profile asks for it. Landlock applies to the
+// calling thread only, so the restriction and the start happen on a locked
+// thread which is never unlocked and exits with the goroutine.
+func (st *initState) startApplication(cmd *exec.Cmd) error {
+	if !st.profile.Landlock {
+		return cmd.Start()
+	}
+	if fs.LandlockABI() < 1 {
+		st.log.Warning("Landlock is not supported by the kernel, starting application without it")
+		return cmd.Start()
+	}
+	rules := append(st.fs.LandlockRules(), st.landlockBaseRules()...)
+	done := make(chan error)
+	go func() {
+		runtime.LockOSThread()
+		if err := fs.LandlockRestrictSelf(rules); err != nil {
+			done <- fmt.Errorf("failed to apply landlock restrictions: %v", err)
+			return
+		}
+		done <- cmd.Start()
+	}()
+	return <-done
+}
+
+// landlockBaseRules grants access to the paths every sandbox has
+// besides the bound ones
+func (st *initState) landlockBaseRules() []fs.LandlockRule {
+	return []fs.LandlockRule{
+		{Path: "/etc", Access: fs.LandlockRead},
+		{Path: "/var", Access: fs.LandlockRead},
+		{Path: "/run", Access: fs.LandlockRead},
+		{Path: "/sys", Access: fs.LandlockRead},
+		{Path: "/proc", Access: fs.LandlockReadWrite},
+		{Path: "/dev", Access: fs.LandlockDevices},
+		{Path: "/dev/shm", Access: fs.LandlockFull},
+		{Path: "/tmp", Access: fs.LandlockFull},
+		{Path: path.Join("/run/user", strconv.FormatUint(uint64(st.uid), 10)), Access: fs.LandlockFull},
+	}
+}
+
 func setEnvironOverrides(env []string) []string {
 	for _, evar := range os.Environ() {
 		if strings.HasPrefix(evar, "OZ_") {
@@ -601,6 +680,10 @@ func (st *initState) handleSetupForwarder(rp *ForwarderSuccessMsg, msg *ipc.Mess
 	if len(msg.Fds) == 0 {
 		return fmt.Errorf("SetupForwarder message received, but no file descriptor included")
 	}
+	stats := &ForwarderStats{Proto: rp.Proto, Addr: rp.Addr}
+	st.lock.Lock()
+	st.forwarders = append(st.forwarders, stats)
+	st.lock.Unlock()
 	go func() {
 		f := os.NewFile(uintptr(msg.Fds[0]), "")
 		l, err := net.FileListener(f)
@@ -614,14 +697,39 @@ func (st *initState) handleSetupForwarder(rp *ForwarderSuccessMsg, msg *ipc.Mess
 				st.log.Error(err.Error())
 			}
 			st.log.Info("Forwarder to accepted incoming client.", rp.Addr)
-			go proxyForwarder(&conn, rp.Proto, rp.Addr)
+			go st.proxyForwarder(&conn, rp.Proto, rp.Addr, stats)
 		}
 	}()
 	err := msg.Respond(&OkMsg{})
 	return err
 }
 
-func proxyForwarder(conn *net.Conn, proto string, rAddr string) error {
+func (st *initState) handleForwarderStats(fsm *ForwarderStatsMsg, msg *ipc.Message) error {
+	r := &ForwarderStatsResp{Forwarders: []ForwarderStats{}}
+	st.lock.Lock()
+	for _, f := range st.forwarders {
+		r.Forwarders = append(r.Forwarders, *f)
+	}
+	st.lock.Unlock()
+	return msg.Respond(r)
+}
+
+// forwarderCounter adds the bytes written through it to a counter of a forwarder
+type forwarderCounter struct {
+	st  *initState
+	w   io.Writer
+	val *uint64
+}
+
+func (fc forwarderCounter) Write(p []byte) (int, error) {
+	n, err := fc.w.Write(p)
+	fc.st.lock.Lock()
+	*fc.val += uint64(n)
+	fc.st.lock.Unlock()
+	return n, err
+}
+
+func (st *initState) proxyForwarder(conn *net.Conn, proto string, rAddr string, stats *ForwarderStats) error {
 	rConn, err := net.Dial(proto, rAddr)
 	if err != nil {
 		return fmt.Errorf("Socket: %+v.\n", err)
@@ -630,14 +738,25 @@ func proxyForwarder(conn *net.Conn, proto string, rAddr string) error {
 	var wg sync.WaitGroup
 	wg.Add(2)
 
-	copyLoop := func(dst, src net.Conn) {
+	st.lock.Lock()
+	stats.Connections++
+	stats.Active++
+	st.lock.Unlock()
+	go func() {
+		wg.Wait()
+		st.lock.Lock()
+		stats.Active--
+		st.lock.Unlock()
+	}()
+
+	copyLoop := func(dst, src net.Conn, count *uint64) {
 		defer wg.Done()
 		defer dst.Close()
-		io.Copy(dst, src)
+		io.Copy(forwarderCounter{st, dst, count}, src)
 	}
 
-	go copyLoop(*conn, rConn)
-	go copyLoop(rConn, *conn)
+	go copyLoop(*conn, rConn, &stats.Sent)
+	go copyLoop(rConn, *conn, &stats.Received)
 
 	return nil
 }
@@ -721,6 +840,12 @@ func (st *initState) addChildProcess(cmd *exec.Cmd, track bool) {
 	st.lock.Lock()
 	defer st.lock.Unlock()
 	st.children[cmd.Process.Pid] = procState{cmd: cmd, track: track}
+	if track && st.shutdownTimer != nil {
+		st.shutdownTimer.Stop()
+		st.shutdownTimer = nil
+		st.log.Info("Application relaunched, cancelling pending shutdown.")
+		os.Stderr.WriteString("SHUTDOWN 0\n")
+	}
 }
 
 func (st *initState) removeChildProcess(pid int) bool {
@@ -735,35 +860,69 @@ func (st *initState) removeChildProcess(pid int) bool {
 
 func (st *initState) handleChildExit(pid int, wstatus syscall.WaitStatus) {
 	st.log.Debug("Child process pid=%d exited from init with status %d", pid, wstatus.ExitStatus())
+	st.lock.Lock()
 	track := st.children[pid].track
+	st.lock.Unlock()
 	st.removeChildProcess(pid)
 
-	for _, proc := range st.children {
-		if proc.track {
-			return
-		}
+	if st.hasTrackedProcesses() {
+		return
+	}
+	// Without a watchdog list only the exit of a tracked process can
+	// trigger the shutdown, with one any exit may be the last watched one
+	if !track && len(st.profile.Watchdog) == 0 {
+		return
 	}
 
-	if len(st.profile.Watchdog) > 0 {
-		//if st.getProcessExists(st.profile.Watchdog) {
-		//	return
-		//} else {
-		//	var ww sync.WaitGroup
-		//	ww.Add(1)
-		//	time.AfterFunc(time.Second*5, func() {
-		//		ww.Done()
-		//		st.log.Info("Watchdog timeout expired")
-		//	})
-		//	ww.Wait()
-		track = !st.getProcessExists(st.profile.Watchdog)
-		//}
-	}
-	if track == true && st.profile.AutoShutdown == oz.PROFILE_SHUTDOWN_YES {
+	switch st.profile.AutoShutdown {
+	case oz.PROFILE_SHUTDOWN_YES:
 		st.log.Info("Shutting down sandbox after child exit.")
 		st.shutdown()
+	case oz.PROFILE_SHUTDOWN_SOFT:
+		st.scheduleShutdown()
 	}
 }
 
+// hasTrackedProcesses returns true if a tracked child is still running or,
+// when the profile has a watchdog list, if one of the watched processes is.
+func (st *initState) hasTrackedProcesses() bool {
+	for _, proc := range st.childrenVector() {
+		if proc.track {
+			return true
+		}
+	}
+	return len(st.profile.Watchdog) > 0 && st.getProcessExists(st.profile.Watchdog)
+}
+
+// scheduleShutdown shuts the sandbox down once the grace period of the soft
+// shutdown mode expires, unless the application is relaunched in the meantime.
+// The daemon is notified of the deadline so it can be shown when listing sandboxes.
+func (st *initState) scheduleShutdown() {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if st.shutdownTimer != nil || st.shutdownRequested {
+		return
+	}
+	grace := time.Duration(st.profile.ShutdownGrace) * time.Second
+	st.log.Info("Last tracked process exited, shutting down sandbox in %v unless the application is relaunched.", grace)
+	os.Stderr.WriteString(fmt.Sprintf("SHUTDOWN %d\n", time.Now().Add(grace).Unix()))
+	st.shutdownTimer = time.AfterFunc(grace, st.softShutdown)
+}
+
+func (st *initState) softShutdown() {
+	st.lock.Lock()
+	st.shutdownTimer = nil
+	st.lock.Unlock()
+
+	if st.hasTrackedProcesses() {
+		st.log.Info("Watched process running, cancelling pending shutdown.")
+		os.Stderr.WriteString("SHUTDOWN 0\n")
+		return
+	}
+	st.log.Info("Shutting down sandbox after grace period expired.")
+	st.shutdown()
+}
+
 func (st *initState) getProcessExists(pnames []string) bool {
 	paths, _ := filepath.Glob("/proc/[0-9]*/cmdline")
 	for _, path := range paths {
@@ -896,6 +1055,12 @@ func (st *initState) setupFilesystem(extra_whitelist []oz.WhitelistItem, extra_b
 		}
 	}
 
+	if st.waylandDir != "" {
+		if err := st.fs.BindPath(st.waylandDir, 0, st.display); err != nil {
+			return err
+		}
+	}
+
 	if err := st.fs.Chroot(); err != nil {
 		return err
 	}
@@ -906,7 +1071,13 @@ func (st *initState) setupFilesystem(extra_whitelist []oz.WhitelistItem, extra_b
 	}
 	mo.add( /*st.fs.MountTmp, */ st.fs.MountPts)
 	if st.profile.NoSysProc != true {
-		mo.add(st.fs.MountProc, st.fs.MountSys)
+		mo.add(st.fs.MountProc)
+		// sysfs can only be mounted in a user namespace owning the network namespace
+		if st.profile.UseUserNamespace(st.config) && st.profile.Networking.Nettype == network.TYPE_HOST {
+			st.log.Warning("Not mounting /sys, it is not available in a user namespace with host networking")
+		} else {
+			mo.add(st.fs.MountSys)
+		}
 	}
 	return mo.run()
 }
@@ -30,6 +30,25 @@ type ForwarderSuccessMsg struct {
 	Addr  string
 }
 
+type ForwarderStatsMsg struct {
+	_ string "ForwarderStats"
+}
+
+// ForwarderStats are the counters of a forwarder, bytes are counted from
+// the point of view of the sandbox
+type ForwarderStats struct {
+	Proto       string
+	Addr        string
+	Connections int
+	Active      int
+	Sent        uint64
+	Received    uint64
+}
+
+type ForwarderStatsResp struct {
+	Forwarders []ForwarderStats "ForwarderStatsResp"
+}
+
 var messageFactory = ipc.NewMsgFactory(
 	new(OkMsg),
 	new(ErrorMsg),
@@ -37,4 +56,6 @@ var messageFactory = ipc.NewMsgFactory(
 	new(RunShellMsg),
 	new(RunProgramMsg),
 	new(ForwarderSuccessMsg),
+	new(ForwarderStatsMsg),
+	new(ForwarderStatsResp),
 )
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/codegangsta/cli"
+)
+
+// Output formats selected with the global --format option
+//
+//  - table: human readable output (default)
+//  - plain: one entry per line with tab separated columns and no header
+//  - json:  the daemon response items, the field names are those of the
+//           structures in oz-daemon/protocol.go and are documented in README.mdwn
+const (
+	formatTable = "table"
+	formatPlain = "plain"
+	formatJSON  = "json"
+)
+
+func checkFormat(c *cli.Context) error {
+	switch c.GlobalString("format") {
+	case formatTable, formatPlain, formatJSON:
+		return nil
+	}
+	return fmt.Errorf("Unknown output format `%s`, must be one of: %s, %s, %s", c.GlobalString("format"), formatTable, formatPlain, formatJSON)
+}
+
+func outputFormat(c *cli.Context) string {
+	return c.GlobalString("format")
+}
+
+func printJSON(v interface{}) {
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to encode output: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println(string(out))
+}
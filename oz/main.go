@@ -10,6 +10,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/subgraph/oz"
 	"github.com/subgraph/oz/oz-daemon"
@@ -91,6 +92,14 @@ func runApplication() {
 	app.Email = "info@subgraph.com"
 	app.Version = oz.OzVersion
 	app.EnableBashCompletion = true
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "format",
+			Value: formatTable,
+			Usage: "output format of the listings, one of: table, plain, json",
+		},
+	}
+	app.Before = checkFormat
 	app.Commands = []cli.Command{
 		{
 			Name:   "profiles",
@@ -120,6 +129,62 @@ func runApplication() {
 				},
 			},
 		},
+		{
+			Name:   "inspect",
+			Usage:  "show detailed status of a running sandbox",
+			Action: handleInspect,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "Output the status as JSON",
+				},
+			},
+		},
+		{
+			Name:   "netstat",
+			Usage:  "show the network traffic of running sandboxes",
+			Action: handleNetstat,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "watch, w",
+					Usage: "Refresh the counters and show the current rates",
+				},
+				cli.IntFlag{
+					Name:  "interval",
+					Value: 2,
+					Usage: "Seconds between refreshes in watch mode",
+				},
+			},
+		},
+		{
+			Name:   "throttle",
+			Usage:  "change the bandwidth limits of a running sandbox, a rate of none removes them",
+			Action: handleThrottle,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "egress",
+					Usage: "Only limit the traffic sent by the sandbox",
+				},
+				cli.BoolFlag{
+					Name:  "ingress",
+					Usage: "Only limit the traffic received by the sandbox",
+				},
+				cli.StringFlag{
+					Name:  "burst",
+					Usage: "Burst size in bytes with an optional kb, mb or gb suffix",
+				},
+			},
+		},
+		{
+			Name:   "mute",
+			Usage:  "mute the audio a sandbox forwards through xpra",
+			Action: handleMute,
+		},
+		{
+			Name:   "unmute",
+			Usage:  "unmute the audio a sandbox forwards through xpra",
+			Action: handleMute,
+		},
 		{
 			Name:   "shell",
 			Usage:  "start a shell in a running sandbox",
@@ -202,6 +267,11 @@ func runApplication() {
 			Usage:  "list established proxy circuits",
 			Action: handleListProxies,
 		},
+		{
+			Name:   "reload",
+			Usage:  "reload oz-daemon configuration and profiles, running sandboxes are not affected",
+			Action: handleReload,
+		},
 	}
 	app.Run(os.Args)
 }
@@ -212,8 +282,20 @@ func handleProfiles(c *cli.Context) {
 		fmt.Printf("Error listing profiles: %v\n", err)
 		os.Exit(1)
 	}
-	for i, p := range ps {
-		fmt.Printf("%2d) %-30s %s\n", i+1, p.Name, p.Path)
+	switch outputFormat(c) {
+	case formatJSON:
+		if ps == nil {
+			ps = []daemon.Profile{}
+		}
+		printJSON(ps)
+	case formatPlain:
+		for _, p := range ps {
+			fmt.Printf("%d\t%s\t%s\n", p.Index, p.Name, p.Path)
+		}
+	default:
+		for i, p := range ps {
+			fmt.Printf("%2d) %-30s %s\n", i+1, p.Name, p.Path)
+		}
 	}
 }
 
@@ -240,6 +322,19 @@ func handleList(c *cli.Context) {
 		fmt.Printf("Error listing running sandboxes: %v\n", err)
 		os.Exit(1)
 	}
+	switch outputFormat(c) {
+	case formatJSON:
+		if sboxes == nil {
+			sboxes = []daemon.SandboxInfo{}
+		}
+		printJSON(sboxes)
+		return
+	case formatPlain:
+		for _, sb := range sboxes {
+			fmt.Printf("%d\t%s\t%d\t%v\t%d\t%s\n", sb.Id, sb.Profile, sb.InitPid, sb.Ephemeral, sb.ShutdownIn, sb.VPN)
+		}
+		return
+	}
 	if len(sboxes) == 0 {
 		fmt.Println("No running sandboxes")
 		return
@@ -249,7 +344,128 @@ func handleList(c *cli.Context) {
 		if sb.Ephemeral {
 			ephemeral = " [ephemeral]"
 		}
-		fmt.Printf("%2d) %s%s\n", sb.Id, sb.Profile, ephemeral)
+		shutdown := ""
+		if sb.ShutdownIn > 0 {
+			shutdown = fmt.Sprintf(" [shutdown in %ds]", sb.ShutdownIn)
+		}
+		vpn := ""
+		if sb.VPN != "" {
+			vpn = fmt.Sprintf(" [vpn %s]", sb.VPN)
+		}
+		fmt.Printf("%2d) %s%s%s%s\n", sb.Id, sb.Profile, ephemeral, shutdown, vpn)
+		if c.Bool("verbose") {
+			fmt.Printf("    init pid: %d\n", sb.InitPid)
+			if sb.Usage != nil {
+				fmt.Printf("    memory: %s, cpu time: %v, processes: %d\n",
+					formatBytes(sb.Usage.Memory), time.Duration(sb.Usage.CPUUsec)*time.Microsecond, sb.Usage.Pids)
+			}
+		}
+	}
+}
+
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func handleInspect(c *cli.Context) {
+	if len(c.Args()) == 0 {
+		fmt.Fprintf(os.Stderr, "Need a sandbox id to inspect\n")
+		os.Exit(1)
+	}
+	id, err := strconv.Atoi(c.Args()[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not parse id value %s\n", c.Args()[0])
+		os.Exit(1)
+	}
+	sb, err := daemon.InspectSandbox(id)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Inspect command failed: %s.\n", err)
+		os.Exit(1)
+	}
+	if c.Bool("json") || outputFormat(c) == formatJSON {
+		printJSON(sb)
+		return
+	}
+
+	fmt.Printf("Sandbox %d: %s\n", sb.Id, sb.Profile.Name)
+	fmt.Printf("  Uptime:      %v (started %s)\n", time.Duration(sb.Uptime)*time.Second, sb.Started.Format(time.RFC1123))
+	if sb.ShutdownIn > 0 {
+		fmt.Printf("  Shutdown in: %ds\n", sb.ShutdownIn)
+	}
+	fmt.Printf("  Ephemeral:   %v\n", sb.Ephemeral)
+	fmt.Printf("  Init pid:    %d\n", sb.InitPid)
+	fmt.Printf("  User:        %s (uid %d, gid %d, groups %v)\n", sb.User, sb.Uid, sb.Gid, sb.Gids)
+	fmt.Printf("  User ns:     %v\n", sb.UserNS)
+	if sb.Profile.XServer.Enabled {
+		fmt.Printf("  Display:     :%d\n", sb.Display)
+	} else if sb.Profile.Display.Type == oz.PROFILE_DISPLAY_WAYLAND_PROXY {
+		extensions := "none"
+		if len(sb.Profile.Display.Extensions) > 0 {
+			extensions = strings.Join(sb.Profile.Display.Extensions, ", ")
+		}
+		fmt.Printf("  Display:     Wayland proxy (extensions: %s)\n", extensions)
+	}
+	if sb.Profile.XServer.AudioMode != oz.PROFILE_AUDIO_NONE {
+		audio := string(sb.Profile.XServer.AudioMode)
+		if sb.Muted {
+			audio += " (muted)"
+		}
+		fmt.Printf("  Audio:       %s\n", audio)
+	}
+	fmt.Printf("  Seccomp:     %s\n", sb.SeccompMode)
+	fmt.Printf("  Network:     %s\n", sb.Profile.Networking.Nettype)
+	if sb.Veth != "" {
+		addrs := sb.IP
+		if sb.IP6 != "" {
+			addrs += ", " + sb.IP6
+		}
+		fmt.Printf("  Veth:        %s (%s on bridge %s)\n", sb.Veth, addrs, sb.Bridge)
+		if sb.Bandwidth != "" {
+			fmt.Printf("  Bandwidth:   %s\n", sb.Bandwidth)
+		}
+	}
+	if sb.OpenVPNRunToken != "" {
+		fmt.Printf("  OpenVPN:     pid %d, runtoken %s\n", sb.OpenVPNPid, sb.OpenVPNRunToken)
+		vpn := sb.VPNState
+		if sb.VPNTunnel != "" {
+			vpn += " through " + sb.VPNTunnel
+		}
+		if sb.VPNRestarts > 0 {
+			vpn += fmt.Sprintf(" (%d restarts)", sb.VPNRestarts)
+		}
+		fmt.Printf("  VPN:         %s\n", vpn)
+	}
+	if sb.WireGuardDev != "" {
+		fmt.Printf("  WireGuard:   %s\n", sb.WireGuardDev)
+	}
+	if len(sb.Forwarders) > 0 {
+		fmt.Println("  Forwarders:")
+		for _, f := range sb.Forwarders {
+			fmt.Printf("    %s: %s => %s\n", f.Name, f.Desc, f.Target)
+		}
+	}
+	if len(sb.MountedFiles) > 0 {
+		fmt.Println("  Mounted files:")
+		for _, f := range sb.MountedFiles {
+			fmt.Printf("    %s\n", f)
+		}
+	}
+	fmt.Println("  Processes:")
+	for _, p := range sb.Processes {
+		fmt.Printf("    %5d (host %d) %s\n", p.Pid, p.HostPid, p.Cmdline)
+	}
+	fmt.Println("  Mounts:")
+	for _, m := range sb.Mounts {
+		fmt.Printf("    %s\n", m)
 	}
 }
 
@@ -259,7 +475,19 @@ func handleListBridges(c *cli.Context) {
 		fmt.Printf("Error listing configured bridges: %v\n", err)
 		os.Exit(1)
 	}
-	fmt.Println(strings.Join(bridges, ","))
+	switch outputFormat(c) {
+	case formatJSON:
+		if bridges == nil {
+			bridges = []string{}
+		}
+		printJSON(bridges)
+	case formatPlain:
+		for _, b := range bridges {
+			fmt.Println(b)
+		}
+	default:
+		fmt.Println(strings.Join(bridges, ","))
+	}
 }
 
 func handleMount(c *cli.Context) {
@@ -302,6 +530,46 @@ func handleUmount(c *cli.Context) {
 	}
 }
 
+func handleThrottle(c *cli.Context) {
+	if len(c.Args()) < 2 {
+		fmt.Println("oz throttle [--egress|--ingress] [--burst <size>] <sandbox_id> <rate|none>")
+		os.Exit(1)
+	}
+	id, err := strconv.Atoi(c.Args()[0])
+	if err != nil {
+		fmt.Println("Sandbox id argument must be an integer")
+		os.Exit(1)
+	}
+	msg := &daemon.ThrottleMsg{Id: id}
+	rate, burst := c.Args()[1], c.String("burst")
+	if !c.Bool("ingress") {
+		msg.Egress, msg.EgressBurst = rate, burst
+	}
+	if !c.Bool("egress") {
+		msg.Ingress, msg.IngressBurst = rate, burst
+	}
+	if err := daemon.Throttle(msg); err != nil {
+		fmt.Fprintf(os.Stderr, "Throttle command failed: %s.\n", err)
+		os.Exit(1)
+	}
+}
+
+func handleMute(c *cli.Context) {
+	if len(c.Args()) == 0 {
+		fmt.Printf("oz %s <sandbox_id>\n", c.Command.Name)
+		os.Exit(1)
+	}
+	id, err := strconv.Atoi(c.Args()[0])
+	if err != nil {
+		fmt.Println("Sandbox id argument must be an integer")
+		os.Exit(1)
+	}
+	if err := daemon.Mute(id, c.Command.Name == "mute"); err != nil {
+		fmt.Fprintf(os.Stderr, "Mute command failed: %s.\n", err)
+		os.Exit(1)
+	}
+}
+
 func handleShell(c *cli.Context) {
 	if len(c.Args()) == 0 {
 		fmt.Println("Sandbox id argument needed")
@@ -393,6 +661,28 @@ func handleKill(c *cli.Context) {
 	}
 
 }
+
+func handleReload(c *cli.Context) {
+	diff, err := daemon.Reload()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Reload command failed: %s.\n", err)
+		os.Exit(1)
+	}
+	if len(diff.Added)+len(diff.Removed)+len(diff.Changed) == 0 {
+		fmt.Println("Reloaded, no profile changes")
+		return
+	}
+	for _, name := range diff.Added {
+		fmt.Printf("added:   %s\n", name)
+	}
+	for _, name := range diff.Removed {
+		fmt.Printf("removed: %s\n", name)
+	}
+	for _, name := range diff.Changed {
+		fmt.Printf("changed: %s\n", name)
+	}
+}
+
 func handleLogs(c *cli.Context) {
 	follow := c.Bool("f")
 	ch, err := daemon.Logs(0, follow)
@@ -461,9 +751,21 @@ func handleListForwarders(c *cli.Context) {
 		os.Exit(1)
 	}
 
-	fmt.Printf("Listeners for sandbox %d:\n", id)
-	for _, r := range forwarders {
-		fmt.Printf("  %s: %s => %s\n", r.Name, r.Desc, r.Target)
+	switch outputFormat(c) {
+	case formatJSON:
+		if forwarders == nil {
+			forwarders = []daemon.Forwarder{}
+		}
+		printJSON(forwarders)
+	case formatPlain:
+		for _, r := range forwarders {
+			fmt.Printf("%s\t%s\t%s\n", r.Name, r.Desc, r.Target)
+		}
+	default:
+		fmt.Printf("Listeners for sandbox %d:\n", id)
+		for _, r := range forwarders {
+			fmt.Printf("  %s: %s => %s\n", r.Name, r.Desc, r.Target)
+		}
 	}
 }
 
@@ -473,8 +775,20 @@ func handleListProxies(c *cli.Context) {
 		fmt.Printf("Error listing established proxies: %v\n", err)
 		os.Exit(1)
 	}
-	fmt.Printf("Result: %d entries ...\n", len(res))
-	fmt.Println(strings.Join(res, "\n"))
+	switch outputFormat(c) {
+	case formatJSON:
+		if res == nil {
+			res = []string{}
+		}
+		printJSON(res)
+	case formatPlain:
+		for _, r := range res {
+			fmt.Println(r)
+		}
+	default:
+		fmt.Printf("Result: %d entries ...\n", len(res))
+		fmt.Println(strings.Join(res, "\n"))
+	}
 }
 
 
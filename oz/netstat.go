@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/subgraph/oz/oz-daemon"
+)
+
+func handleNetstat(c *cli.Context) {
+	id := 0
+	if len(c.Args()) > 0 {
+		var err error
+		if id, err = strconv.Atoi(c.Args()[0]); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not parse id value %s\n", c.Args()[0])
+			os.Exit(1)
+		}
+	}
+	if !c.Bool("watch") {
+		stats, err := fetchNetStats(id)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Netstat command failed: %s.\n", err)
+			os.Exit(1)
+		}
+		printNetStats(c, id, stats, nil, 0)
+		return
+	}
+
+	interval := time.Duration(c.Int("interval")) * time.Second
+	if interval <= 0 {
+		fmt.Fprintf(os.Stderr, "Invalid interval %d\n", c.Int("interval"))
+		os.Exit(1)
+	}
+	var prev map[int]*daemon.NetStatsResp
+	for {
+		stats, err := fetchNetStats(id)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Netstat command failed: %s.\n", err)
+			os.Exit(1)
+		}
+		// Clear the terminal before each refresh
+		fmt.Print("\033[H\033[2J")
+		printNetStats(c, id, stats, prev, interval)
+		prev = make(map[int]*daemon.NetStatsResp)
+		for _, s := range stats {
+			prev[s.Id] = s
+		}
+		time.Sleep(interval)
+	}
+}
+
+// fetchNetStats returns the counters of the sandbox with the given id, or of
+// all the running sandboxes if id is 0
+func fetchNetStats(id int) ([]*daemon.NetStatsResp, error) {
+	if id != 0 {
+		s, err := daemon.NetStats(id)
+		if err != nil {
+			return nil, err
+		}
+		return []*daemon.NetStatsResp{s}, nil
+	}
+	sboxes, err := daemon.ListSandboxes()
+	if err != nil {
+		return nil, err
+	}
+	stats := []*daemon.NetStatsResp{}
+	for _, sb := range sboxes {
+		// The sandbox may be gone in the meantime
+		if s, err := daemon.NetStats(sb.Id); err == nil {
+			stats = append(stats, s)
+		}
+	}
+	return stats, nil
+}
+
+// printNetStats prints the counters, along with the rates since the previous
+// refresh in watch mode
+func printNetStats(c *cli.Context, id int, stats []*daemon.NetStatsResp, prev map[int]*daemon.NetStatsResp, interval time.Duration) {
+	switch outputFormat(c) {
+	case formatJSON:
+		if id != 0 {
+			printJSON(stats[0])
+		} else {
+			printJSON(stats)
+		}
+		return
+	case formatPlain:
+		for _, s := range stats {
+			fmt.Printf("%d\t%s\t%s\t%d\t%d\t%d\t%d\t%d\n", s.Id, s.Profile, s.Veth,
+				s.RxBytes, s.RxPackets, s.TxBytes, s.TxPackets, len(s.Connections))
+		}
+		return
+	}
+	if len(stats) == 0 {
+		fmt.Println("No running sandboxes")
+		return
+	}
+	for _, s := range stats {
+		veth := ""
+		if s.Veth != "" {
+			veth = " (" + s.Veth + ")"
+		}
+		fmt.Printf("%2d) %s%s\n", s.Id, s.Profile, veth)
+		rate := func(cur uint64, last func(*daemon.NetStatsResp) uint64) string {
+			p, ok := prev[s.Id]
+			if !ok || cur < last(p) {
+				return ""
+			}
+			return fmt.Sprintf(", %s/s", formatBytes(uint64(float64(cur-last(p))/interval.Seconds())))
+		}
+		if s.Veth != "" {
+			fmt.Printf("    received: %s, %d packets%s\n", formatBytes(s.RxBytes), s.RxPackets,
+				rate(s.RxBytes, func(p *daemon.NetStatsResp) uint64 { return p.RxBytes }))
+			fmt.Printf("    sent:     %s, %d packets%s\n", formatBytes(s.TxBytes), s.TxPackets,
+				rate(s.TxBytes, func(p *daemon.NetStatsResp) uint64 { return p.TxBytes }))
+		}
+		if id == 0 {
+			if len(s.Connections) > 0 || len(s.Forwarders) > 0 {
+				fmt.Printf("    %d proxied connections, %d forwarders\n", len(s.Connections), len(s.Forwarders))
+			}
+			continue
+		}
+		if len(s.Connections) > 0 {
+			fmt.Println("    Proxied connections:")
+			for _, pc := range s.Connections {
+				fmt.Printf("      %s => %s: sent %s, received %s\n", pc.Sandbox, pc.Host, formatBytes(pc.Sent), formatBytes(pc.Received))
+			}
+		}
+		if len(s.Forwarders) > 0 {
+			fmt.Println("    Forwarders:")
+			for _, f := range s.Forwarders {
+				fmt.Printf("      %s: %s => %s: %d connections (%d open), sent %s, received %s\n", f.Name, f.Desc, f.Target,
+					f.Connections, f.Active, formatBytes(f.Sent), formatBytes(f.Received))
+			}
+		}
+	}
+}
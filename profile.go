@@ -22,12 +22,16 @@ type Profile struct {
 	Paths []string
 	// Path of the config file
 	ProfilePath string `json:"-"`
+	// List of base profiles this profile extends, see extends.go for the merge rules
+	Extends []string `json:"extends"`
 	// Default parameters to pass to the program
 	DefaultParams []string `json:"default_params"`
 	// Pass command-line arguments
 	RejectUserArgs bool `json:"reject_user_args"`
 	// Autoshutdown the sandbox when the process exits. One of (no, yes, soft), defaults to yes
 	AutoShutdown ShutdownMode `json:"auto_shutdown"`
+	// Seconds to wait for the application to be relaunched before shutting down in soft mode, defaults to 30
+	ShutdownGrace int `json:"shutdown_grace"`
 	// Optional list of executable names to watch for exit in case initial command spawns and exit
 	Watchdog []string
 	// Optional wrapper binary to use when launching command (ex: tsocks)
@@ -36,6 +40,10 @@ type Profile struct {
 	Multi bool
 	// Disable mounting of sys and proc inside the sandbox
 	NoSysProc bool
+	// Run the sandbox in a user namespace where root is not privileged on the host
+	UserNamespace bool `json:"user_namespace"`
+	// Restrict the filesystem access of the application with Landlock to the bound paths
+	Landlock bool
 	// Disable bind mounting of default directories (etc,usr,bin,lib,lib64)
 	// Also disables default blacklist items (/sbin, /usr/sbin, /usr/bin/sudo)
 	// Normally not used
@@ -53,26 +61,34 @@ type Profile struct {
 	SharedFolders []string `json:"shared_folders"`
 	// Optional XServer config
 	XServer XServerConf
+	// How the application is displayed
+	Display DisplayConf
 	// List of environment variables
 	Environment []EnvVar
 	// Networking
 	Networking NetworkProfile
 	// Firewall
 	Firewall []FWRule
+	// Policy for the traffic not matched by the firewall rules
+	FirewallPolicy network.FirewallPolicy `json:"firewall_policy"`
 	// Seccomp
 	Seccomp SeccompConf
 	// External Forwarders
 	ExternalForwarders []ExternalForwarder `json:"external_forwarders"`
+	// Optional cgroup v2 resource limits
+	Resources ResourcesConf
 }
 
 type ShutdownMode string
 
 const (
-	PROFILE_SHUTDOWN_NO  ShutdownMode = "no"
-	PROFILE_SHUTDOWN_YES ShutdownMode = "yes"
-	//PROFILE_SHUTDOWN_SOFT     ShutdownMode = "soft" // Unimplemented
+	PROFILE_SHUTDOWN_NO   ShutdownMode = "no"
+	PROFILE_SHUTDOWN_YES  ShutdownMode = "yes"
+	PROFILE_SHUTDOWN_SOFT ShutdownMode = "soft"
 )
 
+const defaultShutdownGrace = 30
+
 type AudioMode string
 
 const (
@@ -95,6 +111,24 @@ type XServerConf struct {
 	Environment         []EnvVar  `json:"env"`
 }
 
+type DisplayType string
+
+const (
+	// Through xpra, as configured by the XServer section
+	PROFILE_DISPLAY_XPRA DisplayType = "xpra"
+	// Through a filtering proxy of the Wayland compositor of the user
+	PROFILE_DISPLAY_WAYLAND_PROXY DisplayType = "wayland-proxy"
+	PROFILE_DISPLAY_NONE          DisplayType = "none"
+)
+
+type DisplayConf struct {
+	// Defaults to xpra if the XServer is enabled, none otherwise
+	Type DisplayType
+	// Wayland interfaces the application may use besides the core ones, in
+	// wayland-proxy mode
+	Extensions []string
+}
+
 type SeccompMode string
 
 const (
@@ -115,11 +149,59 @@ type SeccompConf struct {
 	ExtraDefs   []string
 }
 
+// Resource limits of the sandbox cgroup, empty values are left to the kernel
+// defaults. See the cgroup v2 documentation for the meaning of each setting.
+type ResourcesConf struct {
+	// Memory limits in bytes, with an optional K, M, G or T suffix, or "max"
+	MemoryMax  string `json:"memory_max"`
+	MemoryHigh string `json:"memory_high"`
+	// Relative CPU weight between 1 and 10000 (default 100)
+	CPUWeight uint `json:"cpu_weight"`
+	// CPU bandwidth as "$QUOTA $PERIOD" in microseconds, or "max"
+	CPUMax string `json:"cpu_max"`
+	// Maximum number of processes
+	PidsMax uint `json:"pids_max"`
+	// Relative IO weight between 1 and 10000 (default 100)
+	IOWeight uint `json:"io_weight"`
+}
+
+// Bandwidth limits of the sandbox, rates use the units of tc (ie: `2mbit`
+// or `500kbps`) and bursts are in bytes with an optional kb, mb or gb suffix.
+// Egress is the traffic sent by the sandbox, ingress what it receives.
+type BandwidthConf struct {
+	Egress       string `json:"egress"`
+	EgressBurst  string `json:"egress_burst"`
+	Ingress      string `json:"ingress"`
+	IngressBurst string `json:"ingress_burst"`
+}
+
+type VPNType string
+
+const (
+	PROFILE_VPN_OPENVPN VPNType = "openvpn"
+	// Interface moved into the network namespace of the sandbox
+	PROFILE_VPN_WIREGUARD VPNType = "wireguard"
+)
+
+// What becomes of a sandbox whose VPN cannot be restored
+type VPNFailureAction string
+
+const (
+	// The processes of the sandbox are frozen until the VPN is back
+	PROFILE_VPN_FAILURE_PAUSE VPNFailureAction = "pause"
+	PROFILE_VPN_FAILURE_KILL  VPNFailureAction = "kill"
+)
+
 type VPNConf struct {
-	VpnType          string `json:"type"`
-	ConfigPath       string
+	VpnType VPNType `json:"type"`
+	// Relative to the OpenVPN or WireGuard configuration directory
+	ConfigPath string
+	// Name servers and search domains, those of the WireGuard configuration
+	// if empty
 	DNS              []string
 	UserPassFilePath string `json:"authfile"`
+	// Applies to type: openvpn only, defaults to pause
+	OnFailure VPNFailureAction `json:"on_failure"`
 }
 
 type ExternalForwarder struct {
@@ -137,7 +219,7 @@ type ExternalForwarder struct {
 type WhitelistItem struct {
 	Path        string
 	Target      string
-	Symlink     string `json:-"`
+	Symlink     string `json:"-"`
 	ReadOnly    bool   `json:"read_only"`
 	CanCreate   bool   `json:"can_create"`
 	Ignore      bool   `json:"ignore"`
@@ -152,9 +234,16 @@ type BlacklistItem struct {
 }
 
 type FWRule struct {
-	Whitelist bool   `json:"whitelist"`
-	DstHost   string `json:"dst_host"`
-	DstPort   int    `json:"dst_port"`
+	Whitelist bool                      `json:"whitelist"`
+	Direction network.FirewallDirection `json:"direction"`
+	Proto     network.FirewallProto     `json:"proto"`
+	// Host name, address or network in CIDR notation
+	Dst string `json:"dst"`
+	// Ports or ranges of ports (ie: "8000-8080")
+	DstPorts []string `json:"dst_ports"`
+	// Deprecated, same as dst and a single port in dst_ports
+	DstHost string `json:"dst_host"`
+	DstPort int    `json:"dst_port"`
 }
 
 type EnvVar struct {
@@ -168,11 +257,13 @@ const (
 	PROFILE_NETWORK_DNS_NONE DNSMode = "none"
 	PROFILE_NETWORK_DNS_PASS DNSMode = "pass"
 	PROFILE_NETWORK_DNS_DHCP DNSMode = "dhcp"
+	// Queries go through the DNS forwarder of the bridge
+	PROFILE_NETWORK_DNS_FORWARD DNSMode = "forward"
 )
 
 // Sandbox network definition
 type NetworkProfile struct {
-	// One of empty, host, bridge
+	// One of empty, host, bridge, proxy
 	Nettype network.NetType `json:"type"`
 
 	// Name of the bridge to attach to
@@ -189,10 +280,24 @@ type NetworkProfile struct {
 	//  Applies to Nettype: bridge only
 	IpByte uint `json:"ip_byte"`
 
-	// DNS Mode one of: pass, none, dhcp
+	// DNS Mode one of: pass, none, dhcp, forward
 	//  Applies to Nettype: bridge only
 	DNSMode DNSMode `json:"dns_mode"`
 
+	// Domain patterns the sandbox may or may not resolve through the DNS forwarder
+	//  Applies to DNSMode: forward and dhcp only
+	DNSAllow []string `json:"dns_allow"`
+	DNSDeny  []string `json:"dns_deny"`
+
+	// Bandwidth limits of the sandbox
+	//  Applies to Nettype: bridge only
+	Bandwidth BandwidthConf `json:"bandwidth"`
+
+	// Port of the SOCKS5 and HTTP CONNECT egress proxy on the loopback
+	// interface of the sandbox, defaults to 1080
+	//  Applies to Nettype: proxy only
+	ProxyPort uint `json:"proxy_port"`
+
 	// Additional data for the hosts file
 	Hosts string
 }
@@ -218,6 +323,20 @@ func NewDefaultProfile() *Profile {
 	}
 }
 
+// UseUserNamespace returns true if the sandbox should be run in a user namespace,
+// either because the profile asks for it or because it is enabled globally
+func (p *Profile) UseUserNamespace(c *Config) bool {
+	return p.UserNamespace || c.UserNamespace
+}
+
+// EgressProxyPort returns the port of the egress proxy of a sandbox of type proxy
+func (n *NetworkProfile) EgressProxyPort() int {
+	if n.ProxyPort == 0 {
+		return network.DefaultEgressProxyPort
+	}
+	return int(n.ProxyPort)
+}
+
 func (ps Profiles) GetProfileByName(name string) (*Profile, error) {
 	if loadedProfiles == nil {
 		ps, err := LoadProfiles(defaultProfileDirectory)
@@ -262,18 +381,23 @@ func LoadProfiles(dir string) (Profiles, error) {
 		return nil, err
 	}
 	ps := []*Profile{}
+	errs := []string{}
 	for _, f := range fs {
 		if !f.IsDir() {
 			name := path.Join(dir, f.Name())
 			if strings.HasSuffix(f.Name(), ".json") {
 				p, err := loadProfileFile(name)
 				if err != nil {
-					return nil, fmt.Errorf("error loading '%s': %v", f.Name(), err)
+					errs = append(errs, fmt.Sprintf("error loading '%s':\n%v", f.Name(), err))
+					continue
 				}
 				ps = append(ps, p)
 			}
 		}
 	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(errs, "\n"))
+	}
 
 	loadedProfiles = ps
 	return ps, nil
@@ -281,7 +405,8 @@ func LoadProfiles(dir string) (Profiles, error) {
 
 var commentRegexp = regexp.MustCompile("^[ \t]*#")
 
-func loadProfileFile(fpath string) (*Profile, error) {
+// readProfileJSON returns the content of a profile file with the comment lines blanked out
+func readProfileJSON(fpath string) ([]byte, error) {
 	if err := checkConfigPermissions(fpath); err != nil {
 		return nil, err
 	}
@@ -290,16 +415,37 @@ func loadProfileFile(fpath string) (*Profile, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer file.Close()
 	scanner := bufio.NewScanner(file)
 	bs := ""
 	for scanner.Scan() {
 		line := scanner.Text()
-		if !commentRegexp.MatchString(line) {
-			bs += line + "\n"
+		if commentRegexp.MatchString(line) {
+			// Keep the line so positions in errors match the file
+			line = ""
 		}
+		bs += line + "\n"
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return []byte(bs), nil
+}
+
+func loadProfileFile(fpath string) (*Profile, error) {
+	data, err := loadProfileData(fpath, nil)
+	if err != nil {
+		return nil, err
+	}
+	bs, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
 	}
 	p := new(Profile)
-	if err := json.Unmarshal([]byte(bs), p); err != nil {
+	if err := json.Unmarshal(bs, p); err != nil {
+		return nil, err
+	}
+	if err := checkMergedProfile(fpath, p); err != nil {
 		return nil, err
 	}
 	if p.Name == "" {
@@ -308,9 +454,23 @@ func loadProfileFile(fpath string) (*Profile, error) {
 	if p.AutoShutdown == "" {
 		p.AutoShutdown = PROFILE_SHUTDOWN_YES
 	}
+	if p.ShutdownGrace <= 0 {
+		p.ShutdownGrace = defaultShutdownGrace
+	}
 	if p.XServer.AudioMode == "" {
 		p.XServer.AudioMode = PROFILE_AUDIO_NONE
 	}
+	switch p.Display.Type {
+	case "":
+		p.Display.Type = PROFILE_DISPLAY_NONE
+		if p.XServer.Enabled {
+			p.Display.Type = PROFILE_DISPLAY_XPRA
+		}
+	case PROFILE_DISPLAY_XPRA:
+		p.XServer.Enabled = true
+	default:
+		p.XServer.Enabled = false
+	}
 	if p.Seccomp.Mode == "" {
 		p.Seccomp.Mode = PROFILE_SECCOMP_DISABLED
 	}
@@ -0,0 +1,136 @@
+package oz
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/subgraph/oz/network"
+)
+
+// IsSet returns true if any resource limit is configured
+func (r *ResourcesConf) IsSet() bool {
+	return *r != ResourcesConf{}
+}
+
+// CgroupValues returns the cgroup v2 interface files to write with their
+// content, only the configured limits are included.
+func (r *ResourcesConf) CgroupValues() (map[string]string, error) {
+	vals := make(map[string]string)
+	for _, m := range []struct {
+		file  string
+		value string
+	}{
+		{"memory.max", r.MemoryMax},
+		{"memory.high", r.MemoryHigh},
+	} {
+		if m.value == "" {
+			continue
+		}
+		v, err := ParseMemorySize(m.value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", m.file, err)
+		}
+		vals[m.file] = v
+	}
+	if r.CPUWeight != 0 {
+		if r.CPUWeight > 10000 {
+			return nil, fmt.Errorf("cpu.weight: %d is out of range, must be between 1 and 10000", r.CPUWeight)
+		}
+		vals["cpu.weight"] = strconv.FormatUint(uint64(r.CPUWeight), 10)
+	}
+	if r.CPUMax != "" {
+		if err := checkCPUMax(r.CPUMax); err != nil {
+			return nil, fmt.Errorf("cpu.max: %v", err)
+		}
+		vals["cpu.max"] = r.CPUMax
+	}
+	if r.PidsMax != 0 {
+		vals["pids.max"] = strconv.FormatUint(uint64(r.PidsMax), 10)
+	}
+	if r.IOWeight != 0 {
+		if r.IOWeight > 10000 {
+			return nil, fmt.Errorf("io.weight: %d is out of range, must be between 1 and 10000", r.IOWeight)
+		}
+		vals["io.weight"] = "default " + strconv.FormatUint(uint64(r.IOWeight), 10)
+	}
+	return vals, nil
+}
+
+// ParseMemorySize converts a size with an optional K, M, G or T suffix
+// into a number of bytes, "max" is returned as is.
+func ParseMemorySize(size string) (string, error) {
+	s := strings.TrimSpace(size)
+	if s == "max" {
+		return s, nil
+	}
+	mult := uint64(1)
+	if len(s) > 0 {
+		switch strings.ToUpper(s[len(s)-1:]) {
+		case "K":
+			mult = 1 << 10
+		case "M":
+			mult = 1 << 20
+		case "G":
+			mult = 1 << 30
+		case "T":
+			mult = 1 << 40
+		}
+		if mult != 1 {
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || n == 0 {
+		return "", fmt.Errorf("invalid memory size `%s`, must be a number of bytes with an optional K, M, G or T suffix, or max", size)
+	}
+	if n > math.MaxUint64/mult {
+		return "", fmt.Errorf("memory size `%s` is too large", size)
+	}
+	return strconv.FormatUint(n*mult, 10), nil
+}
+
+func checkCPUMax(s string) error {
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields) > 2 {
+		return fmt.Errorf("invalid value `%s`, must be \"$QUOTA $PERIOD\" in microseconds, or max", s)
+	}
+	if fields[0] != "max" {
+		if n, err := strconv.ParseUint(fields[0], 10, 64); err != nil || n < 1000 {
+			return fmt.Errorf("invalid quota `%s`, must be max or at least 1000 microseconds", fields[0])
+		}
+	}
+	if len(fields) == 2 {
+		if n, err := strconv.ParseUint(fields[1], 10, 64); err != nil || n < 1000 || n > 1000000 {
+			return fmt.Errorf("invalid period `%s`, must be between 1000 and 1000000 microseconds", fields[1])
+		}
+	}
+	return nil
+}
+
+// Limits returns the parsed bandwidth limits, unset rates are unlimited
+func (b *BandwidthConf) Limits() (network.Bandwidth, error) {
+	var bw network.Bandwidth
+	for _, f := range []struct {
+		key   string
+		value string
+		parse func(string) (uint64, error)
+		dst   *uint64
+	}{
+		{"egress", b.Egress, network.ParseRate, &bw.EgressRate},
+		{"egress_burst", b.EgressBurst, network.ParseBurst, &bw.EgressBurst},
+		{"ingress", b.Ingress, network.ParseRate, &bw.IngressRate},
+		{"ingress_burst", b.IngressBurst, network.ParseBurst, &bw.IngressBurst},
+	} {
+		if f.value == "" {
+			continue
+		}
+		n, err := f.parse(f.value)
+		if err != nil {
+			return bw, fmt.Errorf("%s: %v", f.key, err)
+		}
+		*f.dst = n
+	}
+	return bw, nil
+}
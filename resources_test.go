@@ -0,0 +1,86 @@
+package oz
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/subgraph/oz/network"
+)
+
+func TestResourcesCgroupValues(t *testing.T) {
+	tests := []struct {
+		res  ResourcesConf
+		vals map[string]string
+		err  bool
+	}{
+		{ResourcesConf{}, map[string]string{}, false},
+		{
+			ResourcesConf{MemoryMax: "2G", MemoryHigh: "1536M", CPUWeight: 50, CPUMax: "50000 100000", PidsMax: 512, IOWeight: 200},
+			map[string]string{
+				"memory.max":  "2147483648",
+				"memory.high": "1610612736",
+				"cpu.weight":  "50",
+				"cpu.max":     "50000 100000",
+				"pids.max":    "512",
+				"io.weight":   "default 200",
+			},
+			false,
+		},
+		{ResourcesConf{MemoryMax: "max", CPUMax: "max"}, map[string]string{"memory.max": "max", "cpu.max": "max"}, false},
+		{ResourcesConf{MemoryMax: "4096"}, map[string]string{"memory.max": "4096"}, false},
+		{ResourcesConf{MemoryMax: "lots"}, nil, true},
+		{ResourcesConf{MemoryHigh: "0"}, nil, true},
+		{ResourcesConf{MemoryMax: "9999999999T"}, nil, true},
+		{ResourcesConf{MemoryMax: "16777215T"}, map[string]string{"memory.max": "18446742974197923840"}, false},
+		{ResourcesConf{CPUWeight: 10001}, nil, true},
+		{ResourcesConf{IOWeight: 20000}, nil, true},
+		{ResourcesConf{CPUMax: "50%"}, nil, true},
+		{ResourcesConf{CPUMax: "50000 10"}, nil, true},
+	}
+	for _, tt := range tests {
+		vals, err := tt.res.CgroupValues()
+		if tt.err {
+			if err == nil {
+				t.Errorf("%+v: expected an error, got %v", tt.res, vals)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%+v: unexpected error: %v", tt.res, err)
+			continue
+		}
+		if !reflect.DeepEqual(vals, tt.vals) {
+			t.Errorf("%+v: got %v, expected %v", tt.res, vals, tt.vals)
+		}
+	}
+}
+
+func TestBandwidthLimits(t *testing.T) {
+	tests := []struct {
+		conf BandwidthConf
+		bw   network.Bandwidth
+		err  bool
+	}{
+		{BandwidthConf{}, network.Bandwidth{}, false},
+		{BandwidthConf{Egress: "1mbit", Ingress: "100kbps", IngressBurst: "64kb"},
+			network.Bandwidth{EgressRate: 1000000, IngressRate: 800000, IngressBurst: 65536}, false},
+		{BandwidthConf{Egress: "1mb"}, network.Bandwidth{}, true},
+		{BandwidthConf{Ingress: "1mbit", IngressBurst: "-1"}, network.Bandwidth{}, true},
+	}
+	for _, tt := range tests {
+		bw, err := tt.conf.Limits()
+		if tt.err {
+			if err == nil {
+				t.Errorf("%+v: expected an error, got %+v", tt.conf, bw)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%+v: unexpected error: %v", tt.conf, err)
+			continue
+		}
+		if bw != tt.bw {
+			t.Errorf("%+v: got %+v, expected %+v", tt.conf, bw, tt.bw)
+		}
+	}
+}
@@ -0,0 +1,644 @@
+package oz
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/subgraph/oz/network"
+)
+
+// ProfileError is a problem found in a profile file at a given position
+type ProfileError struct {
+	File   string
+	Line   int
+	Column int
+	Msg    string
+}
+
+func (e *ProfileError) Error() string {
+	return fmt.Sprintf("%s:%d:%d: %s", e.File, e.Line, e.Column, e.Msg)
+}
+
+// ProfileErrors holds all the problems found in a profile file
+type ProfileErrors []*ProfileError
+
+func (es ProfileErrors) Error() string {
+	msgs := make([]string, len(es))
+	for i, e := range es {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Accepted values for the enumerated profile options, the empty string
+// is always accepted and means the default value should be used.
+var profileEnums = map[reflect.Type][]string{
+	reflect.TypeOf(ShutdownMode("")): {
+		string(PROFILE_SHUTDOWN_NO),
+		string(PROFILE_SHUTDOWN_YES),
+		string(PROFILE_SHUTDOWN_SOFT),
+	},
+	reflect.TypeOf(AudioMode("")): {
+		string(PROFILE_AUDIO_NONE),
+		string(PROFILE_AUDIO_SPEAKER),
+		string(PROFILE_AUDIO_FULL),
+		string(PROFILE_AUDIO_PULSE),
+	},
+	reflect.TypeOf(DisplayType("")): {
+		string(PROFILE_DISPLAY_XPRA),
+		string(PROFILE_DISPLAY_WAYLAND_PROXY),
+		string(PROFILE_DISPLAY_NONE),
+	},
+	reflect.TypeOf(SeccompMode("")): {
+		string(PROFILE_SECCOMP_TRAIN),
+		string(PROFILE_SECCOMP_WHITELIST),
+		string(PROFILE_SECCOMP_BLACKLIST),
+		string(PROFILE_SECCOMP_DISABLED),
+	},
+	reflect.TypeOf(DNSMode("")): {
+		string(PROFILE_NETWORK_DNS_NONE),
+		string(PROFILE_NETWORK_DNS_PASS),
+		string(PROFILE_NETWORK_DNS_DHCP),
+		string(PROFILE_NETWORK_DNS_FORWARD),
+	},
+	reflect.TypeOf(network.NetType("")): {
+		string(network.TYPE_NONE),
+		string(network.TYPE_HOST),
+		string(network.TYPE_EMPTY),
+		string(network.TYPE_BRIDGE),
+		string(network.TYPE_PROXY),
+	},
+	reflect.TypeOf(VPNType("")): {
+		string(PROFILE_VPN_OPENVPN),
+		string(PROFILE_VPN_WIREGUARD),
+	},
+	reflect.TypeOf(VPNFailureAction("")): {
+		string(PROFILE_VPN_FAILURE_PAUSE),
+		string(PROFILE_VPN_FAILURE_KILL),
+	},
+	reflect.TypeOf(network.ProxyType("")): {
+		string(network.PROXY_CLIENT),
+		string(network.PROXY_SERVER),
+	},
+	reflect.TypeOf(network.ProtoType("")): {
+		string(network.PROTO_TCP),
+		string(network.PROTO_UDP),
+		string(network.PROTO_UNIX),
+		string(network.PROTO_TCP_TO_UNIX),
+		string(network.PROTO_UNIXGRAM),
+		string(network.PROTO_UNIXPACKET),
+	},
+	reflect.TypeOf(network.FirewallProto("")): {
+		string(network.FW_PROTO_TCP),
+		string(network.FW_PROTO_UDP),
+		string(network.FW_PROTO_ICMP),
+	},
+	reflect.TypeOf(network.FirewallDirection("")): {
+		string(network.FW_DIRECTION_OUT),
+		string(network.FW_DIRECTION_IN),
+	},
+	reflect.TypeOf(network.FirewallPolicy("")): {
+		string(network.FW_POLICY_ACCEPT),
+		string(network.FW_POLICY_DROP),
+	},
+}
+
+// A value read from a profile along with the offset it was found at
+type profileValue struct {
+	offset int64
+	value  interface{}
+}
+
+// Checks run on a fully read object, indexed by struct type. The fields
+// map is keyed by the Go field name and only holds the fields present in
+// the object.
+var profileChecks = map[reflect.Type]func(v *profileValidator, offset int64, name string, fields map[string]profileValue){
+	reflect.TypeOf(NetworkProfile{}): checkNetworkProfile,
+	reflect.TypeOf(FWRule{}):         checkFWRule,
+	reflect.TypeOf(ResourcesConf{}):  checkResources,
+	reflect.TypeOf(BandwidthConf{}):  checkBandwidth,
+	reflect.TypeOf(DisplayConf{}):    checkDisplay,
+}
+
+// Checks between settings which may come from different files, they are run
+// on the profile once merged with the profiles it extends
+var mergedProfileChecks = []func(p *Profile) []string{
+	checkMergedDNS,
+	checkMergedProxyPort,
+	checkMergedVPN,
+	checkMergedDisplay,
+}
+
+// checkMergedProfile runs the mergedProfileChecks on the profile loaded
+// from fpath, before the defaults are applied
+func checkMergedProfile(fpath string, p *Profile) error {
+	var msgs []string
+	for _, check := range mergedProfileChecks {
+		for _, m := range check(p) {
+			msgs = append(msgs, fpath+": "+m)
+		}
+	}
+	if len(msgs) > 0 {
+		return fmt.Errorf("%s", strings.Join(msgs, "\n"))
+	}
+	return nil
+}
+
+func checkMergedProxyPort(p *Profile) []string {
+	if p.Networking.ProxyPort != 0 && p.Networking.Nettype != network.TYPE_PROXY {
+		return []string{"networking.proxy_port: requires type proxy"}
+	}
+	return nil
+}
+
+func checkMergedVPN(p *Profile) []string {
+	vpn := &p.Networking.VPNConf
+	var msgs []string
+	if vpn.VpnType != "" && vpn.ConfigPath == "" {
+		msgs = append(msgs, fmt.Sprintf("networking.vpn: ConfigPath is required for type %s", vpn.VpnType))
+	}
+	// The DNS forwarder resolves through the host, outside of the tunnel
+	dns := p.Networking.DNSMode
+	if vpn.VpnType == PROFILE_VPN_OPENVPN && (dns == PROFILE_NETWORK_DNS_FORWARD || dns == PROFILE_NETWORK_DNS_DHCP) {
+		msgs = append(msgs, fmt.Sprintf("networking.dns_mode: %s cannot be used with vpn type openvpn", dns))
+	}
+	return msgs
+}
+
+func checkMergedDisplay(p *Profile) []string {
+	if len(p.Display.Extensions) > 0 && p.Display.Type != PROFILE_DISPLAY_WAYLAND_PROXY {
+		return []string{"display.extensions: requires type wayland-proxy"}
+	}
+	return nil
+}
+
+func checkMergedDNS(p *Profile) []string {
+	var msgs []string
+	n := &p.Networking
+	if n.DNSMode == PROFILE_NETWORK_DNS_FORWARD || n.DNSMode == PROFILE_NETWORK_DNS_DHCP {
+		return nil
+	}
+	for _, f := range []struct {
+		key  string
+		list []string
+	}{{"dns_allow", n.DNSAllow}, {"dns_deny", n.DNSDeny}} {
+		if len(f.list) > 0 {
+			msgs = append(msgs, fmt.Sprintf("networking.%s: requires dns_mode forward or dhcp", f.key))
+		}
+	}
+	return msgs
+}
+
+var hostnameRegexp = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?\.)*[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?\.?$`)
+
+func checkNetworkProfile(v *profileValidator, offset int64, name string, fields map[string]profileValue) {
+	if ib, ok := fields["IpByte"]; ok {
+		if n, ok := ib.value.(int64); ok && n != 0 && (n < 2 || n > 254) {
+			v.errorf(ib.offset, "%s.ip_byte: %d is out of range, must be between 2 and 254", name, n)
+		}
+	}
+	if pp, ok := fields["ProxyPort"]; ok {
+		if n, ok := pp.value.(int64); ok && n > 65535 {
+			v.errorf(pp.offset, "%s.proxy_port: %d is out of range, must be between 1 and 65535", name, n)
+		}
+	}
+	for _, f := range []struct{ field, key string }{{"DNSAllow", "dns_allow"}, {"DNSDeny", "dns_deny"}} {
+		list, ok := fields[f.field]
+		if !ok {
+			continue
+		}
+		elems, _ := list.value.([]profileValue)
+		for i, e := range elems {
+			if s, ok := e.value.(string); ok && !validDomainPattern(s) {
+				v.errorf(e.offset, "%s.%s[%d]: `%s` is not a valid domain or `*.domain` pattern", name, f.key, i, s)
+			}
+		}
+	}
+}
+
+func checkFWRule(v *profileValidator, offset int64, name string, fields map[string]profileValue) {
+	dst, hasDst := fields["Dst"]
+	host, hasHost := fields["DstHost"]
+	switch {
+	case !hasDst && !hasHost:
+		v.errorf(offset, "%s: missing dst_host or dst", name)
+	case hasDst && hasHost:
+		v.errorf(host.offset, "%s.dst_host: cannot be used together with dst", name)
+	}
+	for _, f := range []struct {
+		key string
+		val profileValue
+		ok  bool
+	}{{"dst", dst, hasDst}, {"dst_host", host, hasHost}} {
+		if h, ok := f.val.value.(string); f.ok && ok && !validFWDestination(h) {
+			v.errorf(f.val.offset, "%s.%s: `%s` is not a valid address, network, host name or `*.domain` pattern", name, f.key, h)
+		}
+	}
+
+	port, hasPort := fields["DstPort"]
+	if hasPort {
+		if n, ok := port.value.(int64); ok && (n < 0 || n > 65535) {
+			v.errorf(port.offset, "%s.dst_port: %d is out of range, must be between 0 (any) and 65535", name, n)
+		}
+	}
+	ports, hasPorts := fields["DstPorts"]
+	if hasPorts {
+		if hasPort {
+			v.errorf(ports.offset, "%s.dst_ports: cannot be used together with dst_port", name)
+		}
+		elems, _ := ports.value.([]profileValue)
+		for i, e := range elems {
+			if s, ok := e.value.(string); ok {
+				if _, err := network.ParsePortRange(s); err != nil {
+					v.errorf(e.offset, "%s.dst_ports[%d]: %v", name, i, err)
+				}
+			}
+		}
+	}
+	if proto, ok := fields["Proto"]; ok && proto.value == string(network.FW_PROTO_ICMP) && (hasPort || hasPorts) {
+		v.errorf(proto.offset, "%s.proto: ports cannot be used with icmp", name)
+	}
+}
+
+// validFWDestination returns true if s is an address, a network in CIDR
+// notation, a host name or a sub-domain wildcard
+func validFWDestination(s string) bool {
+	if _, _, err := net.ParseCIDR(s); err == nil {
+		return true
+	}
+	return net.ParseIP(s) != nil || validDomainPattern(s)
+}
+
+// validDomainPattern returns true if s is a host name or a sub-domain wildcard (ie: `*.mozilla.org`)
+func validDomainPattern(s string) bool {
+	if network.IsDomainPattern(s) {
+		s = s[2:]
+	}
+	return hostnameRegexp.MatchString(s)
+}
+
+func checkResources(v *profileValidator, offset int64, name string, fields map[string]profileValue) {
+	for _, f := range []struct{ field, key string }{{"MemoryMax", "memory_max"}, {"MemoryHigh", "memory_high"}} {
+		if mem, ok := fields[f.field]; ok {
+			if s, ok := mem.value.(string); ok {
+				if _, err := ParseMemorySize(s); err != nil {
+					v.errorf(mem.offset, "%s.%s: %v", name, f.key, err)
+				}
+			}
+		}
+	}
+	for _, f := range []struct{ field, key string }{{"CPUWeight", "cpu_weight"}, {"IOWeight", "io_weight"}} {
+		if w, ok := fields[f.field]; ok {
+			if n, ok := w.value.(int64); ok && n > 10000 {
+				v.errorf(w.offset, "%s.%s: %d is out of range, must be between 1 and 10000", name, f.key, n)
+			}
+		}
+	}
+	if cm, ok := fields["CPUMax"]; ok {
+		if s, ok := cm.value.(string); ok && s != "" {
+			if err := checkCPUMax(s); err != nil {
+				v.errorf(cm.offset, "%s.cpu_max: %v", name, err)
+			}
+		}
+	}
+}
+
+func checkBandwidth(v *profileValidator, offset int64, name string, fields map[string]profileValue) {
+	for _, f := range []struct {
+		field, key string
+		parse      func(string) (uint64, error)
+	}{
+		{"Egress", "egress", network.ParseRate},
+		{"EgressBurst", "egress_burst", network.ParseBurst},
+		{"Ingress", "ingress", network.ParseRate},
+		{"IngressBurst", "ingress_burst", network.ParseBurst},
+	} {
+		if val, ok := fields[f.field]; ok {
+			if s, ok := val.value.(string); ok && s != "" {
+				if _, err := f.parse(s); err != nil {
+					v.errorf(val.offset, "%s.%s: %v", name, f.key, err)
+				}
+			}
+		}
+	}
+}
+
+var waylandInterfaceRegexp = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+func checkDisplay(v *profileValidator, offset int64, name string, fields map[string]profileValue) {
+	list, ok := fields["Extensions"]
+	if !ok {
+		return
+	}
+	elems, _ := list.value.([]profileValue)
+	for i, e := range elems {
+		if s, ok := e.value.(string); ok && !waylandInterfaceRegexp.MatchString(s) {
+			v.errorf(e.offset, "%s.extensions[%d]: `%s` is not a Wayland interface name", name, i, s)
+		}
+	}
+}
+
+type profileValidator struct {
+	fpath string
+	data  []byte
+	dec   *json.Decoder
+	errs  ProfileErrors
+}
+
+// validateProfileJSON strictly checks the content of a profile file against
+// the Profile structure: unknown fields, values of the wrong type, invalid
+// enumerated values and out of range settings are all reported along with
+// their position in the file.
+func validateProfileJSON(fpath string, data []byte) error {
+	v := &profileValidator{
+		fpath: fpath,
+		data:  data,
+		dec:   json.NewDecoder(bytes.NewReader(data)),
+	}
+	v.dec.UseNumber()
+
+	if err := v.validate(); err != nil {
+		v.syntaxError(err)
+	}
+	if len(v.errs) > 0 {
+		return v.errs
+	}
+	return nil
+}
+
+func (v *profileValidator) validate() error {
+	offset := v.offset()
+	tok, err := v.dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := tok.(json.Delim); !ok || d != '{' {
+		v.errorf(offset, "a profile must be a JSON object, found %s", describeToken(tok))
+		return nil
+	}
+	if err := v.object(reflect.TypeOf(Profile{}), "", offset); err != nil {
+		return err
+	}
+	if tok, err := v.dec.Token(); err != io.EOF {
+		if err != nil {
+			return err
+		}
+		v.errorf(v.dec.InputOffset(), "unexpected %s after the end of the profile", describeToken(tok))
+	}
+	return nil
+}
+
+// value checks the value starting with tok against type t
+func (v *profileValidator) value(t reflect.Type, name string, offset int64, tok json.Token) (interface{}, error) {
+	if tok == nil {
+		return nil, nil
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		if d, ok := tok.(json.Delim); ok && d == '{' {
+			return nil, v.object(t, name, offset)
+		}
+		v.errorf(offset, "%s: expected an object, found %s", name, describeToken(tok))
+	case reflect.Slice:
+		if d, ok := tok.(json.Delim); ok && d == '[' {
+			elems := []profileValue{}
+			for i := 0; v.dec.More(); i++ {
+				eoffset := v.offset()
+				etok, err := v.dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				val, err := v.value(t.Elem(), fmt.Sprintf("%s[%d]", name, i), eoffset, etok)
+				if err != nil {
+					return nil, err
+				}
+				elems = append(elems, profileValue{eoffset, val})
+			}
+			_, err := v.dec.Token()
+			return elems, err
+		}
+		v.errorf(offset, "%s: expected a list, found %s", name, describeToken(tok))
+	case reflect.String:
+		if s, ok := tok.(string); ok {
+			if values, ok := profileEnums[t]; ok && s != "" && !stringInSlice(s, values) {
+				v.errorf(offset, "%s: invalid value `%s`, must be one of: %s", name, s, strings.Join(values, ", "))
+			}
+			return s, nil
+		}
+		v.errorf(offset, "%s: expected a string, found %s", name, describeToken(tok))
+	case reflect.Bool:
+		if b, ok := tok.(bool); ok {
+			return b, nil
+		}
+		v.errorf(offset, "%s: expected true or false, found %s", name, describeToken(tok))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if num, ok := tok.(json.Number); ok {
+			n, err := strconv.ParseInt(string(num), 10, 64)
+			if err != nil {
+				v.errorf(offset, "%s: expected an integer, found %s", name, num)
+				return nil, nil
+			}
+			if n < 0 && t.Kind() >= reflect.Uint {
+				v.errorf(offset, "%s: expected a positive integer, found %d", name, n)
+				return nil, nil
+			}
+			return n, nil
+		}
+		v.errorf(offset, "%s: expected an integer, found %s", name, describeToken(tok))
+	default:
+		return nil, v.skip(tok)
+	}
+	return nil, v.skip(tok)
+}
+
+// object checks the fields of an object against struct type t,
+// the opening delimiter must have already been read.
+func (v *profileValidator) object(t reflect.Type, name string, offset int64) error {
+	fields := make(map[string]profileValue)
+	for v.dec.More() {
+		koffset := v.offset()
+		ktok, err := v.dec.Token()
+		if err != nil {
+			return err
+		}
+		key := ktok.(string)
+		fname := key
+		if name != "" {
+			fname = name + "." + key
+		}
+
+		voffset := v.offset()
+		tok, err := v.dec.Token()
+		if err != nil {
+			return err
+		}
+
+		sf, ok := profileField(t, key)
+		if !ok {
+			v.errorf(koffset, "unknown field `%s`", fname)
+			if err := v.skip(tok); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, ok := fields[sf.Name]; ok {
+			v.errorf(koffset, "duplicate field `%s`", fname)
+		}
+
+		ft := sf.Type
+		if t == reflect.TypeOf(Profile{}) && sf.Name == "Extends" {
+			// A single base profile may be given as a plain string
+			if _, ok := tok.(string); ok {
+				ft = sf.Type.Elem()
+			}
+		}
+		val, err := v.value(ft, fname, voffset, tok)
+		if err != nil {
+			return err
+		}
+		fields[sf.Name] = profileValue{voffset, val}
+	}
+	if _, err := v.dec.Token(); err != nil {
+		return err
+	}
+	if check, ok := profileChecks[t]; ok {
+		if name == "" {
+			name = "profile"
+		}
+		check(v, offset, name, fields)
+	}
+	return nil
+}
+
+// skip consumes the rest of the value starting with tok
+func (v *profileValidator) skip(tok json.Token) error {
+	depth := 0
+	for {
+		if d, ok := tok.(json.Delim); ok {
+			switch d {
+			case '{', '[':
+				depth++
+			default:
+				depth--
+			}
+		}
+		if depth == 0 {
+			return nil
+		}
+		var err error
+		if tok, err = v.dec.Token(); err != nil {
+			return err
+		}
+	}
+}
+
+// offset returns the position of the next token in the file
+func (v *profileValidator) offset() int64 {
+	off := v.dec.InputOffset()
+	for off < int64(len(v.data)) {
+		switch v.data[off] {
+		case ' ', '\t', '\r', '\n', ',', ':':
+			off++
+		default:
+			return off
+		}
+	}
+	return off
+}
+
+func (v *profileValidator) errorf(offset int64, format string, args ...interface{}) {
+	line, col := v.position(offset)
+	v.errs = append(v.errs, &ProfileError{
+		File:   v.fpath,
+		Line:   line,
+		Column: col,
+		Msg:    fmt.Sprintf(format, args...),
+	})
+}
+
+func (v *profileValidator) syntaxError(err error) {
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		// The offset is the one right after the offending character
+		offset := e.Offset
+		if offset > 0 && offset < int64(len(v.data)) {
+			offset--
+		}
+		v.errorf(offset, "%v", e)
+	case *json.UnmarshalTypeError:
+		v.errorf(e.Offset, "%v", e)
+	default:
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			v.errorf(int64(len(v.data)), "unexpected end of file")
+		} else {
+			v.errorf(v.dec.InputOffset(), "%v", err)
+		}
+	}
+}
+
+// position converts a byte offset into a line and column, both starting at 1
+func (v *profileValidator) position(offset int64) (int, int) {
+	if offset > int64(len(v.data)) {
+		offset = int64(len(v.data))
+	}
+	before := v.data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	col := int(offset) - bytes.LastIndexByte(before, '\n')
+	return line, col
+}
+
+// profileField finds the struct field matching a key the same way
+// encoding/json does, that is without regard to case.
+func profileField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(sf.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		if strings.EqualFold(name, key) {
+			return sf, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func describeToken(tok json.Token) string {
+	switch t := tok.(type) {
+	case json.Delim:
+		if t == '{' {
+			return "an object"
+		}
+		return "a list"
+	case string:
+		return fmt.Sprintf("the string `%s`", t)
+	case json.Number:
+		return fmt.Sprintf("the number %s", t)
+	case bool:
+		return fmt.Sprintf("%v", t)
+	}
+	return "null"
+}
+
+func stringInSlice(s string, list []string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
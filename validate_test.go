@@ -0,0 +1,172 @@
+package oz
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateProfileJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile string
+		errs    []string
+	}{
+		{"valid", `{
+			"path": "/usr/bin/app",
+			"extends": "_base/gui.json",
+			"auto_shutdown": "no",
+			"xserver": {"enabled": true, "audio_mode": "pulseaudio"},
+			"whitelist": [{"path": "${HOME}/Downloads", "read_only": true}],
+			"networking": {"type": "bridge", "ip_byte": 42, "dns_mode": "pass",
+				"sockets": [{"type": "client", "proto": "tcp", "port": 9050}]},
+			"firewall": [{"whitelist": true, "dst_host": "example.com", "dst_port": 443}],
+			"seccomp": {"mode": "whitelist", "enforce": true}
+		}`, nil},
+		{"unknown field", `{
+			"path": "/usr/bin/app",
+			"whitelist": [{"path": "/tmp", "read-only": true}]
+		}`, []string{":3:35: unknown field `whitelist[0].read-only`"}},
+		{"symlink is not a profile option", `{
+			"whitelist": [{"path": "/tmp", "symlink": "/foo"}]
+		}`, []string{":2:35: unknown field `whitelist[0].symlink`"}},
+		{"bad enums", `{
+			"auto_shutdown": "maybe",
+			"xserver": {"audio_mode": "loud"},
+			"seccomp": {"mode": "strict"},
+			"networking": {"type": "brige", "dns_mode": "google"}
+		}`, []string{
+			":2:21: auto_shutdown: invalid value `maybe`",
+			":3:30: xserver.audio_mode: invalid value `loud`",
+			":4:24: seccomp.mode: invalid value `strict`",
+			":5:27: networking.type: invalid value `brige`",
+			":5:48: networking.dns_mode: invalid value `google`",
+		}},
+		{"ip_byte out of range", `{
+			"networking": {"ip_byte": 255}
+		}`, []string{":2:30: networking.ip_byte: 255 is out of range"}},
+		{"negative ip_byte", `{
+			"networking": {"ip_byte": -1}
+		}`, []string{":2:30: networking.ip_byte: expected a positive integer"}},
+		{"malformed firewall rules", `{
+			"firewall": [
+				{"whitelist": true, "dst_port": 80},
+				{"dst_host": "bad host", "dst_port": 70000},
+				{"dst_host": "10.0.0.1", "dst_port": "80"}
+			]
+		}`, []string{
+			":3:5: firewall[0]: missing dst_host",
+			":4:18: firewall[1].dst_host: `bad host` is not a valid address",
+			":4:42: firewall[1].dst_port: 70000 is out of range",
+			":5:42: firewall[2].dst_port: expected an integer, found the string `80`",
+		}},
+		{"firewall rules", `{
+			"firewall_policy": "drop",
+			"firewall": [
+				{"whitelist": true, "proto": "tcp", "dst": "10.0.0.0/8", "dst_ports": ["80", "8000-8080"]},
+				{"whitelist": true, "direction": "in", "dst": "192.168.1.10"},
+				{"proto": "icmp", "dst": "example.com"}
+			]
+		}`, nil},
+		{"malformed firewall rules with new fields", `{
+			"firewall_policy": "reject",
+			"firewall": [
+				{"proto": "sctp", "direction": "up", "dst": "10.0.0.0/33"},
+				{"dst": "10.0.0.1", "dst_host": "10.0.0.2"},
+				{"dst": "10.0.0.1", "dst_ports": ["443", "90-80"], "dst_port": 53},
+				{"proto": "icmp", "dst": "10.0.0.1", "dst_ports": ["1"]}
+			]
+		}`, []string{
+			":2:23: firewall_policy: invalid value `reject`",
+			":4:15: firewall[0].proto: invalid value `sctp`",
+			":4:36: firewall[0].direction: invalid value `up`",
+			":4:49: firewall[0].dst: `10.0.0.0/33` is not a valid address",
+			":5:37: firewall[1].dst_host: cannot be used together with dst",
+			":6:38: firewall[2].dst_ports: cannot be used together with dst_port",
+			":6:46: firewall[2].dst_ports[1]: invalid port range `90-80`",
+			":7:15: firewall[3].proto: ports cannot be used with icmp",
+		}},
+		{"dns forwarder", `{
+			"networking": {"type": "bridge", "dns_mode": "forward",
+				"dns_allow": ["*.mozilla.org", "mozilla.net"], "dns_deny": ["ads.mozilla.org"]},
+			"firewall": [{"whitelist": true, "dst": "*.mozilla.org", "dst_port": 443}]
+		}`, nil},
+		{"malformed dns lists", `{
+			"networking": {"dns_mode": "pass", "dns_allow": ["*.*.org"], "dns_deny": ["bad host"]},
+			"firewall": [{"dst": "www.*.org"}]
+		}`, []string{
+			":2:53: networking.dns_allow[0]: `*.*.org` is not a valid domain",
+			":2:78: networking.dns_deny[0]: `bad host` is not a valid domain",
+			":3:25: firewall[0].dst: `www.*.org` is not a valid address",
+		}},
+		{"bad resources", `{
+			"resources": {"memory_max": "2GB", "cpu_weight": 20000, "cpu_max": "half"}
+		}`, []string{
+			":2:32: resources.memory_max: invalid memory size `2GB`",
+			":2:53: resources.cpu_weight: 20000 is out of range",
+			":2:71: resources.cpu_max: invalid quota `half`",
+		}},
+		{"bad bandwidth", `{
+			"networking": {"type": "bridge", "bandwidth": {"egress": "fast", "ingress": "2mbit", "ingress_burst": "1tb"}}
+		}`, []string{
+			":2:61: networking.bandwidth.egress: invalid rate `fast`",
+			":2:106: networking.bandwidth.ingress_burst: invalid burst `1tb`",
+		}},
+		{"bad proxy port", `{
+			"networking": {"type": "empty", "proxy_port": 70000}
+		}`, []string{
+			":2:50: networking.proxy_port: 70000 is out of range, must be between 1 and 65535",
+		}},
+		{"bad vpn", `{
+			"networking": {"type": "bridge", "vpn": {"type": "ipsec"}}
+		}`, []string{
+			":2:53: networking.vpn.type: invalid value `ipsec`, must be one of: openvpn, wireguard",
+		}},
+		{"bad vpn failure action", `{
+			"networking": {"type": "bridge", "vpn": {"type": "openvpn", "ConfigPath": "a.ovpn", "on_failure": "retry"}}
+		}`, []string{
+			":2:102: networking.vpn.on_failure: invalid value `retry`, must be one of: pause, kill",
+		}},
+		{"bad display", `{
+			"display": {"type": "x11", "extensions": ["wp_viewporter", "wp-presentation"]}
+		}`, []string{
+			":2:24: display.type: invalid value `x11`, must be one of: xpra, wayland-proxy, none",
+			":2:63: display.extensions[1]: `wp-presentation` is not a Wayland interface name",
+		}},
+		{"wrong types", `{
+			"multi": "yes",
+			"whitelist": {"path": "/tmp"}
+		}`, []string{
+			":2:13: multi: expected true or false",
+			":3:17: whitelist: expected a list, found an object",
+		}},
+		{"syntax error", `{
+			"path": "/usr/bin/app"
+			"multi": true
+		}`, []string{":3:4: invalid character"}},
+		{"truncated", `{"path": "/usr/bin/app",`, []string{":1:25: unexpected end of JSON input"}},
+	}
+
+	for _, tt := range tests {
+		err := validateProfileJSON("test.json", []byte(tt.profile))
+		if len(tt.errs) == 0 {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: expected errors, got none", tt.name)
+			continue
+		}
+		lines := strings.Split(err.Error(), "\n")
+		if len(lines) != len(tt.errs) {
+			t.Errorf("%s: expected %d errors, got %d:\n%v", tt.name, len(tt.errs), len(lines), err)
+			continue
+		}
+		for i, e := range tt.errs {
+			if !strings.HasPrefix(lines[i], "test.json"+e) {
+				t.Errorf("%s: expected error starting with %q, got %q", tt.name, "test.json"+e, lines[i])
+			}
+		}
+	}
+}
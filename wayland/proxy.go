@@ -0,0 +1,387 @@
+package wayland
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/op/go-logging"
+)
+
+// Name of the proxy socket in the directory bound into the sandbox
+const SocketName = "wayland-0"
+
+// Interfaces of the core Wayland protocol and of xdg-shell, without which no
+// window can be shown, available to every sandbox
+var CoreInterfaces = []string{
+	"wl_compositor",
+	"wl_data_device_manager",
+	"wl_output",
+	"wl_seat",
+	"wl_shell",
+	"wl_shm",
+	"wl_subcompositor",
+	"xdg_wm_base",
+}
+
+// Interfaces through which a client can read the screen or the clipboard of
+// the other clients or type into them. They are only available to profiles
+// listing them in their extensions.
+var PrivilegedInterfaces = []string{
+	"ext_data_control_manager_v1",
+	"ext_image_copy_capture_manager_v1",
+	"ext_output_image_capture_source_manager_v1",
+	"zwlr_data_control_manager_v1",
+	"zwlr_screencopy_manager_v1",
+	"zwlr_virtual_pointer_manager_v1",
+	"zwp_virtual_keyboard_manager_v1",
+}
+
+// IsPrivileged returns whether iface is one of PrivilegedInterfaces
+func IsPrivileged(iface string) bool {
+	for _, p := range PrivilegedInterfaces {
+		if p == iface {
+			return true
+		}
+	}
+	return false
+}
+
+// Wire protocol, see the Wayland documentation
+const (
+	headerSize = 8
+	// The size of a message is 16 bits of its header
+	maxMessageSize = 1<<16 - 1
+	// At most 28 file descriptors are sent by libwayland with a message
+	maxFds = 28
+
+	displayID = 1
+	// Requests of wl_display and wl_registry
+	displayGetRegistry = 1
+	registryBind       = 0
+	// Events of wl_display and wl_registry
+	displayDeleteID      = 1
+	registryGlobal       = 0
+	registryGlobalRemove = 1
+)
+
+// CompositorSocket returns the path of the Wayland socket of the compositor
+// of the user uid, given the environment of its session. The socket must
+// belong to the user.
+func CompositorSocket(env []string, uid int) (string, error) {
+	display, runtime := "wayland-0", fmt.Sprintf("/run/user/%d", uid)
+	for _, e := range env {
+		if strings.HasPrefix(e, "WAYLAND_DISPLAY=") && e != "WAYLAND_DISPLAY=" {
+			display = strings.TrimPrefix(e, "WAYLAND_DISPLAY=")
+		} else if strings.HasPrefix(e, "XDG_RUNTIME_DIR=") && e != "XDG_RUNTIME_DIR=" {
+			runtime = strings.TrimPrefix(e, "XDG_RUNTIME_DIR=")
+		}
+	}
+	socket := display
+	if !path.IsAbs(socket) {
+		socket = path.Join(runtime, display)
+	}
+	fi, err := os.Lstat(socket)
+	if err != nil {
+		return "", err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return "", fmt.Errorf("%s is not a socket", socket)
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); !ok || int(st.Uid) != uid {
+		return "", fmt.Errorf("%s does not belong to uid %d", socket, uid)
+	}
+	return socket, nil
+}
+
+// Proxy is a Wayland socket relaying the connections of a sandbox to the
+// compositor. The sandbox only sees the globals of the allowed interfaces
+// and is disconnected if it binds to any other one.
+type Proxy struct {
+	Socket   string
+	Upstream string
+	allowed  map[string]bool
+	label    string
+	log      *logging.Logger
+	listener *net.UnixListener
+
+	lock   sync.Mutex
+	conns  map[*proxyConn]bool
+	closed bool
+}
+
+// NewProxy listens on socket and relays the connections to the compositor
+// socket upstream, allowing the core interfaces and those in extensions
+func NewProxy(socket, upstream string, extensions []string, label string, log *logging.Logger) (*Proxy, error) {
+	os.Remove(socket)
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: socket, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	p := &Proxy{
+		Socket:   socket,
+		Upstream: upstream,
+		allowed:  make(map[string]bool),
+		label:    label,
+		log:      log,
+		listener: l,
+		conns:    make(map[*proxyConn]bool),
+	}
+	for _, iface := range CoreInterfaces {
+		p.allowed[iface] = true
+	}
+	for _, iface := range extensions {
+		p.allowed[iface] = true
+	}
+	go p.accept()
+	return p, nil
+}
+
+// Close stops accepting connections, closes those relayed and removes the
+// socket
+func (p *Proxy) Close() error {
+	p.lock.Lock()
+	p.closed = true
+	for c := range p.conns {
+		c.close()
+	}
+	p.lock.Unlock()
+	return p.listener.Close()
+}
+
+func (p *Proxy) accept() {
+	for {
+		client, err := p.listener.AcceptUnix()
+		if err != nil {
+			p.lock.Lock()
+			closed := p.closed
+			p.lock.Unlock()
+			if !closed {
+				p.log.Warning("Wayland proxy of %s stopped accepting connections: %v", p.label, err)
+			}
+			return
+		}
+		server, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: p.Upstream, Net: "unix"})
+		if err != nil {
+			p.log.Warning("Wayland proxy of %s unable to connect to %s: %v", p.label, p.Upstream, err)
+			client.Close()
+			continue
+		}
+		c := &proxyConn{
+			p:          p,
+			client:     client,
+			server:     server,
+			registries: make(map[uint32]bool),
+			globals:    make(map[uint32]string),
+			hidden:     make(map[uint32]bool),
+		}
+		p.lock.Lock()
+		if p.closed {
+			p.lock.Unlock()
+			c.close()
+			return
+		}
+		p.conns[c] = true
+		p.lock.Unlock()
+		go c.run()
+	}
+}
+
+// proxyConn is a connection of a client of the sandbox to the compositor
+type proxyConn struct {
+	p      *Proxy
+	client *net.UnixConn
+	server *net.UnixConn
+
+	lock sync.Mutex
+	// Registry objects of the client
+	registries map[uint32]bool
+	// Names of the globals announced to the client, and of those hidden
+	globals map[uint32]string
+	hidden  map[uint32]bool
+}
+
+func (c *proxyConn) close() {
+	c.client.Close()
+	c.server.Close()
+}
+
+func (c *proxyConn) run() {
+	done := make(chan error, 2)
+	go func() { done <- relay(c.client, c.server, c.filterRequest) }()
+	go func() { done <- relay(c.server, c.client, c.filterEvent) }()
+	err := <-done
+	c.close()
+	<-done
+	if err != nil && err != io.EOF {
+		c.p.log.Warning("Wayland proxy of %s closed a connection: %v", c.p.label, err)
+	}
+	c.p.lock.Lock()
+	delete(c.p.conns, c)
+	c.p.lock.Unlock()
+}
+
+// filterRequest checks a request of the client, which is disconnected when
+// binding to a global it was not shown
+func (c *proxyConn) filterRequest(obj uint32, opcode uint16, args []byte) (bool, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	switch {
+	case obj == displayID && opcode == displayGetRegistry:
+		if id, ok := uint32Arg(args, 0); ok {
+			c.registries[id] = true
+		}
+	case c.registries[obj] && opcode == registryBind:
+		name, _ := uint32Arg(args, 0)
+		if _, ok := c.globals[name]; !ok {
+			iface, _ := stringArg(args, 4)
+			return false, fmt.Errorf("client bound to hidden global %d (%s)", name, iface)
+		}
+	}
+	return true, nil
+}
+
+// filterEvent hides the globals of the interfaces which are not allowed
+func (c *proxyConn) filterEvent(obj uint32, opcode uint16, args []byte) (bool, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	switch {
+	case obj == displayID && opcode == displayDeleteID:
+		if id, ok := uint32Arg(args, 0); ok {
+			delete(c.registries, id)
+		}
+	case c.registries[obj] && opcode == registryGlobal:
+		name, _ := uint32Arg(args, 0)
+		iface, ok := stringArg(args, 4)
+		if !ok {
+			return false, fmt.Errorf("malformed global event")
+		}
+		if !c.p.allowed[iface] {
+			if !c.hidden[name] {
+				c.p.log.Debug("Wayland proxy of %s hiding global %s", c.p.label, iface)
+			}
+			c.hidden[name] = true
+			return false, nil
+		}
+		c.globals[name] = iface
+	case c.registries[obj] && opcode == registryGlobalRemove:
+		name, _ := uint32Arg(args, 0)
+		if c.hidden[name] {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func uint32Arg(args []byte, offset int) (uint32, bool) {
+	if len(args) < offset+4 {
+		return 0, false
+	}
+	return binary.NativeEndian.Uint32(args[offset:]), true
+}
+
+// stringArg returns the string argument at offset, its length including the
+// terminating NUL followed by its bytes
+func stringArg(args []byte, offset int) (string, bool) {
+	n, ok := uint32Arg(args, offset)
+	if !ok || n == 0 || len(args) < offset+4+int(n) {
+		return "", false
+	}
+	return string(args[offset+4 : offset+4+int(n)-1]), true
+}
+
+// relay copies the messages read from src to dst, along with the file
+// descriptors passed with them, until either side is closed. The messages
+// for which filter returns false are dropped.
+func relay(src, dst *net.UnixConn, filter func(obj uint32, opcode uint16, args []byte) (bool, error)) error {
+	store := make([]byte, 2*maxMessageSize)
+	buf := store[:0]
+	rbuf := make([]byte, 32*1024)
+	oob := make([]byte, syscall.CmsgSpace(maxFds*4))
+	var fds []int
+	defer func() { closeFds(fds) }()
+	for {
+		n, oobn, _, _, rerr := src.ReadMsgUnix(rbuf, oob)
+		if rerr != nil {
+			n, oobn = 0, 0
+		}
+		if oobn > 0 {
+			received, err := parseRights(oob[:oobn])
+			fds = append(fds, received...)
+			if err != nil {
+				return err
+			}
+		}
+		buf = append(buf, rbuf[:n]...)
+
+		var out []byte
+		for len(buf) >= headerSize {
+			obj := binary.NativeEndian.Uint32(buf)
+			word := binary.NativeEndian.Uint32(buf[4:])
+			size := int(word >> 16)
+			if size < headerSize || size%4 != 0 {
+				return fmt.Errorf("invalid message size %d", size)
+			}
+			if len(buf) < size {
+				break
+			}
+			forward, err := filter(obj, uint16(word), buf[headerSize:size])
+			if err != nil {
+				return err
+			}
+			if forward {
+				out = append(out, buf[:size]...)
+			}
+			buf = buf[size:]
+		}
+		// What is left of an incomplete message
+		buf = append(store[:0], buf...)
+
+		if len(out) > 0 {
+			var rights []byte
+			if len(fds) > 0 {
+				rights = syscall.UnixRights(fds...)
+			}
+			written, _, err := dst.WriteMsgUnix(out, rights, nil)
+			closeFds(fds)
+			fds = nil
+			if err == nil && written < len(out) {
+				_, err = dst.Write(out[written:])
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if rerr != nil {
+			return rerr
+		}
+	}
+}
+
+func parseRights(oob []byte) ([]int, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	var fds []int
+	for _, m := range msgs {
+		rights, err := syscall.ParseUnixRights(&m)
+		if err != nil {
+			return fds, err
+		}
+		fds = append(fds, rights...)
+	}
+	return fds, nil
+}
+
+func closeFds(fds []int) {
+	for _, fd := range fds {
+		syscall.Close(fd)
+	}
+}
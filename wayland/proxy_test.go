@@ -0,0 +1,201 @@
+package wayland
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+// message encodes a Wayland message whose arguments are uint32 or string
+func message(obj uint32, opcode uint16, args ...interface{}) []byte {
+	var body []byte
+	for _, a := range args {
+		switch v := a.(type) {
+		case uint32:
+			body = binary.NativeEndian.AppendUint32(body, v)
+		case string:
+			n := len(v) + 1
+			body = binary.NativeEndian.AppendUint32(body, uint32(n))
+			body = append(body, v...)
+			body = append(body, make([]byte, (n+3)&^3-len(v))...)
+		}
+	}
+	msg := binary.NativeEndian.AppendUint32(nil, obj)
+	msg = binary.NativeEndian.AppendUint32(msg, uint32(headerSize+len(body))<<16|uint32(opcode))
+	return append(msg, body...)
+}
+
+// readMessage reads a message, returning its object, opcode and arguments
+func readMessage(t *testing.T, c net.Conn) (uint32, uint16, []byte) {
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(c, header); err != nil {
+		t.Fatalf("reading a message: %v", err)
+	}
+	word := binary.NativeEndian.Uint32(header[4:])
+	args := make([]byte, int(word>>16)-headerSize)
+	if _, err := io.ReadFull(c, args); err != nil {
+		t.Fatalf("reading a message: %v", err)
+	}
+	return binary.NativeEndian.Uint32(header), uint16(word), args
+}
+
+// testProxy starts a proxy in front of a fake compositor, returning a client
+// connection through the proxy and the connection of the compositor
+func testProxy(t *testing.T, extensions []string) (*net.UnixConn, *net.UnixConn) {
+	dir, err := ioutil.TempDir("", "oz-wayland-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	compositor, err := net.ListenUnix("unix", &net.UnixAddr{Name: path.Join(dir, "compositor"), Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { compositor.Close() })
+
+	p, err := NewProxy(path.Join(dir, SocketName), path.Join(dir, "compositor"), extensions, "test", logging.MustGetLogger("oz-test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+
+	client, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: p.Socket, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	compositor.SetDeadline(time.Now().Add(2 * time.Second))
+	server, err := compositor.AcceptUnix()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return client, server
+}
+
+func TestProxyGlobals(t *testing.T) {
+	client, server := testProxy(t, []string{"wp_viewporter"})
+
+	client.Write(message(displayID, displayGetRegistry, uint32(2)))
+	if obj, opcode, args := readMessage(t, server); obj != displayID || opcode != displayGetRegistry || binary.NativeEndian.Uint32(args) != 2 {
+		t.Fatalf("got request %d.%d %v, expected get_registry", obj, opcode, args)
+	}
+	var events []byte
+	for i, iface := range []string{"wl_compositor", "zwlr_screencopy_manager_v1", "wp_viewporter", "zwp_virtual_keyboard_manager_v1", "xdg_wm_base"} {
+		events = append(events, message(2, registryGlobal, uint32(i+1), iface, uint32(1))...)
+	}
+	events = append(events, message(2, registryGlobalRemove, uint32(2))...)
+	events = append(events, message(2, registryGlobalRemove, uint32(3))...)
+	server.Write(events)
+
+	for _, expected := range []struct {
+		opcode uint16
+		name   uint32
+		iface  string
+	}{
+		{registryGlobal, 1, "wl_compositor"},
+		{registryGlobal, 3, "wp_viewporter"},
+		{registryGlobal, 5, "xdg_wm_base"},
+		{registryGlobalRemove, 3, ""},
+	} {
+		obj, opcode, args := readMessage(t, client)
+		name := binary.NativeEndian.Uint32(args)
+		iface, _ := stringArg(args, 4)
+		if obj != 2 || opcode != expected.opcode || name != expected.name || iface != expected.iface {
+			t.Errorf("got event %d.%d for global %d %q, expected %d.%d for global %d %q",
+				obj, opcode, name, iface, 2, expected.opcode, expected.name, expected.iface)
+		}
+	}
+
+	// Binding to an announced global goes through
+	client.Write(message(2, registryBind, uint32(3), "wp_viewporter", uint32(1), uint32(3)))
+	if obj, opcode, args := readMessage(t, server); obj != 2 || opcode != registryBind || binary.NativeEndian.Uint32(args) != 3 {
+		t.Errorf("got request %d.%d %v, expected a bind to global 3", obj, opcode, args)
+	}
+
+	// The client is disconnected when binding to a hidden one
+	client.Write(message(2, registryBind, uint32(2), "zwlr_screencopy_manager_v1", uint32(1), uint32(4)))
+	server.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if n, err := server.Read(make([]byte, 64)); err != io.EOF {
+		t.Errorf("compositor read %d bytes (%v), expected the connection to be closed", n, err)
+	}
+}
+
+func TestProxyFds(t *testing.T) {
+	client, server := testProxy(t, nil)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	// A wl_shm.create_pool request, whose fd is not part of its arguments
+	_, _, err = client.WriteMsgUnix(message(3, 0, uint32(4), uint32(4096)), syscall.UnixRights(int(w.Fd())), nil)
+	w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 64)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	server.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, oobn, _, _, err := server.ReadMsgUnix(buf, oob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 16 {
+		t.Errorf("compositor read %d bytes, expected 16", n)
+	}
+	fds, err := parseRights(oob[:oobn])
+	if err != nil || len(fds) != 1 {
+		t.Fatalf("compositor received fds %v (%v), expected one", fds, err)
+	}
+	f := os.NewFile(uintptr(fds[0]), "pipe")
+	f.Write([]byte("shared"))
+	f.Close()
+	got := make([]byte, 6)
+	if _, err := io.ReadFull(r, got); err != nil || string(got) != "shared" {
+		t.Errorf("read %q (%v) from the pipe, expected shared", got, err)
+	}
+}
+
+func TestCompositorSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oz-wayland-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l, err := net.Listen("unix", path.Join(dir, "wayland-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	ioutil.WriteFile(path.Join(dir, "wayland-2"), nil, 0600)
+
+	uid := os.Getuid()
+	for _, tt := range []struct {
+		env    []string
+		uid    int
+		socket string
+	}{
+		{[]string{"XDG_RUNTIME_DIR=" + dir, "WAYLAND_DISPLAY=wayland-1"}, uid, path.Join(dir, "wayland-1")},
+		{[]string{"WAYLAND_DISPLAY=" + path.Join(dir, "wayland-1")}, uid, path.Join(dir, "wayland-1")},
+		{[]string{"XDG_RUNTIME_DIR=" + dir, "WAYLAND_DISPLAY=wayland-2"}, uid, ""},
+		{[]string{"XDG_RUNTIME_DIR=" + dir}, uid, ""},
+		{[]string{"XDG_RUNTIME_DIR=" + dir, "WAYLAND_DISPLAY=wayland-1"}, uid + 1, ""},
+	} {
+		socket, err := CompositorSocket(tt.env, tt.uid)
+		if socket != tt.socket || (tt.socket == "") != (err != nil) {
+			t.Errorf("CompositorSocket(%v, %d) = %q, %v, expected %q", tt.env, tt.uid, socket, err, tt.socket)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package wireguard
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/subgraph/oz"
+	"github.com/subgraph/oz/ns"
+
+	"github.com/docker/libcontainer/netlink"
+	"github.com/milosgajdos83/tenus"
+)
+
+// Name of the WireGuard interface inside of the sandboxes
+const SandboxDev = "wg0"
+
+// Keys of the [Interface] section handled by wg-quick rather than by wg
+var quickKeys = map[string]bool{
+	"address":    true,
+	"dns":        true,
+	"mtu":        true,
+	"table":      true,
+	"preup":      true,
+	"postup":     true,
+	"predown":    true,
+	"postdown":   true,
+	"saveconfig": true,
+}
+
+// Conf is a WireGuard configuration file in the format of wg-quick
+type Conf struct {
+	// Addresses of the interface, with the prefix length of their network
+	Addresses []*net.IPNet
+	// Name servers and search domains
+	DNS []string
+	MTU int
+	// The configuration without the wg-quick keys, as read by `wg setconf`
+	Device string
+}
+
+// LoadConf reads the WireGuard configuration conf from the configuration
+// directory
+func LoadConf(c *oz.Config, conf string) (*Conf, error) {
+	f, err := os.Open(path.Join(c.WireGuardConfDir, conf))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseConf(f)
+}
+
+// ParseConf parses a WireGuard configuration in the format of wg-quick
+func ParseConf(r io.Reader) (*Conf, error) {
+	conf := &Conf{}
+	var dev strings.Builder
+	section := ""
+	hasKey, peers := false, 0
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i != -1 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			if section != "interface" && section != "peer" {
+				return nil, fmt.Errorf("line %d: unknown section %s", n, line)
+			}
+			if section == "peer" {
+				peers++
+			}
+			fmt.Fprintf(&dev, "%s\n", line)
+			continue
+		}
+		i := strings.IndexByte(line, '=')
+		if i == -1 {
+			return nil, fmt.Errorf("line %d: expected a key and a value", n)
+		}
+		key, value := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		lkey := strings.ToLower(key)
+		switch {
+		case section == "":
+			return nil, fmt.Errorf("line %d: %s outside of a section", n, key)
+		case section == "interface" && quickKeys[lkey]:
+			if err := conf.set(lkey, value); err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+			continue
+		case section == "interface" && lkey == "privatekey":
+			hasKey = true
+		}
+		fmt.Fprintf(&dev, "%s = %s\n", key, value)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !hasKey {
+		return nil, fmt.Errorf("no PrivateKey in the [Interface] section")
+	}
+	if peers == 0 {
+		return nil, fmt.Errorf("no [Peer] section")
+	}
+	if len(conf.Addresses) == 0 {
+		return nil, fmt.Errorf("no Address in the [Interface] section")
+	}
+	conf.Device = dev.String()
+	return conf, nil
+}
+
+// set applies a wg-quick key of the [Interface] section
+func (c *Conf) set(key, value string) error {
+	switch key {
+	case "address":
+		for _, a := range splitList(value) {
+			ip, ipnet, err := net.ParseCIDR(a)
+			if err != nil {
+				if ip = net.ParseIP(a); ip == nil {
+					return fmt.Errorf("invalid address `%s`", a)
+				}
+				bits := 8 * net.IPv6len
+				if ip.To4() != nil {
+					bits = 8 * net.IPv4len
+				}
+				ipnet = &net.IPNet{Mask: net.CIDRMask(bits, bits)}
+			}
+			c.Addresses = append(c.Addresses, &net.IPNet{IP: ip, Mask: ipnet.Mask})
+		}
+	case "dns":
+		c.DNS = append(c.DNS, splitList(value)...)
+	case "mtu":
+		mtu, err := strconv.Atoi(value)
+		if err != nil || mtu < 1280 || mtu > 65535 {
+			return fmt.Errorf("invalid MTU `%s`", value)
+		}
+		c.MTU = mtu
+	}
+	// Table, scripts and SaveConfig do not apply to sandboxes
+	return nil
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// ResolvConf returns the contents of a resolv.conf file using the name
+// servers of a DNS list, the names in it being search domains
+func ResolvConf(dns []string) string {
+	var servers, search []string
+	for _, item := range dns {
+		if net.ParseIP(item) != nil {
+			servers = append(servers, "nameserver "+item)
+		} else {
+			search = append(search, item)
+		}
+	}
+	if len(search) > 0 {
+		servers = append(servers, "search "+strings.Join(search, " "))
+	}
+	return strings.Join(servers, "\n")
+}
+
+// Start creates the WireGuard interface dev in the network namespace of
+// the daemon, configures it and moves it into the network namespace of the
+// process pid, where it is renamed to SandboxDev and becomes the default
+// route. Its socket stays in the namespace of the daemon, through which the
+// encrypted traffic is sent.
+func Start(conf *Conf, dev string, pid int) error {
+	if err := netlink.NetworkLinkAdd(dev, "wireguard"); err != nil {
+		return fmt.Errorf("unable to create interface %s: %v", dev, err)
+	}
+	link, err := tenus.NewLinkFrom(dev)
+	if err != nil {
+		Stop(dev)
+		return err
+	}
+	if err := setConf(dev, conf); err != nil {
+		Stop(dev)
+		return err
+	}
+	if conf.MTU != 0 {
+		if err := link.SetLinkMTU(conf.MTU); err != nil {
+			Stop(dev)
+			return fmt.Errorf("unable to set the MTU of %s: %v", dev, err)
+		}
+	}
+	if err := link.SetLinkNetNsPid(pid); err != nil {
+		Stop(dev)
+		return fmt.Errorf("unable to move %s to the sandbox: %v", dev, err)
+	}
+	return ns.WithProcessNetNS(pid, func() error {
+		return setupSandboxDev(conf, dev)
+	})
+}
+
+// setConf loads the keys and peers of the configuration into the interface,
+// through the standard input of wg so that the keys are not written to disk
+func setConf(dev string, conf *Conf) error {
+	cmd := exec.Command("wg", "setconf", dev, "/dev/stdin")
+	cmd.Stdin = strings.NewReader(conf.Device)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("wg setconf %s failed: %v: %s", dev, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// setupSandboxDev configures the interface once in the network namespace
+// of the sandbox
+func setupSandboxDev(conf *Conf, dev string) error {
+	ifc, err := net.InterfaceByName(dev)
+	if err != nil {
+		return err
+	}
+	if err := netlink.NetworkChangeName(ifc, SandboxDev); err != nil {
+		return fmt.Errorf("unable to rename %s: %v", dev, err)
+	}
+	link, err := tenus.NewLinkFrom(SandboxDev)
+	if err != nil {
+		return err
+	}
+	v4, v6 := false, false
+	for _, a := range conf.Addresses {
+		if err := link.SetLinkIp(a.IP, a); err != nil {
+			return fmt.Errorf("unable to set address %s: %v", a, err)
+		}
+		if a.IP.To4() != nil {
+			v4 = true
+		} else {
+			v6 = true
+		}
+	}
+	if err := link.SetLinkUp(); err != nil {
+		return fmt.Errorf("unable to bring %s up: %v", SandboxDev, err)
+	}
+	for _, args := range defaultRoutes(v4, v6) {
+		if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("ip %s failed: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
+
+// defaultRoutes returns the ip commands replacing the default routes of the
+// sandbox, those through the bridge of bridged sandboxes. Families without
+// an address on the tunnel are made unreachable rather than left going
+// around it, with the lowest metric so that router advertisements or DHCP
+// can not bring them back.
+func defaultRoutes(v4, v6 bool) [][]string {
+	var cmds [][]string
+	for _, family := range []struct {
+		flag string
+		set  bool
+	}{{"-4", v4}, {"-6", v6}} {
+		if family.set {
+			cmds = append(cmds, []string{family.flag, "route", "replace", "default", "dev", SandboxDev, "metric", "0"})
+		} else {
+			cmds = append(cmds, []string{family.flag, "route", "replace", "unreachable", "default", "metric", "0"})
+		}
+	}
+	return cmds
+}
+
+// Stop removes the interface dev if it was left in the network namespace
+// of the daemon. Once moved, it goes away along with the sandbox.
+func Stop(dev string) error {
+	if _, err := net.InterfaceByName(dev); err != nil {
+		return nil
+	}
+	return netlink.NetworkLinkDel(dev)
+}
@@ -0,0 +1,202 @@
+package wireguard
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/subgraph/oz/ns"
+	"github.com/subgraph/oz/network/nettest"
+
+	"github.com/docker/libcontainer/netlink"
+)
+
+const testConf = `# Sandbox tunnel
+[Interface]
+PrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=
+Address = 10.64.0.2/32, fd00:64::2/128
+DNS = 10.64.0.1, vpn.example
+MTU = 1420
+Table = off
+PostUp = iptables -A FORWARD -i %i -j ACCEPT
+
+[Peer]
+PublicKey = xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=
+AllowedIPs = 0.0.0.0/0, ::/0
+Endpoint = 192.0.2.1:51820 # the server
+PersistentKeepalive = 25
+`
+
+func TestParseConf(t *testing.T) {
+	conf, err := ParseConf(strings.NewReader(testConf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conf.Addresses) != 2 || conf.Addresses[0].String() != "10.64.0.2/32" || conf.Addresses[1].String() != "fd00:64::2/128" {
+		t.Errorf("Addresses = %v", conf.Addresses)
+	}
+	if strings.Join(conf.DNS, " ") != "10.64.0.1 vpn.example" || conf.MTU != 1420 {
+		t.Errorf("DNS = %v, MTU = %d", conf.DNS, conf.MTU)
+	}
+	device := `[Interface]
+PrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=
+[Peer]
+PublicKey = xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=
+AllowedIPs = 0.0.0.0/0, ::/0
+Endpoint = 192.0.2.1:51820
+PersistentKeepalive = 25
+`
+	if conf.Device != device {
+		t.Errorf("Device = %q, expected %q", conf.Device, device)
+	}
+}
+
+func TestParseConfErrors(t *testing.T) {
+	for _, tt := range []struct {
+		conf, err string
+	}{
+		{"PrivateKey = x\n", "line 1: PrivateKey outside of a section"},
+		{"[Interface]\nAddress 10.0.0.2\n", "line 2: expected a key and a value"},
+		{"[Tunnel]\n", "line 1: unknown section [Tunnel]"},
+		{"[Interface]\nAddress = 10.0.0.300/24\n", "line 2: invalid address `10.0.0.300/24`"},
+		{"[Interface]\nMTU = 100\n", "line 2: invalid MTU `100`"},
+		{"[Interface]\nAddress = 10.0.0.2\n[Peer]\nPublicKey = x\n", "no PrivateKey in the [Interface] section"},
+		{"[Interface]\nPrivateKey = x\nAddress = 10.0.0.2\n", "no [Peer] section"},
+		{"[Interface]\nPrivateKey = x\n[Peer]\nPublicKey = x\n", "no Address in the [Interface] section"},
+	} {
+		if _, err := ParseConf(strings.NewReader(tt.conf)); err == nil || err.Error() != tt.err {
+			t.Errorf("ParseConf(%q) = %v, expected %q", tt.conf, err, tt.err)
+		}
+	}
+}
+
+func TestResolvConf(t *testing.T) {
+	expected := "nameserver 10.64.0.1\nnameserver fd00:64::1\nsearch vpn.example corp.example"
+	if s := ResolvConf([]string{"10.64.0.1", "vpn.example", "fd00:64::1", "corp.example"}); s != expected {
+		t.Errorf("ResolvConf() = %q, expected %q", s, expected)
+	}
+}
+
+func TestDefaultRoutes(t *testing.T) {
+	for _, tt := range []struct {
+		v4, v6   bool
+		expected []string
+	}{
+		{true, true, []string{"-4 route replace default dev wg0 metric 0", "-6 route replace default dev wg0 metric 0"}},
+		// IPv6 of the bridge does not go around an IPv4 only tunnel
+		{true, false, []string{"-4 route replace default dev wg0 metric 0", "-6 route replace unreachable default metric 0"}},
+		{false, true, []string{"-4 route replace unreachable default metric 0", "-6 route replace default dev wg0 metric 0"}},
+	} {
+		var cmds []string
+		for _, args := range defaultRoutes(tt.v4, tt.v6) {
+			cmds = append(cmds, strings.Join(args, " "))
+		}
+		if !reflect.DeepEqual(cmds, tt.expected) {
+			t.Errorf("defaultRoutes(%v, %v) = %q, expected %q", tt.v4, tt.v6, cmds, tt.expected)
+		}
+	}
+}
+
+func wgKeys(t *testing.T) (string, string) {
+	priv, err := exec.Command("wg", "genkey").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("wg", "pubkey")
+	cmd.Stdin = strings.NewReader(string(priv))
+	pub, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(priv)), strings.TrimSpace(string(pub))
+}
+
+// TestStart connects a sandbox to a peer living in a second namespace, both
+// tunnels sending their encrypted traffic through the loopback interface of
+// the test
+func TestStart(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("requires root")
+	}
+	if _, err := exec.LookPath("wg"); err != nil {
+		t.Skip("requires wg")
+	}
+	if err := netlink.NetworkLinkAdd("oz-wgtest", "wireguard"); err != nil {
+		t.Skip("kernel without WireGuard: " + err.Error())
+	}
+	netlink.NetworkLinkDel("oz-wgtest")
+
+	sandbox, peer := nettest.NetNS(t), nettest.NetNS(t)
+	sPriv, sPub := wgKeys(t)
+	pPriv, pPub := wgKeys(t)
+	port := 51900 + os.Getpid()%100
+	peerConf, err := ParseConf(strings.NewReader(fmt.Sprintf(
+		"[Interface]\nPrivateKey = %s\nListenPort = %d\nAddress = 10.99.0.1/24\n[Peer]\nPublicKey = %s\nAllowedIPs = 10.99.0.2/32\n",
+		pPriv, port, sPub)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sandboxConf, err := ParseConf(strings.NewReader(fmt.Sprintf(
+		"[Interface]\nPrivateKey = %s\nAddress = 10.99.0.2/24\nDNS = 10.99.0.1\n[Peer]\nPublicKey = %s\nAllowedIPs = 0.0.0.0/0\nEndpoint = 127.0.0.1:%d\n",
+		sPriv, pPub, port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Start(peerConf, "oz-wgtestp", peer); err != nil {
+		t.Fatal(err)
+	}
+	if err := Start(sandboxConf, "oz-wgtests", sandbox); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := net.InterfaceByName("oz-wgtests"); err == nil {
+		t.Errorf("interface left in the namespace of the test")
+	}
+	// The configuration of the sandbox has no IPv6 address
+	err = ns.WithProcessNetNS(sandbox, func() error {
+		out, err := exec.Command("ip", "-6", "route", "show", "default").CombinedOutput()
+		if err == nil && !strings.Contains(string(out), "unreachable default") {
+			t.Errorf("IPv6 default route %q, expected unreachable", out)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var l net.Listener
+	err = ns.WithProcessNetNS(peer, func() (err error) {
+		l, err = net.Listen("tcp", "10.99.0.1:8080")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		if c, err := l.Accept(); err == nil {
+			c.Write([]byte("through the tunnel"))
+			c.Close()
+		}
+	}()
+
+	var c net.Conn
+	err = ns.WithProcessNetNS(sandbox, func() (err error) {
+		c, err = net.DialTimeout("tcp", "10.99.0.1:8080", 5*time.Second)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	buf := make([]byte, 64)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := c.Read(buf)
+	if err != nil || string(buf[:n]) != "through the tunnel" {
+		t.Errorf("got %q (%v)", buf[:n], err)
+	}
+}
@@ -4,16 +4,56 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"path"
+	"strings"
 
 	"github.com/subgraph/oz"
 )
 
 var xpraServerDefaultArgs = []string{
 	"--no-mdns",
-	//"--pulseaudio",
 	"--input-method=keep",
 }
 
+// Names of the sink whose monitor xpra forwards to the speaker of the client
+// and of the source fed by the microphone of the client
+const (
+	PulseSink   = "Xpra-Speaker"
+	PulseSource = "Xpra-Mic"
+)
+
+// ForwardsAudio returns whether the audio mode of config is forwarded by xpra
+// through a pulseaudio server of the sandbox, instead of the one of the host
+func ForwardsAudio(config *oz.XServerConf) bool {
+	return config.AudioMode == oz.PROFILE_AUDIO_SPEAKER || config.AudioMode == oz.PROFILE_AUDIO_FULL
+}
+
+// PulseSocket returns the socket of the pulseaudio server started by xpra in
+// workdir, it is the only audio device of the sandbox
+func PulseSocket(workdir string) string {
+	return path.Join(workdir, "pulse-native")
+}
+
+// pulseaudioCommand returns the command xpra starts its pulseaudio server
+// with. The sandbox only gets a null sink recorded by xpra and, in full mode,
+// a source playing the microphone of the client.
+func pulseaudioCommand(config *oz.XServerConf, workdir string) string {
+	args := []string{
+		"pulseaudio", "--start", "-n", "--daemonize=false", "--system=false",
+		"--exit-idle-time=-1", "--log-target=stderr", "--log-level=2",
+		"--load=module-suspend-on-idle",
+		fmt.Sprintf("'--load=module-null-sink sink_name=%s sink_properties=device.description=%s'", PulseSink, PulseSink),
+	}
+	if config.AudioMode == oz.PROFILE_AUDIO_FULL {
+		args = append(args,
+			"'--load=module-null-sink sink_name=Xpra-Microphone sink_properties=device.description=Xpra-Microphone'",
+			fmt.Sprintf("'--load=module-remap-source source_name=%s master=Xpra-Microphone.monitor source_properties=device.description=%s'", PulseSource, PulseSource),
+		)
+	}
+	args = append(args, fmt.Sprintf("'--load=module-native-protocol-unix socket=%s'", PulseSocket(workdir)))
+	return strings.Join(args, " ")
+}
+
 func NewServer(config *oz.XServerConf, display uint64, spath, workdir string) *Xpra {
 	x := new(Xpra)
 	x.Config = config
@@ -40,11 +80,11 @@ func prepareServerArgs(config *oz.XServerConf, display uint64, workdir string) [
 	args := getDefaultArgs(config)
 	//args = append(args, "--start-child \"/bin/echo _OZ_XXSTARTEDXX\"")
 	args = append(args, xpraServerDefaultArgs...)
-	//if config.AudioMode == oz.PROFILE_AUDIO_FULL || config.AudioMode == oz.PROFILE_AUDIO_SPEAKER {
-	//	args = append(args, "--pulseaudio")
-	//} else {
-	//	args = append(args, "--no-pulseaudio")
-	//}
+	if ForwardsAudio(config) {
+		args = append(args, "--pulseaudio", "--pulseaudio-command="+pulseaudioCommand(config, workdir))
+	} else {
+		args = append(args, "--no-pulseaudio")
+	}
 	args = append(args,
 		fmt.Sprintf("--bind=%s", workdir),
 		fmt.Sprintf("--socket-dir=%s", workdir),
@@ -53,19 +53,15 @@ func getDefaultArgs(config *oz.XServerConf) []string {
 		args = append(args, "--clipboard")
 	}
 
-	// Temporarily disabled
-	/*
-		switch config.AudioMode {
-		case oz.PROFILE_AUDIO_NONE, "":
-	*/
-	args = append(args, "--no-microphone", "--no-speaker")
-	/*
-		case oz.PROFILE_AUDIO_SPEAKER:
-			args = append(args, "--no-microphone", "--speaker")
-		case oz.PROFILE_AUDIO_FULL:
-			args = append(args, "--microphone", "--speaker")
-		}
-	*/
+	switch config.AudioMode {
+	case oz.PROFILE_AUDIO_SPEAKER:
+		args = append(args, "--no-microphone", "--speaker")
+	case oz.PROFILE_AUDIO_FULL:
+		args = append(args, "--microphone", "--speaker")
+	default:
+		// The pulseaudio mode uses the socket of the host directly
+		args = append(args, "--no-microphone", "--no-speaker")
+	}
 	if config.EnableNotifications {
 		args = append(args, "--notifications")
 	} else {